@@ -0,0 +1,99 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// backtest replays stored history through a simulated battery under different reserve
+// schedules, to compare them with what actually happened.
+//
+//	backtest --tariff=EV2A --start=2023-10-01 --end=2024-03-31 example_rules.json
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/battery"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tariff"
+)
+
+func main() {
+	statedir := flag.String("statedir", "/var/lib/powerwall", "Directory in which state files are stored")
+	tariffName := flag.String("tariff", "EV2A", "Built in tariff name or OpenEI URDB JSON file")
+	batteries := flag.Int("batteries", 1, "Number of Powerwall 2 units installed")
+	reserve := flag.Float64("reserve", 20.0, "Backup reserve percent for the self-powered and time-based runs")
+	start := flag.String("start", "", "First day to replay, YYYY-MM-DD. Defaults to a year ago")
+	end := flag.String("end", "", "Last day to replay, YYYY-MM-DD. Defaults to yesterday")
+	timezone := flag.String("timezone", "America/Los_Angeles", "Time zone of the energy site")
+	flag.Parse()
+
+	loc, err := time.LoadLocation(*timezone)
+	if err != nil {
+		log.Fatalf("LoadLocation: %v", err)
+	}
+	t, err := tariff.Load(*tariffName, loc)
+	if err != nil {
+		log.Fatalf("tariff: %v", err)
+	}
+	store, err := history.Open(filepath.Join(*statedir, "history"), loc)
+	if err != nil {
+		log.Fatalf("history Open: %v", err)
+	}
+	endTime := store.StartOfDay(time.Now())
+	if *end != "" {
+		e, err := time.ParseInLocation("2006-01-02", *end, loc)
+		if err != nil {
+			log.Fatalf("--end: %v", err)
+		}
+		endTime = e.AddDate(0, 0, 1)
+	}
+	startTime := endTime.AddDate(-1, 0, 0)
+	if *start != "" {
+		startTime, err = time.ParseInLocation("2006-01-02", *start, loc)
+		if err != nil {
+			log.Fatalf("--start: %v", err)
+		}
+	}
+
+	type run struct {
+		name     string
+		strategy battery.Strategy
+	}
+	strategies := []run{
+		{"self-powered", battery.SelfPowered{ReservePercent: *reserve}},
+		{"time-based", battery.NewTimeBased(t, *reserve)},
+	}
+	for _, filename := range flag.Args() {
+		s, err := battery.ReadSchedule(filename, loc)
+		if err != nil {
+			log.Fatalf("ReadSchedule: %v", err)
+		}
+		strategies = append(strategies, run{s.Name, s})
+	}
+
+	intervals, err := store.Intervals(history.FiveMinutes, startTime, endTime)
+	if err != nil {
+		log.Fatalf("Intervals: %v", err)
+	}
+	if len(intervals) == 0 {
+		log.Fatalf("No 5 minute history between %v and %v", startTime, endTime)
+	}
+	initial := intervals[0].PercentageCharged
+	b := battery.Powerwall2(*batteries)
+
+	fmt.Printf("%s to %s on %s, %d Powerwall(s)\n", startTime.Format("2006-01-02"),
+		endTime.AddDate(0, 0, -1).Format("2006-01-02"), t.Name, *batteries)
+	fmt.Printf("%-20s %10s %12s %16s %16s\n", "", "cost", "peak import", "end of day SoC", "backup hours")
+	row := func(name string, r battery.Result) {
+		fmt.Printf("%-20s %10.2f %8.1f kWh %6.1f%% (%3.0f%%) %7.1f (%5.1f)\n", name, r.Bill.Total,
+			r.PeakImportKWh, r.EndOfDaySoC, r.MinEndOfDaySoC, r.BackupHours, r.MinBackupHours)
+	}
+	row("actual", battery.Measure(intervals, t, loc))
+	row("no battery", battery.Measure(battery.NoBattery(intervals), t, loc))
+	for _, s := range strategies {
+		row(s.name, battery.Backtest(b, intervals, s.strategy, t, initial, loc))
+	}
+	fmt.Println("End of day SoC and backup hours are averages, with the worst day in parentheses.")
+}
@@ -0,0 +1,150 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// capacity-sweep replays stored history with more Powerwalls and optionally more solar,
+// to estimate what adding them would save and how long they would take to pay back.
+//
+//	capacity-sweep --batteries=1,2,3 --kwp=7.2 --extra-kwp=0,3 --battery-cost=12000
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/battery"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tariff"
+)
+
+func parseList(name, list string) []float64 {
+	var values []float64
+	for _, s := range strings.Split(list, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			log.Fatalf("--%s: %v", name, err)
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+func main() {
+	statedir := flag.String("statedir", "/var/lib/powerwall", "Directory in which state files are stored")
+	tariffName := flag.String("tariff", "EV2A", "Built in tariff name or OpenEI URDB JSON file")
+	strategy := flag.String("strategy", "time-based", "time-based, self-powered, or a JSON reserve schedule file")
+	reserve := flag.Float64("reserve", 20.0, "Backup reserve percent for time-based and self-powered")
+	batteries := flag.String("batteries", "1,2,3", "Comma separated numbers of Powerwall 2 units to simulate")
+	installed := flag.Int("installed", 1, "Number of Powerwall 2 units installed now")
+	kwp := flag.Float64("kwp", 0, "Size of the existing solar array in kWp, needed for --extra-kwp")
+	extraKwp := flag.String("extra-kwp", "0", "Comma separated kWp of solar to add")
+	batteryCost := flag.Float64("battery-cost", 15000, "Installed cost of each additional Powerwall in dollars")
+	solarCost := flag.Float64("solar-cost", 3000, "Installed cost of each additional kWp of solar in dollars")
+	start := flag.String("start", "", "First day to replay, YYYY-MM-DD. Defaults to a year ago")
+	timezone := flag.String("timezone", "America/Los_Angeles", "Time zone of the energy site")
+	flag.Parse()
+
+	loc, err := time.LoadLocation(*timezone)
+	if err != nil {
+		log.Fatalf("LoadLocation: %v", err)
+	}
+	t, err := tariff.Load(*tariffName, loc)
+	if err != nil {
+		log.Fatalf("tariff: %v", err)
+	}
+	extras := parseList("extra-kwp", *extraKwp)
+	for _, e := range extras {
+		if e != 0 && *kwp <= 0 {
+			log.Fatalf("--extra-kwp needs the size of the existing array in --kwp")
+		}
+	}
+	// A reserve schedule keeps state as it replays, so make a new one for every run.
+	strategyFor := func() battery.Strategy {
+		switch *strategy {
+		case "time-based":
+			return battery.NewTimeBased(t, *reserve)
+		case "self-powered":
+			return battery.SelfPowered{ReservePercent: *reserve}
+		}
+		s, err := battery.ReadSchedule(*strategy, loc)
+		if err != nil {
+			log.Fatalf("ReadSchedule: %v", err)
+		}
+		return s
+	}
+	strategyFor() // check that a schedule file is readable before doing any work
+
+	store, err := history.Open(filepath.Join(*statedir, "history"), loc)
+	if err != nil {
+		log.Fatalf("history Open: %v", err)
+	}
+	startTime := store.StartOfDay(time.Now()).AddDate(-1, 0, 0)
+	if *start != "" {
+		startTime, err = time.ParseInLocation("2006-01-02", *start, loc)
+		if err != nil {
+			log.Fatalf("--start: %v", err)
+		}
+	}
+	endTime := startTime.AddDate(1, 0, 0)
+	intervals, err := store.Intervals(history.FiveMinutes, startTime, endTime)
+	if err != nil {
+		log.Fatalf("Intervals: %v", err)
+	}
+	if len(intervals) == 0 {
+		log.Fatalf("No 5 minute history between %v and %v", startTime, endTime)
+	}
+	var hours, loadWh float64
+	for _, i := range intervals {
+		hours += i.Duration.Hours()
+		loadWh += i.LoadWh
+	}
+	annualize := 365.0 * 24.0 / hours
+	averageLoadW := loadWh / hours
+	initial := intervals[0].PercentageCharged
+
+	baseline := battery.Measure(battery.NoBattery(intervals), t, loc).Bill.Total * annualize
+	current := battery.Backtest(battery.Powerwall2(*installed), intervals, strategyFor(), t, initial, loc).Bill.Total * annualize
+
+	fmt.Printf("%-9s %-9s %11s %11s %11s %10s %9s %15s\n", "batteries", "+kWp", "annual cost",
+		"vs none", "vs now", "added cost", "payback", "backup hours")
+	for _, n := range parseList("batteries", *batteries) {
+		for _, extra := range extras {
+			scaled := intervals
+			if extra != 0 {
+				scaled = battery.ScaleSolar(intervals, (*kwp+extra) / *kwp)
+			}
+			b := battery.Powerwall2(int(n))
+			r := battery.Backtest(b, scaled, strategyFor(), t, initial, loc)
+			cost := r.Bill.Total * annualize
+			added := (n-float64(*installed))*(*batteryCost) + extra*(*solarCost)
+			payback := "-"
+			if saved := current - cost; added > 0 && saved > 0 {
+				payback = fmt.Sprintf("%.1f yr", added/saved)
+			} else if added > 0 {
+				payback = "never"
+			}
+			fmt.Printf("%-9.0f %-9.1f %11.2f %11.2f %11.2f %10.0f %9s %6.1f (%5.1f)\n", n, extra, cost,
+				baseline-cost, current-cost, math.Max(0, added), payback, r.BackupHours, r.MinBackupHours)
+		}
+	}
+
+	fmt.Printf("\nAssumptions:\n")
+	fmt.Printf("  %.0f days of history from %s, costs scaled to 365 days\n", hours/24.0, startTime.Format("2006-01-02"))
+	fmt.Printf("  tariff %s at today's prices for every year of the payback period\n", t.Name)
+	fmt.Printf("  %s strategy with a %.0f%% reserve, starting at %.0f%% charged\n", *strategy, *reserve, initial)
+	fmt.Printf("  each Powerwall 2 is %.1f kWh and %.1f kW, %.1f%% round trip efficient, charging from solar only\n",
+		battery.Powerwall2(1).CapacityWh/1000, battery.Powerwall2(1).MaxChargeW/1000,
+		battery.Powerwall2(1).RoundTripEfficiency*100)
+	fmt.Printf("  no battery degradation, incentives, financing or inflation\n")
+	if *kwp > 0 {
+		fmt.Printf("  extra solar produces in proportion to the existing %.1f kWp, with the same shading\n", *kwp)
+	}
+	fmt.Printf("  added cost %.0f per Powerwall beyond %d and %.0f per kWp\n", *batteryCost, *installed, *solarCost)
+	fmt.Printf("  backup hours are at the house's average load of %.0f W, from the charge at midnight\n", averageLoadW)
+	fmt.Printf("    averaged over the days, with the worst day in parentheses\n")
+}
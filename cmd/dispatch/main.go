@@ -0,0 +1,269 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// dispatch plans the backup reserve for the next 48 hours from the solar and load
+// forecasts and the tariff, and prints the plan. With --execute it sets the reserve for
+// the current hour, and with --loop it keeps re-planning and executing.
+//
+//	dispatch --tariff=EV2A --solcast-resource=abcd-1234 --horizon=horizon.json --execute --loop
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/battery"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/carbon"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/dispatch"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/forecast"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/loadforecast"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/notify"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/solcast"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tariff"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tesla"
+)
+
+func main() {
+	statedir := flag.String("statedir", "/var/lib/powerwall", "Directory in which state files are stored")
+	tokens := flag.String("tokens", "", "OAuth tokens file, defaults to tokens in --statedir")
+	api := flag.String("api", tesla.DefaultBaseURL, "Tesla Fleet API base URL")
+	siteId := flag.Int64("site-id", 0, "Energy site ID, found from the account if not set")
+	tariffName := flag.String("tariff", "EV2A", "Built in tariff name or OpenEI URDB JSON file")
+	priceFeed := flag.String("price-feed", "", "URL or file of day-ahead hourly prices, overriding the tariff where they exist")
+	carbonCSV := flag.String("carbon-csv", "", "CSV file of grid carbon intensity, with time and g_per_kwh columns")
+	wattTimeRegion := flag.String("watttime-region", "", "WattTime region for grid carbon intensity, credentials in WATTTIME_USERNAME and WATTTIME_PASSWORD")
+	carbonPrice := flag.Float64("carbon-price", 0, "Weight given to grid emissions when planning, in $/kg CO2")
+	batteries := flag.Int("batteries", 1, "Number of Powerwall 2 units installed")
+	minReserve := flag.Float64("min-reserve", 20, "Backup reserve percent always kept for an outage")
+	hours := flag.Int("hours", 48, "Number of hours to plan")
+	solcastResource := flag.String("solcast-resource", "", "Solcast rooftop site resource ID, API key in SOLCAST_API_KEY")
+	latitude := flag.Float64("latitude", 0, "Site latitude in degrees, for the clear sky fallback")
+	longitude := flag.Float64("longitude", 0, "Site longitude in degrees, for the clear sky fallback")
+	tilt := flag.Float64("tilt", 20, "Panel tilt in degrees from horizontal")
+	azimuth := flag.Float64("azimuth", 180, "Panel azimuth in degrees clockwise from north")
+	kwp := flag.Float64("kwp", 0, "Nameplate DC rating of the array in kW, enables the clear sky fallback")
+	horizon := flag.String("horizon", "", "Horizon profile JSON file from horizon-fit")
+	corrections := flag.String("corrections", "", "Forecast corrections JSON file from forecast-accuracy")
+	timezone := flag.String("timezone", "America/Los_Angeles", "Time zone of the energy site")
+	execute := flag.Bool("execute", false, "Set the backup reserve for the current hour")
+	loop := flag.Bool("loop", false, "Keep re-planning every --interval, executing each hour of the plan")
+	interval := flag.Duration("interval", 15*time.Minute, "How often to check the forecasts in --loop")
+	solarRefresh := flag.Duration("solar-refresh", 2*time.Hour, "How often to fetch a new solar forecast, within the Solcast quota")
+	notifyFile := flag.String("notify", "", "JSON file configuring notifications, to report failed commands")
+	flag.Parse()
+
+	if *tokens == "" {
+		*tokens = filepath.Join(*statedir, "tokens")
+	}
+	loc, err := time.LoadLocation(*timezone)
+	if err != nil {
+		log.Fatalf("LoadLocation: %v", err)
+	}
+	t, err := tariff.Load(*tariffName, loc)
+	if err != nil {
+		log.Fatalf("tariff: %v", err)
+	}
+	var prices tariff.PriceProvider = t
+	var dayAhead *tariff.DayAhead
+	if *priceFeed != "" {
+		dayAhead = &tariff.DayAhead{Source: *priceFeed, CacheFile: filepath.Join(*statedir, "prices.json"), Fallback: t}
+		if err = dayAhead.LoadCache(); err != nil {
+			log.Printf("price cache: %v", err)
+		}
+		prices = dayAhead
+	}
+
+	var notifier *notify.Router
+	if *notifyFile != "" {
+		c, err := notify.ReadConfig(*notifyFile)
+		if err != nil {
+			log.Fatalf("notify: %v", err)
+		}
+		if notifier, err = c.Router(); err != nil {
+			log.Fatalf("notify: %v", err)
+		}
+		notifier.StateFile = filepath.Join(*statedir, notify.StateFilename)
+	}
+	sendNotification := func(m notify.Message) {
+		if notifier == nil {
+			return
+		}
+		if _, err := notifier.Send(m); err != nil {
+			log.Printf("%v", err)
+		}
+	}
+
+	var carbonProvider carbon.Provider
+	if *carbonCSV != "" {
+		carbonProvider = &carbon.File{Filename: *carbonCSV}
+	} else if *wattTimeRegion != "" {
+		carbonProvider = &carbon.WattTime{
+			Username: os.Getenv("WATTTIME_USERNAME"),
+			Password: os.Getenv("WATTTIME_PASSWORD"),
+			Region:   *wattTimeRegion,
+		}
+	}
+
+	// Solcast first, with the clear sky model as the fallback when it is down or out of
+	// quota. Every forecast is archived for forecast-accuracy as the provider returned
+	// it, before shading and corrections, which are learned from the archive.
+	archive := &forecast.Archive{Dir: filepath.Join(*statedir, "forecasts")}
+	var solar forecast.Fallback
+	if *solcastResource != "" {
+		solar = append(solar, solcast.New(os.Getenv("SOLCAST_API_KEY"), *solcastResource, archive))
+	}
+	site := &forecast.ClearSky{Latitude: *latitude, Longitude: *longitude, Tilt: *tilt, Azimuth: *azimuth, KWp: *kwp}
+	if *kwp > 0 {
+		solar = append(solar, &forecast.Recorder{
+			Forecaster: site,
+			Archive:    archive,
+			Source:     "clearsky",
+			OnError:    func(err error) { log.Printf("forecast archive: %v", err) },
+		})
+	}
+	if len(solar) == 0 {
+		log.Fatalf("--solcast-resource or --kwp must be provided.")
+	}
+	var forecaster forecast.Forecaster = solar
+	if *horizon != "" {
+		h, err := forecast.ReadHorizon(*horizon)
+		if err != nil {
+			log.Fatalf("ReadHorizon: %v", err)
+		}
+		forecaster = &forecast.Shaded{Forecaster: forecaster, Site: site, Horizon: h}
+	}
+	if *corrections != "" {
+		c, err := forecast.ReadCorrections(*corrections)
+		if err != nil {
+			log.Fatalf("ReadCorrections: %v", err)
+		}
+		forecaster = &forecast.Corrected{Forecaster: forecaster, Corrections: c}
+	}
+
+	store, err := history.Open(filepath.Join(*statedir, "history"), loc)
+	if err != nil {
+		log.Fatalf("history Open: %v", err)
+	}
+	model, err := trainLoad(store, loc)
+	if err != nil {
+		log.Fatalf("load model: %v", err)
+	}
+
+	tokenFile := &tesla.TokenFile{
+		Filename: *tokens,
+		OnError: func(err error) {
+			sendNotification(notify.Message{Event: notify.TokenRefreshFailed, Key: "token_refresh",
+				Title: "Tesla access token refresh failing",
+				Body:  fmt.Sprintf("%v\nThe tokens may need to be replaced by logging in again.", err)})
+		},
+	}
+	if _, err = tokenFile.Token(); err != nil {
+		log.Fatalf("tokens: %v", err)
+	}
+	c := tokenFile.Client()
+	if *siteId == 0 {
+		*siteId, err = tesla.FindEnergySite(c, *api)
+		if err != nil {
+			log.Fatalf("FindEnergySite: %v", err)
+		}
+	}
+	client := &tesla.Client{HTTP: c, SiteURL: tesla.SiteURL(*api, *siteId)}
+
+	planner := &dispatch.Planner{
+		Optimizer: &dispatch.Optimizer{
+			Battery:           battery.Powerwall2(*batteries),
+			Prices:            prices,
+			MinReservePercent: *minReserve,
+			CarbonPrice:       *carbonPrice,
+		},
+		Solar: forecaster,
+		Load: func(start time.Time, hours int) ([]loadforecast.Hour, error) {
+			return model.Predict(start, hours, nil), nil
+		},
+		SoC: func() (float64, error) {
+			status, err := client.LiveStatus()
+			if err != nil {
+				return 0, err
+			}
+			return status.PercentageCharged, nil
+		},
+		Hours:        *hours,
+		SolarRefresh: *solarRefresh,
+	}
+
+	applied := -1
+	var pricesRefreshed time.Time
+	for {
+		now := time.Now()
+		// The feed is published a day ahead, hourly is plenty.
+		if dayAhead != nil && now.Sub(pricesRefreshed) >= time.Hour {
+			if err := dayAhead.Refresh(); err != nil {
+				log.Printf("price feed: %v", err)
+			}
+			pricesRefreshed = now
+		}
+		if carbonProvider != nil {
+			intensities, err := carbonProvider.Intensities(now.Add(-time.Hour), now.Add(time.Duration(*hours)*time.Hour))
+			if err != nil {
+				log.Printf("carbon intensity: %v", err)
+			} else {
+				planner.Optimizer.Carbon = planner.Optimizer.Carbon.Merge(intensities, now.Add(-time.Hour))
+			}
+		}
+		plan, replanned, err := planner.Update(now)
+		if err != nil {
+			if !*loop {
+				log.Fatalf("plan: %v", err)
+			}
+			log.Printf("plan: %v", err)
+		}
+		if replanned {
+			fmt.Print(plan.Explain())
+		}
+		var step *dispatch.Step
+		if plan != nil {
+			step = plan.StepAt(now)
+		}
+		// Without a state of charge from this round, a held reserve could be set above it.
+		if soc, fetched := planner.LastSoC(); *execute && step != nil && fetched.Equal(now) {
+			if reserve := plan.Reserve(step, soc); reserve != applied {
+				if err = client.Apply(reserve, step.Mode); err != nil {
+					sendNotification(notify.Message{Event: notify.CommandFailed,
+						Title: fmt.Sprintf("Setting the Powerwall reserve to %d%% failed", reserve),
+						Body:  err.Error()})
+					if !*loop {
+						log.Fatalf("Apply: %v", err)
+					}
+					log.Printf("Apply: %v", err)
+				} else {
+					log.Printf("%s: %s, reserve %d%%", step.Start.Format("15:04"), step.Action, reserve)
+					applied = reserve
+				}
+			}
+		}
+		if !*loop {
+			return
+		}
+		if notifier != nil {
+			if err = notifier.Flush(time.Now()); err != nil {
+				log.Printf("%v", err)
+			}
+		}
+		time.Sleep(*interval)
+	}
+}
+
+// trainLoad trains a load model on the last year of 5 minute history.
+func trainLoad(store *history.Store, loc *time.Location) (*loadforecast.Model, error) {
+	end := time.Now()
+	intervals, err := store.Intervals(history.FiveMinutes, end.AddDate(-1, 0, 0), end)
+	if err != nil {
+		return nil, err
+	}
+	return loadforecast.Train(loadforecast.SamplesFromIntervals(intervals), loc)
+}
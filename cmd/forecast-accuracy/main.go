@@ -0,0 +1,128 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// forecast-accuracy compares archived solar forecasts against measured production,
+// printing MAPE and bias by forecast horizon and by hour of day. It can also learn a
+// per-month, per-hour correction to apply to future forecasts.
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/forecast"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+)
+
+func writeMetrics(w *csv.Writer, group string, metrics map[int]forecast.Metrics) {
+	keys := make([]int, 0, len(metrics))
+	for k := range metrics {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	for _, k := range keys {
+		m := metrics[k]
+		w.Write([]string{
+			group,
+			fmt.Sprintf("%d", k),
+			fmt.Sprintf("%d", m.Count),
+			fmt.Sprintf("%.1f", m.MAPE),
+			fmt.Sprintf("%.3f", m.BiasKW),
+		})
+	}
+}
+
+// readStore returns the average solar power over each stored 5 minute interval, timed
+// at the end of the interval like a forecast period.
+func readStore(statedir string, loc *time.Location, start, end time.Time) ([]forecast.Production, error) {
+	store, err := history.Open(filepath.Join(statedir, "history"), loc)
+	if err != nil {
+		return nil, err
+	}
+	intervals, err := store.Intervals(history.FiveMinutes, start, end)
+	if err != nil {
+		return nil, err
+	}
+	measured := make([]forecast.Production, 0, len(intervals))
+	for _, i := range intervals {
+		measured = append(measured, forecast.Production{Time: i.End(), Watts: i.SolarWh / i.Duration.Hours()})
+	}
+	return measured, nil
+}
+
+func main() {
+	statedir := flag.String("statedir", "/var/lib/powerwall", "Directory in which state files are stored")
+	archiveDir := flag.String("archive", "", "Directory of archived forecasts, defaults to forecasts in --statedir")
+	production := flag.String("production", "", "CSV file with time and solar_watts columns, instead of the history in --statedir")
+	days := flag.Int("days", 30, "Number of days of forecasts to evaluate")
+	source := flag.String("source", "", "Only evaluate forecasts from this source")
+	timezone := flag.String("timezone", "America/Los_Angeles", "Time zone for hour of day")
+	corrections := flag.String("corrections", "", "If set, write learned corrections to this file")
+	maxLead := flag.Duration("max-lead", 48*time.Hour,
+		"Only learn corrections from forecasts issued at most this far ahead")
+	flag.Parse()
+
+	if *archiveDir == "" {
+		*archiveDir = filepath.Join(*statedir, "forecasts")
+	}
+	loc, err := time.LoadLocation(*timezone)
+	if err != nil {
+		log.Fatalf("LoadLocation: %v", err)
+	}
+
+	archive := &forecast.Archive{Dir: *archiveDir}
+	end := time.Now()
+	start := end.AddDate(0, 0, -*days)
+	forecasts, err := archive.Load(start, end)
+	if err != nil {
+		log.Fatalf("Load: %v", err)
+	}
+
+	var measured []forecast.Production
+	if *production != "" {
+		f, err := os.Open(*production)
+		if err != nil {
+			log.Fatalf("Open: %v", err)
+		}
+		measured, err = forecast.ReadProductionCSV(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("ReadProductionCSV: %v", err)
+		}
+	} else if measured, err = readStore(*statedir, loc, start, end); err != nil {
+		log.Fatalf("history: %v", err)
+	}
+
+	if *source != "" {
+		var filtered []forecast.IssuedForecast
+		for _, fc := range forecasts {
+			if fc.Source == *source {
+				filtered = append(filtered, fc)
+			}
+		}
+		forecasts = filtered
+	}
+
+	comparisons := forecast.Compare(forecasts, measured)
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"group", "key", "count", "mape_percent", "bias_kw"})
+	writeMetrics(w, "lead_hours", forecast.Summarize(comparisons, forecast.ByLeadHours))
+	writeMetrics(w, "hour_of_day", forecast.Summarize(comparisons, forecast.ByHourOfDay(loc)))
+	w.Flush()
+	if err = w.Error(); err != nil {
+		log.Fatalf("Write: %v", err)
+	}
+
+	if *corrections != "" {
+		c := forecast.LearnCorrections(comparisons, loc, *maxLead)
+		if err = c.WriteToFile(*corrections); err != nil {
+			log.Fatalf("WriteToFile: %v", err)
+		}
+	}
+}
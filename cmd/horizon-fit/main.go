@@ -0,0 +1,57 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// horizon-fit estimates the local horizon profile from a year of measured solar
+// production, writing JSON suitable for forecast.ReadHorizon.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/forecast"
+)
+
+func main() {
+	production := flag.String("production", "", "CSV file with time and solar_watts columns")
+	latitude := flag.Float64("latitude", 0, "Site latitude in degrees, north is positive")
+	longitude := flag.Float64("longitude", 0, "Site longitude in degrees, east is positive")
+	tilt := flag.Float64("tilt", 20, "Panel tilt in degrees from horizontal")
+	azimuth := flag.Float64("azimuth", 180, "Panel azimuth in degrees clockwise from north")
+	kwp := flag.Float64("kwp", 0, "Nameplate DC rating of the array in kW")
+	bin := flag.Float64("bin", 5, "Width of each azimuth bin in degrees")
+	threshold := flag.Float64("threshold", 0.5,
+		"Fraction of clear sky production above which the sun is considered visible")
+	flag.Parse()
+
+	if *production == "" || *kwp <= 0 {
+		log.Fatalf("--production and --kwp must be provided.")
+	}
+
+	f, err := os.Open(*production)
+	if err != nil {
+		log.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	measured, err := forecast.ReadProductionCSV(f)
+	if err != nil {
+		log.Fatalf("ReadProductionCSV: %v", err)
+	}
+
+	site := &forecast.ClearSky{
+		Latitude:  *latitude,
+		Longitude: *longitude,
+		Tilt:      *tilt,
+		Azimuth:   *azimuth,
+		KWp:       *kwp,
+	}
+	h := forecast.FitHorizon(site, measured, *bin, *threshold)
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(h); err != nil {
+		log.Fatalf("Encode: %v", err)
+	}
+}
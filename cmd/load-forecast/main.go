@@ -0,0 +1,92 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// load-forecast trains a house load model from history and prints an hourly kWh
+// forecast with 10th and 90th percentile bands.
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/loadforecast"
+)
+
+func main() {
+	statedir := flag.String("statedir", "/var/lib/powerwall", "Directory in which state files are stored")
+	days := flag.Int("days", 365, "Days of stored history to train on")
+	csvFile := flag.String("history", "", "CSV file with time, load_watts and optional temperature_c, instead of the stored history")
+	temperatures := flag.String("temperatures", "",
+		"Optional CSV file of forecast temperature, with time and temperature_c columns")
+	hours := flag.Int("hours", 48, "Number of hours to forecast")
+	timezone := flag.String("timezone", "America/Los_Angeles", "Time zone of the house")
+	flag.Parse()
+
+	loc, err := time.LoadLocation(*timezone)
+	if err != nil {
+		log.Fatalf("LoadLocation: %v", err)
+	}
+
+	var samples []loadforecast.Sample
+	if *csvFile != "" {
+		f, err := os.Open(*csvFile)
+		if err != nil {
+			log.Fatalf("Open: %v", err)
+		}
+		samples, err = loadforecast.ReadSamplesCSV(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("ReadSamplesCSV: %v", err)
+		}
+	} else {
+		store, err := history.Open(filepath.Join(*statedir, "history"), loc)
+		if err != nil {
+			log.Fatalf("history Open: %v", err)
+		}
+		end := time.Now()
+		intervals, err := store.Intervals(history.FiveMinutes, end.AddDate(0, 0, -*days), end)
+		if err != nil {
+			log.Fatalf("history Intervals: %v", err)
+		}
+		samples = loadforecast.SamplesFromIntervals(intervals)
+	}
+
+	var temps []loadforecast.Temperature
+	if *temperatures != "" {
+		f, err := os.Open(*temperatures)
+		if err != nil {
+			log.Fatalf("Open: %v", err)
+		}
+		temps, err = loadforecast.ReadTemperaturesCSV(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("ReadTemperaturesCSV: %v", err)
+		}
+	}
+
+	model, err := loadforecast.Train(samples, loc)
+	if err != nil {
+		log.Fatalf("Train: %v", err)
+	}
+
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"time", "kwh", "low_kwh", "high_kwh"})
+	for _, h := range model.Predict(time.Now(), *hours, temps) {
+		w.Write([]string{
+			h.Start.In(loc).Format(time.RFC3339),
+			fmt.Sprintf("%.2f", h.KWh),
+			fmt.Sprintf("%.2f", h.Low),
+			fmt.Sprintf("%.2f", h.High),
+		})
+	}
+	w.Flush()
+	if err = w.Error(); err != nil {
+		log.Fatalf("Write: %v", err)
+	}
+}
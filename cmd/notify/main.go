@@ -0,0 +1,53 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// notify sends one notification through the notifiers configured for its event, so that
+// cron jobs can report their failures the same way the daemon does. The body is read from
+// stdin. With --if-output nothing is sent if stdin is empty, which suits a command that
+// is quiet unless something goes wrong:
+//
+//	powerwall --percent=50 ... 2>&1 | notify --if-output --title="4pm reserve change failed"
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/notify"
+)
+
+func main() {
+	config := flag.String("config", "/etc/powerwall/notify.json", "JSON file configuring notifications")
+	statedir := flag.String("statedir", "/var/lib/powerwall", "Directory in which state files are stored, shared with the daemon")
+	event := flag.String("event", string(notify.CommandFailed), "Event type, which selects the notifiers")
+	title := flag.String("title", "", "Title of the notification")
+	ifOutput := flag.Bool("if-output", false, "Only send if stdin is not empty, for commands which are quiet on success")
+	flag.Parse()
+
+	if *title == "" {
+		log.Fatalf("--title must be provided.")
+	}
+	c, err := notify.ReadConfig(*config)
+	if err != nil {
+		log.Fatalf("ReadConfig: %v", err)
+	}
+	r, err := c.Router()
+	if err != nil {
+		log.Fatalf("Router: %v", err)
+	}
+	r.StateFile = filepath.Join(*statedir, notify.StateFilename)
+	body, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatalf("stdin: %v", err)
+	}
+	if *ifOutput && strings.TrimSpace(string(body)) == "" {
+		return
+	}
+	if _, err = r.Send(notify.Message{Event: notify.Event(*event), Title: *title, Body: string(body)}); err != nil {
+		log.Fatalf("%v", err)
+	}
+}
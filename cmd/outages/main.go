@@ -0,0 +1,103 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// outages lists the grid outages recorded by the powerwall daemon. With --fetch it first
+// merges in Tesla's backup history, for outages which happened while the daemon was not
+// running.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/outage"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tesla"
+)
+
+func soc(percent float64) string {
+	if percent == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.0f%%", percent)
+}
+
+func main() {
+	statedir := flag.String("statedir", "/var/lib/powerwall", "Directory in which state files are stored")
+	fetch := flag.Bool("fetch", false, "Merge in Tesla's backup history before listing")
+	tokens := flag.String("tokens", "", "OAuth tokens file, defaults to tokens in --statedir")
+	api := flag.String("api", tesla.DefaultBaseURL, "Tesla Fleet API base URL")
+	siteId := flag.Int64("site-id", 0, "Energy site ID, found from the account if not set")
+	since := flag.String("since", "", "Only list outages starting on or after this day, YYYY-MM-DD")
+	timezone := flag.String("timezone", "America/Los_Angeles", "Time zone of the energy site")
+	flag.Parse()
+
+	loc, err := time.LoadLocation(*timezone)
+	if err != nil {
+		log.Fatalf("LoadLocation: %v", err)
+	}
+	tracker, err := outage.Open(filepath.Join(*statedir, "outages.json"))
+	if err != nil {
+		log.Fatalf("outage Open: %v", err)
+	}
+
+	if *fetch {
+		if *tokens == "" {
+			*tokens = filepath.Join(*statedir, "tokens")
+		}
+		c, err := tesla.HTTPClientFromFile(*tokens)
+		if err != nil {
+			log.Fatalf("HTTPClientFromFile: %v", err)
+		}
+		if *siteId == 0 {
+			*siteId, err = tesla.FindEnergySite(c, *api)
+			if err != nil {
+				log.Fatalf("FindEnergySite: %v", err)
+			}
+		}
+		client := &tesla.Client{HTTP: c, SiteURL: tesla.SiteURL(*api, *siteId)}
+		events, err := client.BackupHistory()
+		if err != nil {
+			log.Fatalf("BackupHistory: %v", err)
+		}
+		added, err := tracker.MergeBackupHistory(events)
+		if err != nil {
+			log.Fatalf("MergeBackupHistory: %v", err)
+		}
+		log.Printf("Added %d outages from backup history", added)
+	}
+
+	var first time.Time
+	if *since != "" {
+		if first, err = time.ParseInLocation("2006-01-02", *since, loc); err != nil {
+			log.Fatalf("--since: %v", err)
+		}
+	}
+	var events []outage.Event
+	for _, e := range tracker.Events() {
+		if !e.Start.Before(first) {
+			events = append(events, e)
+		}
+	}
+
+	now := time.Now()
+	fmt.Printf("%-16s %-16s %10s %6s %6s %9s %9s  %s\n", "start", "end", "duration", "soc", "soc", "supplied", "battery", "source")
+	for _, e := range events {
+		end := "ongoing"
+		if !e.Ongoing() {
+			end = e.End.In(loc).Format("2006-01-02 15:04")
+		}
+		supplied, battery := "-", "-"
+		if e.SuppliedWh > 0 {
+			supplied = fmt.Sprintf("%.1f kWh", e.SuppliedWh/1000.0)
+			battery = fmt.Sprintf("%.1f kWh", e.BatteryWh/1000.0)
+		}
+		fmt.Printf("%-16s %-16s %10s %6s %6s %9s %9s  %s\n", e.Start.In(loc).Format("2006-01-02 15:04"), end,
+			e.Duration(now).Round(time.Minute), soc(e.StartSoC), soc(e.EndSoC), supplied, battery, e.Source)
+	}
+	s := outage.Summarize(events, now)
+	fmt.Printf("\n%d outages, %s in total, the longest %s.\n", s.Count, s.Duration.Round(time.Minute),
+		s.Longest.Round(time.Minute))
+}
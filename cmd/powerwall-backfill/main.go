@@ -0,0 +1,91 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// powerwall-backfill fills gaps in the local history from Tesla's calendar_history,
+// optionally writing the fetched power series for promtool to backfill Prometheus.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/backfill"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tesla"
+)
+
+func main() {
+	statedir := flag.String("statedir", "/var/lib/powerwall", "Directory in which state files are stored")
+	tokens := flag.String("tokens", "", "OAuth tokens file, defaults to tokens in --statedir")
+	api := flag.String("api", tesla.DefaultBaseURL, "Tesla Fleet API base URL")
+	siteId := flag.Int64("site-id", 0, "Energy site ID, found from the account if not set")
+	days := flag.Int("days", 7, "Number of days back from now to backfill")
+	start := flag.String("start", "", "First day to backfill, YYYY-MM-DD. Overrides --days")
+	end := flag.String("end", "", "Last day to backfill, YYYY-MM-DD. Defaults to now")
+	timezone := flag.String("timezone", "America/Los_Angeles", "Time zone of the energy site")
+	openmetrics := flag.String("openmetrics", "", "If set, write the power series to this file for promtool")
+	flag.Parse()
+
+	if *tokens == "" {
+		*tokens = filepath.Join(*statedir, "tokens")
+	}
+	loc, err := time.LoadLocation(*timezone)
+	if err != nil {
+		log.Fatalf("LoadLocation: %v", err)
+	}
+
+	endTime := time.Now().Truncate(history.FiveMinutes)
+	if *end != "" {
+		t, err := time.ParseInLocation("2006-01-02", *end, loc)
+		if err != nil {
+			log.Fatalf("--end: %v", err)
+		}
+		endTime = t.AddDate(0, 0, 1)
+	}
+	startTime := endTime.AddDate(0, 0, -*days)
+	if *start != "" {
+		startTime, err = time.ParseInLocation("2006-01-02", *start, loc)
+		if err != nil {
+			log.Fatalf("--start: %v", err)
+		}
+	}
+
+	c, err := tesla.HTTPClientFromFile(*tokens)
+	if err != nil {
+		log.Fatalf("HTTPClientFromFile: %v", err)
+	}
+	if *siteId == 0 {
+		*siteId, err = tesla.FindEnergySite(c, *api)
+		if err != nil {
+			log.Fatalf("FindEnergySite: %v", err)
+		}
+	}
+	client := &tesla.Client{HTTP: c, SiteURL: tesla.SiteURL(*api, *siteId)}
+
+	store, err := history.Open(filepath.Join(*statedir, "history"), loc)
+	if err != nil {
+		log.Fatalf("history Open: %v", err)
+	}
+	result, err := backfill.Run(client, store, startTime, endTime)
+	if err != nil {
+		log.Fatalf("backfill: %v", err)
+	}
+	log.Printf("Backfilled %d intervals over %d days", result.Intervals, result.Days)
+
+	if *openmetrics != "" {
+		f, err := os.Create(*openmetrics)
+		if err != nil {
+			log.Fatalf("Create: %v", err)
+		}
+		err = backfill.WriteOpenMetrics(f, result.Points)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			log.Fatalf("WriteOpenMetrics: %v", err)
+		}
+	}
+}
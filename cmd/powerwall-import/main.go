@@ -0,0 +1,65 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// powerwall-import loads power and energy CSV files exported from the Tesla app into the
+// local history.
+//
+//	powerwall-import --statedir=/var/lib/powerwall ~/Downloads/*.csv
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/teslaapp"
+)
+
+func main() {
+	statedir := flag.String("statedir", "/var/lib/powerwall", "Directory in which state files are stored")
+	timezone := flag.String("timezone", "America/Los_Angeles",
+		"Time zone of timestamps without a UTC offset")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		log.Fatalf("Usage: powerwall-import [flags] export.csv...")
+	}
+	loc, err := time.LoadLocation(*timezone)
+	if err != nil {
+		log.Fatalf("LoadLocation: %v", err)
+	}
+	store, err := history.Open(filepath.Join(*statedir, "history"), loc)
+	if err != nil {
+		log.Fatalf("history Open: %v", err)
+	}
+
+	var exports []*teslaapp.Export
+	for _, filename := range flag.Args() {
+		f, err := os.Open(filename)
+		if err != nil {
+			log.Fatalf("Open: %v", err)
+		}
+		export, err := teslaapp.Read(f, loc)
+		f.Close()
+		if err != nil {
+			log.Fatalf("%s: %v", filename, err)
+		}
+		log.Printf("%s: %d intervals", filename, len(export.Intervals))
+		exports = append(exports, export)
+	}
+
+	// Storing 5 minute intervals recomputes the daily rollup from them. Import the
+	// power files first so the app's own daily energy totals are what remains.
+	sort.SliceStable(exports, func(i, j int) bool {
+		return exports[i].Resolution < exports[j].Resolution
+	})
+	for _, export := range exports {
+		if err = store.PutIntervals(export.Resolution, export.Intervals); err != nil {
+			log.Fatalf("PutIntervals: %v", err)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// powerwall-promimport pulls the solar, battery, load and grid series out of Prometheus
+// and integrates them into 5 minute interval energy. The intervals are either stored in
+// the local history or written as CSV for the analysis tools, whose time and *_watts
+// columns hold the average power over each interval.
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/promquery"
+)
+
+var metrics = []struct {
+	name string
+	set  func(s *history.Sample, v float64)
+}{
+	{"sherwood_energymon_solar_watts", func(s *history.Sample, v float64) { s.SolarPower = v }},
+	{"sherwood_energymon_powerwall_watts", func(s *history.Sample, v float64) { s.BatteryPower = v }},
+	{"sherwood_energymon_house_load_watts", func(s *history.Sample, v float64) { s.LoadPower = v }},
+	{"sherwood_energymon_grid_watts", func(s *history.Sample, v float64) { s.GridPower = v }},
+}
+
+func fetchSamples(c *promquery.Client, selector string, start, end time.Time, step time.Duration) ([]history.Sample, error) {
+	byTime := make(map[int64]*history.Sample)
+	for _, m := range metrics {
+		// Collapse multiple scrape targets into one series.
+		series, err := c.QueryRange("avg("+m.name+selector+")", start, end, step)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", m.name, err)
+		}
+		for _, s := range series {
+			for _, p := range s.Points {
+				sample, ok := byTime[p.Time.Unix()]
+				if !ok {
+					sample = &history.Sample{Time: p.Time}
+					byTime[p.Time.Unix()] = sample
+				}
+				m.set(sample, p.Value)
+			}
+		}
+	}
+
+	samples := make([]history.Sample, 0, len(byTime))
+	for _, s := range byTime {
+		samples = append(samples, *s)
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].Time.Before(samples[j].Time) })
+	return samples, nil
+}
+
+func writeCSV(intervals []history.Interval, loc *time.Location) error {
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"time", "solar_watts", "battery_watts", "load_watts", "grid_watts",
+		"solar_wh", "load_wh", "grid_import_wh", "grid_export_wh", "battery_charge_wh",
+		"battery_discharge_wh"})
+	for _, i := range intervals {
+		hours := i.Duration.Hours()
+		w.Write([]string{
+			i.Start.Add(i.Duration / 2).In(loc).Format(time.RFC3339),
+			fmt.Sprintf("%.1f", i.SolarWh/hours),
+			fmt.Sprintf("%.1f", (i.BatteryDischargeWh-i.BatteryChargeWh)/hours),
+			fmt.Sprintf("%.1f", i.LoadWh/hours),
+			fmt.Sprintf("%.1f", (i.GridImportWh-i.GridExportWh)/hours),
+			fmt.Sprintf("%.2f", i.SolarWh),
+			fmt.Sprintf("%.2f", i.LoadWh),
+			fmt.Sprintf("%.2f", i.GridImportWh),
+			fmt.Sprintf("%.2f", i.GridExportWh),
+			fmt.Sprintf("%.2f", i.BatteryChargeWh),
+			fmt.Sprintf("%.2f", i.BatteryDischargeWh),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func main() {
+	prometheus := flag.String("prometheus", "http://localhost:9090", "Prometheus server URL")
+	selector := flag.String("selector", "", `Label matchers added to each metric, e.g. {job="powerwall"}`)
+	start := flag.String("start", "", "First day to pull, YYYY-MM-DD")
+	end := flag.String("end", "", "Last day to pull, YYYY-MM-DD. Defaults to yesterday")
+	step := flag.Duration("step", time.Minute, "Query resolution")
+	timezone := flag.String("timezone", "America/Los_Angeles", "Time zone of the dates")
+	store := flag.Bool("store", false, "Store intervals in the local history instead of printing CSV")
+	statedir := flag.String("statedir", "/var/lib/powerwall", "Directory in which state files are stored")
+	flag.Parse()
+
+	loc, err := time.LoadLocation(*timezone)
+	if err != nil {
+		log.Fatalf("LoadLocation: %v", err)
+	}
+	if *start == "" {
+		log.Fatalf("--start must be provided.")
+	}
+	startTime, err := time.ParseInLocation("2006-01-02", *start, loc)
+	if err != nil {
+		log.Fatalf("--start: %v", err)
+	}
+	now := time.Now().In(loc)
+	endTime := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	if *end != "" {
+		t, err := time.ParseInLocation("2006-01-02", *end, loc)
+		if err != nil {
+			log.Fatalf("--end: %v", err)
+		}
+		endTime = t.AddDate(0, 0, 1)
+	}
+
+	c := &promquery.Client{URL: *prometheus}
+	samples, err := fetchSamples(c, *selector, startTime, endTime, *step)
+	if err != nil {
+		log.Fatalf("Prometheus: %v", err)
+	}
+	intervals := history.Integrate(samples, history.FiveMinutes)
+	for idx := range intervals {
+		intervals[idx].Source = "prometheus"
+	}
+
+	if !*store {
+		if err = writeCSV(intervals, loc); err != nil {
+			log.Fatalf("Write: %v", err)
+		}
+		return
+	}
+
+	s, err := history.Open(filepath.Join(*statedir, "history"), loc)
+	if err != nil {
+		log.Fatalf("history Open: %v", err)
+	}
+	if err = s.PutIntervals(history.FiveMinutes, intervals); err != nil {
+		log.Fatalf("PutIntervals: %v", err)
+	}
+	log.Printf("Stored %d intervals", len(intervals))
+}
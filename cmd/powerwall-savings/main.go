@@ -0,0 +1,132 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// powerwall-savings works out what a day or month of stored history cost under a tariff,
+// and how much the battery and our scheduling of it saved.
+//
+//	powerwall-savings --statedir=/var/lib/powerwall --tariff=EV2A --month=2024-01
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/battery"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/savings"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tariff"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func main() {
+	statedir := flag.String("statedir", "/var/lib/powerwall", "Directory in which state files are stored")
+	tariffName := flag.String("tariff", "EV2A", "Built in tariff name or OpenEI URDB JSON file")
+	dayAheadPrices := flag.Bool("day-ahead", false, "Price energy using the day-ahead prices cached in --statedir")
+	date := flag.String("date", "", "Day to report on, YYYY-MM-DD. Defaults to yesterday")
+	month := flag.String("month", "", "Month to report on, YYYY-MM. Overrides --date")
+	batteries := flag.Int("batteries", 1, "Number of Powerwall 2 units installed")
+	reserve := flag.Float64("reserve", 20.0, "Backup reserve percent for the self-powered comparison")
+	timezone := flag.String("timezone", "America/Los_Angeles", "Time zone of the energy site")
+	textfile := flag.String("textfile", "", "If set, write the last day's figures here for the node_exporter textfile collector")
+	flag.Parse()
+
+	loc, err := time.LoadLocation(*timezone)
+	if err != nil {
+		log.Fatalf("LoadLocation: %v", err)
+	}
+	t, err := tariff.Load(*tariffName, loc)
+	if err != nil {
+		log.Fatalf("tariff: %v", err)
+	}
+	store, err := history.Open(filepath.Join(*statedir, "history"), loc)
+	if err != nil {
+		log.Fatalf("history Open: %v", err)
+	}
+
+	start := store.StartOfDay(time.Now()).AddDate(0, 0, -1)
+	end := start.AddDate(0, 0, 1)
+	if *date != "" {
+		start, err = time.ParseInLocation("2006-01-02", *date, loc)
+		if err != nil {
+			log.Fatalf("--date: %v", err)
+		}
+		end = start.AddDate(0, 0, 1)
+	}
+	if *month != "" {
+		start, err = time.ParseInLocation("2006-01", *month, loc)
+		if err != nil {
+			log.Fatalf("--month: %v", err)
+		}
+		end = start.AddDate(0, 1, 0)
+	}
+
+	intervals, err := store.Intervals(history.FiveMinutes, start, end)
+	if err != nil {
+		log.Fatalf("Intervals: %v", err)
+	}
+	if len(intervals) == 0 {
+		log.Fatalf("No 5 minute history between %v and %v", start, end)
+	}
+	opts := savings.Options{
+		Battery:                   battery.Powerwall2(*batteries),
+		SelfPoweredReservePercent: *reserve,
+	}
+	if *dayAheadPrices {
+		dayAhead := &tariff.DayAhead{CacheFile: filepath.Join(*statedir, "prices.json"), Fallback: t}
+		if err = dayAhead.LoadCache(); err != nil {
+			log.Fatalf("LoadCache: %v", err)
+		}
+		opts.Prices = dayAhead
+	}
+	days := savings.Compute(t, opts, intervals, loc)
+
+	fmt.Printf("Tariff %s\n", t.Name)
+	fmt.Printf("%-10s %9s %11s %12s %9s %9s\n", "day", "actual", "no battery", "self-powered",
+		"battery", "strategy")
+	var total savings.Day
+	for _, d := range days {
+		fmt.Printf("%-10s %9.2f %11.2f %12.2f %9.2f %9.2f\n", d.Start.Format("2006-01-02"),
+			d.Actual.Total, d.NoBattery.Total, d.SelfPowered.Total, d.BatterySavings(),
+			d.StrategySavings())
+		total.Actual.Total += d.Actual.Total
+		total.NoBattery.Total += d.NoBattery.Total
+		total.SelfPowered.Total += d.SelfPowered.Total
+	}
+	if len(days) > 1 {
+		fmt.Printf("%-10s %9.2f %11.2f %12.2f %9.2f %9.2f\n", "total",
+			total.Actual.Total, total.NoBattery.Total, total.SelfPowered.Total,
+			total.BatterySavings(), total.StrategySavings())
+	}
+
+	if *textfile != "" {
+		if err = writeTextfile(*textfile, days[len(days)-1]); err != nil {
+			log.Fatalf("textfile: %v", err)
+		}
+	}
+}
+
+// writeTextfile exports one day's figures in the Prometheus text format.
+func writeTextfile(filename string, d savings.Day) error {
+	reg := prometheus.NewRegistry()
+	cost := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sherwood_energymon_daily_cost_dollars",
+		Help: "Grid cost of the most recent day reported, actual and counterfactual",
+	}, []string{"scenario"})
+	saved := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sherwood_energymon_daily_savings_dollars",
+		Help: "Savings over the most recent day reported",
+	}, []string{"source"})
+	reg.MustRegister(cost, saved)
+
+	cost.WithLabelValues("actual").Set(d.Actual.Total)
+	cost.WithLabelValues("no_battery").Set(d.NoBattery.Total)
+	cost.WithLabelValues("self_powered").Set(d.SelfPowered.Total)
+	saved.WithLabelValues("battery").Set(d.BatterySavings())
+	saved.WithLabelValues("strategy").Set(d.StrategySavings())
+
+	// WriteToTextfile writes to a temporary file and renames it into place.
+	return prometheus.WriteToTextfile(filename, reg)
+}
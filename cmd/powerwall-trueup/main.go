@@ -0,0 +1,73 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// powerwall-trueup shows the net metering balance since the last annual true-up and
+// projects what will be owed at the next one.
+//
+//	powerwall-trueup --tariff=EV2A --trueup=03-15 --nbc=0.03
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/nem"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tariff"
+)
+
+func main() {
+	statedir := flag.String("statedir", "/var/lib/powerwall", "Directory in which state files are stored")
+	tariffName := flag.String("tariff", "EV2A", "Built in tariff name or OpenEI URDB JSON file")
+	scheme := flag.Int("nem", 2, "Net metering scheme, 2 or 3")
+	trueUp := flag.String("trueup", "01-01", "Annual true-up anniversary, MM-DD")
+	nbc := flag.Float64("nbc", 0.0, "Non-bypassable charges in $/kWh imported")
+	exportRates := flag.String("nem3-export-rates", "", "JSON file of NEM 3 export rates by month and hour")
+	timezone := flag.String("timezone", "America/Los_Angeles", "Time zone of the energy site")
+	flag.Parse()
+
+	loc, err := time.LoadLocation(*timezone)
+	if err != nil {
+		log.Fatalf("LoadLocation: %v", err)
+	}
+	t, err := tariff.Load(*tariffName, loc)
+	if err != nil {
+		log.Fatalf("tariff: %v", err)
+	}
+	c := nem.Config{Tariff: t, Scheme: nem.Scheme(*scheme), NonBypassable: *nbc}
+	if err = c.ParseAnniversary(*trueUp); err != nil {
+		log.Fatalf("--trueup: %v", err)
+	}
+	if *exportRates != "" {
+		if c.ExportRates, err = nem.ReadExportRates(*exportRates); err != nil {
+			log.Fatalf("ReadExportRates: %v", err)
+		}
+	}
+	store, err := history.Open(filepath.Join(*statedir, "history"), loc)
+	if err != nil {
+		log.Fatalf("history Open: %v", err)
+	}
+
+	status, err := nem.Track(c, store, time.Now())
+	if err != nil {
+		log.Fatalf("Track: %v", err)
+	}
+	fmt.Printf("NEM %d on %s, true-up year %s to %s\n", *scheme, t.Name,
+		status.Start.Format("2006-01-02"), status.End.Format("2006-01-02"))
+	fmt.Printf("%-16s %10s %10s\n", "", "to date", "projected")
+	row := func(name string, ytd, projected float64) {
+		fmt.Printf("%-16s %10.2f %10.2f\n", name, ytd, projected)
+	}
+	ytd, projected := status.YearToDate, status.Projected
+	row("energy charges", ytd.EnergyCharges, projected.EnergyCharges)
+	row("export credits", -ytd.ExportCredits, -projected.ExportCredits)
+	row("baseline credits", -ytd.BaselineCredits, -projected.BaselineCredits)
+	row("fixed charges", ytd.FixedCharges, projected.FixedCharges)
+	row("non-bypassable", ytd.NonBypassable, projected.NonBypassable)
+	row("balance", ytd.Balance(), projected.Balance())
+	row("true-up", ytd.TrueUp(), projected.TrueUp())
+	fmt.Printf("Projection based on %s\n", status.Basis)
+}
@@ -4,70 +4,43 @@
 package main
 
 import (
-	"encoding/json"
 	"net/http"
-	"os"
-	"sync"
-	"time"
-	"golang.org/x/oauth2"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tesla"
 )
 
 type TeslaState struct {
-	mu       sync.Mutex
-	apiUrl   string
-	siteId   int
-	clientId string
-	tokens   oauth2.Token
+	// Adds the OAuth bearer token, refreshing it as needed.
+	c      *http.Client
+	apiUrl string
+	siteId int64
 }
 
 var state TeslaState
-var tokenFile = "/var/lib/powerwall/tokens"
-
-func (s *TeslaState) ReadFromFile() error {
-	b, err := os.ReadFile(tokenFile)
-	if err != nil {
-		return err
-	}
-
-	var newTokens oauth2.Token
-	err = json.Unmarshal(b, &newTokens)
-	if err != nil {
-		return err
-	}
-
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.tokens = newTokens
-
-	return nil
-}
 
-func (s *TeslaState) WriteToFile() error {
-	s.mu.Lock()
-	b, err := json.Marshal(s)
-	s.mu.Unlock()
-	if err != nil {
-		return err
+// initTesla reads the OAuth tokens and finds the energy site. Refreshed tokens are
+// saved back to tokenFile, which the other commands can share.
+func initTesla(tokenFile, baseURL string, siteId int64) error {
+	tokens := &tesla.TokenFile{
+		Filename:  tokenFile,
+		OnRefresh: func() { refreshSuccess.Add(1) },
+		OnError: func(err error) {
+			refreshFailed.Add(1)
+			notifyTokenRefreshFailed(err)
+		},
 	}
-
-	f, err := os.OpenFile(tokenFile, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
+	if _, err := tokens.Token(); err != nil {
 		return err
 	}
-	defer f.Close()
-
-	f.Write(b)
-}
-
-func ApiUpdateAccessToken() {
-	req, err := http.NewRequest(http.MethodPost, url, nil)
-	if err != nil {
-		refreshFailed.Add(1)
-		return
+	c := tokens.Client()
+	if siteId == 0 {
+		var err error
+		if siteId, err = tesla.FindEnergySite(c, baseURL); err != nil {
+			return err
+		}
 	}
-
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-}
-
-func ApiGet(req *http.Request) {
+	state.c = c
+	state.siteId = siteId
+	state.apiUrl = tesla.SiteURL(baseURL, siteId)
+	return nil
 }
@@ -0,0 +1,150 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/battery"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/forecast"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/loadforecast"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var backupRuntime = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "sherwood_energymon_backup_runtime_hours",
+	Help: "Estimated hours the energy left in the Powerwall would run the house without the grid.",
+})
+
+// Status is served as JSON on /status.
+type Status struct {
+	Time              time.Time `json:"time"`
+	GridStatus        string    `json:"grid_status"`
+	IslandStatus      string    `json:"island_status"`
+	OffGrid           bool      `json:"off_grid"`
+	PercentageCharged float64   `json:"percentage_charged"`
+	EnergyLeft        float64   `json:"energy_left"`
+
+	// BackupRuntimeHours is capped at the length of the load forecast, in which case
+	// BackupRunsOut is nil.
+	BackupRuntimeHours float64    `json:"backup_runtime_hours"`
+	BackupRunsOut      *time.Time `json:"backup_runs_out,omitempty"`
+}
+
+const backupHours = 48
+
+var backup struct {
+	mu     sync.Mutex
+	status Status
+
+	model    *loadforecast.Model
+	trained  time.Time
+	training bool
+
+	// Nil unless --backup-solar, then the latest forecast archived by dispatch.
+	archive *forecast.Archive
+	solar   []forecast.SolarPrediction
+	fetched time.Time
+}
+
+func initBackup(statedir string, withSolar bool) {
+	if withSolar {
+		backup.archive = &forecast.Archive{Dir: filepath.Join(statedir, "forecasts")}
+	}
+	prometheus.MustRegister(backupRuntime)
+	// Ahead of the other hooks, checkLowSoC reads the runtime this computes.
+	pollHooks = append([]func(history.Sample){updateBackup}, pollHooks...)
+	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		backup.mu.Lock()
+		status := backup.status
+		backup.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	})
+}
+
+// loadModel returns the current load model, starting to retrain it from the last year
+// of history once a day. Reading a year of history takes a while, so training happens in
+// the background rather than holding up polling and /status. Called with backup.mu held.
+func loadModel(now time.Time) *loadforecast.Model {
+	if historyStore == nil || backup.training || now.Sub(backup.trained) < 24*time.Hour {
+		return backup.model
+	}
+	backup.trained = now
+	backup.training = true
+	go func() {
+		model, err := trainBackupModel(now)
+		if err != nil {
+			log.Printf("backup load model: %v", err)
+		}
+		backup.mu.Lock()
+		defer backup.mu.Unlock()
+		if model != nil {
+			backup.model = model
+		}
+		backup.training = false
+	}()
+	return backup.model
+}
+
+func trainBackupModel(now time.Time) (*loadforecast.Model, error) {
+	intervals, err := historyStore.Intervals(history.FiveMinutes, now.AddDate(-1, 0, 0), now)
+	if err != nil {
+		return nil, err
+	}
+	return loadforecast.Train(loadforecast.SamplesFromIntervals(intervals), historyStore.Location())
+}
+
+// solarForecast returns the newest archived forecast, re-reading the archive hourly.
+func solarForecast(now time.Time) []forecast.SolarPrediction {
+	if backup.archive == nil || now.Sub(backup.fetched) < time.Hour {
+		return backup.solar
+	}
+	backup.fetched = now
+	forecasts, err := backup.archive.Load(now.Add(-12*time.Hour), now)
+	if err != nil {
+		log.Printf("backup solar forecast: %v", err)
+		return backup.solar
+	}
+	if len(forecasts) > 0 {
+		backup.solar = forecasts[len(forecasts)-1].Predictions
+	}
+	return backup.solar
+}
+
+// updateBackup estimates the backup runtime on every poll. While islanded the estimate
+// starts from the load the house is actually drawing.
+func updateBackup(cur history.Sample) {
+	backup.mu.Lock()
+	defer backup.mu.Unlock()
+	status := Status{
+		Time:              cur.Time,
+		GridStatus:        cur.GridStatus,
+		IslandStatus:      cur.IslandStatus,
+		OffGrid:           cur.OffGrid(),
+		PercentageCharged: cur.PercentageCharged,
+		EnergyLeft:        cur.EnergyLeft,
+	}
+	if model := loadModel(cur.Time); model != nil {
+		nowW := 0.0
+		if status.OffGrid {
+			nowW = cur.LoadPower
+		}
+		runtime, runsOut := battery.BackupRuntime(cur.EnergyLeft, cur.TotalPackEnergy, cur.Time, nowW,
+			model.Predict(cur.Time, backupHours, nil), solarForecast(cur.Time))
+		status.BackupRuntimeHours = runtime.Hours()
+		if runsOut {
+			t := cur.Time.Add(runtime)
+			status.BackupRunsOut = &t
+		}
+		backupRuntime.Set(status.BackupRuntimeHours)
+	}
+	backup.status = status
+}
@@ -0,0 +1,53 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/balance"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	balanceViolations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sherwood_energymon_balance_violations_total",
+		Help: "Number of polls in which the meters don't add up, by the likely cause.",
+	}, []string{"kind"})
+	balanceError = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sherwood_energymon_balance_error_watts",
+		Help: "Solar plus grid plus battery power less the house load in Watts, ideally close to zero.",
+	})
+)
+
+var (
+	validator      *balance.Validator
+	lastViolations = make(map[string]time.Time)
+)
+
+func initBalance(latitude, longitude float64) {
+	validator = &balance.Validator{Latitude: latitude, Longitude: longitude}
+	prometheus.MustRegister(balanceViolations)
+	prometheus.MustRegister(balanceError)
+	for _, kind := range []string{balance.Imbalance, balance.SolarReversed, balance.GridReversed,
+		balance.BatteryReversed, balance.NegativeSolar, balance.SolarAtNight} {
+		balanceViolations.WithLabelValues(kind)
+	}
+	pollHooks = append(pollHooks, checkBalance)
+}
+
+// checkBalance logs each kind of violation at most once an hour, a reversed CT would
+// otherwise fill the log.
+func checkBalance(cur history.Sample) {
+	balanceError.Set(balance.Error(cur))
+	for _, v := range validator.Check(cur) {
+		balanceViolations.WithLabelValues(v.Kind).Inc()
+		if cur.Time.Sub(lastViolations[v.Kind]) >= time.Hour {
+			log.Printf("meter check %s: %s", v.Kind, v.Detail)
+			lastViolations[v.Kind] = cur.Time
+		}
+	}
+}
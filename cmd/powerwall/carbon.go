@@ -0,0 +1,119 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/carbon"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	carbonIntensity = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sherwood_energymon_grid_carbon_intensity_grams_per_kwh",
+		Help: "Current carbon intensity of grid electricity in gCO2/kWh.",
+	})
+	gridEmissions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sherwood_energymon_grid_emissions_grams_total",
+		Help: "CO2 emitted by the grid to supply energy we imported, in grams.",
+	})
+	solarAvoided = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sherwood_energymon_solar_avoided_emissions_grams_total",
+		Help: "CO2 emissions displaced by solar production, in grams.",
+	})
+	// A gauge rather than a counter because charging when the grid is dirtier than
+	// when discharging makes it go down.
+	batteryAvoided = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sherwood_energymon_battery_avoided_emissions_grams",
+		Help: "CO2 emissions avoided by shifting energy through the battery since startup, in grams.",
+	})
+)
+
+var (
+	carbonProvider carbon.Provider
+	carbonMu       sync.Mutex
+	carbonSeries   carbon.Series
+)
+
+// initCarbon picks a carbon intensity source: a local CSV file, or WattTime for region
+// with credentials from the WATTTIME_USERNAME and WATTTIME_PASSWORD environment variables.
+func initCarbon(csvFile, region string) {
+	switch {
+	case csvFile != "":
+		carbonProvider = &carbon.File{Filename: csvFile}
+	case region != "":
+		carbonProvider = &carbon.WattTime{
+			Username: os.Getenv("WATTTIME_USERNAME"),
+			Password: os.Getenv("WATTTIME_PASSWORD"),
+			Region:   region,
+		}
+	default:
+		return
+	}
+	prometheus.MustRegister(carbonIntensity)
+	prometheus.MustRegister(gridEmissions)
+	prometheus.MustRegister(solarAvoided)
+	prometheus.MustRegister(batteryAvoided)
+	sampleHooks = append(sampleHooks, updateEmissions)
+}
+
+func updateEmissions(prev, cur history.Sample) {
+	carbonMu.Lock()
+	series := carbonSeries
+	carbonMu.Unlock()
+
+	intervals := history.Integrate([]history.Sample{prev, cur}, history.FiveMinutes)
+	e := carbon.Compute(intervals, series)
+	gridEmissions.Add(e.Grid)
+	solarAvoided.Add(e.SolarAvoided)
+	batteryAvoided.Add(e.BatteryAvoided)
+}
+
+func refreshCarbon() {
+	now := time.Now()
+	intensities, err := carbonProvider.Intensities(now.Add(-2*time.Hour), now.Add(24*time.Hour))
+	if err != nil {
+		log.Printf("carbon intensity: %v", err)
+		return
+	}
+	carbonMu.Lock()
+	carbonSeries = carbonSeries.Merge(intensities, now.Add(-2*time.Hour))
+	carbonMu.Unlock()
+}
+
+func updateCarbonIntensity() {
+	carbonMu.Lock()
+	g, ok := carbonSeries.At(time.Now())
+	carbonMu.Unlock()
+	if ok {
+		carbonIntensity.Set(g)
+	}
+}
+
+// CarbonLoop fetches intensity every 15 minutes and updates the gauge every 5.
+func CarbonLoop() {
+	if carbonProvider == nil {
+		return
+	}
+	refreshCarbon()
+	updateCarbonIntensity()
+	t := time.NewTicker(5 * time.Minute)
+	defer t.Stop()
+	lastRefresh := time.Now()
+	for {
+		select {
+		case now := <-t.C:
+			if now.Sub(lastRefresh) >= 15*time.Minute {
+				refreshCarbon()
+				lastRefresh = now
+			}
+			updateCarbonIntensity()
+		}
+	}
+}
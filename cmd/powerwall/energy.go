@@ -11,29 +11,29 @@ import (
 )
 
 type TeslaOuterResponse struct {
-	response TeslaInnerResponse
+	Response TeslaInnerResponse `json:"response"`
 }
 
 type TeslaInnerResponse struct {
-	SolarPower        int     // `json:"solar_power"`
-	EnergyLeft        float64 // `json:"energy_left"`
-	TotalPackEnergy   int     // `json:"total_pack_energy"`
-	PercentageCharged float64 // `json:"percentage_charged"`
-	BackupCapable     bool    // `json:"backup_capable"`
-	BatteryPower      int     // `json:"battery_power"`
-	LoadPower         int     // `json:"load_power"`
-	GridStatus        string  // `json:"grid_status"`
-	GridPower         int     // `json:"grid_power"`
-	IslandStatus      string  // `json:"island_status"`
-	StormModeActive   bool    // `json:"storm_mode_active"`
-	Timestamp         string  // `json:"timestamp"`
+	SolarPower        int     `json:"solar_power"`
+	EnergyLeft        float64 `json:"energy_left"`
+	TotalPackEnergy   int     `json:"total_pack_energy"`
+	PercentageCharged float64 `json:"percentage_charged"`
+	BackupCapable     bool    `json:"backup_capable"`
+	BatteryPower      int     `json:"battery_power"`
+	LoadPower         int     `json:"load_power"`
+	GridStatus        string  `json:"grid_status"`
+	GridPower         int     `json:"grid_power"`
+	IslandStatus      string  `json:"island_status"`
+	StormModeActive   bool    `json:"storm_mode_active"`
+	Timestamp         string  `json:"timestamp"`
 }
 
 func updateMetricsFromTesla(tesla *TeslaState) {
 	url := tesla.apiUrl + "/live_status"
 	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
-		fetchFailed.Add(1)
+		fetchFailure(fetchFailed, err.Error())
 		return
 	}
 
@@ -42,26 +42,53 @@ func updateMetricsFromTesla(tesla *TeslaState) {
 
 	res, err := tesla.c.Do(req)
 	if err != nil {
-		fetchFailed.Add(1)
+		fetchFailure(fetchFailed, err.Error())
 		return
 	}
 	if res.StatusCode == 403 {
-		fetchAuthFailed.Add(1)
+		fetchFailure(fetchAuthFailed, "403 Forbidden")
 		return
 	}
 	if res.StatusCode != 200 {
-		fetchFailed.Add(1)
+		fetchFailure(fetchFailed, res.Status)
 		return
 	}
 
 	defer res.Body.Close()
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
-		fetchFailed.Add(1)
+		fetchFailure(fetchFailed, err.Error())
 		return
 	}
 
 	decoder := json.NewDecoder(bytes.NewReader(body))
 	var r TeslaOuterResponse
-	decoder.Decode(r)
+	err = decoder.Decode(&r)
+	if err != nil {
+		fetchFailure(fetchFailed, err.Error())
+		return
+	}
+	fetchSucceeded()
+
+	updateLiveMetrics(&r.Response)
+	recordHistory(&r.Response)
+}
+
+func updateLiveMetrics(r *TeslaInnerResponse) {
+	solarPower.Set(float64(r.SolarPower))
+	powerwallEnergy.Set(r.EnergyLeft)
+	powerwallCapacity.Set(float64(r.TotalPackEnergy))
+	powerwallPower.Set(float64(r.BatteryPower))
+	houseLoadPower.Set(float64(r.LoadPower))
+	gridPower.Set(float64(r.GridPower))
+	gridPresent.Set(boolToFloat(r.GridStatus == "Active"))
+	stormModeActive.Set(boolToFloat(r.StormModeActive))
+	onGrid.Set(boolToFloat(r.IslandStatus == "on_grid"))
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,92 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/flow"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	flowPower = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sherwood_energymon_flow_watts",
+		Help: "Instantaneous power flowing from one of solar, battery or grid to another, in Watts.",
+	}, []string{"from", "to"})
+	flowEnergy = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sherwood_energymon_flow_wh_total",
+		Help: "Energy which has flowed from one of solar, battery or grid to another, in Watt-hours.",
+	}, []string{"from", "to"})
+	selfConsumption = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sherwood_energymon_self_consumption_ratio",
+		Help: "Fraction of today's solar production used on site rather than exported.",
+	})
+	selfSufficiency = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sherwood_energymon_self_sufficiency_ratio",
+		Help: "Fraction of today's house load not drawn from the grid.",
+	})
+)
+
+func initFlows() {
+	prometheus.MustRegister(flowPower)
+	prometheus.MustRegister(flowEnergy)
+	prometheus.MustRegister(selfConsumption)
+	prometheus.MustRegister(selfSufficiency)
+	sampleHooks = append(sampleHooks, updateFlows)
+	pollHooks = append(pollHooks, updateDayRatios)
+}
+
+// updateFlows holds prev's power until cur, the same way history.Integrate does.
+func updateFlows(prev, cur history.Sample) {
+	end := cur.Time
+	if end.Sub(prev.Time) > history.MaxGap {
+		end = prev.Time.Add(history.MaxGap)
+	}
+	f := flow.Decompose(prev.SolarPower, prev.BatteryPower, prev.LoadPower, prev.GridPower)
+	hours := end.Sub(prev.Time).Hours()
+	for idx, w := range f.Values() {
+		flowEnergy.WithLabelValues(flow.Paths[idx].From, flow.Paths[idx].To).Add(w * hours)
+	}
+
+	now := flow.Decompose(cur.SolarPower, cur.BatteryPower, cur.LoadPower, cur.GridPower)
+	for idx, w := range now.Values() {
+		flowPower.WithLabelValues(flow.Paths[idx].From, flow.Paths[idx].To).Set(w)
+	}
+}
+
+// updateDayRatios computes today's ratios from the history store, so that they survive
+// a restart and include backfilled intervals. The rollups lag the polls by up to an
+// hour, the polls since the last rollup are integrated here.
+func updateDayRatios(cur history.Sample) {
+	if historyStore == nil {
+		return
+	}
+	start := historyStore.StartOfDay(cur.Time)
+	end := cur.Time.Add(time.Second)
+	intervals, err := historyStore.Intervals(history.FiveMinutes, start, end)
+	if err != nil {
+		log.Printf("flow Intervals: %v", err)
+		return
+	}
+	from := start
+	if len(intervals) > 0 {
+		from = intervals[len(intervals)-1].End()
+	}
+	samples, err := historyStore.Samples(from.Add(-history.MaxGap), end)
+	if err != nil {
+		log.Printf("flow Samples: %v", err)
+		return
+	}
+	for _, interval := range history.Integrate(samples, history.FiveMinutes) {
+		if !interval.Start.Before(from) {
+			intervals = append(intervals, interval)
+		}
+	}
+	day := history.Sum(intervals)
+	selfConsumption.Set(flow.SelfConsumption(day.SolarWh, day.GridExportWh))
+	selfSufficiency.Set(flow.SelfSufficiency(day.LoadWh, day.GridImportWh))
+}
@@ -0,0 +1,112 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/backfill"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tesla"
+)
+
+var historyStore *history.Store
+
+// sampleHooks are called with each pair of consecutive polls, for metrics which
+// integrate power over time. pollHooks are called with every poll once it is recorded,
+// including the first after a restart.
+var (
+	sampleHooks []func(prev, cur history.Sample)
+	pollHooks   []func(cur history.Sample)
+	lastSample  *history.Sample
+)
+
+func initHistory(statedir string, loc *time.Location, retention history.Retention) error {
+	s, err := history.Open(filepath.Join(statedir, "history"), loc)
+	if err != nil {
+		return err
+	}
+	s.Retention = retention
+	historyStore = s
+	return nil
+}
+
+func sampleFromTesla(r *TeslaInnerResponse) history.Sample {
+	t, err := time.Parse(time.RFC3339, r.Timestamp)
+	if err != nil {
+		t = time.Now()
+	}
+	return history.Sample{
+		Time:              t,
+		SolarPower:        float64(r.SolarPower),
+		BatteryPower:      float64(r.BatteryPower),
+		LoadPower:         float64(r.LoadPower),
+		GridPower:         float64(r.GridPower),
+		EnergyLeft:        r.EnergyLeft,
+		TotalPackEnergy:   float64(r.TotalPackEnergy),
+		PercentageCharged: r.PercentageCharged,
+		GridStatus:        r.GridStatus,
+		IslandStatus:      r.IslandStatus,
+		StormModeActive:   r.StormModeActive,
+	}
+}
+
+func recordHistory(r *TeslaInnerResponse) {
+	cur := sampleFromTesla(r)
+	if lastSample != nil && cur.Time.After(lastSample.Time) {
+		for _, hook := range sampleHooks {
+			hook(*lastSample, cur)
+		}
+	}
+	lastSample = &cur
+
+	if historyStore != nil {
+		if err := historyStore.Record(cur); err != nil {
+			log.Printf("history Record: %v", err)
+		}
+	}
+	for _, hook := range pollHooks {
+		hook(cur)
+	}
+}
+
+// rollupHistory rolls up the polls, then updates the gauges computed from the rollups.
+func rollupHistory() {
+	if err := historyStore.Rollup(time.Now()); err != nil {
+		log.Printf("history Rollup: %v", err)
+	}
+	updateSavings()
+	updateNEM()
+}
+
+// RollupHistoryLoop rolls up once at startup and then hourly. On fly.io the daemon may
+// not run for an hour at a time, so the gauges can't wait for the first tick.
+func RollupHistoryLoop() {
+	rollupHistory()
+	t := time.NewTicker(time.Hour)
+	defer t.Stop()
+	for range t.C {
+		rollupHistory()
+	}
+}
+
+// BackfillHistory fills in whatever we missed while not running. On fly.io with
+// auto_stop_machines that can be most of the time, so it runs on every startup. Outages
+// Tesla recorded in the meantime are merged in too.
+func BackfillHistory(s *TeslaState, days int) {
+	client := &tesla.Client{HTTP: s.c, SiteURL: s.apiUrl}
+	mergeBackupHistory(client)
+	if historyStore == nil || days <= 0 {
+		return
+	}
+	end := time.Now().Truncate(history.FiveMinutes)
+	result, err := backfill.Run(client, historyStore, end.AddDate(0, 0, -days), end)
+	if err != nil {
+		log.Printf("backfill: %v", err)
+		return
+	}
+	log.Printf("Backfilled %d intervals over %d days", result.Intervals, result.Days)
+}
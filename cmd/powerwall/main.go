@@ -4,16 +4,90 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"path/filepath"
+	"time"
 
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tesla"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
+	statedir := flag.String("statedir", "/var/lib/powerwall", "Directory in which to store state files")
+	tokens := flag.String("tokens", "", "OAuth tokens file, defaults to tokens in --statedir")
+	api := flag.String("api", tesla.DefaultBaseURL, "Tesla Fleet API base URL")
+	siteId := flag.Int64("site-id", 0, "Energy site ID, found from the account if not set")
+	timezone := flag.String("timezone", "America/Los_Angeles", "Time zone of the energy site, for daily rollups and tariffs")
+	rawDays := flag.Int("history-raw-days", 14, "Days of raw polls to keep, 0 keeps forever")
+	fiveMinuteDays := flag.Int("history-5m-days", 400, "Days of 5 minute rollups to keep, 0 keeps forever")
+	dailyDays := flag.Int("history-daily-days", 0, "Days of daily rollups to keep, 0 keeps forever")
+	backfillDays := flag.Int("backfill-days", 7, "Days of missing history to backfill on startup")
+	tariffName := flag.String("tariff", "", "Built in tariff name or OpenEI URDB JSON file, enables savings and true-up tracking")
+	batteries := flag.Int("batteries", 1, "Number of Powerwall 2 units installed, for the savings gauges")
+	savingsReserve := flag.Float64("savings-reserve", 20.0, "Backup reserve percent for the self-powered savings comparison")
+	nemScheme := flag.Int("nem", 2, "Net metering scheme, 2 or 3")
+	trueUp := flag.String("trueup", "01-01", "Annual true-up anniversary, MM-DD")
+	nbc := flag.Float64("nbc", 0.0, "Non-bypassable charges in $/kWh imported")
+	exportRates := flag.String("nem3-export-rates", "", "JSON file of NEM 3 export rates by month and hour")
+	priceFeed := flag.String("price-feed", "", "URL or file of day-ahead hourly prices, overriding --tariff where they exist")
+	carbonCSV := flag.String("carbon-csv", "", "CSV file of grid carbon intensity, with time and g_per_kwh columns")
+	wattTimeRegion := flag.String("watttime-region", "", "WattTime region for grid carbon intensity, such as CAISO_NORTH")
+	latitude := flag.Float64("latitude", 0, "Site latitude in degrees, to check for solar production at night")
+	longitude := flag.Float64("longitude", 0, "Site longitude in degrees, to check for solar production at night")
+	backupSolar := flag.Bool("backup-solar", false, "Count forecast solar archived by dispatch in the backup runtime")
+	notifyFile := flag.String("notify", "", "JSON file configuring notifications of outages and failures")
+	mqttBroker := flag.String("mqtt-broker", "", "MQTT broker to publish to, such as tcp://localhost:1883, password in MQTT_PASSWORD")
+	mqttUsername := flag.String("mqtt-username", "", "MQTT broker username")
+	mqttTopic := flag.String("mqtt-topic", "powerwall", "MQTT topic under which state is published and commands received")
+	mqttDiscovery := flag.String("mqtt-discovery-prefix", "homeassistant", "Home Assistant MQTT discovery prefix")
+	flag.Parse()
+
 	initPrometheusMetrics()
-	token := ReadSavedState()
+	if err := initNotify(*notifyFile, *statedir); err != nil {
+		log.Fatalf("initNotify: %v", err)
+	}
+	if *tokens == "" {
+		*tokens = filepath.Join(*statedir, "tokens")
+	}
+	if err := initTesla(*tokens, *api, *siteId); err != nil {
+		log.Fatalf("initTesla: %v", err)
+	}
+
+	loc, err := time.LoadLocation(*timezone)
+	if err != nil {
+		log.Fatalf("LoadLocation: %v", err)
+	}
+	err = initHistory(*statedir, loc, history.Retention{
+		Raw:        time.Duration(*rawDays) * 24 * time.Hour,
+		FiveMinute: time.Duration(*fiveMinuteDays) * 24 * time.Hour,
+		Daily:      time.Duration(*dailyDays) * 24 * time.Hour,
+	})
+	if err != nil {
+		log.Fatalf("initHistory: %v", err)
+	}
+	if err = initSavings(*tariffName, loc, *batteries, *savingsReserve); err != nil {
+		log.Fatalf("initSavings: %v", err)
+	}
+	if err = initNEM(*tariffName, loc, *nemScheme, *trueUp, *nbc, *exportRates); err != nil {
+		log.Fatalf("initNEM: %v", err)
+	}
+	if err = initPrices(*statedir, *tariffName, loc, *priceFeed); err != nil {
+		log.Fatalf("initPrices: %v", err)
+	}
+	initCarbon(*carbonCSV, *wattTimeRegion)
+	initFlows()
+	initBalance(*latitude, *longitude)
+	initBackup(*statedir, *backupSolar)
+	if err = initOutages(*statedir); err != nil {
+		log.Fatalf("initOutages: %v", err)
+	}
+	if err = initMQTT(*mqttBroker, *mqttTopic, *mqttDiscovery, *mqttUsername); err != nil {
+		log.Fatalf("initMQTT: %v", err)
+	}
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "ok")
@@ -21,6 +95,14 @@ func main() {
 	})
 	http.Handle("/metrics", promhttp.Handler())
 
+	go func() {
+		// Roll up what was backfilled before computing anything from the rollups.
+		BackfillHistory(&state, *backfillDays)
+		RollupHistoryLoop()
+	}()
 	go UpdateMetricsLoop()
+	go PriceLoop()
+	go CarbonLoop()
+	go MQTTLoop(&state)
 	log.Fatal(http.ListenAndServe("0.0.0.0:8080", nil))
 }
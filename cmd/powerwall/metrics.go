@@ -68,14 +68,16 @@ var (
 	})
 )
 
+// UpdateMetricsLoop polls every 5 minutes, or every minute while islanded so that the
+// backup runtime follows what the house is drawing.
 func UpdateMetricsLoop() {
-	t := time.NewTicker(300 * time.Second)
-	defer t.Stop()
 	for {
-		select {
-		case <-t.C:
-			updateMetricsFromTesla(&Tesla)
+		interval := 300 * time.Second
+		if lastSample != nil && lastSample.OffGrid() {
+			interval = 60 * time.Second
 		}
+		time.Sleep(interval)
+		updateMetricsFromTesla(&state)
 	}
 }
 
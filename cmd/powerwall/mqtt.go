@@ -0,0 +1,284 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/mqtt"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/notify"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tesla"
+)
+
+// mqttState is published to <topic>/state after every poll.
+type mqttState struct {
+	Time               time.Time `json:"time"`
+	SolarPower         float64   `json:"solar_power"`
+	BatteryPower       float64   `json:"battery_power"`
+	LoadPower          float64   `json:"load_power"`
+	GridPower          float64   `json:"grid_power"`
+	PercentageCharged  float64   `json:"percentage_charged"`
+	EnergyLeft         float64   `json:"energy_left"`
+	GridStatus         string    `json:"grid_status"`
+	StormModeActive    bool      `json:"storm_mode_active"`
+	BackupRuntimeHours float64   `json:"backup_runtime_hours"`
+}
+
+var mqttPublisher struct {
+	client    *mqtt.Client
+	topic     string
+	discovery []mqtt.Message
+
+	// Commands from Home Assistant are applied one at a time by mqttCommandLoop.
+	commands chan mqtt.Message
+}
+
+func initMQTT(broker, topic, prefix, username string) error {
+	if broker == "" {
+		return nil
+	}
+	hostname, _ := os.Hostname()
+	p := &mqttPublisher
+	p.topic = topic
+	p.commands = make(chan mqtt.Message, 10)
+	p.client = &mqtt.Client{
+		Broker:   broker,
+		ClientID: "powerwall-" + hostname,
+		Username: username,
+		Password: os.Getenv("MQTT_PASSWORD"),
+		Will:     &mqtt.Message{Topic: topic + "/availability", Payload: []byte("offline"), Retain: true},
+		OnMessage: func(m mqtt.Message) {
+			select {
+			case p.commands <- m:
+			default:
+				log.Printf("mqtt: dropped command on %s, still applying earlier ones", m.Topic)
+			}
+		},
+	}
+	discovery, err := mqtt.Discovery(prefix, mqtt.Device{
+		Identifiers:  []string{strings.ReplaceAll(topic, "/", "_")},
+		Name:         "Powerwall",
+		Manufacturer: "Tesla",
+		Model:        "Powerwall",
+	}, topic+"/availability", homeAssistantEntities(topic))
+	if err != nil {
+		return err
+	}
+	p.discovery = discovery
+	pollHooks = append(pollHooks, publishState)
+	return nil
+}
+
+func homeAssistantEntities(topic string) []mqtt.Entity {
+	state := topic + "/state"
+	sensor := func(id, name, field, unit, class, stateClass string) mqtt.Entity {
+		return mqtt.Entity{Component: "sensor", ObjectID: id, Config: map[string]interface{}{
+			"name":                name,
+			"state_topic":         state,
+			"value_template":      "{{ value_json." + field + " }}",
+			"unit_of_measurement": unit,
+			"device_class":        class,
+			"state_class":         stateClass,
+		}}
+	}
+	runtime := sensor("backup_runtime", "Backup runtime", "backup_runtime_hours", "h", "duration", "measurement")
+	runtime.Config["suggested_display_precision"] = 1
+	return []mqtt.Entity{
+		sensor("solar_power", "Solar power", "solar_power", "W", "power", "measurement"),
+		sensor("battery_power", "Battery power", "battery_power", "W", "power", "measurement"),
+		sensor("load_power", "Load power", "load_power", "W", "power", "measurement"),
+		sensor("grid_power", "Grid power", "grid_power", "W", "power", "measurement"),
+		sensor("percentage_charged", "Charge", "percentage_charged", "%", "battery", "measurement"),
+		sensor("energy_left", "Energy left", "energy_left", "Wh", "energy_storage", "measurement"),
+		runtime,
+		{Component: "binary_sensor", ObjectID: "grid_status", Config: map[string]interface{}{
+			"name":           "Grid",
+			"state_topic":    state,
+			"value_template": "{{ 'ON' if value_json.grid_status == 'Active' else 'OFF' }}",
+			"device_class":   "power",
+		}},
+		{Component: "binary_sensor", ObjectID: "storm_mode", Config: map[string]interface{}{
+			"name":           "Storm watch",
+			"state_topic":    state,
+			"value_template": "{{ 'ON' if value_json.storm_mode_active else 'OFF' }}",
+			"icon":           "mdi:weather-lightning",
+		}},
+		{Component: "number", ObjectID: "backup_reserve", Config: map[string]interface{}{
+			"name":                "Backup reserve",
+			"state_topic":         topic + "/reserve",
+			"command_topic":       topic + "/reserve/set",
+			"min":                 0,
+			"max":                 100,
+			"step":                1,
+			"unit_of_measurement": "%",
+			"mode":                "slider",
+		}},
+		{Component: "select", ObjectID: "operation_mode", Config: map[string]interface{}{
+			"name":          "Operation mode",
+			"state_topic":   topic + "/mode",
+			"command_topic": topic + "/mode/set",
+			"options":       []string{tesla.SelfConsumption, tesla.Autonomous, tesla.Backup},
+		}},
+	}
+}
+
+// publishState runs on every poll, so Home Assistant has the state as soon as the daemon
+// starts.
+func publishState(cur history.Sample) {
+	backup.mu.Lock()
+	hours := backup.status.BackupRuntimeHours
+	backup.mu.Unlock()
+	b, err := json.Marshal(mqttState{
+		Time:               cur.Time,
+		SolarPower:         cur.SolarPower,
+		BatteryPower:       cur.BatteryPower,
+		LoadPower:          cur.LoadPower,
+		GridPower:          cur.GridPower,
+		PercentageCharged:  cur.PercentageCharged,
+		EnergyLeft:         cur.EnergyLeft,
+		GridStatus:         cur.GridStatus,
+		StormModeActive:    cur.StormModeActive,
+		BackupRuntimeHours: hours,
+	})
+	if err != nil {
+		log.Printf("mqtt: %v", err)
+		return
+	}
+	// Dropped while disconnected, the next poll will be along soon.
+	mqttPublisher.client.Publish(mqtt.Message{Topic: mqttPublisher.topic + "/state", Payload: b})
+}
+
+// publishSettings publishes the reserve and mode the Powerwall reports, so Home
+// Assistant shows what is in effect rather than what it last asked for.
+func publishSettings(client *tesla.Client) error {
+	info, err := client.SiteInfo()
+	if err != nil {
+		return err
+	}
+	p := &mqttPublisher
+	for _, m := range []mqtt.Message{
+		{Topic: p.topic + "/reserve", Payload: []byte(strconv.Itoa(int(math.Round(info.BackupReservePercent)))), Retain: true},
+		{Topic: p.topic + "/mode", Payload: []byte(info.DefaultRealMode), Retain: true},
+	} {
+		if err = p.client.Publish(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MQTTLoop keeps the broker connection up, reconnecting with backoff. Each connection
+// publishes the discovery configs and subscribes to the command topics again.
+func MQTTLoop(s *TeslaState) {
+	p := &mqttPublisher
+	if p.client == nil {
+		return
+	}
+	go mqttCommandLoop(s)
+	backoff := 5 * time.Second
+	for {
+		if err := mqttConnect(); err != nil {
+			log.Printf("mqtt: %v, retrying in %v", err, backoff)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > 5*time.Minute {
+				backoff = 5 * time.Minute
+			}
+			continue
+		}
+		backoff = 5 * time.Second
+		log.Printf("mqtt: connected to %s", p.client.Broker)
+		if err := publishSettings(&tesla.Client{HTTP: s.c, SiteURL: s.apiUrl}); err != nil {
+			log.Printf("mqtt: %v", err)
+		}
+
+		// The settings can also be changed from the app or by dispatch.
+		t := time.NewTicker(time.Hour)
+	connected:
+		for {
+			select {
+			case <-t.C:
+				if err := publishSettings(&tesla.Client{HTTP: s.c, SiteURL: s.apiUrl}); err != nil {
+					log.Printf("mqtt: %v", err)
+				}
+			case <-p.client.Done():
+				break connected
+			}
+		}
+		t.Stop()
+		log.Printf("mqtt: connection lost: %v", p.client.Err())
+	}
+}
+
+func mqttConnect() error {
+	p := &mqttPublisher
+	if err := p.client.Connect(); err != nil {
+		return err
+	}
+	messages := make([]mqtt.Message, len(p.discovery), len(p.discovery)+1)
+	copy(messages, p.discovery)
+	messages = append(messages, mqtt.Message{Topic: p.topic + "/availability", Payload: []byte("online"), Retain: true})
+	for _, m := range messages {
+		if err := p.client.Publish(m); err != nil {
+			p.client.Close()
+			return err
+		}
+	}
+	if err := p.client.Subscribe(p.topic+"/reserve/set", p.topic+"/mode/set"); err != nil {
+		p.client.Close()
+		return err
+	}
+	return nil
+}
+
+// mqttCommandLoop applies commands through tesla.Client.Apply, which reads the settings
+// back to check that they took effect. It returns when commands is closed.
+func mqttCommandLoop(s *TeslaState) {
+	p := &mqttPublisher
+	for m := range p.commands {
+		if m.Retain {
+			// A retained command would be applied again on every reconnect, long after
+			// whoever sent it has moved on.
+			log.Printf("mqtt: ignored retained command on %s", m.Topic)
+			continue
+		}
+		client := &tesla.Client{HTTP: s.c, SiteURL: s.apiUrl}
+		payload := strings.TrimSpace(string(m.Payload))
+		var err error
+		var what string
+		switch m.Topic {
+		case p.topic + "/reserve/set":
+			what = fmt.Sprintf("Setting the Powerwall reserve to %s%%", payload)
+			var percent float64
+			if percent, err = strconv.ParseFloat(payload, 64); err == nil {
+				err = client.Apply(int(math.Round(percent)), "")
+			}
+		case p.topic + "/mode/set":
+			what = fmt.Sprintf("Setting the Powerwall mode to %s", payload)
+			var info *tesla.SiteInfo
+			if info, err = client.SiteInfo(); err == nil {
+				err = client.Apply(int(math.Round(info.BackupReservePercent)), payload)
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			log.Printf("mqtt: %s failed: %v", what, err)
+			sendNotification(notify.Message{Event: notify.CommandFailed,
+				Title: what + " failed", Body: err.Error()})
+		} else {
+			log.Printf("mqtt: %s", what)
+		}
+		if err = publishSettings(client); err != nil {
+			log.Printf("mqtt: %v", err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/mqtt"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tesla"
+)
+
+// fakeSite applies the settings posted to it and records each one.
+type fakeSite struct {
+	reserve float64
+	mode    string
+	posts   []string
+}
+
+func (f *fakeSite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/1/energy_sites/1")
+	switch {
+	case r.Method == http.MethodPost:
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch path {
+		case "/backup":
+			f.reserve = body["backup_reserve_percent"].(float64)
+		case "/operation":
+			f.mode = body["default_real_mode"].(string)
+		}
+		f.posts = append(f.posts, fmt.Sprintf("%s %v", path, body))
+		fmt.Fprintf(w, `{"response": {"code": 201, "message": "Updated"}}`)
+	case path == "/site_info":
+		fmt.Fprintf(w, `{"response": {"backup_reserve_percent": %v, "default_real_mode": %q}}`, f.reserve, f.mode)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestMQTTCommandLoop(t *testing.T) {
+	site := &fakeSite{reserve: 20, mode: tesla.SelfConsumption}
+	server := httptest.NewServer(site)
+	defer server.Close()
+
+	p := &mqttPublisher
+	saved := *p
+	defer func() { *p = saved }()
+	p.topic = "powerwall"
+	// Never connected, so publishing the settings back fails and is only logged.
+	p.client = &mqtt.Client{}
+	p.commands = make(chan mqtt.Message, 10)
+
+	p.commands <- mqtt.Message{Topic: "powerwall/reserve/set", Payload: []byte("90"), Retain: true}
+	p.commands <- mqtt.Message{Topic: "powerwall/reserve/set", Payload: []byte(" 50.4\n")}
+	p.commands <- mqtt.Message{Topic: "powerwall/mode/set", Payload: []byte(tesla.Autonomous)}
+	p.commands <- mqtt.Message{Topic: "powerwall/other", Payload: []byte("1")}
+	close(p.commands)
+	mqttCommandLoop(&TeslaState{c: server.Client(), apiUrl: tesla.SiteURL(server.URL, 1)})
+
+	if site.reserve != 50 || site.mode != tesla.Autonomous {
+		t.Errorf("site got reserve=%v mode=%q", site.reserve, site.mode)
+	}
+	for _, post := range site.posts {
+		if strings.Contains(post, "90") {
+			t.Errorf("retained command applied: %s", post)
+		}
+	}
+	if len(site.posts) != 3 {
+		t.Errorf("got posts %q, want the reserve, then the mode and the same reserve", site.posts)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/nem"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tariff"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	nemBalance = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sherwood_energymon_nem_balance_dollars",
+		Help: "Net metering balance since the last true-up in dollars, negative if in credit.",
+	})
+	nemProjected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sherwood_energymon_nem_projected_trueup_dollars",
+		Help: "Projected amount owed at the next true-up in dollars.",
+	})
+	nemTrueUpTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sherwood_energymon_nem_trueup_timestamp_seconds",
+		Help: "Time of the next true-up, in seconds since the epoch.",
+	})
+)
+
+var nemConfig *nem.Config
+
+// initNEM enables true-up tracking if a tariff was given.
+func initNEM(tariffName string, loc *time.Location, scheme int, anniversary string, nbc float64, exportRates string) error {
+	if tariffName == "" {
+		return nil
+	}
+	t, err := tariff.Load(tariffName, loc)
+	if err != nil {
+		return err
+	}
+	c := &nem.Config{Tariff: t, Scheme: nem.Scheme(scheme), NonBypassable: nbc}
+	if err = c.ParseAnniversary(anniversary); err != nil {
+		return err
+	}
+	if exportRates != "" {
+		if c.ExportRates, err = nem.ReadExportRates(exportRates); err != nil {
+			return err
+		}
+	}
+	if err = c.Validate(); err != nil {
+		return fmt.Errorf("%v, see --nem3-export-rates", err)
+	}
+	prometheus.MustRegister(nemBalance)
+	prometheus.MustRegister(nemProjected)
+	prometheus.MustRegister(nemTrueUpTime)
+	nemConfig = c
+	return nil
+}
+
+// updateNEM runs after each history rollup, the balance only changes as fast as the
+// 5 minute rollups do.
+func updateNEM() {
+	if nemConfig == nil || historyStore == nil {
+		return
+	}
+	status, err := nem.Track(*nemConfig, historyStore, time.Now())
+	if err != nil {
+		log.Printf("nem Track: %v", err)
+		return
+	}
+	nemBalance.Set(status.YearToDate.Balance())
+	nemProjected.Set(status.Projected.TrueUp())
+	nemTrueUpTime.Set(float64(status.End.Unix()))
+}
@@ -0,0 +1,106 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/notify"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	notifier     *notify.Router
+	notifyConfig *notify.Config
+
+	consecutiveFetchFailures int
+)
+
+func initNotify(filename, statedir string) error {
+	if filename == "" {
+		return nil
+	}
+	c, err := notify.ReadConfig(filename)
+	if err != nil {
+		return err
+	}
+	r, err := c.Router()
+	if err != nil {
+		return err
+	}
+	r.StateFile = filepath.Join(statedir, notify.StateFilename)
+	notifyConfig, notifier = c, r
+	pollHooks = append(pollHooks, checkLowSoC)
+	go flushNotifications()
+	return nil
+}
+
+// flushNotifications sends the messages held back by the rate limit once it allows.
+func flushNotifications() {
+	for now := range time.Tick(time.Minute) {
+		if err := notifier.Flush(now); err != nil {
+			log.Printf("%v", err)
+		}
+	}
+}
+
+// sendNotification doesn't wait for delivery, an unreachable SMTP server must not hold
+// up polling.
+func sendNotification(m notify.Message) {
+	if notifier == nil {
+		return
+	}
+	go func() {
+		if _, err := notifier.Send(m); err != nil {
+			log.Printf("%v", err)
+		}
+	}()
+}
+
+func checkLowSoC(cur history.Sample) {
+	if notifier == nil || !cur.OffGrid() || cur.PercentageCharged >= notifyConfig.LowSoCPercent {
+		return
+	}
+	backup.mu.Lock()
+	hours := backup.status.BackupRuntimeHours
+	backup.mu.Unlock()
+	body := fmt.Sprintf("The grid is down and the Powerwall is %.0f%% charged.", cur.PercentageCharged)
+	if hours > 0 {
+		body += fmt.Sprintf(" At the expected load it will last about %.1f more hours.", hours)
+	}
+	sendNotification(notify.Message{Event: notify.LowSoC, Key: "low_soc", Time: cur.Time,
+		Title: fmt.Sprintf("Powerwall at %.0f%% during outage", cur.PercentageCharged), Body: body})
+}
+
+// fetchFailure counts a failed poll of live_status, notifying once when the failures in
+// a row reach the threshold.
+func fetchFailure(counter prometheus.Counter, reason string) {
+	counter.Add(1)
+	consecutiveFetchFailures++
+	if notifier != nil && consecutiveFetchFailures == notifyConfig.FetchFailures {
+		sendNotification(notify.Message{Event: notify.FetchFailures, Key: "fetch_failures",
+			Title: fmt.Sprintf("Powerwall polls failing, %d in a row", consecutiveFetchFailures),
+			Body:  "The latest failure: " + reason})
+	}
+}
+
+func fetchSucceeded() {
+	fetchSuccess.Add(1)
+	if notifier != nil && consecutiveFetchFailures >= notifyConfig.FetchFailures {
+		sendNotification(notify.Message{Event: notify.FetchFailures, Key: "fetch_recovered", Resolved: true,
+			Title: "Powerwall polls working again",
+			Body:  fmt.Sprintf("After %d failures in a row.", consecutiveFetchFailures)})
+	}
+	consecutiveFetchFailures = 0
+}
+
+func notifyTokenRefreshFailed(err error) {
+	sendNotification(notify.Message{Event: notify.TokenRefreshFailed, Key: "token_refresh",
+		Title: "Tesla access token refresh failing",
+		Body:  fmt.Sprintf("%v\nThe tokens may need to be replaced by logging in again.", err)})
+}
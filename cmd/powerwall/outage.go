@@ -0,0 +1,98 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/notify"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/outage"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tesla"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	outageCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sherwood_energymon_outage_count",
+		Help: "Number of grid outages recorded.",
+	})
+	outageDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sherwood_energymon_outage_duration_seconds",
+		Help: "Total duration of recorded grid outages in seconds, including one in progress.",
+	})
+)
+
+var outages *outage.Tracker
+
+func initOutages(statedir string) error {
+	t, err := outage.Open(filepath.Join(statedir, "outages.json"))
+	if err != nil {
+		return err
+	}
+	outages = t
+	prometheus.MustRegister(outageCount)
+	prometheus.MustRegister(outageDuration)
+	updateOutageMetrics(time.Now())
+	sampleHooks = append(sampleHooks, observeOutage)
+	return nil
+}
+
+func updateOutageMetrics(now time.Time) {
+	s := outage.Summarize(outages.Events(), now)
+	outageCount.Set(float64(s.Count))
+	outageDuration.Set(s.Duration.Seconds())
+}
+
+func observeOutage(prev, cur history.Sample) {
+	e, err := outages.Observe(prev, cur)
+	if err != nil {
+		log.Printf("outages: %v", err)
+	}
+	if e != nil {
+		if e.Ongoing() {
+			log.Printf("Grid outage started at %s, %.0f%% charged", e.Start.Format(time.RFC3339), e.StartSoC)
+			sendNotification(notify.Message{Event: notify.GridOutage, Time: cur.Time,
+				Key:   "outage " + e.Start.Format(time.RFC3339),
+				Title: "Grid outage",
+				Body:  fmt.Sprintf("The grid went down at %s, the Powerwall is %.0f%% charged.", e.Start.Format("15:04"), e.StartSoC)})
+		} else {
+			log.Printf("Grid outage ended after %s, %.0f%% charged, house drew %.1f kWh",
+				e.Duration(cur.Time).Round(time.Second), e.EndSoC, e.SuppliedWh/1000.0)
+			// Tesla's times are more precise, and if the outage ended while we weren't
+			// polling they are the only ones we have.
+			go mergeBackupHistory(&tesla.Client{HTTP: state.c, SiteURL: state.apiUrl})
+			sendNotification(notify.Message{Event: notify.GridOutage, Time: cur.Time,
+				Key:      "restored " + e.Start.Format(time.RFC3339),
+				Resolved: true,
+				Title:    "Grid restored",
+				Body: fmt.Sprintf("The grid is back after %s. The Powerwall is %.0f%% charged, the house drew %.1f kWh.",
+					e.Duration(cur.Time).Round(time.Minute), e.EndSoC, e.SuppliedWh/1000.0)})
+		}
+	}
+	updateOutageMetrics(cur.Time)
+}
+
+// mergeBackupHistory picks up outages which happened while the daemon wasn't running.
+func mergeBackupHistory(client *tesla.Client) {
+	if outages == nil {
+		return
+	}
+	events, err := client.BackupHistory()
+	if err != nil {
+		log.Printf("backup history: %v", err)
+		return
+	}
+	added, err := outages.MergeBackupHistory(events)
+	if err != nil {
+		log.Printf("outages: %v", err)
+	}
+	if added > 0 {
+		log.Printf("Added %d outages from backup history", added)
+	}
+	updateOutageMetrics(time.Now())
+}
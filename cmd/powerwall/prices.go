@@ -0,0 +1,97 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tariff"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	importPrice = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sherwood_energymon_import_price_dollars_per_kwh",
+		Help: "Current price of energy drawn from the grid in dollars per kWh.",
+	})
+	exportPrice = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sherwood_energymon_export_price_dollars_per_kwh",
+		Help: "Current credit for energy sent to the grid in dollars per kWh.",
+	})
+)
+
+var (
+	priceProvider tariff.PriceProvider
+	dayAhead      *tariff.DayAhead
+)
+
+// initPrices sets up the price gauges from the tariff, overridden by a day-ahead price
+// feed for the hours it covers. Fetched prices are cached in statedir.
+func initPrices(statedir, tariffName string, loc *time.Location, feed string) error {
+	var fallback tariff.PriceProvider
+	if tariffName != "" {
+		t, err := tariff.Load(tariffName, loc)
+		if err != nil {
+			return err
+		}
+		fallback = t
+	}
+	priceProvider = fallback
+	if feed != "" {
+		dayAhead = &tariff.DayAhead{
+			Source:    feed,
+			CacheFile: filepath.Join(statedir, "prices.json"),
+			Fallback:  fallback,
+		}
+		if err := dayAhead.LoadCache(); err != nil {
+			log.Printf("price cache: %v", err)
+		}
+		priceProvider = dayAhead
+	}
+	if priceProvider == nil {
+		return nil
+	}
+	prometheus.MustRegister(importPrice)
+	prometheus.MustRegister(exportPrice)
+	return nil
+}
+
+func updatePrices() {
+	p := priceProvider.PriceAt(time.Now())
+	importPrice.Set(p.Import)
+	exportPrice.Set(p.Export)
+}
+
+// PriceLoop refreshes the day-ahead feed every hour and the gauges every 5 minutes, so
+// that they change promptly at the start of each hour.
+func PriceLoop() {
+	if priceProvider == nil {
+		return
+	}
+	refresh := func() {
+		if dayAhead == nil {
+			return
+		}
+		if err := dayAhead.Refresh(); err != nil {
+			log.Printf("price feed: %v", err)
+		}
+	}
+	refresh()
+	updatePrices()
+	t := time.NewTicker(5 * time.Minute)
+	defer t.Stop()
+	lastRefresh := time.Now()
+	for {
+		select {
+		case now := <-t.C:
+			if now.Sub(lastRefresh) >= time.Hour {
+				refresh()
+				lastRefresh = now
+			}
+			updatePrices()
+		}
+	}
+}
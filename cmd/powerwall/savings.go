@@ -0,0 +1,74 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/battery"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/savings"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tariff"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The same series powerwall-savings --textfile writes.
+var (
+	dailyCost = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sherwood_energymon_daily_cost_dollars",
+		Help: "Grid cost of yesterday, actual and counterfactual",
+	}, []string{"scenario"})
+	dailySavings = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sherwood_energymon_daily_savings_dollars",
+		Help: "Savings over yesterday",
+	}, []string{"source"})
+)
+
+var (
+	savingsTariff  *tariff.Tariff
+	savingsOptions savings.Options
+)
+
+// initSavings enables the daily cost and savings gauges if a tariff was given.
+func initSavings(tariffName string, loc *time.Location, batteries int, reserve float64) error {
+	if tariffName == "" {
+		return nil
+	}
+	t, err := tariff.Load(tariffName, loc)
+	if err != nil {
+		return err
+	}
+	savingsTariff = t
+	savingsOptions = savings.Options{
+		Battery:                   battery.Powerwall2(batteries),
+		SelfPoweredReservePercent: reserve,
+	}
+	prometheus.MustRegister(dailyCost)
+	prometheus.MustRegister(dailySavings)
+	return nil
+}
+
+// updateSavings prices yesterday after each history rollup, in case it was backfilled.
+func updateSavings() {
+	if savingsTariff == nil || historyStore == nil {
+		return
+	}
+	end := historyStore.StartOfDay(time.Now())
+	intervals, err := historyStore.Intervals(history.FiveMinutes, end.AddDate(0, 0, -1), end)
+	if err != nil {
+		log.Printf("savings: %v", err)
+		return
+	}
+	days := savings.Compute(savingsTariff, savingsOptions, intervals, historyStore.Location())
+	if len(days) == 0 {
+		return
+	}
+	d := days[len(days)-1]
+	dailyCost.WithLabelValues("actual").Set(d.Actual.Total)
+	dailyCost.WithLabelValues("no_battery").Set(d.NoBattery.Total)
+	dailyCost.WithLabelValues("self_powered").Set(d.SelfPowered.Total)
+	dailySavings.WithLabelValues("battery").Set(d.BatterySavings())
+	dailySavings.WithLabelValues("strategy").Set(d.StrategySavings())
+}
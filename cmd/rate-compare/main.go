@@ -0,0 +1,110 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// rate-compare replays a year of stored history under several tariffs, re-simulating the
+// battery for each, and ranks them by annual cost.
+//
+//	rate-compare --tariffs=EV2A,E-ELEC,E-TOU-C --strategy=time-based
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/battery"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/savings"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tariff"
+)
+
+func main() {
+	statedir := flag.String("statedir", "/var/lib/powerwall", "Directory in which state files are stored")
+	tariffNames := flag.String("tariffs", strings.Join(tariff.BuiltinNames(), ","),
+		"Comma separated built in tariff names or OpenEI URDB JSON files")
+	strategy := flag.String("strategy", "time-based", "time-based, self-powered, or a JSON reserve schedule file")
+	batteries := flag.Int("batteries", 1, "Number of Powerwall 2 units installed")
+	reserve := flag.Float64("reserve", 20.0, "Backup reserve percent for time-based and self-powered")
+	start := flag.String("start", "", "First day to replay, YYYY-MM-DD. Defaults to a year ago")
+	timezone := flag.String("timezone", "America/Los_Angeles", "Time zone of the energy site")
+	flag.Parse()
+
+	loc, err := time.LoadLocation(*timezone)
+	if err != nil {
+		log.Fatalf("LoadLocation: %v", err)
+	}
+	var tariffs []*tariff.Tariff
+	for _, name := range strings.Split(*tariffNames, ",") {
+		t, err := tariff.Load(strings.TrimSpace(name), loc)
+		if err != nil {
+			log.Fatalf("tariff: %v", err)
+		}
+		tariffs = append(tariffs, t)
+	}
+	// A reserve schedule keeps state as it replays, so make a new one for every plan.
+	strategyFor := func(t *tariff.Tariff) battery.Strategy {
+		switch *strategy {
+		case "time-based":
+			return battery.NewTimeBased(t, *reserve)
+		case "self-powered":
+			return battery.SelfPowered{ReservePercent: *reserve}
+		}
+		s, err := battery.ReadSchedule(*strategy, loc)
+		if err != nil {
+			log.Fatalf("ReadSchedule: %v", err)
+		}
+		return s
+	}
+	strategyFor(tariffs[0]) // check that a schedule file is readable before doing any work
+
+	store, err := history.Open(filepath.Join(*statedir, "history"), loc)
+	if err != nil {
+		log.Fatalf("history Open: %v", err)
+	}
+	startTime := store.StartOfDay(time.Now()).AddDate(-1, 0, 0)
+	if *start != "" {
+		startTime, err = time.ParseInLocation("2006-01-02", *start, loc)
+		if err != nil {
+			log.Fatalf("--start: %v", err)
+		}
+	}
+	endTime := startTime.AddDate(1, 0, 0)
+	intervals, err := store.Intervals(history.FiveMinutes, startTime, endTime)
+	if err != nil {
+		log.Fatalf("Intervals: %v", err)
+	}
+	if len(intervals) == 0 {
+		log.Fatalf("No 5 minute history between %v and %v", startTime, endTime)
+	}
+	days := float64(len(intervals)) * history.FiveMinutes.Hours() / 24.0
+	if days < 360 {
+		log.Printf("Only %.0f days of history, annual costs cover those days only", days)
+	}
+
+	plans := savings.ComparePlans(tariffs, battery.Powerwall2(*batteries), strategyFor, intervals, loc)
+	fmt.Printf("%s to %s, %s strategy, %d Powerwall(s), %.0f%% reserve\n",
+		startTime.Format("2006-01-02"), endTime.Format("2006-01-02"), *strategy, *batteries, *reserve)
+	for rank, p := range plans {
+		extra := ""
+		if rank > 0 {
+			extra = fmt.Sprintf(" (+%.2f)", p.Total.Total-plans[0].Total.Total)
+		}
+		fmt.Printf("%d. %-10s %10.2f%s\n", rank+1, p.Tariff.Name, p.Total.Total, extra)
+	}
+
+	fmt.Printf("\n%-8s", "month")
+	for _, p := range plans {
+		fmt.Printf(" %10s", p.Tariff.Name)
+	}
+	fmt.Println()
+	for idx, m := range plans[0].Months {
+		fmt.Printf("%-8s", m.Start.Format("2006-01"))
+		for _, p := range plans {
+			fmt.Printf(" %10.2f", p.Months[idx].Bill.Total)
+		}
+		fmt.Println()
+	}
+}
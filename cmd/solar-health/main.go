@@ -0,0 +1,129 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// solar-health compares stored solar production against the clear sky model and the
+// archived forecasts, looking for sustained underperformance and mid-day dropouts. It
+// exits with status 1 if it finds any, so that cron can mail the report.
+//
+//	solar-health --latitude=37.4 --longitude=-122.1 --kwp=7.2 --horizon=horizon.json
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/forecast"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/solarhealth"
+)
+
+func main() {
+	statedir := flag.String("statedir", "/var/lib/powerwall", "Directory in which state files are stored")
+	archiveDir := flag.String("archive", "", "Directory of archived forecasts, defaults to forecasts in --statedir")
+	source := flag.String("source", "", "Only use forecasts from this source")
+	days := flag.Int("days", 60, "Number of days of history to analyze")
+	latitude := flag.Float64("latitude", 0, "Site latitude in degrees")
+	longitude := flag.Float64("longitude", 0, "Site longitude in degrees")
+	tilt := flag.Float64("tilt", 20, "Panel tilt in degrees from horizontal")
+	azimuth := flag.Float64("azimuth", 180, "Panel azimuth in degrees clockwise from north")
+	kwp := flag.Float64("kwp", 0, "Nameplate DC rating of the array in kW")
+	horizon := flag.String("horizon", "", "Horizon profile JSON file from horizon-fit")
+	referenceDays := flag.Int("reference-days", 28, "Days of history establishing what the array can do")
+	sustainDays := flag.Int("sustain-days", 7, "Days every one of which must fall short to be underperformance")
+	threshold := flag.Float64("threshold", 0.2, "Fraction short of the reference which counts as underperforming")
+	dropout := flag.Duration("dropout", 10*time.Minute, "Shortest stop in production to report as a dropout")
+	alertsOnly := flag.Bool("alerts-only", false, "Print only the alerts, not the daily table")
+	timezone := flag.String("timezone", "America/Los_Angeles", "Time zone of the energy site")
+	flag.Parse()
+
+	if *kwp <= 0 || (*latitude == 0 && *longitude == 0) {
+		log.Fatalf("--latitude, --longitude and --kwp must be provided.")
+	}
+	loc, err := time.LoadLocation(*timezone)
+	if err != nil {
+		log.Fatalf("LoadLocation: %v", err)
+	}
+	site := &forecast.ClearSky{Latitude: *latitude, Longitude: *longitude, Tilt: *tilt, Azimuth: *azimuth, KWp: *kwp}
+	if *horizon != "" {
+		if site.Horizon, err = forecast.ReadHorizon(*horizon); err != nil {
+			log.Fatalf("ReadHorizon: %v", err)
+		}
+	}
+
+	store, err := history.Open(filepath.Join(*statedir, "history"), loc)
+	if err != nil {
+		log.Fatalf("history Open: %v", err)
+	}
+	now := time.Now().In(loc)
+	end := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	start := end.AddDate(0, 0, -*days)
+	intervals, err := store.Intervals(history.FiveMinutes, start, end)
+	if err != nil {
+		log.Fatalf("Intervals: %v", err)
+	}
+	if len(intervals) == 0 {
+		log.Fatalf("No history between %s and %s", start.Format("2006-01-02"), end.Format("2006-01-02"))
+	}
+
+	if *archiveDir == "" {
+		*archiveDir = filepath.Join(*statedir, "forecasts")
+	}
+	archive := &forecast.Archive{Dir: *archiveDir}
+	// Day-ahead forecasts for the first day were issued before it.
+	forecasts, err := archive.Load(start.AddDate(0, 0, -2), end)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatalf("Load: %v", err)
+	}
+	if *source != "" {
+		var filtered []forecast.IssuedForecast
+		for _, fc := range forecasts {
+			if fc.Source == *source {
+				filtered = append(filtered, fc)
+			}
+		}
+		forecasts = filtered
+	}
+
+	a := &solarhealth.Analyzer{
+		Site:            site,
+		Forecasts:       forecasts,
+		Location:        loc,
+		ReferenceDays:   *referenceDays,
+		SustainDays:     *sustainDays,
+		Threshold:       *threshold,
+		DropoutDuration: *dropout,
+	}
+	result, alerts := a.Analyze(intervals)
+
+	if !*alertsOnly {
+		fmt.Printf("%-10s %9s %9s %6s %9s %7s\n", "day", "measured", "clearsky", "index", "forecast", "ratio")
+		for _, d := range result {
+			ratio := "-"
+			forecastKWh := "-"
+			if r, ok := d.ForecastRatio(); ok {
+				ratio = fmt.Sprintf("%.0f%%", r*100)
+				forecastKWh = fmt.Sprintf("%.1f", d.ForecastKWh)
+			}
+			fmt.Printf("%-10s %9.1f %9.1f %5.0f%% %9s %7s\n", d.Start.Format("2006-01-02"),
+				d.MeasuredKWh, d.ClearSkyKWh, d.Index()*100, forecastKWh, ratio)
+		}
+		fmt.Println()
+	}
+	if len(alerts) == 0 {
+		if !*alertsOnly {
+			fmt.Println("No underperformance or dropouts found.")
+		}
+		return
+	}
+	var lost float64
+	for _, alert := range alerts {
+		fmt.Println(alert)
+		lost += alert.LostKWh
+	}
+	fmt.Printf("About %.1f kWh lost in total.\n", lost)
+	os.Exit(1)
+}
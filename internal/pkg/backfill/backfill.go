@@ -0,0 +1,187 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package backfill fills gaps in the local history from Tesla's calendar_history.
+//
+// The poller runs on fly.io with auto_stop_machines, so any time it is stopped the data
+// would otherwise be lost for good. Tesla keeps a 5 minute power series and daily energy
+// totals for every site, which is enough to rebuild what we missed.
+package backfill
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tesla"
+)
+
+// Gaps returns the start of every 5 minute slot in [start, end) with no stored interval.
+func Gaps(store *history.Store, start, end time.Time) ([]time.Time, error) {
+	intervals, err := store.Intervals(history.FiveMinutes, start, end)
+	if err != nil {
+		return nil, err
+	}
+	have := make(map[int64]bool, len(intervals))
+	for _, interval := range intervals {
+		have[interval.Start.Unix()] = true
+	}
+
+	var gaps []time.Time
+	for t := start.Truncate(history.FiveMinutes); t.Before(end); t = t.Add(history.FiveMinutes) {
+		if !t.Before(start) && !have[t.Unix()] {
+			gaps = append(gaps, t)
+		}
+	}
+	return gaps, nil
+}
+
+// Result summarizes a backfill run.
+type Result struct {
+	Days      int
+	Intervals int
+	Points    []tesla.PowerPoint // every power point fetched, for WriteOpenMetrics
+}
+
+// Run fetches calendar_history for every day between start and end which has gaps, and
+// stores the 5 minute intervals which were missing. Data we polled ourselves is never
+// replaced. Days with no polled data at all take their daily totals from Tesla's energy
+// series, which is more accurate than integrating the power series.
+func Run(client *tesla.Client, store *history.Store, start, end time.Time) (*Result, error) {
+	gaps, err := Gaps(store, start, end)
+	if err != nil {
+		return nil, err
+	}
+	byDay := make(map[time.Time]map[int64]bool)
+	for _, gap := range gaps {
+		day := store.StartOfDay(gap)
+		if byDay[day] == nil {
+			byDay[day] = make(map[int64]bool)
+		}
+		byDay[day][gap.Unix()] = true
+	}
+	days := make([]time.Time, 0, len(byDay))
+	for day := range byDay {
+		days = append(days, day)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+
+	loc := store.Location()
+	result := &Result{}
+	for _, day := range days {
+		next := day.AddDate(0, 0, 1)
+		points, err := client.PowerHistory(day, next.Add(-time.Second), loc)
+		if err != nil {
+			return result, fmt.Errorf("PowerHistory %s: %v", day.Format("2006-01-02"), err)
+		}
+		result.Points = append(result.Points, points...)
+
+		var intervals []history.Interval
+		for _, interval := range Intervals(points) {
+			if byDay[day][interval.Start.Unix()] {
+				intervals = append(intervals, interval)
+			}
+		}
+		if err = store.PutIntervals(history.FiveMinutes, intervals); err != nil {
+			return result, err
+		}
+		result.Days++
+		result.Intervals += len(intervals)
+
+		slots := int(next.Sub(day) / history.FiveMinutes)
+		if len(byDay[day]) < slots {
+			continue
+		}
+		energy, err := client.EnergyHistory(day, next.Add(-time.Second), loc)
+		if err != nil {
+			return result, fmt.Errorf("EnergyHistory %s: %v", day.Format("2006-01-02"), err)
+		}
+		for _, e := range energy {
+			if store.StartOfDay(e.Timestamp).Equal(day) {
+				daily := DailyInterval(e)
+				daily.Start = day
+				daily.Duration = next.Sub(day)
+				if err = store.PutIntervals(history.Daily, []history.Interval{daily}); err != nil {
+					return result, err
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+// Intervals converts a calendar_history power series to 5 minute intervals.
+func Intervals(points []tesla.PowerPoint) []history.Interval {
+	intervals := make([]history.Interval, 0, len(points))
+	for _, p := range points {
+		sample := history.Sample{
+			Time:         p.Timestamp,
+			SolarPower:   p.SolarPower,
+			BatteryPower: p.BatteryPower,
+			GridPower:    p.GridPower,
+			LoadPower:    p.LoadPower(),
+		}
+		end := history.Sample{Time: p.Timestamp.Add(history.FiveMinutes)}
+		for _, interval := range history.Integrate([]history.Sample{sample, end}, history.FiveMinutes) {
+			interval.Source = "calendar_history"
+			intervals = append(intervals, interval)
+		}
+	}
+	return intervals
+}
+
+// DailyInterval converts a calendar_history energy total to an Interval.
+func DailyInterval(e tesla.EnergyPoint) history.Interval {
+	return history.Interval{
+		Start:        e.Timestamp,
+		Duration:     24 * time.Hour,
+		SolarWh:      e.SolarEnergyExported,
+		GridImportWh: e.GridEnergyImported,
+		GridExportWh: e.GridEnergyExportedFromSolar + e.GridEnergyExportedFromBattery,
+		LoadWh: e.ConsumerEnergyImportedFromGrid + e.ConsumerEnergyImportedFromSolar +
+			e.ConsumerEnergyImportedFromBattery,
+		BatteryChargeWh:    e.BatteryEnergyImportedFromGrid + e.BatteryEnergyImportedFromSolar,
+		BatteryDischargeWh: e.BatteryEnergyExported,
+		Source:             "calendar_history",
+	}
+}
+
+// WriteOpenMetrics writes points in the OpenMetrics text format using the same metric
+// names as the poller, suitable for
+// promtool tsdb create-blocks-from openmetrics backfill.txt /path/to/prometheus/data
+func WriteOpenMetrics(w io.Writer, points []tesla.PowerPoint) error {
+	metrics := []struct {
+		name  string
+		help  string
+		value func(tesla.PowerPoint) float64
+	}{
+		{"sherwood_energymon_solar_watts", "Instantaneous solar power production in Watts.",
+			func(p tesla.PowerPoint) float64 { return p.SolarPower }},
+		{"sherwood_energymon_powerwall_watts", "Instantaneous powerwall power production in Watts (can be negative).",
+			func(p tesla.PowerPoint) float64 { return p.BatteryPower }},
+		{"sherwood_energymon_house_load_watts", "Instantaneous power demand from the house in watts.",
+			func(p tesla.PowerPoint) float64 { return p.LoadPower() }},
+		{"sherwood_energymon_grid_watts", "Instantaneous power drawn from the grid in watts (can be negative).",
+			func(p tesla.PowerPoint) float64 { return p.GridPower }},
+	}
+
+	sorted := make([]tesla.PowerPoint, len(points))
+	copy(sorted, points)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Timestamp.Before(sorted[j].Timestamp) })
+
+	for _, m := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", m.name, m.help, m.name); err != nil {
+			return err
+		}
+		for _, p := range sorted {
+			_, err := fmt.Fprintf(w, "%s %g %d\n", m.name, m.value(p), p.Timestamp.Unix())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	_, err := fmt.Fprintf(w, "# EOF\n")
+	return err
+}
@@ -0,0 +1,103 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package backfill
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tesla"
+)
+
+func TestRun(t *testing.T) {
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatalf("LoadLocation: %v", err)
+	}
+	day := time.Date(2024, 3, 7, 0, 0, 0, 0, loc)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/1/energy_sites/42/calendar_history" {
+			http.NotFound(w, r)
+			return
+		}
+		start, err := time.Parse(time.RFC3339, r.URL.Query().Get("start_date"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Query().Get("kind") {
+		case "power":
+			var points []string
+			for ts := start; ts.Before(start.AddDate(0, 0, 1)); ts = ts.Add(5 * time.Minute) {
+				points = append(points, fmt.Sprintf(
+					`{"timestamp":%q,"solar_power":1200,"battery_power":0,"grid_power":1200}`,
+					ts.Format(time.RFC3339)))
+			}
+			fmt.Fprintf(w, `{"response":{"time_series":[%s]}}`, strings.Join(points, ","))
+		case "energy":
+			fmt.Fprintf(w, `{"response":{"time_series":[{"timestamp":%q,`+
+				`"solar_energy_exported":30000,"grid_energy_imported":25000,`+
+				`"consumer_energy_imported_from_grid":25000,"consumer_energy_imported_from_solar":30000}]}}`,
+				start.Format(time.RFC3339))
+		}
+	}))
+	defer server.Close()
+
+	store, err := history.Open(t.TempDir(), loc)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	// We were polling during the first hour of the second day.
+	var polled []history.Interval
+	for ts := day.AddDate(0, 0, 1); ts.Before(day.AddDate(0, 0, 1).Add(time.Hour)); ts = ts.Add(5 * time.Minute) {
+		polled = append(polled, history.Interval{Start: ts, Duration: 5 * time.Minute, LoadWh: 1, Source: "poll"})
+	}
+	if err = store.PutIntervals(history.FiveMinutes, polled); err != nil {
+		t.Fatalf("PutIntervals: %v", err)
+	}
+
+	client := &tesla.Client{HTTP: server.Client(), SiteURL: tesla.SiteURL(server.URL, 42)}
+	result, err := Run(client, store, day, day.AddDate(0, 0, 2))
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if result.Days != 2 || result.Intervals != 2*288-12 {
+		t.Errorf("Run got days=%d intervals=%d want 2, %d", result.Days, result.Intervals, 2*288-12)
+	}
+
+	gaps, err := Gaps(store, day, day.AddDate(0, 0, 2))
+	if err != nil || len(gaps) != 0 {
+		t.Errorf("Gaps after Run got=%d err=%v", len(gaps), err)
+	}
+
+	daily, err := store.Intervals(history.Daily, day, day.AddDate(0, 0, 2))
+	if err != nil || len(daily) != 2 {
+		t.Fatalf("daily got=%d err=%v want=2", len(daily), err)
+	}
+	// The first day was entirely missing and takes Tesla's own totals.
+	if daily[0].LoadWh != 55000 || daily[0].SolarWh != 30000 {
+		t.Errorf("first day got=%+v want Tesla energy totals", daily[0])
+	}
+	// The second day mixes our polls with the power series.
+	if want := 12.0 + 276*200; math.Abs(daily[1].LoadWh-want) > 1e-6 || daily[1].Source != "mixed" {
+		t.Errorf("second day got=%+v want LoadWh=%v", daily[1], want)
+	}
+
+	var b bytes.Buffer
+	if err = WriteOpenMetrics(&b, result.Points[:1]); err != nil {
+		t.Fatalf("WriteOpenMetrics: %v", err)
+	}
+	want := fmt.Sprintf("sherwood_energymon_house_load_watts 2400 %d\n", day.Unix())
+	if !strings.Contains(b.String(), want) || !strings.HasSuffix(b.String(), "# EOF\n") {
+		t.Errorf("WriteOpenMetrics got=%q want %q", b.String(), want)
+	}
+}
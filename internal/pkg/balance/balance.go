@@ -0,0 +1,124 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package balance checks that the power reported at each of the Powerwall's meters adds
+// up, to catch a current transformer installed backwards or a failing meter before a
+// year of data has been recorded wrong.
+package balance
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/forecast"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+)
+
+// Kinds of Violation.
+const (
+	// Solar, grid and battery don't add up to the load, and no single reversed meter
+	// explains it.
+	Imbalance = "imbalance"
+
+	// The balance holds only with one meter's sign flipped, the signature of a current
+	// transformer clamped on backwards.
+	SolarReversed   = "solar_ct_reversed"
+	GridReversed    = "grid_ct_reversed"
+	BatteryReversed = "battery_ct_reversed"
+
+	// An inverter draws a few watts at night, but never produces a negative amount of
+	// power worth mentioning.
+	NegativeSolar = "negative_solar"
+
+	// Production while the sun is below the horizon means the solar CT is measuring
+	// something else, often a load sharing the circuit.
+	SolarAtNight = "solar_at_night"
+)
+
+// Violation is one problem found in a Sample.
+type Violation struct {
+	Kind   string
+	Detail string
+}
+
+// Validator checks samples. The zero value checks the balance with default tolerances
+// and skips the night time check.
+type Validator struct {
+	// The balance may be off by ToleranceW plus TolerancePercent of the load before it
+	// is a Violation. Default to 100 W and 5%.
+	ToleranceW       float64
+	TolerancePercent float64
+
+	// Solar power below -StandbyW, or above StandbyW at night, is a Violation.
+	// Defaults to 50 W.
+	StandbyW float64
+
+	// Site location for the night time check, which is skipped if both are zero.
+	Latitude  float64
+	Longitude float64
+}
+
+func (v *Validator) tolerance(load float64) float64 {
+	w, pct := v.ToleranceW, v.TolerancePercent
+	if w <= 0 {
+		w = 100
+	}
+	if pct <= 0 {
+		pct = 5
+	}
+	return w + math.Abs(load)*pct/100.0
+}
+
+func (v *Validator) standby() float64 {
+	if v.StandbyW <= 0 {
+		return 50
+	}
+	return v.StandbyW
+}
+
+// Error returns how far the sources are from the load, in watts: solar + grid +
+// battery - load.
+func Error(s history.Sample) float64 {
+	return s.SolarPower + s.GridPower + s.BatteryPower - s.LoadPower
+}
+
+// Check returns the problems found in s, if any.
+func (v *Validator) Check(s history.Sample) []Violation {
+	var violations []Violation
+	tolerance := v.tolerance(s.LoadPower)
+	if e := Error(s); math.Abs(e) > tolerance {
+		kind := Imbalance
+		// Flipping a meter's sign changes the balance by twice its reading. Only blame
+		// one which is reading enough to matter.
+		for _, flip := range []struct {
+			kind  string
+			power float64
+		}{
+			{SolarReversed, s.SolarPower},
+			{GridReversed, s.GridPower},
+			{BatteryReversed, s.BatteryPower},
+		} {
+			if math.Abs(flip.power) > tolerance && math.Abs(e-2*flip.power) <= tolerance {
+				kind = flip.kind
+				break
+			}
+		}
+		violations = append(violations, Violation{Kind: kind, Detail: fmt.Sprintf(
+			"solar %.0fW + grid %.0fW + battery %.0fW is off from load %.0fW by %.0fW",
+			s.SolarPower, s.GridPower, s.BatteryPower, s.LoadPower, e)})
+	}
+
+	if s.SolarPower < -v.standby() {
+		violations = append(violations, Violation{Kind: NegativeSolar,
+			Detail: fmt.Sprintf("solar %.0fW", s.SolarPower)})
+	}
+	if v.Latitude != 0 || v.Longitude != 0 {
+		// Civil twilight, diffuse light produces a little before sunrise.
+		if elevation, _ := forecast.SunPosition(s.Time, v.Latitude, v.Longitude); elevation < -6 &&
+			s.SolarPower > v.standby() {
+			violations = append(violations, Violation{Kind: SolarAtNight,
+				Detail: fmt.Sprintf("solar %.0fW with the sun %.0f degrees below the horizon", s.SolarPower, -elevation)})
+		}
+	}
+	return violations
+}
@@ -0,0 +1,51 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package balance
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+)
+
+func TestCheck(t *testing.T) {
+	v := &Validator{Latitude: 37.4, Longitude: -122.1}
+	noon := time.Date(2024, 6, 10, 20, 0, 0, 0, time.UTC)    // 1pm PDT
+	midnight := time.Date(2024, 6, 11, 7, 0, 0, 0, time.UTC) // midnight PDT
+	tests := []struct {
+		name   string
+		sample history.Sample
+		want   []string
+	}{
+		{"balanced", history.Sample{Time: noon, SolarPower: 5000, BatteryPower: -2000, LoadPower: 1030, GridPower: -2000}, nil},
+		{"grid reversed", history.Sample{Time: noon, SolarPower: 3000, LoadPower: 1000, GridPower: 2000}, []string{GridReversed}},
+		{"solar reversed", history.Sample{Time: noon, SolarPower: -3000, LoadPower: 1000, GridPower: -2000},
+			[]string{SolarReversed, NegativeSolar}},
+		{"battery reversed", history.Sample{Time: midnight, BatteryPower: -1500, LoadPower: 1500}, []string{BatteryReversed}},
+		{"meter fault", history.Sample{Time: noon, SolarPower: 3000, LoadPower: 5000, GridPower: 500}, []string{Imbalance}},
+		{"solar at night", history.Sample{Time: midnight, SolarPower: 800, LoadPower: 1000, GridPower: 200}, []string{SolarAtNight}},
+		{"standby draw", history.Sample{Time: midnight, SolarPower: -20, LoadPower: 480, GridPower: 500}, nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, violation := range v.Check(tt.sample) {
+			got = append(got, violation.Kind)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for idx := range got {
+			if got[idx] != tt.want[idx] {
+				t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			}
+		}
+	}
+
+	// Without a location the night time check is skipped.
+	if got := (&Validator{}).Check(history.Sample{Time: midnight, SolarPower: 800, LoadPower: 1000, GridPower: 200}); len(got) != 0 {
+		t.Errorf("Check without a location got %v", got)
+	}
+}
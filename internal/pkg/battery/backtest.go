@@ -0,0 +1,110 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package battery
+
+import (
+	"math"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tariff"
+)
+
+// Result summarizes how a strategy did over a run of intervals.
+type Result struct {
+	Bill tariff.Bill
+
+	// Energy imported during the highest priced period of each day.
+	PeakImportKWh float64
+
+	// State of charge at local midnight, averaged over the days and the lowest.
+	EndOfDaySoC    float64
+	MinEndOfDaySoC float64
+
+	// How long the energy in the battery at the end of each day would have run the
+	// house at its average load, averaged over the days and the shortest.
+	BackupHours    float64
+	MinBackupHours float64
+}
+
+// Backtest simulates strategy s through intervals and measures the result.
+func Backtest(b Battery, intervals []history.Interval, s Strategy, t *tariff.Tariff, initialSoCPercent float64, loc *time.Location) Result {
+	return Measure(Simulate(b, intervals, s, initialSoCPercent), t, loc)
+}
+
+// Measure works out the Result of intervals, which may be simulated or what actually
+// happened.
+func Measure(intervals []history.Interval, t *tariff.Tariff, loc *time.Location) Result {
+	var r Result
+	usage := make([]tariff.Usage, len(intervals))
+	var loadWh float64
+	var duration time.Duration
+	peaks := make(map[time.Time]float64)
+	for idx, i := range intervals {
+		usage[idx] = tariff.Usage{Start: i.Start, Duration: i.Duration,
+			ImportKWh: i.GridImportWh / 1000.0, ExportKWh: i.GridExportWh / 1000.0}
+		if isPeak(t, i.Start.Add(i.Duration/2), loc, peaks) {
+			r.PeakImportKWh += i.GridImportWh / 1000.0
+		}
+		loadWh += i.LoadWh
+		duration += i.Duration
+	}
+	r.Bill = t.Cost(usage)
+	averageLoadW := 0.0
+	if duration > 0 {
+		averageLoadW = loadWh / duration.Hours()
+	}
+
+	days := 0
+	r.MinEndOfDaySoC = math.Inf(1)
+	r.MinBackupHours = math.Inf(1)
+	for _, i := range intervals {
+		end := i.End().In(loc)
+		if end.Hour() != 0 || end.Minute() != 0 {
+			continue
+		}
+		days++
+		r.EndOfDaySoC += i.PercentageCharged
+		r.MinEndOfDaySoC = math.Min(r.MinEndOfDaySoC, i.PercentageCharged)
+		if averageLoadW > 0 {
+			hours := i.EnergyLeft / averageLoadW
+			r.BackupHours += hours
+			r.MinBackupHours = math.Min(r.MinBackupHours, hours)
+		}
+	}
+	if days == 0 {
+		r.MinEndOfDaySoC, r.MinBackupHours = 0, 0
+		return r
+	}
+	r.EndOfDaySoC /= float64(days)
+	r.BackupHours /= float64(days)
+	if averageLoadW == 0 {
+		r.MinBackupHours = 0
+	}
+	return r
+}
+
+// isPeak returns whether tm falls in the highest priced period of its day. Period names
+// differ between tariffs, "peak" for the built in ones but "period 2" from URDB and the
+// hour for day-ahead prices, so peak is defined by price. A day with one flat price has
+// no peak. peaks caches the highest price of each day, or -1 if the price is flat.
+func isPeak(prices tariff.PriceProvider, tm time.Time, loc *time.Location, peaks map[time.Time]float64) bool {
+	local := tm.In(loc)
+	day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	peak, ok := peaks[day]
+	if !ok {
+		highest, lowest := math.Inf(-1), math.Inf(1)
+		for t := day; t.Before(day.AddDate(0, 0, 1)); t = t.Add(15 * time.Minute) {
+			p := prices.PriceAt(t).Import
+			highest = math.Max(highest, p)
+			lowest = math.Min(lowest, p)
+		}
+		peak = highest
+		if highest-lowest < 1e-9 {
+			peak = -1
+		}
+		peaks[day] = peak
+	}
+	return peak >= 0 && prices.PriceAt(tm).Import >= peak-1e-9
+}
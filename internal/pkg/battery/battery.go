@@ -0,0 +1,171 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package battery simulates a Powerwall replaying recorded solar production and house
+// load, to ask what the grid would have seen under a different strategy.
+package battery
+
+import (
+	"math"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tariff"
+)
+
+// Battery describes the installed storage.
+type Battery struct {
+	CapacityWh    float64
+	MaxChargeW    float64
+	MaxDischargeW float64
+
+	// The Powerwall is 92.5% round trip efficient, half of the loss is charged on the
+	// way in and half on the way out.
+	RoundTripEfficiency float64
+}
+
+// Powerwall2 returns n Powerwall 2 units: 13.5 kWh usable and 5 kW continuous each.
+func Powerwall2(n int) Battery {
+	return Battery{
+		CapacityWh:          13500.0 * float64(n),
+		MaxChargeW:          5000.0 * float64(n),
+		MaxDischargeW:       5000.0 * float64(n),
+		RoundTripEfficiency: 0.925,
+	}
+}
+
+// Decision is what the battery may do during one interval.
+type Decision struct {
+	// The battery will not discharge below this state of charge. A reserve above the
+	// current charge does not charge from the grid: we are only allowed to charge the
+	// battery from solar.
+	ReservePercent float64
+
+	// Surplus solar is exported rather than stored.
+	NoSolarCharge bool
+}
+
+// Strategy decides what the battery may do in the interval starting at t.
+type Strategy interface {
+	Decide(t time.Time, socPercent float64) Decision
+}
+
+// SelfPowered is the Powerwall's default mode: store surplus solar, power the house
+// from the battery whenever solar falls short, down to the backup reserve.
+type SelfPowered struct {
+	ReservePercent float64
+}
+
+func (s SelfPowered) Decide(t time.Time, socPercent float64) Decision {
+	return Decision{ReservePercent: s.ReservePercent}
+}
+
+// TimeBased approximates the Powerwall's time-based control mode: store surplus solar,
+// but only discharge while energy costs more than in the cheapest period of the day.
+type TimeBased struct {
+	Tariff         *tariff.Tariff
+	ReservePercent float64
+
+	cheapest map[time.Time]float64
+}
+
+// NewTimeBased returns a TimeBased strategy for tariff t.
+func NewTimeBased(t *tariff.Tariff, reservePercent float64) *TimeBased {
+	return &TimeBased{Tariff: t, ReservePercent: reservePercent, cheapest: make(map[time.Time]float64)}
+}
+
+func (s *TimeBased) Decide(t time.Time, socPercent float64) Decision {
+	if s.Tariff.PriceAt(t).Import > s.cheapestImport(t) {
+		return Decision{ReservePercent: s.ReservePercent}
+	}
+	return Decision{ReservePercent: math.Max(socPercent, s.ReservePercent)}
+}
+
+// cheapestImport is the lowest import price on the day containing t, looking at each
+// quarter hour. It is called for every interval so is cached by day.
+func (s *TimeBased) cheapestImport(t time.Time) float64 {
+	loc := s.Tariff.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	local := t.In(loc)
+	day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	if price, ok := s.cheapest[day]; ok {
+		return price
+	}
+	price := math.Inf(1)
+	for tm := day; tm.Before(day.AddDate(0, 0, 1)); tm = tm.Add(15 * time.Minute) {
+		price = math.Min(price, s.Tariff.PriceAt(tm).Import)
+	}
+	s.cheapest[day] = price
+	return price
+}
+
+// Simulate replays the solar production and house load of intervals through b under
+// strategy s, starting from initialSoCPercent. It returns the intervals with the grid
+// and battery flows replaced by the simulated ones.
+func Simulate(b Battery, intervals []history.Interval, s Strategy, initialSoCPercent float64) []history.Interval {
+	oneWay := math.Sqrt(b.RoundTripEfficiency)
+	if oneWay <= 0 {
+		oneWay = 1.0
+	}
+	energy := b.CapacityWh * initialSoCPercent / 100.0
+
+	simulated := make([]history.Interval, len(intervals))
+	for idx, interval := range intervals {
+		soc := 0.0
+		if b.CapacityWh > 0 {
+			soc = energy / b.CapacityWh * 100.0
+		}
+		d := s.Decide(interval.Start, soc)
+		hours := interval.Duration.Hours()
+
+		out := interval
+		out.GridImportWh, out.GridExportWh = 0, 0
+		out.BatteryChargeWh, out.BatteryDischargeWh = 0, 0
+
+		surplus := interval.SolarWh - interval.LoadWh
+		if surplus > 0 {
+			if !d.NoSolarCharge {
+				charge := math.Min(surplus, b.MaxChargeW*hours)
+				charge = math.Max(0, math.Min(charge, (b.CapacityWh-energy)/oneWay))
+				energy += charge * oneWay
+				out.BatteryChargeWh = charge
+				surplus -= charge
+			}
+			out.GridExportWh = surplus
+		} else {
+			deficit := -surplus
+			reserve := b.CapacityWh * d.ReservePercent / 100.0
+			discharge := math.Min(deficit, b.MaxDischargeW*hours)
+			discharge = math.Max(0, math.Min(discharge, (energy-reserve)*oneWay))
+			energy -= discharge / oneWay
+			out.BatteryDischargeWh = discharge
+			out.GridImportWh = deficit - discharge
+		}
+
+		out.EnergyLeft = energy
+		if b.CapacityWh > 0 {
+			out.PercentageCharged = energy / b.CapacityWh * 100.0
+		}
+		out.Source = "simulated"
+		simulated[idx] = out
+	}
+	return simulated
+}
+
+// NoBattery returns the grid flows the house would have had without any battery.
+func NoBattery(intervals []history.Interval) []history.Interval {
+	return Simulate(Battery{}, intervals, SelfPowered{}, 0)
+}
+
+// ScaleSolar returns intervals with solar production multiplied by factor, to ask what
+// a larger array would have done. Only SolarWh changes, Simulate recomputes the flows.
+func ScaleSolar(intervals []history.Interval, factor float64) []history.Interval {
+	scaled := make([]history.Interval, len(intervals))
+	for idx, i := range intervals {
+		i.SolarWh *= factor
+		scaled[idx] = i
+	}
+	return scaled
+}
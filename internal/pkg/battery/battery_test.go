@@ -0,0 +1,211 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package battery
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/forecast"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/loadforecast"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tariff"
+)
+
+func TestSimulate(t *testing.T) {
+	start := time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)
+	intervals := []history.Interval{
+		// 6 kWh of surplus solar, limited to 5 kW of charging.
+		{Start: start, Duration: time.Hour, SolarWh: 7000, LoadWh: 1000},
+		// 4 kWh of load with no solar.
+		{Start: start.Add(time.Hour), Duration: time.Hour, LoadWh: 4000},
+	}
+	b := Powerwall2(1)
+	sim := Simulate(b, intervals, SelfPowered{ReservePercent: 20}, 20)
+
+	if sim[0].BatteryChargeWh != 5000 || sim[0].GridExportWh != 1000 {
+		t.Errorf("charge=%v export=%v, want 5000 and 1000", sim[0].BatteryChargeWh, sim[0].GridExportWh)
+	}
+	stored := 2700 + 5000*math.Sqrt(0.925)
+	if math.Abs(sim[0].EnergyLeft-stored) > 0.01 {
+		t.Errorf("EnergyLeft=%v, want %v", sim[0].EnergyLeft, stored)
+	}
+	if sim[1].BatteryDischargeWh != 4000 || sim[1].GridImportWh != 0 {
+		t.Errorf("discharge=%v import=%v, want 4000 and 0", sim[1].BatteryDischargeWh, sim[1].GridImportWh)
+	}
+	// Round trip losses: 5 kWh in, 4 kWh out, leaves less than the 1 kWh difference.
+	if left := sim[1].EnergyLeft - 2700; left <= 0 || left >= 1000 {
+		t.Errorf("energy above reserve=%v, want between 0 and 1000", left)
+	}
+
+	none := NoBattery(intervals)
+	if none[0].GridExportWh != 6000 || none[1].GridImportWh != 4000 {
+		t.Errorf("NoBattery export=%v import=%v, want 6000 and 4000", none[0].GridExportWh, none[1].GridImportWh)
+	}
+
+	more := NoBattery(ScaleSolar(intervals, 1.5))
+	if more[0].SolarWh != 10500 || more[0].GridExportWh != 9500 || intervals[0].SolarWh != 7000 {
+		t.Errorf("ScaleSolar solar=%v export=%v original=%v", more[0].SolarWh, more[0].GridExportWh, intervals[0].SolarWh)
+	}
+}
+
+func TestTimeBased(t *testing.T) {
+	ev2a := tariff.EV2A()
+	s := NewTimeBased(ev2a, 20)
+	offPeak := time.Date(2024, 1, 10, 10, 0, 0, 0, ev2a.Location)
+	if d := s.Decide(offPeak, 80); d.ReservePercent != 80 {
+		t.Errorf("off peak reserve=%v, want to hold at 80", d.ReservePercent)
+	}
+	if d := s.Decide(offPeak.Add(7*time.Hour), 80); d.ReservePercent != 20 {
+		t.Errorf("peak reserve=%v, want 20", d.ReservePercent)
+	}
+	if d := s.Decide(offPeak, 10); d.ReservePercent != 20 {
+		t.Errorf("off peak below reserve got %v, want 20", d.ReservePercent)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	loc := time.UTC
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "rules.json")
+	rules := `{"name": "winter", "initial_percent": 20, "rules": [
+		{"months": [12, 1], "hour": 6, "percent": 100},
+		{"months": [12, 1], "hour": 15, "hold": true},
+		{"months": [12, 1], "hour": 16, "percent": 50}
+	]}`
+	if err := os.WriteFile(filename, []byte(rules), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	s, err := ReadSchedule(filename, loc)
+	if err != nil {
+		t.Fatalf("ReadSchedule: %v", err)
+	}
+
+	day := time.Date(2024, 1, 10, 0, 0, 0, 0, loc)
+	tests := []struct {
+		hour    float64
+		soc     float64
+		reserve float64
+	}{
+		{0, 60, 20},
+		{5.5, 60, 20},
+		{6, 60, 100},
+		{14.75, 85, 100},
+		{15, 85, 85}, // hold at the charge when the rule fires
+		{15.5, 90, 85},
+		{16, 90, 50},
+		{30, 40, 100}, // 6am the next day, the intervening rules are skipped over
+	}
+	for _, tt := range tests {
+		tm := day.Add(time.Duration(tt.hour * float64(time.Hour)))
+		if d := s.Decide(tm, tt.soc); d.ReservePercent != tt.reserve {
+			t.Errorf("Decide(%v, %v) reserve=%v, want %v", tm, tt.soc, d.ReservePercent, tt.reserve)
+		}
+	}
+
+	if err := os.WriteFile(filename, []byte(`{"rules": [{"hour": 24, "percent": 50}]}`), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := ReadSchedule(filename, loc); err == nil {
+		t.Errorf("ReadSchedule accepted hour 24")
+	}
+}
+
+func TestBacktest(t *testing.T) {
+	ev2a := tariff.EV2A()
+	loc := ev2a.Location
+	day := time.Date(2024, 1, 10, 0, 0, 0, 0, loc)
+
+	// 1kW load all day, 3kW of solar from 9am to 1pm.
+	var intervals []history.Interval
+	for h := 0; h < 24; h++ {
+		i := history.Interval{Start: day.Add(time.Duration(h) * time.Hour), Duration: time.Hour, LoadWh: 1000}
+		if h >= 9 && h < 13 {
+			i.SolarWh = 3000
+		}
+		intervals = append(intervals, i)
+	}
+
+	b := Powerwall2(1)
+	none := Measure(NoBattery(intervals), ev2a, loc)
+	if none.PeakImportKWh != 5 || none.EndOfDaySoC != 0 || none.BackupHours != 0 {
+		t.Errorf("no battery got %+v", none)
+	}
+	selfPowered := Backtest(b, intervals, SelfPowered{ReservePercent: 20}, ev2a, 20, loc)
+	if selfPowered.EndOfDaySoC != 20 {
+		t.Errorf("self-powered EndOfDaySoC=%v, want 20", selfPowered.EndOfDaySoC)
+	}
+	// 20% of 13.5 kWh at an average load of 1 kW.
+	if math.Abs(selfPowered.BackupHours-2.7) > 1e-6 {
+		t.Errorf("self-powered BackupHours=%v, want 2.7", selfPowered.BackupHours)
+	}
+	// Holding the charge from 1pm until 4pm covers all of peak, self-powered runs out
+	// part way through.
+	hold := &Schedule{InitialPercent: 20, Location: loc, Rules: []Rule{
+		{Hour: 13, Hold: true},
+		{Hour: 16, Percent: 20},
+	}}
+	held := Backtest(b, intervals, hold, ev2a, 20, loc)
+	if held.PeakImportKWh != 0 || selfPowered.PeakImportKWh == 0 {
+		t.Errorf("peak import hold=%v self-powered=%v", held.PeakImportKWh, selfPowered.PeakImportKWh)
+	}
+	if held.Bill.Total >= selfPowered.Bill.Total {
+		t.Errorf("hold cost %.2f, self-powered %.2f", held.Bill.Total, selfPowered.Bill.Total)
+	}
+
+	// Peak is the highest price of the day, whatever the period is called.
+	renamed := tariff.EV2A()
+	for s := range renamed.Seasons {
+		for p := range renamed.Seasons[s].Periods {
+			renamed.Seasons[s].Periods[p].Name = fmt.Sprintf("period %d", p)
+		}
+	}
+	if r := Measure(NoBattery(intervals), renamed, loc); r.PeakImportKWh != 5 {
+		t.Errorf("URDB style period names got PeakImportKWh=%v, want 5", r.PeakImportKWh)
+	}
+}
+
+func TestBackupRuntime(t *testing.T) {
+	now := time.Date(2024, 1, 10, 18, 0, 0, 0, time.UTC)
+	var load []loadforecast.Hour
+	for h := 0; h < 24; h++ {
+		load = append(load, loadforecast.Hour{Start: now.Add(time.Duration(h) * time.Hour), KWh: 1.0})
+	}
+
+	runtime, runsOut := BackupRuntime(5000, 13500, now, 0, load, nil)
+	if !runsOut || runtime != 5*time.Hour {
+		t.Errorf("BackupRuntime got %v %v, want 5h", runtime, runsOut)
+	}
+	// 2kW for the first hour, then 1kW.
+	runtime, _ = BackupRuntime(5000, 13500, now, 2000, load, nil)
+	if runtime != 4*time.Hour {
+		t.Errorf("BackupRuntime with live load got %v, want 4h", runtime)
+	}
+	runtime, runsOut = BackupRuntime(30000, 40000, now, 0, load, nil)
+	if runsOut || runtime != 24*time.Hour {
+		t.Errorf("BackupRuntime beyond the forecast got %v %v", runtime, runsOut)
+	}
+
+	// 3kW of solar from 9am to 1pm the next morning puts back 8kWh, enough to last
+	// past the end of the forecast.
+	var solar []forecast.SolarPrediction
+	for h := 1; h <= 24; h++ {
+		end := now.Add(time.Duration(h) * time.Hour)
+		kw := 0.0
+		if end.Hour() > 9 && end.Hour() <= 13 {
+			kw = 3.0
+		}
+		solar = append(solar, forecast.SolarPrediction{End: end, KWatts: kw})
+	}
+	if runtime, runsOut = BackupRuntime(16000, 20000, now, 0, load, nil); !runsOut || runtime != 16*time.Hour {
+		t.Errorf("BackupRuntime without solar got %v %v, want 16h", runtime, runsOut)
+	}
+	if runtime, runsOut = BackupRuntime(16000, 20000, now, 0, load, solar); runsOut || runtime != 24*time.Hour {
+		t.Errorf("BackupRuntime with solar got %v %v, want 24h", runtime, runsOut)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package battery
+
+import (
+	"math"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/forecast"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/loadforecast"
+)
+
+// runtimeStep is the resolution of BackupRuntime.
+const runtimeStep = 5 * time.Minute
+
+// BackupRuntime estimates how long energyWh in the battery would run the house from now
+// if the grid were down, drawing the load forecast and, if solar is not nil, recharging
+// from forecast solar up to capacityWh. Until the end of the current hour the house is
+// assumed to draw nowW if that is positive, the live load is a better guide than the
+// model in the middle of an outage.
+//
+// The second result is false if the battery outlasts the load forecast, in which case
+// the runtime is the length of the forecast.
+func BackupRuntime(energyWh, capacityWh float64, now time.Time, nowW float64,
+	load []loadforecast.Hour, solar []forecast.SolarPrediction) (time.Duration, bool) {
+	if len(load) == 0 {
+		return 0, false
+	}
+	end := load[len(load)-1].Start.Add(time.Hour)
+	firstHourEnd := now.Truncate(time.Hour).Add(time.Hour)
+	hourIdx := 0
+	for t := now; t.Before(end); t = t.Add(runtimeStep) {
+		for hourIdx < len(load)-1 && !t.Before(load[hourIdx+1].Start) {
+			hourIdx++
+		}
+		loadW := load[hourIdx].KWh * 1000.0
+		if nowW > 0 && t.Before(firstHourEnd) {
+			loadW = nowW
+		}
+		solarW := 0.0
+		if solar != nil {
+			solarW = forecast.EnergyBetween(solar, t, t.Add(runtimeStep)) * 1000.0 / runtimeStep.Hours()
+		}
+		netWh := (loadW - solarW) * runtimeStep.Hours()
+		if netWh >= energyWh && netWh > 0 {
+			runtime := t.Sub(now) + time.Duration(float64(runtimeStep)*energyWh/netWh)
+			return runtime.Round(time.Second), true
+		}
+		energyWh = math.Min(energyWh-netWh, capacityWh)
+	}
+	return end.Sub(now), false
+}
@@ -0,0 +1,115 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package battery
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// Rule changes the backup reserve at Hour:Minute every day in Months, like one line of
+// the crontab in cmd/obsolete-local-api/example_crontab.txt.
+type Rule struct {
+	Months []time.Month `json:"months,omitempty"` // all months if empty
+	Hour   int          `json:"hour"`
+	Minute int          `json:"minute,omitempty"`
+
+	// Set the reserve to Percent, or with Hold to whatever the charge is at the time.
+	Percent float64 `json:"percent,omitempty"`
+	Hold    bool    `json:"hold,omitempty"`
+}
+
+func (r Rule) appliesIn(m time.Month) bool {
+	if len(r.Months) == 0 {
+		return true
+	}
+	for _, month := range r.Months {
+		if month == m {
+			return true
+		}
+	}
+	return false
+}
+
+// Schedule is a Strategy made of Rules. The reserve set by a Rule stays in effect until
+// the next one fires. A Schedule keeps track of the reserve between calls to Decide, so
+// it can only replay one series of intervals, in order.
+type Schedule struct {
+	Name           string  `json:"name"`
+	InitialPercent float64 `json:"initial_percent"`
+	Rules          []Rule  `json:"rules"`
+
+	Location *time.Location `json:"-"`
+
+	reserve float64
+	last    time.Time
+}
+
+// ReadSchedule reads a Schedule from a JSON file.
+func ReadSchedule(filename string, loc *time.Location) (*Schedule, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	s := &Schedule{}
+	if err = json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	for _, r := range s.Rules {
+		if r.Hour < 0 || r.Hour > 23 || r.Minute < 0 || r.Minute > 59 {
+			return nil, fmt.Errorf("%s: bad rule time %02d:%02d", filename, r.Hour, r.Minute)
+		}
+		if !r.Hold && (r.Percent < 0 || r.Percent > 100) {
+			return nil, fmt.Errorf("%s: bad rule percent %v", filename, r.Percent)
+		}
+	}
+	if s.Name == "" {
+		s.Name = filename
+	}
+	s.Location = loc
+	return s, nil
+}
+
+func (s *Schedule) Decide(t time.Time, socPercent float64) Decision {
+	if s.last.IsZero() {
+		s.reserve = s.InitialPercent
+		s.last = t.Add(-time.Nanosecond)
+	}
+	loc := s.Location
+	if loc == nil {
+		loc = time.Local
+	}
+
+	// Every rule which fired in (last, t], oldest first.
+	type firing struct {
+		at   time.Time
+		rule Rule
+	}
+	var fired []firing
+	from := s.last.In(loc)
+	for day := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, loc); !day.After(t); day = day.AddDate(0, 0, 1) {
+		for _, r := range s.Rules {
+			if !r.appliesIn(day.Month()) {
+				continue
+			}
+			at := time.Date(day.Year(), day.Month(), day.Day(), r.Hour, r.Minute, 0, 0, loc)
+			if at.After(s.last) && !at.After(t) {
+				fired = append(fired, firing{at, r})
+			}
+		}
+	}
+	sort.SliceStable(fired, func(i, j int) bool { return fired[i].at.Before(fired[j].at) })
+	for _, f := range fired {
+		if f.rule.Hold {
+			s.reserve = socPercent
+		} else {
+			s.reserve = f.rule.Percent
+		}
+	}
+	s.last = t
+	return Decision{ReservePercent: s.reserve}
+}
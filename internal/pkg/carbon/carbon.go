@@ -0,0 +1,200 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package carbon provides the carbon intensity of grid electricity, and works out the
+// emissions due to grid import and those avoided by solar and the battery.
+package carbon
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+)
+
+// Intensity is the grid's carbon intensity in gCO2/kWh from Time until the next
+// Intensity, typically 5 minutes later. Marginal intensity, the emissions of whichever
+// generator responds to a change in demand, is what matters for deciding when to use
+// energy. Average intensity is the mix of everything generating.
+type Intensity struct {
+	Time        time.Time
+	GramsPerKWh float64
+}
+
+// Provider fetches carbon intensity for a range of times, which may extend into the
+// future as a forecast.
+type Provider interface {
+	Intensities(start, end time.Time) ([]Intensity, error)
+}
+
+// MaxAge is how long an Intensity is assumed to hold if no later one follows it.
+const MaxAge = time.Hour
+
+// Series is a sorted run of Intensity.
+type Series []Intensity
+
+// NewSeries sorts intensities into a Series, dropping duplicate times.
+func NewSeries(intensities []Intensity) Series {
+	s := make(Series, 0, len(intensities))
+	s = append(s, intensities...)
+	sort.SliceStable(s, func(i, j int) bool { return s[i].Time.Before(s[j].Time) })
+	out := s[:0]
+	for _, i := range s {
+		if len(out) > 0 && out[len(out)-1].Time.Equal(i.Time) {
+			out[len(out)-1] = i
+			continue
+		}
+		out = append(out, i)
+	}
+	return out
+}
+
+// At returns the intensity in effect at t, and false if the series doesn't cover t.
+func (s Series) At(t time.Time) (float64, bool) {
+	idx := sort.Search(len(s), func(i int) bool { return s[i].Time.After(t) })
+	if idx == 0 {
+		return 0, false
+	}
+	i := s[idx-1]
+	if t.Sub(i.Time) >= MaxAge {
+		return 0, false
+	}
+	return i.GramsPerKWh, true
+}
+
+// Merge returns a Series with the intensities from newer replacing any at the same
+// times, dropping those before oldest.
+func (s Series) Merge(newer []Intensity, oldest time.Time) Series {
+	var kept []Intensity
+	for _, i := range append(append([]Intensity{}, s...), newer...) {
+		if !i.Time.Before(oldest) {
+			kept = append(kept, i)
+		}
+	}
+	return NewSeries(kept)
+}
+
+// File is a Provider reading a local CSV file. See ReadCSV.
+type File struct {
+	Filename string
+}
+
+func (f *File) Intensities(start, end time.Time) ([]Intensity, error) {
+	file, err := os.Open(f.Filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	all, err := ReadCSV(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", f.Filename, err)
+	}
+	var in []Intensity
+	for _, i := range all {
+		if !i.Time.Before(start.Add(-MaxAge)) && i.Time.Before(end) {
+			in = append(in, i)
+		}
+	}
+	return in, nil
+}
+
+// ReadCSV reads intensities from CSV with a header row. The "time" column holds RFC3339
+// timestamps or Unix seconds, "g_per_kwh" the intensity in gCO2/kWh. A "lbs_per_mwh"
+// column, as WattTime reports, may be used instead.
+func ReadCSV(r io.Reader) (Series, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	timeCol, valueCol, scale := -1, -1, 1.0
+	for idx, name := range header {
+		switch strings.TrimSpace(strings.ToLower(name)) {
+		case "time":
+			timeCol = idx
+		case "g_per_kwh":
+			valueCol, scale = idx, 1.0
+		case "lbs_per_mwh":
+			valueCol, scale = idx, gramsPerKWhPerLbsPerMWh
+		}
+	}
+	if timeCol < 0 || valueCol < 0 {
+		return nil, fmt.Errorf("CSV needs time and g_per_kwh columns, got %v", header)
+	}
+
+	var intensities []Intensity
+	for line := 2; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		t, err := parseTime(record[timeCol])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(record[valueCol]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		intensities = append(intensities, Intensity{Time: t, GramsPerKWh: v * scale})
+	}
+	return NewSeries(intensities), nil
+}
+
+func parseTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	secs, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("time %q is neither RFC3339 nor Unix seconds", s)
+	}
+	return time.Unix(secs, 0), nil
+}
+
+// Emissions are in grams of CO2.
+type Emissions struct {
+	// Emitted by the grid to supply what we imported.
+	Grid float64
+
+	// Grid generation displaced by our solar production, whether used in the house,
+	// stored or exported.
+	SolarAvoided float64
+
+	// The battery moves energy in time. This is the intensity of the grid when it
+	// discharged less the intensity when it charged, and can be negative.
+	BatteryAvoided float64
+
+	// Energy during which the intensity was unknown, and which isn't counted above.
+	UnknownWh float64
+}
+
+// Add accumulates the emissions of one interval at gPerKWh.
+func (e *Emissions) Add(i history.Interval, gPerKWh float64) {
+	e.Grid += i.GridImportWh / 1000.0 * gPerKWh
+	e.SolarAvoided += i.SolarWh / 1000.0 * gPerKWh
+	e.BatteryAvoided += (i.BatteryDischargeWh - i.BatteryChargeWh) / 1000.0 * gPerKWh
+}
+
+// Compute returns the emissions of intervals, each at the intensity at its midpoint.
+func Compute(intervals []history.Interval, s Series) Emissions {
+	var e Emissions
+	for _, i := range intervals {
+		g, ok := s.At(i.Start.Add(i.Duration / 2))
+		if !ok {
+			e.UnknownWh += i.GridImportWh + i.SolarWh + i.BatteryDischargeWh + i.BatteryChargeWh
+			continue
+		}
+		e.Add(i, g)
+	}
+	return e
+}
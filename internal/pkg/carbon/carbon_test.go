@@ -0,0 +1,111 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package carbon
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+)
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+func TestReadCSVAndCompute(t *testing.T) {
+	start := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	csv := fmt.Sprintf("time,g_per_kwh\n%d,200\n%s,400\n", start.Add(5*time.Minute).Unix(), start.Format(time.RFC3339))
+	s, err := ReadCSV(strings.NewReader(csv))
+	if err != nil {
+		t.Fatalf("ReadCSV: %v", err)
+	}
+	if g, ok := s.At(start.Add(time.Minute)); !ok || g != 400 {
+		t.Errorf("At(12:01) got %v %v, want 400", g, ok)
+	}
+	if g, ok := s.At(start.Add(6 * time.Minute)); !ok || g != 200 {
+		t.Errorf("At(12:06) got %v %v, want 200", g, ok)
+	}
+	if _, ok := s.At(start.Add(2 * time.Hour)); ok {
+		t.Errorf("At beyond MaxAge is known")
+	}
+	if _, ok := s.At(start.Add(-time.Minute)); ok {
+		t.Errorf("At before the series is known")
+	}
+
+	lbs, err := ReadCSV(strings.NewReader(fmt.Sprintf("time,lbs_per_mwh\n%d,1000\n", start.Unix())))
+	if err != nil || !near(lbs[0].GramsPerKWh, 453.59237) {
+		t.Errorf("ReadCSV lbs_per_mwh got %v %v", lbs, err)
+	}
+	if _, err = ReadCSV(strings.NewReader("time,value\n1,2\n")); err == nil {
+		t.Errorf("ReadCSV accepted CSV without an intensity column")
+	}
+
+	intervals := []history.Interval{
+		{Start: start, Duration: 5 * time.Minute, GridImportWh: 1000, SolarWh: 500, BatteryChargeWh: 500},
+		{Start: start.Add(5 * time.Minute), Duration: 5 * time.Minute, BatteryDischargeWh: 500},
+		{Start: start.Add(3 * time.Hour), Duration: 5 * time.Minute, GridImportWh: 1000},
+	}
+	e := Compute(intervals, s)
+	if !near(e.Grid, 400) || !near(e.SolarAvoided, 200) || !near(e.UnknownWh, 1000) {
+		t.Errorf("Compute got %+v", e)
+	}
+	// Charged at 400 g/kWh, discharged at 200 g/kWh: the battery made things worse.
+	if !near(e.BatteryAvoided, -100) {
+		t.Errorf("BatteryAvoided got %v, want -100", e.BatteryAvoided)
+	}
+
+	merged := s.Merge([]Intensity{{Time: start, GramsPerKWh: 300}}, start)
+	if g, _ := merged.At(start); len(merged) != 2 || g != 300 {
+		t.Errorf("Merge got %+v", merged)
+	}
+}
+
+func TestWattTime(t *testing.T) {
+	now := time.Now().Truncate(5 * time.Minute)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != "user" || p != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"token": "abc"}`)
+	})
+	data := func(w http.ResponseWriter, r *http.Request, t time.Time, value float64) {
+		if r.Header.Get("Authorization") != "Bearer abc" || r.URL.Query().Get("region") != "CAISO_NORTH" ||
+			r.URL.Query().Get("signal_type") != "co2_moer" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"data": [{"point_time": %q, "value": %v}], "meta": {"units": "lbs_co2_per_mwh"}}`,
+			t.UTC().Format(time.RFC3339), value)
+	}
+	mux.HandleFunc("/v3/historical", func(w http.ResponseWriter, r *http.Request) {
+		data(w, r, now.Add(-time.Hour), 1000)
+	})
+	mux.HandleFunc("/v3/forecast", func(w http.ResponseWriter, r *http.Request) {
+		data(w, r, now.Add(time.Hour), 500)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	w := &WattTime{Username: "user", Password: "secret", Region: "CAISO_NORTH", BaseURL: server.URL, HTTP: server.Client()}
+	intensities, err := w.Intensities(now.Add(-2*time.Hour), now.Add(2*time.Hour))
+	if err != nil {
+		t.Fatalf("Intensities: %v", err)
+	}
+	if len(intensities) != 2 || !near(intensities[0].GramsPerKWh, 453.59237) || !near(intensities[1].GramsPerKWh, 226.796185) {
+		t.Errorf("Intensities got %+v", intensities)
+	}
+
+	w = &WattTime{Username: "user", Password: "wrong", Region: "CAISO_NORTH", BaseURL: server.URL, HTTP: server.Client()}
+	if _, err = w.Intensities(now.Add(-time.Hour), now); err == nil {
+		t.Errorf("Intensities with a bad password succeeded")
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package carbon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const DefaultWattTimeURL = "https://api.watttime.org"
+
+// WattTime reports in pounds per megawatt-hour.
+const gramsPerKWhPerLbsPerMWh = 453.59237 / 1000.0
+
+// WattTime is a Provider using the WattTime v3 API, which gives the marginal operating
+// emissions rate (co2_moer) for a balancing authority region such as CAISO_NORTH.
+// https://docs.watttime.org/
+type WattTime struct {
+	Username string
+	Password string
+	Region   string
+
+	// Defaults to co2_moer.
+	SignalType string
+
+	// Default to DefaultWattTimeURL and http.DefaultClient.
+	BaseURL string
+	HTTP    *http.Client
+
+	token   string
+	expires time.Time
+}
+
+type wattTimeData struct {
+	Data []struct {
+		PointTime time.Time `json:"point_time"`
+		Value     float64   `json:"value"`
+	} `json:"data"`
+	Meta struct {
+		Units string `json:"units"`
+	} `json:"meta"`
+}
+
+func (w *WattTime) client() *http.Client {
+	if w.HTTP == nil {
+		return http.DefaultClient
+	}
+	return w.HTTP
+}
+
+func (w *WattTime) baseURL() string {
+	if w.BaseURL == "" {
+		return DefaultWattTimeURL
+	}
+	return w.BaseURL
+}
+
+// login fetches a token, which WattTime issues for 30 minutes.
+func (w *WattTime) login() error {
+	if w.token != "" && time.Now().Before(w.expires) {
+		return nil
+	}
+	req, err := http.NewRequest(http.MethodGet, w.baseURL()+"/login", nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(w.Username, w.Password)
+	res, err := w.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("WattTime login: status=%d", res.StatusCode)
+	}
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return err
+	}
+	w.token = body.Token
+	w.expires = time.Now().Add(25 * time.Minute)
+	return nil
+}
+
+func (w *WattTime) get(path string, query url.Values) ([]Intensity, error) {
+	if err := w.login(); err != nil {
+		return nil, err
+	}
+	u := w.baseURL() + path + "?" + query.Encode()
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+w.token)
+	req.Header.Set("User-Agent", "https://github.com/DentonGentry/powerwall")
+	res, err := w.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return nil, fmt.Errorf("GET %s: status=%d %s", u, res.StatusCode, body)
+	}
+
+	var data wattTimeData
+	if err = json.NewDecoder(res.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	scale := 1.0
+	switch data.Meta.Units {
+	case "lbs_co2_per_mwh", "":
+		scale = gramsPerKWhPerLbsPerMWh
+	case "g_co2_per_kwh":
+	default:
+		return nil, fmt.Errorf("WattTime units %q not supported", data.Meta.Units)
+	}
+	intensities := make([]Intensity, len(data.Data))
+	for idx, d := range data.Data {
+		intensities[idx] = Intensity{Time: d.PointTime, GramsPerKWh: d.Value * scale}
+	}
+	return intensities, nil
+}
+
+// Intensities fetches history for the part of [start, end) in the past and the
+// forecast for the part in the future.
+func (w *WattTime) Intensities(start, end time.Time) ([]Intensity, error) {
+	signal := w.SignalType
+	if signal == "" {
+		signal = "co2_moer"
+	}
+	now := time.Now()
+	var all []Intensity
+	if start.Before(now) {
+		query := url.Values{}
+		query.Set("region", w.Region)
+		query.Set("signal_type", signal)
+		query.Set("start", start.UTC().Format(time.RFC3339))
+		histEnd := end
+		if histEnd.After(now) {
+			histEnd = now
+		}
+		query.Set("end", histEnd.UTC().Format(time.RFC3339))
+		past, err := w.get("/v3/historical", query)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, past...)
+	}
+	if end.After(now) {
+		query := url.Values{}
+		query.Set("region", w.Region)
+		query.Set("signal_type", signal)
+		query.Set("horizon_hours", fmt.Sprintf("%d", int(end.Sub(now).Hours()+1)))
+		future, err := w.get("/v3/forecast", query)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range future {
+			if i.Time.Before(end) {
+				all = append(all, i)
+			}
+		}
+	}
+	return NewSeries(all), nil
+}
@@ -0,0 +1,379 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package dispatch plans the Powerwall's backup reserve hour by hour over the next day
+// or two, choosing when to hold the battery and when to let it power the house so as to
+// minimize the cost of grid energy.
+package dispatch
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/battery"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/carbon"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/forecast"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/loadforecast"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tariff"
+)
+
+// Hour is the expected solar production and house load for one hour.
+type Hour struct {
+	Start    time.Time
+	SolarKWh float64
+	LoadKWh  float64
+}
+
+// Inputs lines up a solar forecast and a load forecast into hours starting at the hour
+// containing start. Hours beyond the end of the load forecast are dropped.
+func Inputs(start time.Time, solar []forecast.SolarPrediction, load []loadforecast.Hour) []Hour {
+	start = start.Truncate(time.Hour)
+	var hours []Hour
+	for _, l := range load {
+		if l.Start.Before(start) {
+			continue
+		}
+		hours = append(hours, Hour{
+			Start:    l.Start,
+			SolarKWh: forecast.EnergyBetween(solar, l.Start, l.Start.Add(time.Hour)),
+			LoadKWh:  l.KWh,
+		})
+	}
+	return hours
+}
+
+// Action is what the battery does for an hour.
+type Action int
+
+const (
+	// Discharge powers the house from the battery, down to the minimum reserve.
+	Discharge Action = iota
+
+	// Hold sets the reserve to the current charge, so the battery stores surplus solar
+	// but does not discharge. The house runs from the grid.
+	Hold
+)
+
+func (a Action) String() string {
+	if a == Hold {
+		return "hold"
+	}
+	return "discharge"
+}
+
+// Step is one hour of a Plan.
+type Step struct {
+	Start  time.Time
+	Action Action
+
+	// What to send to the Powerwall for this hour. The plan only covers the reserve, so
+	// Mode is empty and the operation mode is left as it is.
+	ReservePercent int
+	Mode           string
+
+	// Expected state of charge at the start and end of the hour.
+	SoCStart float64
+	SoCEnd   float64
+
+	SolarKWh  float64
+	LoadKWh   float64
+	ImportKWh float64
+	ExportKWh float64
+	Price     tariff.Price
+	Cost      float64
+
+	// Grid carbon intensity in gCO2/kWh and the net emissions of the hour in grams,
+	// zero if the Optimizer has no carbon intensity.
+	GramsPerKWh float64
+	Emissions   float64
+}
+
+// Plan is the optimized schedule.
+type Plan struct {
+	Created time.Time
+	Steps   []Step
+
+	// Cost of the grid energy in the plan, not counting the value of what is left in the
+	// battery at the end.
+	Cost float64
+
+	// Net grams of CO2 due to grid import less export.
+	Emissions float64
+
+	MinReservePercent float64
+	TerminalValue     float64
+}
+
+// StepAt returns the step in effect at t, or nil if the plan doesn't cover t.
+func (p *Plan) StepAt(t time.Time) *Step {
+	for idx := range p.Steps {
+		s := &p.Steps[idx]
+		if !t.Before(s.Start) && t.Before(s.Start.Add(time.Hour)) {
+			return s
+		}
+	}
+	return nil
+}
+
+// holdReserve is the reserve which holds the battery at socPercent. It rounds down: a
+// reserve above the current charge could ask the Powerwall to charge from the grid.
+func holdReserve(minReservePercent, socPercent float64) int {
+	return int(math.Ceil(math.Max(minReservePercent, math.Floor(socPercent))))
+}
+
+// Reserve returns the reserve to set for s when the battery is at socPercent. A Hold
+// step's reserve is the charge the plan expected, and the battery may have drifted below
+// that without straying far enough to re-plan.
+func (p *Plan) Reserve(s *Step, socPercent float64) int {
+	if s.Action != Hold {
+		return s.ReservePercent
+	}
+	if held := holdReserve(p.MinReservePercent, socPercent); held < s.ReservePercent {
+		return held
+	}
+	return s.ReservePercent
+}
+
+// Explain describes the plan for a person, one line for each run of hours with the same
+// action.
+func (p *Plan) Explain() string {
+	var b strings.Builder
+	if len(p.Steps) == 0 {
+		return "Empty plan\n"
+	}
+	fmt.Fprintf(&b, "Plan for %d hours from %s, starting at %.0f%% charged, minimum reserve %.0f%%.\n",
+		len(p.Steps), p.Steps[0].Start.Format("Mon 15:04"), p.Steps[0].SoCStart, p.MinReservePercent)
+	fmt.Fprintf(&b, "Expected grid cost $%.2f, energy left at the end valued at $%.2f/kWh.\n",
+		p.Cost, p.TerminalValue)
+	if p.Emissions != 0 {
+		fmt.Fprintf(&b, "Expected net grid emissions %.1f kg CO2.\n", p.Emissions/1000.0)
+	}
+
+	for start := 0; start < len(p.Steps); {
+		end := start + 1
+		for end < len(p.Steps) && p.Steps[end].Action == p.Steps[start].Action {
+			end++
+		}
+		run := p.Steps[start:end]
+		first, last := run[0], run[len(run)-1]
+		var imported, solar, load float64
+		maxPrice, minPrice := 0.0, math.Inf(1)
+		for _, s := range run {
+			imported += s.ImportKWh
+			solar += s.SolarKWh
+			load += s.LoadKWh
+			maxPrice = math.Max(maxPrice, s.Price.Import)
+			minPrice = math.Min(minPrice, s.Price.Import)
+		}
+		fmt.Fprintf(&b, "%s - %s %-9s %3.0f%% -> %3.0f%%  ", first.Start.Format("Mon 15:04"),
+			last.Start.Add(time.Hour).Format("15:04"), first.Action, first.SoCStart, last.SoCEnd)
+		switch first.Action {
+		case Hold:
+			later := 0.0
+			for _, s := range p.Steps[end:] {
+				if s.Action == Discharge {
+					later = math.Max(later, s.Price.Import)
+				}
+			}
+			fmt.Fprintf(&b, "grid at %s, saving the battery for $%.2f/kWh later",
+				priceRange(minPrice, maxPrice), later)
+		case Discharge:
+			fmt.Fprintf(&b, "battery instead of grid at %s", priceRange(minPrice, maxPrice))
+			if imported > 0.05 {
+				fmt.Fprintf(&b, ", still importing %.1f kWh", imported)
+			}
+		}
+		if solar > load {
+			fmt.Fprintf(&b, ", %.1f kWh of surplus solar", solar-load)
+		}
+		b.WriteString("\n")
+		start = end
+	}
+	return b.String()
+}
+
+func priceRange(min, max float64) string {
+	if max-min < 0.005 {
+		return fmt.Sprintf("$%.2f/kWh", min)
+	}
+	return fmt.Sprintf("$%.2f-%.2f/kWh", min, max)
+}
+
+// Optimizer finds the cheapest Plan by dynamic programming over the battery's state of
+// charge, which is divided into steps of StepPercent.
+type Optimizer struct {
+	Battery battery.Battery
+	Prices  tariff.PriceProvider
+
+	// The battery never discharges below this, it is what we keep for an outage.
+	MinReservePercent float64
+
+	// Resolution of the state of charge, defaults to 1%.
+	StepPercent float64
+
+	// What a kWh left in the battery at the end of the plan is worth. Without it the plan
+	// would empty the battery at the end of every horizon. Defaults to the average
+	// import price over the plan.
+	TerminalValue float64
+
+	// Optional grid carbon intensity. Each gram of net emissions is charged at
+	// CarbonPrice in $/kg CO2 when choosing the plan, but Step.Cost and Plan.Cost
+	// remain what is actually paid. Hours Carbon doesn't cover are given the mean
+	// intensity of the hours it does, and without any there is no carbon term at all.
+	Carbon      carbon.Series
+	CarbonPrice float64
+}
+
+// carbonIntensities returns the intensity for each hour. A forecast shorter than the plan
+// would otherwise make the uncovered hours look free of carbon and push imports into
+// them.
+func (o *Optimizer) carbonIntensities(hours []Hour) []float64 {
+	intensities := make([]float64, len(hours))
+	covered := make([]bool, len(hours))
+	sum, n := 0.0, 0
+	for idx, h := range hours {
+		if g, ok := o.Carbon.At(h.Start.Add(30 * time.Minute)); ok {
+			intensities[idx], covered[idx] = g, true
+			sum += g
+			n++
+		}
+	}
+	if n == 0 {
+		return intensities
+	}
+	for idx := range intensities {
+		if !covered[idx] {
+			intensities[idx] = sum / float64(n)
+		}
+	}
+	return intensities
+}
+
+// fixed is a Strategy which always makes the same Decision.
+type fixed battery.Decision
+
+func (f fixed) Decide(t time.Time, socPercent float64) battery.Decision {
+	return battery.Decision(f)
+}
+
+// outcome of taking an action for one hour.
+type outcome struct {
+	soc    float64
+	cost   float64
+	grams  float64
+	result history.Interval
+}
+
+// weighted is what the optimizer minimizes, the cost plus the price of the emissions.
+func (o *Optimizer) weighted(out outcome) float64 {
+	return out.cost + out.grams/1000.0*o.CarbonPrice
+}
+
+func (o *Optimizer) step(h Hour, price tariff.Price, gPerKWh, socPercent float64, a Action) outcome {
+	reserve := o.MinReservePercent
+	if a == Hold {
+		reserve = math.Max(reserve, socPercent)
+	}
+	interval := history.Interval{
+		Start:    h.Start,
+		Duration: time.Hour,
+		SolarWh:  h.SolarKWh * 1000.0,
+		LoadWh:   h.LoadKWh * 1000.0,
+	}
+	sim := battery.Simulate(o.Battery, []history.Interval{interval},
+		fixed(battery.Decision{ReservePercent: reserve}), socPercent)[0]
+	cost := sim.GridImportWh/1000.0*price.Import - sim.GridExportWh/1000.0*price.Export
+	grams := (sim.GridImportWh - sim.GridExportWh) / 1000.0 * gPerKWh
+	return outcome{soc: sim.PercentageCharged, cost: cost, grams: grams, result: sim}
+}
+
+// Optimize returns the cheapest plan for hours, starting from socPercent.
+func (o *Optimizer) Optimize(hours []Hour, socPercent float64) *Plan {
+	stepPercent := o.StepPercent
+	if stepPercent <= 0 {
+		stepPercent = 1.0
+	}
+	states := int(math.Round(100.0/stepPercent)) + 1
+	prices := make([]tariff.Price, len(hours))
+	intensities := o.carbonIntensities(hours)
+	terminal := o.TerminalValue
+	for idx, h := range hours {
+		prices[idx] = o.Prices.PriceAt(h.Start.Add(30 * time.Minute))
+		if o.TerminalValue == 0 {
+			terminal += prices[idx].Import / float64(len(hours))
+		}
+	}
+	// Energy left at the end displaces grid energy later, and its emissions.
+	var terminalCarbon float64
+	for _, g := range intensities {
+		terminalCarbon += g / 1000.0 * o.CarbonPrice / float64(len(hours))
+	}
+
+	// value[h][i] is the least cost from the start of hour h onwards with the battery
+	// at state i. Storage beyond the end of the plan is worth the terminal value.
+	value := make([][]float64, len(hours)+1)
+	value[len(hours)] = make([]float64, states)
+	for i := range value[len(hours)] {
+		kwh := o.Battery.CapacityWh * float64(i) * stepPercent / 100.0 / 1000.0
+		value[len(hours)][i] = -kwh * (terminal + terminalCarbon)
+	}
+	interpolate := func(v []float64, soc float64) float64 {
+		x := math.Max(0, math.Min(soc/stepPercent, float64(states-1)))
+		lo := int(math.Floor(x))
+		if lo >= states-1 {
+			return v[states-1]
+		}
+		frac := x - float64(lo)
+		return v[lo]*(1-frac) + v[lo+1]*frac
+	}
+	best := func(h int, soc float64) (Action, outcome, float64) {
+		bestAction, bestTotal := Discharge, math.Inf(1)
+		var bestOutcome outcome
+		for _, a := range []Action{Discharge, Hold} {
+			out := o.step(hours[h], prices[h], intensities[h], soc, a)
+			// Prefer Discharge, the Powerwall's default, unless holding is cheaper.
+			if total := o.weighted(out) + interpolate(value[h+1], out.soc); total < bestTotal-1e-9 {
+				bestAction, bestOutcome, bestTotal = a, out, total
+			}
+		}
+		return bestAction, bestOutcome, bestTotal
+	}
+	for h := len(hours) - 1; h >= 0; h-- {
+		value[h] = make([]float64, states)
+		for i := range value[h] {
+			_, _, value[h][i] = best(h, float64(i)*stepPercent)
+		}
+	}
+
+	plan := &Plan{Created: time.Now(), MinReservePercent: o.MinReservePercent, TerminalValue: terminal}
+	soc := socPercent
+	for h := range hours {
+		a, out, _ := best(h, soc)
+		reserve := int(math.Ceil(o.MinReservePercent))
+		if a == Hold {
+			reserve = holdReserve(o.MinReservePercent, soc)
+		}
+		plan.Steps = append(plan.Steps, Step{
+			Start:          hours[h].Start,
+			Action:         a,
+			ReservePercent: reserve,
+			SoCStart:       soc,
+			SoCEnd:         out.soc,
+			SolarKWh:       hours[h].SolarKWh,
+			LoadKWh:        hours[h].LoadKWh,
+			ImportKWh:      out.result.GridImportWh / 1000.0,
+			ExportKWh:      out.result.GridExportWh / 1000.0,
+			Price:          prices[h],
+			Cost:           out.cost,
+			GramsPerKWh:    intensities[h],
+			Emissions:      out.grams,
+		})
+		plan.Cost += out.cost
+		plan.Emissions += out.grams
+		soc = out.soc
+	}
+	return plan
+}
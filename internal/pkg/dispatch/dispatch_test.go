@@ -0,0 +1,219 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dispatch
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/battery"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/carbon"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/forecast"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/loadforecast"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tariff"
+)
+
+// winterDays is 1kW of load all day, with 3kW of solar from 9am to 1pm.
+func winterDays(start time.Time, days int) []Hour {
+	var hours []Hour
+	for h := 0; h < 24*days; h++ {
+		hour := Hour{Start: start.Add(time.Duration(h) * time.Hour), LoadKWh: 1}
+		if h%24 >= 9 && h%24 < 13 {
+			hour.SolarKWh = 3
+		}
+		hours = append(hours, hour)
+	}
+	return hours
+}
+
+func TestOptimize(t *testing.T) {
+	ev2a := tariff.EV2A()
+	start := time.Date(2024, 1, 10, 0, 0, 0, 0, ev2a.Location)
+	hours := winterDays(start, 2)
+	o := &Optimizer{Battery: battery.Powerwall2(1), Prices: ev2a, MinReservePercent: 20}
+	plan := o.Optimize(hours, 50)
+
+	if len(plan.Steps) != 48 {
+		t.Fatalf("len(Steps)=%d, want 48", len(plan.Steps))
+	}
+	for _, s := range plan.Steps {
+		if s.SoCEnd < 20-1e-6 || s.ReservePercent < 20 {
+			t.Errorf("%v went below the minimum reserve: %+v", s.Start, s)
+		}
+		if s.Mode != "" {
+			t.Errorf("%v changes the operation mode to %q", s.Start, s.Mode)
+		}
+	}
+	for h := 16; h < 21; h++ {
+		if s := plan.Steps[h]; s.Action != Discharge || s.ImportKWh > 1e-6 {
+			t.Errorf("peak hour %d got %v importing %.2f kWh", h, s.Action, s.ImportKWh)
+		}
+	}
+	var held *Step
+	for idx := range plan.Steps {
+		if s := &plan.Steps[idx]; held == nil && s.Action == Hold && s.ReservePercent > 25 {
+			held = s
+		}
+	}
+	if held == nil {
+		t.Fatalf("plan never holds the battery above 25%%:\n%s", plan.Explain())
+	}
+	// A held reserve never goes above the actual charge, or below the minimum.
+	for _, tc := range []struct {
+		soc  float64
+		want int
+	}{{float64(held.ReservePercent) + 10, held.ReservePercent}, {23.7, 23}, {10, 20}} {
+		if got := plan.Reserve(held, tc.soc); got != tc.want {
+			t.Errorf("Reserve(hold at %d%%, %.1f%%) got %d want %d", held.ReservePercent, tc.soc, got, tc.want)
+		}
+	}
+	if s := plan.Steps[17]; plan.Reserve(&s, 10) != s.ReservePercent {
+		t.Errorf("Reserve changed a discharge step")
+	}
+
+	// The plan must beat self-powered mode, counting what is left in the battery.
+	var intervals []history.Interval
+	for _, h := range hours {
+		intervals = append(intervals, history.Interval{Start: h.Start, Duration: time.Hour,
+			SolarWh: h.SolarKWh * 1000, LoadWh: h.LoadKWh * 1000})
+	}
+	sim := battery.Simulate(o.Battery, intervals, battery.SelfPowered{ReservePercent: 20}, 50)
+	selfPowered := 0.0
+	for _, i := range sim {
+		p := ev2a.PriceAt(i.Start.Add(30 * time.Minute))
+		selfPowered += i.GridImportWh/1000*p.Import - i.GridExportWh/1000*p.Export
+	}
+	selfPowered -= sim[len(sim)-1].EnergyLeft / 1000 * plan.TerminalValue
+	planned := plan.Cost - plan.Steps[47].SoCEnd/100*o.Battery.CapacityWh/1000*plan.TerminalValue
+	if planned > selfPowered+1e-6 {
+		t.Errorf("plan %.2f costs more than self-powered %.2f:\n%s", planned, selfPowered, plan.Explain())
+	}
+
+	explanation := plan.Explain()
+	if !strings.Contains(explanation, "hold") || !strings.Contains(explanation, "discharge") {
+		t.Errorf("Explain missing actions:\n%s", explanation)
+	}
+	if s := plan.StepAt(start.Add(16*time.Hour + 30*time.Minute)); s == nil || s.Start.Hour() != 16 {
+		t.Errorf("StepAt(16:30) got %+v", s)
+	}
+	if s := plan.StepAt(start.Add(48 * time.Hour)); s != nil {
+		t.Errorf("StepAt beyond the plan got %+v", s)
+	}
+}
+
+func TestOptimizeCarbon(t *testing.T) {
+	flat := &tariff.Tariff{Name: "flat", Location: time.UTC, Seasons: []tariff.Season{{
+		Name:    "all",
+		Months:  []time.Month{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+		Periods: []tariff.Period{{Name: "flat", Days: tariff.AllDays, End: 1440, ImportPrice: 0.30, ExportPrice: 0.30}},
+	}}}
+	start := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	hours := winterDays(start, 1)
+	// The grid is clean until 6pm, then gas peakers run.
+	var intensities []carbon.Intensity
+	for h := 0; h < 24; h++ {
+		g := 200.0
+		if h >= 18 {
+			g = 800
+		}
+		intensities = append(intensities, carbon.Intensity{Time: start.Add(time.Duration(h) * time.Hour), GramsPerKWh: g})
+	}
+
+	o := &Optimizer{Battery: battery.Powerwall2(1), Prices: flat, MinReservePercent: 20,
+		Carbon: carbon.NewSeries(intensities)}
+	costOnly := o.Optimize(hours, 50)
+	o.CarbonPrice = 0.2
+	aware := o.Optimize(hours, 50)
+
+	for h := 18; h < 24; h++ {
+		if s := aware.Steps[h]; s.Action != Discharge || s.ImportKWh > 1e-6 {
+			t.Errorf("dirty hour %d got %v importing %.2f kWh:\n%s", h, s.Action, s.ImportKWh, aware.Explain())
+		}
+	}
+	if aware.Emissions >= costOnly.Emissions {
+		t.Errorf("carbon aware plan emits %.0fg, cost only plan %.0fg", aware.Emissions, costOnly.Emissions)
+	}
+	if s := aware.Steps[20]; s.GramsPerKWh != 800 {
+		t.Errorf("Steps[20].GramsPerKWh got %v, want 800", s.GramsPerKWh)
+	}
+
+	// A second day beyond the end of the carbon forecast is priced at its mean, not as
+	// free of carbon.
+	o.Carbon = carbon.NewSeries(intensities[:12])
+	plan := o.Optimize(winterDays(start, 2), 50)
+	if s := plan.Steps[40]; s.GramsPerKWh != 200 {
+		t.Errorf("uncovered Steps[40].GramsPerKWh got %v, want the mean 200", s.GramsPerKWh)
+	}
+	o.Carbon = nil
+	if plan = o.Optimize(hours, 50); plan.Emissions != 0 {
+		t.Errorf("plan without carbon data has %.0fg of emissions", plan.Emissions)
+	}
+}
+
+type fakeSolar struct {
+	kw      float64
+	fetches int
+}
+
+func (f *fakeSolar) Forecast() ([]forecast.SolarPrediction, error) {
+	f.fetches++
+	start := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	var prediction []forecast.SolarPrediction
+	for h := 1; h <= 48; h++ {
+		kw := 0.0
+		if h%24 > 9 && h%24 <= 13 {
+			kw = f.kw
+		}
+		prediction = append(prediction, forecast.SolarPrediction{End: start.Add(time.Duration(h) * time.Hour), KWatts: kw})
+	}
+	return prediction, nil
+}
+
+func TestPlanner(t *testing.T) {
+	ev2a := tariff.EV2A()
+	solar := &fakeSolar{kw: 3}
+	soc := 50.0
+	p := &Planner{
+		Optimizer: &Optimizer{Battery: battery.Powerwall2(1), Prices: ev2a, MinReservePercent: 20},
+		Solar:     solar,
+		Load: func(start time.Time, hours int) ([]loadforecast.Hour, error) {
+			var load []loadforecast.Hour
+			for h := 0; h < hours; h++ {
+				load = append(load, loadforecast.Hour{Start: start.Truncate(time.Hour).Add(time.Duration(h) * time.Hour), KWh: 1})
+			}
+			return load, nil
+		},
+		SoC:          func() (float64, error) { return soc, nil },
+		Hours:        24,
+		SolarRefresh: 2 * time.Minute,
+	}
+	now := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	plan, replanned, err := p.Update(now)
+	if err != nil || !replanned || plan == nil {
+		t.Fatalf("first Update got replanned=%v err=%v", replanned, err)
+	}
+	if _, replanned, _ = p.Update(now.Add(time.Minute)); replanned {
+		t.Errorf("Update re-planned with nothing changed")
+	}
+	solar.kw = 1
+	if _, replanned, _ = p.Update(now.Add(2 * time.Minute)); !replanned {
+		t.Errorf("Update did not re-plan when the solar forecast dropped")
+	}
+	if solar.fetches != 2 {
+		t.Errorf("solar forecast fetched %d times, want 2", solar.fetches)
+	}
+	soc = 90
+	if _, replanned, _ = p.Update(now.Add(3 * time.Minute)); !replanned {
+		t.Errorf("Update did not re-plan when the battery strayed from the plan")
+	}
+	if _, replanned, _ = p.Update(now.Add(7 * time.Hour)); !replanned {
+		t.Errorf("Update did not re-plan an old plan")
+	}
+	if math.IsNaN(p.Plan().Cost) {
+		t.Errorf("plan cost is NaN")
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dispatch
+
+import (
+	"math"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/forecast"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/loadforecast"
+)
+
+// Planner keeps a Plan up to date, re-planning when the forecasts or the battery stray
+// from what the current plan assumed.
+type Planner struct {
+	Optimizer *Optimizer
+	Solar     forecast.Forecaster
+	Load      func(start time.Time, hours int) ([]loadforecast.Hour, error)
+	SoC       func() (float64, error)
+
+	// How far ahead to plan, defaults to 48 hours.
+	Hours int
+
+	// Re-plan if the solar plus load forecast for the remaining hours has moved by more
+	// than this many kWh. Defaults to 1.
+	ForecastThreshold float64
+
+	// Re-plan if the state of charge is this many percent away from the plan.
+	// Defaults to 5.
+	SoCThreshold float64
+
+	// Re-plan at least this often, defaults to 6 hours.
+	MaxAge time.Duration
+
+	// How long a solar forecast is used before fetching a new one, defaults to 2 hours.
+	// Solcast allows hobbyist sites 10 requests a day.
+	SolarRefresh time.Duration
+
+	plan         *Plan
+	solar        []forecast.SolarPrediction
+	solarFetched time.Time
+	soc          float64
+	socFetched   time.Time
+}
+
+// Plan returns the current plan, which may be nil.
+func (p *Planner) Plan() *Plan {
+	return p.plan
+}
+
+// LastSoC returns the state of charge fetched by the latest Update, and when.
+func (p *Planner) LastSoC() (float64, time.Time) {
+	return p.soc, p.socFetched
+}
+
+// Update fetches the current state of charge and fresh forecasts and re-plans if
+// anything has changed enough to matter. It returns the plan in effect and whether it
+// is a new one.
+func (p *Planner) Update(now time.Time) (*Plan, bool, error) {
+	hours := p.Hours
+	if hours <= 0 {
+		hours = 48
+	}
+	soc, err := p.SoC()
+	if err != nil {
+		return p.plan, false, err
+	}
+	p.soc, p.socFetched = soc, now
+	solar, err := p.solarForecast(now)
+	if err != nil {
+		return p.plan, false, err
+	}
+	load, err := p.Load(now, hours)
+	if err != nil {
+		return p.plan, false, err
+	}
+	inputs := Inputs(now, solar, load)
+
+	if !p.needsReplan(now, inputs, soc) {
+		return p.plan, false, nil
+	}
+	plan := p.Optimizer.Optimize(inputs, soc)
+	plan.Created = now
+	p.plan = plan
+	return plan, true, nil
+}
+
+// solarForecast returns the cached solar forecast, fetching a new one every
+// SolarRefresh.
+func (p *Planner) solarForecast(now time.Time) ([]forecast.SolarPrediction, error) {
+	refresh := p.SolarRefresh
+	if refresh <= 0 {
+		refresh = 2 * time.Hour
+	}
+	if p.solar != nil && now.Sub(p.solarFetched) < refresh {
+		return p.solar, nil
+	}
+	solar, err := p.Solar.Forecast()
+	if err != nil {
+		return nil, err
+	}
+	p.solar = solar
+	p.solarFetched = now
+	return solar, nil
+}
+
+func (p *Planner) needsReplan(now time.Time, inputs []Hour, soc float64) bool {
+	if p.plan == nil {
+		return true
+	}
+	maxAge := p.MaxAge
+	if maxAge <= 0 {
+		maxAge = 6 * time.Hour
+	}
+	if now.Sub(p.plan.Created) >= maxAge {
+		return true
+	}
+	current := p.plan.StepAt(now)
+	if current == nil {
+		return true
+	}
+
+	socThreshold := p.SoCThreshold
+	if socThreshold <= 0 {
+		socThreshold = 5.0
+	}
+	// Where the plan expected the battery to be by now.
+	frac := now.Sub(current.Start).Hours()
+	expected := current.SoCStart + (current.SoCEnd-current.SoCStart)*frac
+	if math.Abs(soc-expected) > socThreshold {
+		return true
+	}
+
+	threshold := p.ForecastThreshold
+	if threshold <= 0 {
+		threshold = 1.0
+	}
+	moved := 0.0
+	for _, h := range inputs {
+		if s := p.plan.StepAt(h.Start); s != nil {
+			moved += math.Abs(h.SolarKWh-s.SolarKWh) + math.Abs(h.LoadKWh-s.LoadKWh)
+		}
+	}
+	return moved > threshold
+}
@@ -0,0 +1,39 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fileutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "state.json")
+	for _, content := range []string{"first", "second"} {
+		if err := WriteFileAtomic(filename, []byte(content), 0600); err != nil {
+			t.Fatalf("WriteFileAtomic: %v", err)
+		}
+		b, err := os.ReadFile(filename)
+		if err != nil || string(b) != content {
+			t.Errorf("got %q, %v, want %q", b, err, content)
+		}
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("mode got %v, want 0600", fi.Mode())
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+
+	if err := WriteFileAtomic(filepath.Join(dir, "missing", "state.json"), nil, 0644); err == nil {
+		t.Errorf("WriteFileAtomic into a missing directory succeeded")
+	}
+}
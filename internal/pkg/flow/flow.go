@@ -0,0 +1,84 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package flow works out where energy goes between solar, the battery, the house and the
+// grid, which the Powerwall only reports as the net power at each of them.
+package flow
+
+import (
+	"math"
+)
+
+// Flows are the power in watts along each path. All are zero or positive.
+type Flows struct {
+	SolarHome    float64
+	SolarBattery float64
+	SolarGrid    float64
+	BatteryHome  float64
+	BatteryGrid  float64
+	GridHome     float64
+	GridBattery  float64
+}
+
+// Path names a flow, for labelling metrics.
+type Path struct {
+	From, To string
+}
+
+// Paths lists every flow in the order of the Flows fields.
+var Paths = []Path{
+	{"solar", "home"},
+	{"solar", "battery"},
+	{"solar", "grid"},
+	{"battery", "home"},
+	{"battery", "grid"},
+	{"grid", "home"},
+	{"grid", "battery"},
+}
+
+// Values returns the flows in the order of Paths.
+func (f Flows) Values() []float64 {
+	return []float64{f.SolarHome, f.SolarBattery, f.SolarGrid, f.BatteryHome, f.BatteryGrid,
+		f.GridHome, f.GridBattery}
+}
+
+// Decompose splits the net power at each meter into flows, using Tesla's signs: battery
+// is positive when discharging, grid is positive when importing. Solar serves the house
+// first, then charges the battery, then exports. The battery serves the house before
+// exporting, and grid import serves the house before charging the battery. Whatever
+// doesn't balance because of meter error is left out rather than guessed at.
+func Decompose(solar, battery, load, grid float64) Flows {
+	solar = math.Max(solar, 0)
+	load = math.Max(load, 0)
+	discharge, charge := math.Max(battery, 0), math.Max(-battery, 0)
+	imported, exported := math.Max(grid, 0), math.Max(-grid, 0)
+
+	var f Flows
+	f.SolarHome = math.Min(solar, load)
+	f.SolarBattery = math.Min(solar-f.SolarHome, charge)
+	f.SolarGrid = math.Min(solar-f.SolarHome-f.SolarBattery, exported)
+	f.BatteryHome = math.Min(discharge, load-f.SolarHome)
+	f.BatteryGrid = math.Max(math.Min(discharge-f.BatteryHome, exported-f.SolarGrid), 0)
+	f.GridHome = math.Max(math.Min(imported, load-f.SolarHome-f.BatteryHome), 0)
+	f.GridBattery = math.Max(math.Min(imported-f.GridHome, charge-f.SolarBattery), 0)
+	return f
+}
+
+// SelfConsumption is the fraction of solarWh used on site, directly or through the
+// battery, rather than exported. It is 0 with no production. Battery energy exported
+// counts against it, as the meters can't tell it from solar.
+func SelfConsumption(solarWh, exportWh float64) float64 {
+	if solarWh <= 0 {
+		return 0
+	}
+	return math.Max(solarWh-exportWh, 0) / solarWh
+}
+
+// SelfSufficiency is the fraction of loadWh not drawn from the grid. It is 0 with no
+// load. Grid energy charging the battery counts against it.
+func SelfSufficiency(loadWh, importWh float64) float64 {
+	if loadWh <= 0 {
+		return 0
+	}
+	return math.Max(loadWh-importWh, 0) / loadWh
+}
@@ -0,0 +1,53 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package flow
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDecompose(t *testing.T) {
+	tests := []struct {
+		name                       string
+		solar, battery, load, grid float64
+		want                       Flows
+	}{
+		{"solar charging and exporting", 5000, -2000, 1000, -2000,
+			Flows{SolarHome: 1000, SolarBattery: 2000, SolarGrid: 2000}},
+		{"battery and grid at night", 0, 3000, 4000, 1000,
+			Flows{BatteryHome: 3000, GridHome: 1000}},
+		{"battery exporting", 0, 5000, 1000, -4000,
+			Flows{BatteryHome: 1000, BatteryGrid: 4000}},
+		{"grid charging", 1000, -3000, 500, 2500,
+			Flows{SolarHome: 500, SolarBattery: 500, GridBattery: 2500}},
+		{"meter noise", -10, 0, 800, 790,
+			Flows{GridHome: 790}},
+	}
+	for _, tt := range tests {
+		if got := Decompose(tt.solar, tt.battery, tt.load, tt.grid); got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRatios(t *testing.T) {
+	// 8 kWh of solar, 4 kWh of it exported. 6 kWh of load, 2 kWh of it imported.
+	if got := SelfConsumption(8000, 4000); math.Abs(got-0.5) > 1e-9 {
+		t.Errorf("SelfConsumption got %v, want 0.5", got)
+	}
+	if got := SelfSufficiency(6000, 2000); math.Abs(got-2.0/3.0) > 1e-9 {
+		t.Errorf("SelfSufficiency got %v, want 0.667", got)
+	}
+	// Battery export on a cloudy day can exceed production.
+	if got := SelfConsumption(1000, 3000); got != 0 {
+		t.Errorf("SelfConsumption with battery export got %v, want 0", got)
+	}
+	if SelfConsumption(0, 0) != 0 || SelfSufficiency(0, 0) != 0 {
+		t.Errorf("ratios with no energy not zero")
+	}
+	if len(Paths) != len(Flows{}.Values()) {
+		t.Errorf("Paths and Values disagree")
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package forecast
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+// Comparison pairs one forecast interval with the production measured during it.
+type Comparison struct {
+	Source     string
+	Issued     time.Time
+	End        time.Time
+	Period     time.Duration
+	ForecastKW float64
+	MeasuredKW float64
+}
+
+// Lead is how far ahead of the interval the forecast was issued.
+func (c Comparison) Lead() time.Duration {
+	return c.End.Add(-c.Period).Sub(c.Issued)
+}
+
+// Compare lines up every archived forecast interval with the average measured power
+// over the same interval. Intervals with no measurements are skipped.
+func Compare(forecasts []IssuedForecast, measured []Production) []Comparison {
+	measured = append([]Production(nil), measured...)
+	sort.Slice(measured, func(i, j int) bool { return measured[i].Time.Before(measured[j].Time) })
+
+	var comparisons []Comparison
+	for _, f := range forecasts {
+		for idx, p := range f.Predictions {
+			period := Period(f.Predictions, idx)
+			start := p.End.Add(-period)
+			if p.End.Before(f.Issued) {
+				continue
+			}
+
+			lo := sort.Search(len(measured), func(i int) bool { return measured[i].Time.After(start) })
+			sum, n := 0.0, 0
+			for i := lo; i < len(measured) && !measured[i].Time.After(p.End); i++ {
+				sum += measured[i].Watts
+				n++
+			}
+			if n == 0 {
+				continue
+			}
+			comparisons = append(comparisons, Comparison{
+				Source:     f.Source,
+				Issued:     f.Issued,
+				End:        p.End,
+				Period:     period,
+				ForecastKW: p.KWatts,
+				MeasuredKW: sum / float64(n) / 1000.0,
+			})
+		}
+	}
+	return comparisons
+}
+
+// Metrics summarizes forecast error over a group of intervals.
+//
+// MAPE is undefined when nothing was produced, so it only covers intervals where at least
+// minMeasuredKW was measured. Bias covers every interval, positive means over-forecast.
+type Metrics struct {
+	Count     int
+	MAPECount int
+	MAPE      float64 // percent
+	BiasKW    float64
+}
+
+const minMeasuredKW = 0.1
+
+// Summarize groups comparisons by key and computes Metrics for each group.
+func Summarize(comparisons []Comparison, key func(Comparison) int) map[int]Metrics {
+	metrics := make(map[int]Metrics)
+	for _, c := range comparisons {
+		k := key(c)
+		m := metrics[k]
+		m.Count++
+		m.BiasKW += c.ForecastKW - c.MeasuredKW
+		if c.MeasuredKW >= minMeasuredKW {
+			m.MAPECount++
+			m.MAPE += math.Abs(c.ForecastKW-c.MeasuredKW) / c.MeasuredKW
+		}
+		metrics[k] = m
+	}
+	for k, m := range metrics {
+		m.BiasKW /= float64(m.Count)
+		if m.MAPECount > 0 {
+			m.MAPE = m.MAPE / float64(m.MAPECount) * 100.0
+		}
+		metrics[k] = m
+	}
+	return metrics
+}
+
+// ByLeadHours groups comparisons by how many whole hours ahead they were issued.
+func ByLeadHours(c Comparison) int {
+	return int(c.Lead().Hours())
+}
+
+// ByHourOfDay returns a key function grouping comparisons by the local hour of day.
+func ByHourOfDay(loc *time.Location) func(Comparison) int {
+	return func(c Comparison) int {
+		return c.End.Add(-c.Period / 2).In(loc).Hour()
+	}
+}
+
+// Corrections holds a multiplicative correction for each month and hour of day, learned
+// from how our hillside actually performs relative to the forecast.
+type Corrections struct {
+	Location string          `json:"location"`
+	Factors  [12][24]float64 `json:"factors"`
+	Samples  [12][24]int     `json:"samples"`
+
+	loc *time.Location
+}
+
+// Minimum intervals in a month/hour bucket before we trust its correction factor.
+const minCorrectionSamples = 4
+
+// LearnCorrections computes Corrections from comparisons. Only forecasts issued up to
+// maxLead ahead are used, as those are the ones we plan with.
+func LearnCorrections(comparisons []Comparison, loc *time.Location, maxLead time.Duration) *Corrections {
+	var forecastSum, measuredSum [12][24]float64
+	corrections := &Corrections{Location: loc.String(), loc: loc}
+	for _, c := range comparisons {
+		if c.Lead() > maxLead {
+			continue
+		}
+		t := c.End.Add(-c.Period / 2).In(loc)
+		m, h := int(t.Month())-1, t.Hour()
+		forecastSum[m][h] += c.ForecastKW
+		measuredSum[m][h] += c.MeasuredKW
+		corrections.Samples[m][h]++
+	}
+	for m := range corrections.Factors {
+		for h := range corrections.Factors[m] {
+			corrections.Factors[m][h] = 1.0
+			if corrections.Samples[m][h] >= minCorrectionSamples && forecastSum[m][h] > 0 {
+				// Limit the correction, a handful of freak intervals shouldn't
+				// let us scale a forecast to absurd values.
+				f := measuredSum[m][h] / forecastSum[m][h]
+				corrections.Factors[m][h] = math.Max(0.0, math.Min(3.0, f))
+			}
+		}
+	}
+	return corrections
+}
+
+// ReadCorrections loads Corrections written by WriteToFile.
+func ReadCorrections(filename string) (*Corrections, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var c Corrections
+	if err = json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (c *Corrections) WriteToFile(filename string) error {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, b, 0644)
+}
+
+// Factor returns the correction for an interval centered on t.
+func (c *Corrections) Factor(t time.Time) float64 {
+	if c.loc == nil {
+		loc, err := time.LoadLocation(c.Location)
+		if err != nil {
+			loc = time.Local
+		}
+		c.loc = loc
+	}
+	t = t.In(c.loc)
+	return c.Factors[int(t.Month())-1][t.Hour()]
+}
+
+// Corrected applies learned Corrections to any Forecaster.
+type Corrected struct {
+	Forecaster  Forecaster
+	Corrections *Corrections
+}
+
+func (c *Corrected) Forecast() ([]SolarPrediction, error) {
+	prediction, err := c.Forecaster.Forecast()
+	if err != nil {
+		return nil, err
+	}
+	corrected := make([]SolarPrediction, len(prediction))
+	for idx, p := range prediction {
+		period := Period(prediction, idx)
+		corrected[idx] = p
+		corrected[idx].KWatts = p.KWatts * c.Corrections.Factor(p.End.Add(-period/2))
+	}
+	return corrected, nil
+}
@@ -0,0 +1,140 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package forecast
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IssuedForecast is a forecast as it was fetched at Issued, so it can later be compared
+// against what was actually produced.
+type IssuedForecast struct {
+	Source      string            `json:"source"`
+	Issued      time.Time         `json:"issued"`
+	Predictions []SolarPrediction `json:"predictions"`
+}
+
+// Archive stores every forecast in Dir, one JSON file per forecast.
+type Archive struct {
+	Dir string
+}
+
+// Save writes one forecast to the archive.
+func (a *Archive) Save(f IssuedForecast) error {
+	if err := os.MkdirAll(a.Dir, 0755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	// Nanoseconds, so that two forecasts saved in the same second don't overwrite each other.
+	filename := filepath.Join(a.Dir, fmt.Sprintf("%s-%d.%09d.json", f.Source, f.Issued.Unix(), f.Issued.Nanosecond()))
+	newfilename := filename + ".new"
+	if err = os.WriteFile(newfilename, b, 0644); err != nil {
+		_ = os.Remove(newfilename)
+		return err
+	}
+	if err = os.Rename(newfilename, filename); err != nil {
+		_ = os.Remove(newfilename)
+		return err
+	}
+	return nil
+}
+
+// parseIssued parses the time in an archive filename, seconds and nanoseconds or just the
+// seconds of older archives.
+func parseIssued(s string) (time.Time, bool) {
+	var nsecs int64
+	if dot := strings.Index(s, "."); dot >= 0 {
+		var err error
+		if nsecs, err = strconv.ParseInt(s[dot+1:], 10, 64); err != nil {
+			return time.Time{}, false
+		}
+		s = s[:dot]
+	}
+	secs, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(secs, nsecs), true
+}
+
+// Load returns the forecasts issued between start and end, oldest first.
+func (a *Archive) Load(start, end time.Time) ([]IssuedForecast, error) {
+	entries, err := os.ReadDir(a.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var forecasts []IssuedForecast
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		dash := strings.LastIndex(name, "-")
+		if dash < 0 {
+			continue
+		}
+		issued, ok := parseIssued(strings.TrimSuffix(name[dash+1:], ".json"))
+		if !ok {
+			continue
+		}
+		if issued.Before(start) || !issued.Before(end) {
+			continue
+		}
+
+		b, err := os.ReadFile(filepath.Join(a.Dir, name))
+		if err != nil {
+			return nil, err
+		}
+		var f IssuedForecast
+		if err = json.Unmarshal(b, &f); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		forecasts = append(forecasts, f)
+	}
+
+	sort.Slice(forecasts, func(i, j int) bool {
+		return forecasts[i].Issued.Before(forecasts[j].Issued)
+	})
+	return forecasts, nil
+}
+
+// Recorder saves every forecast fetched from Forecaster into Archive before returning it.
+// A failure to save is passed to OnError rather than returned, so that a full disk does
+// not stop us from planning.
+type Recorder struct {
+	Forecaster Forecaster
+	Archive    *Archive
+	Source     string
+
+	// Called if saving to the Archive fails. May be nil.
+	OnError func(error)
+}
+
+func (r *Recorder) Forecast() ([]SolarPrediction, error) {
+	prediction, err := r.Forecaster.Forecast()
+	if err != nil {
+		return nil, err
+	}
+	err = r.Archive.Save(IssuedForecast{
+		Source:      r.Source,
+		Issued:      time.Now(),
+		Predictions: prediction,
+	})
+	if err != nil && r.OnError != nil {
+		r.OnError(err)
+	}
+	return prediction, nil
+}
@@ -0,0 +1,146 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package forecast
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+// CloudCover is the forecast fraction of the sky covered by cloud, 0.0 - 1.0, from Time
+// until the next entry.
+type CloudCover struct {
+	Time     time.Time
+	Fraction float64
+}
+
+// ClearSky predicts solar production from the geometry of the array and the position
+// of the sun, scaled down by forecast cloud cover. It needs no network access.
+//
+// Irradiance uses the Meinel model for direct normal irradiance with the Kasten-Young
+// air mass, a fixed diffuse fraction, and the Kasten-Czeplak cloud cover correction.
+// This is far simpler than what Solcast does, but tracks the shape of the day well.
+type ClearSky struct {
+	Latitude  float64 // degrees, north is positive
+	Longitude float64 // degrees, east is positive
+	Tilt      float64 // degrees from horizontal
+	Azimuth   float64 // degrees clockwise from north, 180 is facing south
+	KWp       float64 // nameplate DC rating of the array
+
+	// Fraction of production lost to inverter, wiring, soiling and temperature.
+	// Defaults to 0.14 if zero.
+	Losses float64
+
+	// Sorted by Time. If empty, every interval is assumed to be cloudless.
+	CloudCover []CloudCover
+
+	// If set, the direct beam is blocked whenever the sun is below the local horizon.
+	Horizon *Horizon
+
+	Period time.Duration // length of each prediction, defaults to 30 minutes.
+	Hours  int           // how far ahead to predict, defaults to 48.
+}
+
+// Irradiance on the plane of the array in W/m^2, split into the direct beam and the
+// diffuse sky + ground reflected components.
+type Irradiance struct {
+	Direct  float64
+	Diffuse float64
+}
+
+func (c *ClearSky) Forecast() ([]SolarPrediction, error) {
+	if c.KWp <= 0 {
+		return nil, errors.New("ClearSky: KWp must be positive")
+	}
+	period := c.period()
+	hours := c.Hours
+	if hours <= 0 {
+		hours = 48
+	}
+	start := time.Now().Truncate(period)
+	return c.Predict(start, start.Add(time.Duration(hours)*time.Hour), period), nil
+}
+
+// Predict returns predictions for each period between start and end.
+func (c *ClearSky) Predict(start, end time.Time, period time.Duration) []SolarPrediction {
+	var prediction []SolarPrediction
+	for t := start; t.Before(end); t = t.Add(period) {
+		kw := 0.0
+		n := 0
+		for s := t.Add(samplePeriod / 2); s.Before(t.Add(period)); s = s.Add(samplePeriod) {
+			kw += c.PowerAt(s)
+			n++
+		}
+		if n > 0 {
+			kw /= float64(n)
+		}
+		prediction = append(prediction, SolarPrediction{End: t.Add(period), KWatts: kw})
+	}
+	return prediction
+}
+
+// PowerAt returns the instantaneous production in kW predicted at time t.
+func (c *ClearSky) PowerAt(t time.Time) float64 {
+	irr := c.IrradianceAt(t)
+	if c.Horizon != nil && !c.Horizon.SunVisible(t, c.Latitude, c.Longitude) {
+		irr.Direct = 0
+	}
+	return c.kw(irr.Direct+irr.Diffuse) * c.cloudFactor(t)
+}
+
+// IrradianceAt returns the clear sky irradiance on the array at time t, without cloud
+// and ignoring any Horizon.
+func (c *ClearSky) IrradianceAt(t time.Time) Irradiance {
+	elevation, azimuth := SunPosition(t, c.Latitude, c.Longitude)
+	if elevation <= 0 {
+		return Irradiance{}
+	}
+
+	zenith := 90.0 - elevation
+	airMass := 1.0 / (math.Cos(zenith*deg) + 0.50572*math.Pow(96.07995-zenith, -1.6364))
+	dni := 1353.0 * math.Pow(0.7, math.Pow(airMass, 0.678))
+	dhi := 0.1 * dni
+	ghi := dni*math.Cos(zenith*deg) + dhi
+
+	tilt := c.Tilt * deg
+	cosAOI := math.Cos(zenith*deg)*math.Cos(tilt) +
+		math.Sin(zenith*deg)*math.Sin(tilt)*math.Cos((azimuth-c.Azimuth)*deg)
+
+	const albedo = 0.2
+	return Irradiance{
+		Direct:  dni * math.Max(cosAOI, 0.0),
+		Diffuse: dhi*(1.0+math.Cos(tilt))/2.0 + albedo*ghi*(1.0-math.Cos(tilt))/2.0,
+	}
+}
+
+// kw converts plane of array irradiance to power produced by the array.
+func (c *ClearSky) kw(irradiance float64) float64 {
+	losses := c.Losses
+	if losses == 0 {
+		losses = 0.14
+	}
+	return c.KWp * irradiance / 1000.0 * (1.0 - losses)
+}
+
+func (c *ClearSky) cloudFactor(t time.Time) float64 {
+	idx := sort.Search(len(c.CloudCover), func(i int) bool {
+		return c.CloudCover[i].Time.After(t)
+	})
+	if idx == 0 {
+		return 1.0
+	}
+	fraction := math.Max(0.0, math.Min(1.0, c.CloudCover[idx-1].Fraction))
+	return 1.0 - 0.75*math.Pow(fraction, 3.4)
+}
+
+func (c *ClearSky) period() time.Duration {
+	if c.Period <= 0 {
+		return 30 * time.Minute
+	}
+	return c.Period
+}
+
+const samplePeriod = 5 * time.Minute
@@ -0,0 +1,67 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package forecast defines solar production forecasts and the providers which produce them.
+package forecast
+
+import (
+	"time"
+)
+
+// SolarPrediction is the average power expected over the interval ending at End.
+type SolarPrediction struct {
+	End    time.Time
+	KWatts float64
+}
+
+// A Forecaster returns predicted solar production, stretching at least 24 hours into the
+// future. Solcast is one implementation, ClearSky is an offline implementation which keeps
+// working when Solcast is down or our API quota has been used up.
+type Forecaster interface {
+	Forecast() ([]SolarPrediction, error)
+}
+
+// Fallback tries each Forecaster in turn, returning the first successful forecast.
+type Fallback []Forecaster
+
+func (f Fallback) Forecast() (prediction []SolarPrediction, err error) {
+	for _, forecaster := range f {
+		prediction, err = forecaster.Forecast()
+		if err == nil {
+			return prediction, nil
+		}
+	}
+	return nil, err
+}
+
+// Period returns the length of prediction[idx], inferred from the spacing of the
+// predictions around it. Solcast and ClearSky both default to 30 minutes.
+func Period(prediction []SolarPrediction, idx int) time.Duration {
+	if idx > 0 {
+		return prediction[idx].End.Sub(prediction[idx-1].End)
+	}
+	if len(prediction) > 1 {
+		return prediction[1].End.Sub(prediction[0].End)
+	}
+	return 30 * time.Minute
+}
+
+// EnergyBetween returns the kWh predicted between start and end, counting the part of
+// each prediction which overlaps that window.
+func EnergyBetween(prediction []SolarPrediction, start, end time.Time) float64 {
+	kwh := 0.0
+	for idx, p := range prediction {
+		pStart := p.End.Add(-Period(prediction, idx))
+		from, to := pStart, p.End
+		if start.After(from) {
+			from = start
+		}
+		if end.Before(to) {
+			to = end
+		}
+		if to.After(from) {
+			kwh += p.KWatts * to.Sub(from).Hours()
+		}
+	}
+	return kwh
+}
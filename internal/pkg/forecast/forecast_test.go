@@ -0,0 +1,253 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package forecast
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSunPosition(t *testing.T) {
+	// Solar noon in Sunnyvale, CA near the June solstice.
+	noon := time.Date(2024, 6, 20, 20, 10, 0, 0, time.UTC)
+	elevation, azimuth := SunPosition(noon, 37.37, -122.04)
+	if math.Abs(elevation-76.1) > 0.5 {
+		t.Errorf("noon elevation got=%.2f want=76.1", elevation)
+	}
+	if math.Abs(azimuth-180.0) > 3.0 {
+		t.Errorf("noon azimuth got=%.2f want=180", azimuth)
+	}
+
+	morning := time.Date(2024, 6, 20, 15, 0, 0, 0, time.UTC)
+	_, azimuth = SunPosition(morning, 37.37, -122.04)
+	if azimuth < 45.0 || azimuth > 135.0 {
+		t.Errorf("morning azimuth got=%.2f want east", azimuth)
+	}
+
+	midnight := time.Date(2024, 6, 20, 7, 10, 0, 0, time.UTC)
+	elevation, _ = SunPosition(midnight, 37.37, -122.04)
+	if elevation > -20.0 {
+		t.Errorf("midnight elevation got=%.2f want below horizon", elevation)
+	}
+}
+
+func TestClearSky(t *testing.T) {
+	c := ClearSky{Latitude: 37.37, Longitude: -122.04, Tilt: 20, Azimuth: 180, KWp: 10}
+	noon := time.Date(2024, 6, 20, 20, 10, 0, 0, time.UTC)
+	midnight := time.Date(2024, 6, 20, 7, 10, 0, 0, time.UTC)
+
+	if kw := c.PowerAt(midnight); kw != 0 {
+		t.Errorf("PowerAt(midnight) got=%.2f want=0", kw)
+	}
+	clear := c.PowerAt(noon)
+	if clear < 6.0 || clear > 10.0 {
+		t.Errorf("PowerAt(noon) got=%.2f want 6-10 kW", clear)
+	}
+
+	c.CloudCover = []CloudCover{{Time: noon.Add(-time.Hour), Fraction: 1.0}}
+	if cloudy := c.PowerAt(noon); math.Abs(cloudy-clear*0.25) > 0.01 {
+		t.Errorf("PowerAt(noon, overcast) got=%.2f want=%.2f", cloudy, clear*0.25)
+	}
+
+	prediction := c.Predict(noon.Truncate(time.Hour), noon.Truncate(time.Hour).Add(24*time.Hour),
+		30*time.Minute)
+	if len(prediction) != 48 {
+		t.Fatalf("len(Predict) got=%d want=48", len(prediction))
+	}
+	if !prediction[0].End.Equal(noon.Truncate(time.Hour).Add(30 * time.Minute)) {
+		t.Errorf("Predict[0].End got=%v", prediction[0].End)
+	}
+}
+
+type failingForecaster struct{}
+
+func (f failingForecaster) Forecast() ([]SolarPrediction, error) {
+	return nil, errors.New("quota exceeded")
+}
+
+func TestFallback(t *testing.T) {
+	c := &ClearSky{Latitude: 37.37, Longitude: -122.04, Tilt: 20, Azimuth: 180, KWp: 10}
+	prediction, err := Fallback{failingForecaster{}, c}.Forecast()
+	if err != nil {
+		t.Fatalf("Fallback.Forecast: %v", err)
+	}
+	if len(prediction) != 96 {
+		t.Errorf("len(Fallback.Forecast) got=%d want=96", len(prediction))
+	}
+
+	_, err = Fallback{failingForecaster{}}.Forecast()
+	if err == nil {
+		t.Errorf("Fallback.Forecast of only failing forecasters succeeded")
+	}
+}
+
+func TestEnergyBetween(t *testing.T) {
+	start := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	prediction := []SolarPrediction{
+		{End: start.Add(30 * time.Minute), KWatts: 2},
+		{End: start.Add(60 * time.Minute), KWatts: 4},
+		{End: start.Add(90 * time.Minute), KWatts: 6},
+	}
+	if kwh := EnergyBetween(prediction, start, start.Add(time.Hour)); kwh != 3 {
+		t.Errorf("EnergyBetween first hour got=%v want=3", kwh)
+	}
+	// Half of the second prediction and half of the third.
+	if kwh := EnergyBetween(prediction, start.Add(45*time.Minute), start.Add(75*time.Minute)); kwh != 2.5 {
+		t.Errorf("EnergyBetween overlapping got=%v want=2.5", kwh)
+	}
+	if kwh := EnergyBetween(prediction, start.Add(2*time.Hour), start.Add(3*time.Hour)); kwh != 0 {
+		t.Errorf("EnergyBetween beyond the forecast got=%v want=0", kwh)
+	}
+}
+
+func TestHorizonElevationAt(t *testing.T) {
+	h := &Horizon{Points: []HorizonPoint{{90, 10}, {180, 20}, {270, 30}}}
+	tests := []struct {
+		azimuth float64
+		want    float64
+	}{
+		{90, 10},
+		{135, 15},
+		{270, 30},
+		{0, 20},
+		{360, 20},
+		{315, 25},
+		{45, 15},
+	}
+	for _, tt := range tests {
+		if got := h.ElevationAt(tt.azimuth); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("ElevationAt(%v) got=%v want=%v", tt.azimuth, got, tt.want)
+		}
+	}
+
+	var empty *Horizon
+	if got := empty.ElevationAt(180); got != 0 {
+		t.Errorf("nil ElevationAt got=%v want=0", got)
+	}
+}
+
+func TestShadedAndFitHorizon(t *testing.T) {
+	site := &ClearSky{Latitude: 37.37, Longitude: -122.04, Tilt: 20, Azimuth: 180, KWp: 10}
+	hill := &Horizon{Points: []HorizonPoint{{0, 0}, {170, 0}, {190, 40}, {350, 40}}}
+
+	// A hill to the south west blocks the sun shortly after noon in winter.
+	afternoon := time.Date(2024, 12, 21, 22, 0, 0, 0, time.UTC)
+	prediction := []SolarPrediction{
+		{End: afternoon, KWatts: 5.0},
+		{End: afternoon.Add(30 * time.Minute), KWatts: 5.0},
+	}
+	shaded := (&Shaded{Site: site, Horizon: hill}).Apply(prediction)
+	if shaded[1].KWatts >= 2.5 || shaded[1].KWatts <= 0 {
+		t.Errorf("Shaded afternoon got=%.2f want only diffuse", shaded[1].KWatts)
+	}
+
+	// Generate a year of production under that hill and fit it back.
+	site.Horizon = hill
+	var measured []Production
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for ts := start; ts.Before(start.AddDate(1, 0, 0)); ts = ts.Add(15 * time.Minute) {
+		measured = append(measured, Production{Time: ts, Watts: site.PowerAt(ts) * 1000.0})
+	}
+	site.Horizon = nil
+	fit := FitHorizon(site, measured, 10, 0.5)
+	for _, az := range []float64{205, 245} {
+		if got := fit.ElevationAt(az); math.Abs(got-40) > 2 {
+			t.Errorf("FitHorizon.ElevationAt(%v) got=%.1f want about 40", az, got)
+		}
+	}
+	if got := fit.ElevationAt(120); got > 3 {
+		t.Errorf("FitHorizon.ElevationAt(120) got=%.1f want about 0", got)
+	}
+}
+
+type fixedForecaster []SolarPrediction
+
+func (f fixedForecaster) Forecast() ([]SolarPrediction, error) {
+	return f, nil
+}
+
+func TestAccuracy(t *testing.T) {
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatalf("LoadLocation: %v", err)
+	}
+	issued := time.Date(2024, 1, 10, 6, 0, 0, 0, loc)
+	var predictions []SolarPrediction
+	var measured []Production
+	for h := 1; h <= 24; h++ {
+		end := issued.Add(time.Duration(h) * time.Hour)
+		predictions = append(predictions, SolarPrediction{End: end, KWatts: 2.0})
+		// The hill costs us half of the forecast every afternoon.
+		watts := 2000.0
+		if end.Hour() > 12 {
+			watts = 1000.0
+		}
+		for m := 0; m < 60; m += 5 {
+			measured = append(measured, Production{Time: end.Add(-time.Duration(m) * time.Minute), Watts: watts})
+		}
+	}
+
+	archive := &Archive{Dir: t.TempDir()}
+	recorder := &Recorder{Forecaster: fixedForecaster(predictions), Archive: archive, Source: "solcast"}
+	if _, err := recorder.Forecast(); err != nil {
+		t.Fatalf("Recorder.Forecast: %v", err)
+	}
+	for _, offset := range []time.Duration{0, 100 * time.Millisecond} {
+		if err = archive.Save(IssuedForecast{Source: "clearsky", Issued: issued.Add(offset), Predictions: predictions}); err != nil {
+			t.Fatalf("Archive.Save: %v", err)
+		}
+	}
+	forecasts, err := archive.Load(issued.Add(-time.Hour), issued.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Archive.Load: %v", err)
+	}
+	if len(forecasts) != 2 || forecasts[0].Source != "clearsky" || len(forecasts[0].Predictions) != 24 ||
+		!forecasts[1].Issued.Equal(issued.Add(100*time.Millisecond)) {
+		t.Fatalf("Archive.Load got=%+v", forecasts)
+	}
+	forecasts = forecasts[:1]
+
+	// Compare must leave the caller's measurements in the order they were given.
+	first := measured[0]
+	comparisons := Compare(forecasts, measured)
+	if measured[0] != first {
+		t.Errorf("Compare reordered the measurements")
+	}
+	if len(comparisons) != 24 {
+		t.Fatalf("len(Compare) got=%d want=24", len(comparisons))
+	}
+	byHour := Summarize(comparisons, ByHourOfDay(loc))
+	if m := byHour[10]; m.Count != 1 || m.MAPE != 0 || m.BiasKW != 0 {
+		t.Errorf("Summarize[10] got=%+v want perfect", m)
+	}
+	if m := byHour[14]; math.Abs(m.MAPE-100.0) > 1e-9 || math.Abs(m.BiasKW-1.0) > 1e-9 {
+		t.Errorf("Summarize[14] got=%+v want MAPE=100 Bias=1", m)
+	}
+	byLead := Summarize(comparisons, ByLeadHours)
+	if m := byLead[0]; m.Count != 1 {
+		t.Errorf("Summarize lead 0 got=%+v", m)
+	}
+
+	// Repeat the same day a few times so every bucket has enough samples.
+	var many []Comparison
+	for i := 0; i < minCorrectionSamples; i++ {
+		many = append(many, comparisons...)
+	}
+	corrections := LearnCorrections(many, loc, 48*time.Hour)
+	corrected, err := (&Corrected{Forecaster: fixedForecaster(predictions), Corrections: corrections}).Forecast()
+	if err != nil {
+		t.Fatalf("Corrected.Forecast: %v", err)
+	}
+	for _, p := range corrected {
+		want := 2.0
+		if p.End.Hour() > 12 {
+			want = 1.0
+		}
+		if math.Abs(p.KWatts-want) > 1e-9 {
+			t.Errorf("Corrected %v got=%.2f want=%.2f", p.End, p.KWatts, want)
+		}
+	}
+}
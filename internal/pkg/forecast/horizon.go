@@ -0,0 +1,189 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package forecast
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+// HorizonPoint is the elevation of the local horizon in degrees, looking toward Azimuth
+// (degrees clockwise from north).
+type HorizonPoint struct {
+	Azimuth   float64 `json:"azimuth"`
+	Elevation float64 `json:"elevation"`
+}
+
+// Horizon is the profile of the local skyline. Our house sits below a hill, and in winter
+// the sun drops behind the hilltop shortly after noon. Generic forecasts know nothing of
+// this, so we mask out the direct beam whenever the sun is below the local horizon.
+type Horizon struct {
+	Points []HorizonPoint `json:"points"`
+}
+
+// ReadHorizon loads a Horizon from a JSON file of the form
+// {"points": [{"azimuth": 180, "elevation": 12.5}, ...]}
+func ReadHorizon(filename string) (*Horizon, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var h Horizon
+	if err = json.Unmarshal(b, &h); err != nil {
+		return nil, err
+	}
+	if len(h.Points) == 0 {
+		return nil, errors.New("horizon has no points")
+	}
+	h.sort()
+	return &h, nil
+}
+
+func (h *Horizon) sort() {
+	sort.Slice(h.Points, func(i, j int) bool {
+		return h.Points[i].Azimuth < h.Points[j].Azimuth
+	})
+}
+
+// ElevationAt returns the horizon elevation toward azimuth, interpolating linearly
+// between points and wrapping around through north.
+func (h *Horizon) ElevationAt(azimuth float64) float64 {
+	if h == nil || len(h.Points) == 0 {
+		return 0.0
+	}
+	n := len(h.Points)
+	azimuth = math.Mod(math.Mod(azimuth, 360.0)+360.0, 360.0)
+	idx := sort.Search(n, func(i int) bool { return h.Points[i].Azimuth >= azimuth })
+
+	lo, hi := h.Points[(idx+n-1)%n], h.Points[idx%n]
+	switch idx {
+	case 0:
+		lo.Azimuth -= 360.0
+	case n:
+		hi.Azimuth += 360.0
+	}
+	if hi.Azimuth == lo.Azimuth {
+		return hi.Elevation
+	}
+	frac := (azimuth - lo.Azimuth) / (hi.Azimuth - lo.Azimuth)
+	return lo.Elevation + frac*(hi.Elevation-lo.Elevation)
+}
+
+// SunVisible reports whether the sun clears the local horizon at time t.
+func (h *Horizon) SunVisible(t time.Time, latitude, longitude float64) bool {
+	elevation, azimuth := SunPosition(t, latitude, longitude)
+	return elevation > 0 && elevation > h.ElevationAt(azimuth)
+}
+
+// ShadeFactor returns the fraction of clear sky production from site which remains
+// between start and end, once the direct beam is blocked by the horizon. The diffuse
+// component is left alone.
+func ShadeFactor(site *ClearSky, h *Horizon, start, end time.Time) float64 {
+	total := 0.0
+	remaining := 0.0
+	for s := start.Add(samplePeriod / 2); s.Before(end); s = s.Add(samplePeriod) {
+		irr := site.IrradianceAt(s)
+		total += irr.Direct + irr.Diffuse
+		remaining += irr.Diffuse
+		if h.SunVisible(s, site.Latitude, site.Longitude) {
+			remaining += irr.Direct
+		}
+	}
+	if total == 0 {
+		return 1.0
+	}
+	return remaining / total
+}
+
+// Shaded applies a Horizon to any Forecaster. Site supplies the location and geometry of
+// the array, used to estimate how much of each forecast interval is direct beam.
+type Shaded struct {
+	Forecaster Forecaster
+	Site       *ClearSky
+	Horizon    *Horizon
+}
+
+func (s *Shaded) Forecast() ([]SolarPrediction, error) {
+	prediction, err := s.Forecaster.Forecast()
+	if err != nil {
+		return nil, err
+	}
+	return s.Apply(prediction), nil
+}
+
+// Apply scales each interval of prediction by the ShadeFactor for that interval.
+func (s *Shaded) Apply(prediction []SolarPrediction) []SolarPrediction {
+	shaded := make([]SolarPrediction, len(prediction))
+	for idx, p := range prediction {
+		period := Period(prediction, idx)
+		shaded[idx] = p
+		shaded[idx].KWatts = p.KWatts * ShadeFactor(s.Site, s.Horizon, p.End.Add(-period), p.End)
+	}
+	return shaded
+}
+
+// FitHorizon estimates the Horizon from a long history of measured production,
+// ideally a full year so the sun has swept across every azimuth it can reach.
+//
+// Measured production is compared against clear sky production in cells of binWidth
+// degrees of azimuth by one degree of elevation. On a clear day a sunlit array produces
+// close to the clear sky estimate while a shaded one only gets the diffuse component,
+// so a cell counts as sunlit if the best ratio seen in it reaches threshold. The horizon
+// in each azimuth bin sits at the top of the highest cell which was never sunlit.
+func FitHorizon(site *ClearSky, measured []Production, binWidth, threshold float64) *Horizon {
+	type cell struct {
+		count    int
+		maxRatio float64
+	}
+	bins := int(math.Ceil(360.0 / binWidth))
+	cells := make([]map[int]*cell, bins)
+	for idx := range cells {
+		cells[idx] = make(map[int]*cell)
+	}
+
+	for _, m := range measured {
+		elevation, azimuth := SunPosition(m.Time, site.Latitude, site.Longitude)
+		if elevation <= 1.0 {
+			continue
+		}
+		irr := site.IrradianceAt(m.Time)
+		expected := site.kw(irr.Direct+irr.Diffuse) * 1000.0
+		if expected < site.KWp*20.0 {
+			// Too little light to tell sun from shade.
+			continue
+		}
+		bin := int(azimuth/binWidth) % bins
+		e := int(elevation)
+		c, ok := cells[bin][e]
+		if !ok {
+			c = &cell{}
+			cells[bin][e] = c
+		}
+		c.count++
+		c.maxRatio = math.Max(c.maxRatio, m.Watts/expected)
+	}
+
+	h := &Horizon{}
+	for bin, column := range cells {
+		if len(column) == 0 {
+			continue
+		}
+		horizon := 0
+		for e, c := range column {
+			if c.count >= 3 && c.maxRatio < threshold && e+1 > horizon {
+				horizon = e + 1
+			}
+		}
+		h.Points = append(h.Points, HorizonPoint{
+			Azimuth:   (float64(bin) + 0.5) * binWidth,
+			Elevation: float64(horizon),
+		})
+	}
+	h.sort()
+	return h
+}
@@ -0,0 +1,72 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package forecast
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Production is a measurement of solar power at Time.
+type Production struct {
+	Time  time.Time
+	Watts float64
+}
+
+// ReadProductionCSV reads measured production from CSV with a header row. The "time"
+// column holds RFC3339 timestamps or Unix seconds, the "solar_watts" column holds power.
+// Other columns are ignored.
+func ReadProductionCSV(r io.Reader) ([]Production, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	timeCol, wattsCol := -1, -1
+	for idx, name := range header {
+		switch strings.TrimSpace(name) {
+		case "time":
+			timeCol = idx
+		case "solar_watts":
+			wattsCol = idx
+		}
+	}
+	if timeCol < 0 || wattsCol < 0 {
+		return nil, fmt.Errorf("CSV needs time and solar_watts columns, got %v", header)
+	}
+
+	var production []Production
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		t, err := ParseTime(record[timeCol])
+		if err != nil {
+			return nil, err
+		}
+		watts, err := strconv.ParseFloat(strings.TrimSpace(record[wattsCol]), 64)
+		if err != nil {
+			return nil, err
+		}
+		production = append(production, Production{Time: t, Watts: watts})
+	}
+	return production, nil
+}
+
+// ParseTime accepts either an RFC3339 timestamp or Unix seconds.
+func ParseTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Unix(0, int64(secs*1e9)), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
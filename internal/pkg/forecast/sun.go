@@ -0,0 +1,61 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package forecast
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	deg = math.Pi / 180.0
+	rad = 180.0 / math.Pi
+)
+
+// SunPosition returns the elevation above the horizon and the azimuth (clockwise from
+// north) of the sun in degrees, at time t for the given latitude and longitude.
+//
+// This is the NOAA General Solar Position calculation, which is accurate to within a
+// fraction of a degree. That is plenty for estimating solar production.
+// https://gml.noaa.gov/grad/solcalc/solareqns.PDF
+func SunPosition(t time.Time, latitude, longitude float64) (elevation, azimuth float64) {
+	t = t.UTC()
+	hour := float64(t.Hour()) + float64(t.Minute())/60.0 + float64(t.Second())/3600.0
+	gamma := 2.0 * math.Pi / 365.0 * (float64(t.YearDay()-1) + (hour-12.0)/24.0)
+
+	eqtime := 229.18 * (0.000075 + 0.001868*math.Cos(gamma) - 0.032077*math.Sin(gamma) -
+		0.014615*math.Cos(2*gamma) - 0.040849*math.Sin(2*gamma))
+	decl := 0.006918 - 0.399912*math.Cos(gamma) + 0.070257*math.Sin(gamma) -
+		0.006758*math.Cos(2*gamma) + 0.000907*math.Sin(2*gamma) -
+		0.002697*math.Cos(3*gamma) + 0.00148*math.Sin(3*gamma)
+
+	trueSolarMinutes := hour*60.0 + eqtime + 4.0*longitude
+	hourAngle := math.Mod(trueSolarMinutes/4.0-180.0, 360.0)
+	if hourAngle < -180.0 {
+		hourAngle += 360.0
+	} else if hourAngle >= 180.0 {
+		hourAngle -= 360.0
+	}
+	hourAngle *= deg
+
+	lat := latitude * deg
+	cosZenith := math.Sin(lat)*math.Sin(decl) + math.Cos(lat)*math.Cos(decl)*math.Cos(hourAngle)
+	cosZenith = math.Max(-1.0, math.Min(1.0, cosZenith))
+	zenith := math.Acos(cosZenith)
+
+	// The azimuth is undefined with the sun directly overhead, or at the poles.
+	denominator := math.Cos(lat) * math.Sin(zenith)
+	if math.Abs(denominator) < 1e-9 {
+		return 90.0 - zenith*rad, 180.0
+	}
+	cosAz := (math.Sin(lat)*cosZenith - math.Sin(decl)) / denominator
+	az := math.Acos(math.Max(-1.0, math.Min(1.0, cosAz))) * rad
+	if hourAngle > 0 {
+		azimuth = math.Mod(az+180.0, 360.0)
+	} else {
+		azimuth = math.Mod(540.0-az, 360.0)
+	}
+
+	return 90.0 - zenith*rad, azimuth
+}
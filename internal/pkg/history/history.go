@@ -0,0 +1,422 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package history keeps a local record of every poll of the Powerwall, so that planning,
+// reports and backtests have something to look back at.
+//
+// Data lives in the state directory as JSON lines: raw samples and 5 minute rollups in
+// one file per local day, daily rollups in one file per year.
+//
+//	statedir/history/raw/2024-03-07.jsonl
+//	statedir/history/5m/2024-03-07.jsonl
+//	statedir/history/daily/2024.jsonl
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sample is one poll of live_status. Battery power is positive when discharging, grid
+// power is positive when importing.
+type Sample struct {
+	Time              time.Time `json:"time"`
+	SolarPower        float64   `json:"solar_power"`
+	BatteryPower      float64   `json:"battery_power"`
+	LoadPower         float64   `json:"load_power"`
+	GridPower         float64   `json:"grid_power"`
+	EnergyLeft        float64   `json:"energy_left"`
+	TotalPackEnergy   float64   `json:"total_pack_energy"`
+	PercentageCharged float64   `json:"percentage_charged"`
+	GridStatus        string    `json:"grid_status,omitempty"`
+	IslandStatus      string    `json:"island_status,omitempty"`
+	StormModeActive   bool      `json:"storm_mode_active,omitempty"`
+}
+
+// OffGrid reports whether the site was islanded when the sample was taken.
+func (s Sample) OffGrid() bool {
+	return s.GridStatus == "Inactive" || strings.HasPrefix(s.IslandStatus, "off_grid")
+}
+
+// Interval is the energy which flowed during Duration starting at Start.
+type Interval struct {
+	Start              time.Time     `json:"start"`
+	Duration           time.Duration `json:"duration"`
+	SolarWh            float64       `json:"solar_wh"`
+	LoadWh             float64       `json:"load_wh"`
+	GridImportWh       float64       `json:"grid_import_wh"`
+	GridExportWh       float64       `json:"grid_export_wh"`
+	BatteryChargeWh    float64       `json:"battery_charge_wh"`
+	BatteryDischargeWh float64       `json:"battery_discharge_wh"`
+
+	// State of the battery at the end of the interval, zero if not known.
+	EnergyLeft        float64 `json:"energy_left,omitempty"`
+	PercentageCharged float64 `json:"percentage_charged,omitempty"`
+
+	// How much of the interval was spent islanded from the grid.
+	OffGrid time.Duration `json:"off_grid,omitempty"`
+
+	// Where the data came from: "poll", "calendar_history", "tesla_app", "prometheus".
+	Source string `json:"source,omitempty"`
+}
+
+// End returns the time at which the interval ends.
+func (i Interval) End() time.Time {
+	return i.Start.Add(i.Duration)
+}
+
+// Resolutions of stored rollups.
+const (
+	FiveMinutes = 5 * time.Minute
+	Daily       = 24 * time.Hour
+)
+
+// A sample is assumed to hold until the next one, up to MaxGap. Longer gaps are missing
+// data rather than a long steady state.
+const MaxGap = 15 * time.Minute
+
+// Retention is how long to keep each kind of data. Zero keeps it forever.
+type Retention struct {
+	Raw        time.Duration
+	FiveMinute time.Duration
+	Daily      time.Duration
+}
+
+// DefaultRetention keeps raw polls for two weeks, 5 minute rollups for a bit over a year
+// so that a full year can be replayed, and daily rollups forever.
+var DefaultRetention = Retention{
+	Raw:        14 * 24 * time.Hour,
+	FiveMinute: 400 * 24 * time.Hour,
+}
+
+// Store is the on-disk history.
+type Store struct {
+	mu        sync.Mutex
+	dir       string
+	loc       *time.Location
+	Retention Retention
+}
+
+// Open returns a Store in dir, creating it if needed. Days begin at midnight in loc.
+func Open(dir string, loc *time.Location) (*Store, error) {
+	for _, sub := range []string{"raw", "5m", "daily"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &Store{dir: dir, loc: loc, Retention: DefaultRetention}, nil
+}
+
+// Location returns the time zone in which the Store divides days.
+func (s *Store) Location() *time.Location {
+	return s.loc
+}
+
+func (s *Store) dayFile(sub string, t time.Time) string {
+	return filepath.Join(s.dir, sub, t.In(s.loc).Format("2006-01-02")+".jsonl")
+}
+
+func (s *Store) yearFile(t time.Time) string {
+	return filepath.Join(s.dir, "daily", t.In(s.loc).Format("2006")+".jsonl")
+}
+
+// StartOfDay returns local midnight at the start of the day containing t.
+func (s *Store) StartOfDay(t time.Time) time.Time {
+	t = t.In(s.loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, s.loc)
+}
+
+// Record appends one sample to the raw history.
+func (s *Store) Record(sample Sample) error {
+	b, err := json.Marshal(sample)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.dayFile("raw", sample.Time), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// Samples returns the raw samples in [start, end), oldest first.
+func (s *Store) Samples(start, end time.Time) ([]Sample, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.samples(start, end)
+}
+
+func (s *Store) samples(start, end time.Time) ([]Sample, error) {
+	var samples []Sample
+	for day := s.StartOfDay(start); day.Before(end); day = day.AddDate(0, 0, 1) {
+		err := readLines(s.dayFile("raw", day), func(b []byte) error {
+			var sample Sample
+			if err := json.Unmarshal(b, &sample); err != nil {
+				return err
+			}
+			if !sample.Time.Before(start) && sample.Time.Before(end) {
+				samples = append(samples, sample)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Time.Before(samples[j].Time) })
+	return samples, nil
+}
+
+// Intervals returns rollups at resolution res (FiveMinutes or Daily) which start in
+// [start, end), oldest first.
+func (s *Store) Intervals(res time.Duration, start, end time.Time) ([]Interval, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.intervals(res, start, end)
+}
+
+func (s *Store) intervals(res time.Duration, start, end time.Time) ([]Interval, error) {
+	var files []string
+	switch res {
+	case FiveMinutes:
+		for day := s.StartOfDay(start); day.Before(end); day = day.AddDate(0, 0, 1) {
+			files = append(files, s.dayFile("5m", day))
+		}
+	case Daily:
+		for year := s.StartOfDay(start).Year(); year <= end.In(s.loc).Year(); year++ {
+			files = append(files, s.yearFile(time.Date(year, 1, 1, 0, 0, 0, 0, s.loc)))
+		}
+	default:
+		return nil, fmt.Errorf("history: unsupported resolution %v", res)
+	}
+
+	var intervals []Interval
+	for _, filename := range files {
+		err := readLines(filename, func(b []byte) error {
+			var interval Interval
+			if err := json.Unmarshal(b, &interval); err != nil {
+				return err
+			}
+			if !interval.Start.Before(start) && interval.Start.Before(end) {
+				intervals = append(intervals, interval)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].Start.Before(intervals[j].Start) })
+	return intervals, nil
+}
+
+// PutIntervals merges intervals at resolution res into the store, replacing any existing
+// interval with the same Start. Daily rollups are recomputed for every day touched by
+// 5 minute intervals. This is how backfilled and imported data arrives.
+func (s *Store) PutIntervals(res time.Duration, intervals []Interval) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.putIntervals(res, intervals)
+}
+
+func (s *Store) putIntervals(res time.Duration, intervals []Interval) error {
+	byFile := make(map[string][]Interval)
+	days := make(map[time.Time]bool)
+	for _, interval := range intervals {
+		switch res {
+		case FiveMinutes:
+			filename := s.dayFile("5m", interval.Start)
+			byFile[filename] = append(byFile[filename], interval)
+			days[s.StartOfDay(interval.Start)] = true
+		case Daily:
+			filename := s.yearFile(interval.Start)
+			byFile[filename] = append(byFile[filename], interval)
+		default:
+			return fmt.Errorf("history: unsupported resolution %v", res)
+		}
+	}
+
+	for filename, updates := range byFile {
+		merged := make(map[int64]Interval)
+		err := readLines(filename, func(b []byte) error {
+			var interval Interval
+			if err := json.Unmarshal(b, &interval); err != nil {
+				return err
+			}
+			merged[interval.Start.Unix()] = interval
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, interval := range updates {
+			merged[interval.Start.Unix()] = interval
+		}
+		if err = writeIntervals(filename, merged); err != nil {
+			return err
+		}
+	}
+
+	for day := range days {
+		if err := s.rollupDaily(day); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollupDaily sums the 5 minute intervals of one day into a daily interval.
+func (s *Store) rollupDaily(day time.Time) error {
+	next := day.AddDate(0, 0, 1)
+	intervals, err := s.intervals(FiveMinutes, day, next)
+	if err != nil || len(intervals) == 0 {
+		return err
+	}
+	daily := Sum(intervals)
+	daily.Start = day
+	daily.Duration = next.Sub(day)
+	return s.putIntervals(Daily, []Interval{daily})
+}
+
+// Rollup computes 5 minute and daily rollups from the raw samples of the day containing
+// now and the day before, then drops data older than the Retention. The poller should
+// call it periodically. Only intervals which the samples fully cover are written, the
+// partial ones at the edges of a gap would replace complete intervals from backfill or
+// import.
+func (s *Store) Rollup(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	today := s.StartOfDay(now)
+	for _, day := range []time.Time{today.AddDate(0, 0, -1), today} {
+		// Include the last sample of the previous day, it holds until the first
+		// sample of this one. Likewise the first sample of the next day closes out
+		// the last sample of this one.
+		samples, err := s.samples(day.Add(-MaxGap), day.AddDate(0, 0, 1).Add(MaxGap))
+		if err != nil {
+			return err
+		}
+		var intervals []Interval
+		integrated, coverage := integrate(samples, FiveMinutes)
+		for idx, interval := range integrated {
+			if coverage[idx] == FiveMinutes && !interval.Start.Before(day) && interval.Start.Before(day.AddDate(0, 0, 1)) {
+				intervals = append(intervals, interval)
+			}
+		}
+		if err = s.putIntervals(FiveMinutes, intervals); err != nil {
+			return err
+		}
+	}
+	return s.prune(now)
+}
+
+func (s *Store) prune(now time.Time) error {
+	rules := []struct {
+		sub       string
+		retention time.Duration
+		layout    string
+	}{
+		{"raw", s.Retention.Raw, "2006-01-02"},
+		{"5m", s.Retention.FiveMinute, "2006-01-02"},
+		{"daily", s.Retention.Daily, "2006"},
+	}
+	for _, rule := range rules {
+		if rule.retention <= 0 {
+			continue
+		}
+		cutoff := now.Add(-rule.retention)
+		entries, err := os.ReadDir(filepath.Join(s.dir, rule.sub))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			start, err := time.ParseInLocation(rule.layout, strings.TrimSuffix(entry.Name(), ".jsonl"), s.loc)
+			if err != nil {
+				continue
+			}
+			end := start.AddDate(0, 0, 1)
+			if rule.sub == "daily" {
+				end = start.AddDate(1, 0, 0)
+			}
+			if end.Before(cutoff) {
+				if err = os.Remove(filepath.Join(s.dir, rule.sub, entry.Name())); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func readLines(filename string, f func([]byte) error) error {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		if err = f(line); err != nil {
+			return fmt.Errorf("%s: %v", filename, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func writeIntervals(filename string, merged map[int64]Interval) error {
+	keys := make([]int64, 0, len(merged))
+	for k := range merged {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	newfilename := filename + ".new"
+	f, err := os.OpenFile(newfilename, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, k := range keys {
+		b, err := json.Marshal(merged[k])
+		if err != nil {
+			f.Close()
+			_ = os.Remove(newfilename)
+			return err
+		}
+		w.Write(append(b, '\n'))
+	}
+	if err = w.Flush(); err != nil {
+		f.Close()
+		_ = os.Remove(newfilename)
+		return err
+	}
+	if err = f.Close(); err != nil {
+		_ = os.Remove(newfilename)
+		return err
+	}
+	if err = os.Rename(newfilename, filename); err != nil {
+		_ = os.Remove(newfilename)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package history
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIntegrate(t *testing.T) {
+	start := time.Date(2024, 3, 7, 12, 0, 0, 0, time.UTC)
+	samples := []Sample{
+		{Time: start, SolarPower: 6000, LoadPower: 2000, BatteryPower: -3000, GridPower: -1000},
+		{Time: start.Add(2*time.Minute + 30*time.Second), SolarPower: 0, LoadPower: 1200,
+			BatteryPower: 200, GridPower: 1000, GridStatus: "Inactive"},
+		{Time: start.Add(7*time.Minute + 30*time.Second)},
+		// A long gap, only MaxGap of the previous sample counts.
+		{Time: start.Add(2 * time.Hour)},
+	}
+	intervals := Integrate(samples, FiveMinutes)
+	if len(intervals) != 5 {
+		t.Fatalf("len(Integrate) got=%d want=5", len(intervals))
+	}
+
+	first := intervals[0]
+	if math.Abs(first.SolarWh-250) > 1e-9 || math.Abs(first.LoadWh-(2000.0/24+1200.0/24)) > 1e-9 {
+		t.Errorf("first interval got=%+v", first)
+	}
+	if math.Abs(first.BatteryChargeWh-125) > 1e-9 || math.Abs(first.BatteryDischargeWh-200.0/24) > 1e-9 {
+		t.Errorf("first interval battery got=%+v", first)
+	}
+	if math.Abs(first.GridExportWh-1000.0/24) > 1e-9 || math.Abs(first.GridImportWh-1000.0/24) > 1e-9 {
+		t.Errorf("first interval grid got=%+v", first)
+	}
+	if first.OffGrid != 150*time.Second {
+		t.Errorf("first interval OffGrid got=%v want=2m30s", first.OffGrid)
+	}
+
+	sum := Sum(intervals)
+	if sum.Duration != 25*time.Minute || math.Abs(sum.SolarWh-250) > 1e-9 {
+		t.Errorf("Sum got=%+v", sum)
+	}
+
+	reversed := []Sample{samples[3], samples[2], samples[1], samples[0]}
+	if got := Integrate(reversed, FiveMinutes); len(got) != 5 || got[0] != first {
+		t.Errorf("Integrate of reversed samples got=%+v", got)
+	}
+	if !reversed[0].Time.Equal(samples[3].Time) {
+		t.Errorf("Integrate reordered its input")
+	}
+}
+
+func TestStore(t *testing.T) {
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatalf("LoadLocation: %v", err)
+	}
+	dir := t.TempDir()
+	s, err := Open(dir, loc)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// One poll every 5 minutes at a steady 1.2kW load, across midnight.
+	day := time.Date(2024, 3, 7, 0, 0, 0, 0, loc)
+	for ts := day.Add(-time.Hour); ts.Before(day.AddDate(0, 0, 1).Add(time.Hour)); ts = ts.Add(5 * time.Minute) {
+		err = s.Record(Sample{Time: ts, LoadPower: 1200, GridPower: 1200, EnergyLeft: 5000})
+		if err != nil {
+			t.Fatalf("Record: %v", err)
+		}
+	}
+	if err = s.Rollup(day.Add(12 * time.Hour)); err != nil {
+		t.Fatalf("Rollup: %v", err)
+	}
+
+	samples, err := s.Samples(day, day.Add(time.Hour))
+	if err != nil || len(samples) != 12 {
+		t.Fatalf("Samples got=%d err=%v want=12", len(samples), err)
+	}
+	intervals, err := s.Intervals(FiveMinutes, day, day.AddDate(0, 0, 1))
+	if err != nil || len(intervals) != 288 {
+		t.Fatalf("Intervals(5m) got=%d err=%v want=288", len(intervals), err)
+	}
+	daily, err := s.Intervals(Daily, day, day.AddDate(0, 0, 1))
+	if err != nil || len(daily) != 1 {
+		t.Fatalf("Intervals(daily) got=%d err=%v want=1", len(daily), err)
+	}
+	if math.Abs(daily[0].LoadWh-1200*24) > 1e-6 || daily[0].Duration != 24*time.Hour {
+		t.Errorf("daily got=%+v want 28.8kWh", daily[0])
+	}
+
+	// Backfilled data replaces the matching interval and updates the daily rollup.
+	backfill := intervals[0]
+	backfill.LoadWh += 1000
+	backfill.Source = "calendar_history"
+	if err = s.PutIntervals(FiveMinutes, []Interval{backfill}); err != nil {
+		t.Fatalf("PutIntervals: %v", err)
+	}
+	daily, err = s.Intervals(Daily, day, day.AddDate(0, 0, 1))
+	if err != nil || math.Abs(daily[0].LoadWh-(1200*24+1000)) > 1e-6 || daily[0].Source != "mixed" {
+		t.Errorf("daily after backfill got=%+v err=%v", daily, err)
+	}
+
+	s.Retention = Retention{Raw: 24 * time.Hour}
+	// The poll at 01:02 is followed by a gap until 01:30, covering only part of 01:15.
+	// That interval comes from backfill and must survive the next Rollup.
+	next := day.AddDate(0, 0, 1)
+	for _, m := range []time.Duration{62, 90} {
+		if err = s.Record(Sample{Time: next.Add(m * time.Minute), LoadPower: 1200, GridPower: 1200}); err != nil {
+			t.Fatalf("Record: %v", err)
+		}
+	}
+	backfill = Interval{Start: next.Add(75 * time.Minute), Duration: FiveMinutes, LoadWh: 100, Source: "calendar_history"}
+	if err = s.PutIntervals(FiveMinutes, []Interval{backfill}); err != nil {
+		t.Fatalf("PutIntervals: %v", err)
+	}
+	if err = s.Rollup(next.Add(12 * time.Hour)); err != nil {
+		t.Fatalf("Rollup: %v", err)
+	}
+	intervals, err = s.Intervals(FiveMinutes, next.Add(time.Hour), next.Add(2*time.Hour))
+	if err != nil || len(intervals) != 4 || intervals[3].Source != "calendar_history" || intervals[3].LoadWh != 100 {
+		t.Errorf("Intervals around the gap got=%+v err=%v, want 01:00 to 01:10 from polls and 01:15 from backfill", intervals, err)
+	}
+
+	if err = s.Rollup(day.AddDate(0, 0, 3)); err != nil {
+		t.Fatalf("Rollup: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "raw", "2024-03-07.jsonl")); !os.IsNotExist(err) {
+		t.Errorf("raw history was not pruned: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "5m", "2024-03-07.jsonl")); err != nil {
+		t.Errorf("5m history was pruned: %v", err)
+	}
+}
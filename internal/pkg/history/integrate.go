@@ -0,0 +1,112 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package history
+
+import (
+	"sort"
+	"time"
+)
+
+// Integrate turns instantaneous samples into interval energy. Each sample's power is held
+// until the next sample, or for at most MaxGap, and split across intervals of length
+// period. The last sample has nothing after it and contributes no energy.
+func Integrate(samples []Sample, period time.Duration) []Interval {
+	intervals, _ := integrate(samples, period)
+	return intervals
+}
+
+// integrate also returns how much of each interval the samples cover, which is less than
+// period at the edges of a gap.
+func integrate(samples []Sample, period time.Duration) ([]Interval, []time.Duration) {
+	samples = append([]Sample(nil), samples...)
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Time.Before(samples[j].Time) })
+
+	byStart := make(map[int64]*Interval)
+	covered := make(map[int64]time.Duration)
+	var starts []int64
+	for idx := 0; idx+1 < len(samples); idx++ {
+		sample := samples[idx]
+		end := samples[idx+1].Time
+		if end.Sub(sample.Time) > MaxGap {
+			end = sample.Time.Add(MaxGap)
+		}
+
+		for t := sample.Time; t.Before(end); {
+			start := t.Truncate(period)
+			next := start.Add(period)
+			if next.After(end) {
+				next = end
+			}
+
+			interval, ok := byStart[start.Unix()]
+			if !ok {
+				interval = &Interval{Start: start, Duration: period, Source: "poll"}
+				byStart[start.Unix()] = interval
+				starts = append(starts, start.Unix())
+			}
+			covered[start.Unix()] += next.Sub(t)
+			hours := next.Sub(t).Hours()
+			addPower(interval, sample, hours)
+			if sample.OffGrid() {
+				interval.OffGrid += next.Sub(t)
+			}
+			interval.EnergyLeft = sample.EnergyLeft
+			interval.PercentageCharged = sample.PercentageCharged
+			t = next
+		}
+	}
+
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	intervals := make([]Interval, len(starts))
+	coverage := make([]time.Duration, len(starts))
+	for idx, start := range starts {
+		intervals[idx] = *byStart[start]
+		coverage[idx] = covered[start]
+	}
+	return intervals, coverage
+}
+
+func addPower(interval *Interval, sample Sample, hours float64) {
+	if sample.SolarPower > 0 {
+		interval.SolarWh += sample.SolarPower * hours
+	}
+	interval.LoadWh += sample.LoadPower * hours
+	if sample.GridPower > 0 {
+		interval.GridImportWh += sample.GridPower * hours
+	} else {
+		interval.GridExportWh -= sample.GridPower * hours
+	}
+	if sample.BatteryPower > 0 {
+		interval.BatteryDischargeWh += sample.BatteryPower * hours
+	} else {
+		interval.BatteryChargeWh -= sample.BatteryPower * hours
+	}
+}
+
+// Sum combines consecutive intervals into one spanning all of them. The battery state
+// is taken from the last interval which reported it.
+func Sum(intervals []Interval) Interval {
+	if len(intervals) == 0 {
+		return Interval{}
+	}
+	sum := Interval{Start: intervals[0].Start, Source: intervals[0].Source}
+	for _, i := range intervals {
+		sum.SolarWh += i.SolarWh
+		sum.LoadWh += i.LoadWh
+		sum.GridImportWh += i.GridImportWh
+		sum.GridExportWh += i.GridExportWh
+		sum.BatteryChargeWh += i.BatteryChargeWh
+		sum.BatteryDischargeWh += i.BatteryDischargeWh
+		sum.OffGrid += i.OffGrid
+		if i.EnergyLeft != 0 || i.PercentageCharged != 0 {
+			sum.EnergyLeft = i.EnergyLeft
+			sum.PercentageCharged = i.PercentageCharged
+		}
+		if i.Source != sum.Source {
+			sum.Source = "mixed"
+		}
+	}
+	sum.Duration = intervals[len(intervals)-1].End().Sub(sum.Start)
+	return sum
+}
@@ -0,0 +1,354 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package loadforecast predicts how much energy the house will draw over the next day or
+// two, learned from the history of LoadPower by season, weekday and hour.
+package loadforecast
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/forecast"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+)
+
+// Sample is a measurement of house load at Time. TemperatureC is the outdoor temperature
+// at the time, or NaN if not known. Our heat pumps dominate the load, so temperature
+// explains much of the difference between one winter day and the next.
+type Sample struct {
+	Time         time.Time
+	Watts        float64
+	TemperatureC float64
+}
+
+// Temperature is a forecast outdoor temperature from Time until the next entry.
+type Temperature struct {
+	Time         time.Time
+	TemperatureC float64
+}
+
+// Hour is the predicted energy use in the hour starting at Start. Low and High bound
+// the 10th and 90th percentiles.
+type Hour struct {
+	Start time.Time
+	KWh   float64
+	Low   float64
+	High  float64
+}
+
+// z-score of the 90th percentile of a normal distribution.
+const z90 = 1.2816
+
+// Minimum observations for a bucket or temperature fit to be trusted. A bucket for one
+// day of the week needs as many as a temperature fit, with less data the weekday/weekend
+// bucket is used.
+const (
+	minBucketHours      = 3
+	minTemperatureHours = 10
+	minDayHours         = minTemperatureHours
+)
+
+// Besides time.Weekday, key.day can group all weekdays or both weekend days.
+const (
+	weekdays = 7
+	weekends = 8
+)
+
+type key struct {
+	season int // 0=winter (Dec-Feb), 1=spring, 2=summer, 3=autumn
+	day    int
+	hour   int
+}
+
+func keyFor(t time.Time) key {
+	return key{
+		season: (int(t.Month()) % 12) / 3,
+		day:    int(t.Weekday()),
+		hour:   t.Hour(),
+	}
+}
+
+// dayType returns the key for the same hour on all weekdays, or on both weekend days.
+func (k key) dayType() key {
+	if k.day == int(time.Saturday) || k.day == int(time.Sunday) {
+		k.day = weekends
+	} else {
+		k.day = weekdays
+	}
+	return k
+}
+
+type observation struct {
+	kwh  float64
+	temp float64
+}
+
+// bucket models energy use in one hour as a linear function of temperature. Without
+// temperature data, slope is zero and the model is the mean.
+type bucket struct {
+	n         int
+	intercept float64
+	slope     float64
+	meanTemp  float64
+	stddev    float64
+}
+
+func fit(obs []observation) bucket {
+	b := bucket{n: len(obs)}
+	sumKWh := 0.0
+	for _, o := range obs {
+		sumKWh += o.kwh
+	}
+	b.intercept = sumKWh / float64(len(obs))
+
+	var withTemp []observation
+	for _, o := range obs {
+		if !math.IsNaN(o.temp) {
+			withTemp = append(withTemp, o)
+		}
+	}
+	if len(withTemp) >= minTemperatureHours {
+		var sx, sy, sxx, sxy float64
+		for _, o := range withTemp {
+			sx += o.temp
+			sy += o.kwh
+			sxx += o.temp * o.temp
+			sxy += o.temp * o.kwh
+		}
+		n := float64(len(withTemp))
+		variance := sxx/n - (sx/n)*(sx/n)
+		if variance > 1.0 {
+			b.slope = (sxy/n - (sx/n)*(sy/n)) / variance
+			b.meanTemp = sx / n
+			b.intercept = sy / n
+		}
+	}
+
+	sumSq := 0.0
+	for _, o := range obs {
+		r := o.kwh - b.predict(o.temp)
+		sumSq += r * r
+	}
+	if len(obs) > 1 {
+		b.stddev = math.Sqrt(sumSq / float64(len(obs)-1))
+	}
+	return b
+}
+
+func (b bucket) predict(temp float64) float64 {
+	if math.IsNaN(temp) || b.slope == 0 {
+		return b.intercept
+	}
+	return b.intercept + b.slope*(temp-b.meanTemp)
+}
+
+// Model is a trained load forecaster.
+type Model struct {
+	loc     *time.Location
+	buckets map[key]bucket
+	byHour  [24]bucket
+	overall bucket
+}
+
+// Train builds a Model from load history. Samples are averaged into hourly energy in
+// loc, hours without any samples are ignored.
+func Train(samples []Sample, loc *time.Location) (*Model, error) {
+	type accum struct {
+		watts, temp float64
+		n, nTemp    int
+	}
+	hours := make(map[int64]*accum)
+	for _, s := range samples {
+		h := s.Time.Truncate(time.Hour).Unix()
+		a, ok := hours[h]
+		if !ok {
+			a = &accum{}
+			hours[h] = a
+		}
+		a.watts += s.Watts
+		a.n++
+		if !math.IsNaN(s.TemperatureC) {
+			a.temp += s.TemperatureC
+			a.nTemp++
+		}
+	}
+	if len(hours) == 0 {
+		return nil, fmt.Errorf("no load history to train on")
+	}
+
+	byKey := make(map[key][]observation)
+	var byHour [24][]observation
+	var all []observation
+	for h, a := range hours {
+		o := observation{kwh: a.watts / float64(a.n) / 1000.0, temp: math.NaN()}
+		if a.nTemp > 0 {
+			o.temp = a.temp / float64(a.nTemp)
+		}
+		k := keyFor(time.Unix(h, 0).In(loc))
+		byKey[k] = append(byKey[k], o)
+		byKey[k.dayType()] = append(byKey[k.dayType()], o)
+		byHour[k.hour] = append(byHour[k.hour], o)
+		all = append(all, o)
+	}
+
+	m := &Model{loc: loc, buckets: make(map[key]bucket), overall: fit(all)}
+	for k, obs := range byKey {
+		min := minBucketHours
+		if k.day < weekdays {
+			min = minDayHours
+		}
+		if len(obs) >= min {
+			m.buckets[k] = fit(obs)
+		}
+	}
+	for h, obs := range byHour {
+		if len(obs) > 0 {
+			m.byHour[h] = fit(obs)
+		}
+	}
+	return m, nil
+}
+
+func (m *Model) bucketFor(t time.Time) bucket {
+	k := keyFor(t.In(m.loc))
+	if b, ok := m.buckets[k]; ok {
+		return b
+	}
+	if b, ok := m.buckets[k.dayType()]; ok {
+		return b
+	}
+	if b := m.byHour[k.hour]; b.n > 0 {
+		return b
+	}
+	return m.overall
+}
+
+// Predict returns an hourly forecast for hours hours starting with the hour containing
+// start. temperatures may be nil, or sorted by Time.
+func (m *Model) Predict(start time.Time, hours int, temperatures []Temperature) []Hour {
+	start = start.Truncate(time.Hour)
+	forecast := make([]Hour, hours)
+	for idx := range forecast {
+		t := start.Add(time.Duration(idx) * time.Hour)
+		b := m.bucketFor(t)
+		kwh := math.Max(0.0, b.predict(temperatureAt(temperatures, t.Add(30*time.Minute))))
+		forecast[idx] = Hour{
+			Start: t,
+			KWh:   kwh,
+			Low:   math.Max(0.0, kwh-z90*b.stddev),
+			High:  kwh + z90*b.stddev,
+		}
+	}
+	return forecast
+}
+
+func temperatureAt(temperatures []Temperature, t time.Time) float64 {
+	idx := sort.Search(len(temperatures), func(i int) bool {
+		return temperatures[i].Time.After(t)
+	})
+	if idx == 0 {
+		return math.NaN()
+	}
+	return temperatures[idx-1].TemperatureC
+}
+
+// SamplesFromIntervals turns stored history into Samples of the average load over each
+// interval, without temperature.
+func SamplesFromIntervals(intervals []history.Interval) []Sample {
+	samples := make([]Sample, 0, len(intervals))
+	for _, i := range intervals {
+		if i.Duration <= 0 {
+			continue
+		}
+		samples = append(samples, Sample{
+			Time:         i.Start,
+			Watts:        i.LoadWh / i.Duration.Hours(),
+			TemperatureC: math.NaN(),
+		})
+	}
+	return samples
+}
+
+// ReadSamplesCSV reads load history from CSV with a header row. The "time" column holds
+// RFC3339 timestamps or Unix seconds, "load_watts" holds power. An optional
+// "temperature_c" column holds outdoor temperature, which may be left empty.
+func ReadSamplesCSV(r io.Reader) ([]Sample, error) {
+	var samples []Sample
+	err := readCSV(r, "load_watts", func(t time.Time, watts, temp float64) {
+		samples = append(samples, Sample{Time: t, Watts: watts, TemperatureC: temp})
+	})
+	return samples, err
+}
+
+// ReadTemperaturesCSV reads a temperature forecast from CSV with "time" and
+// "temperature_c" columns.
+func ReadTemperaturesCSV(r io.Reader) ([]Temperature, error) {
+	var temperatures []Temperature
+	err := readCSV(r, "", func(t time.Time, _, temp float64) {
+		if !math.IsNaN(temp) {
+			temperatures = append(temperatures, Temperature{Time: t, TemperatureC: temp})
+		}
+	})
+	sort.Slice(temperatures, func(i, j int) bool {
+		return temperatures[i].Time.Before(temperatures[j].Time)
+	})
+	return temperatures, err
+}
+
+func readCSV(r io.Reader, valueName string, add func(t time.Time, value, temp float64)) error {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return err
+	}
+	timeCol, valueCol, tempCol := -1, -1, -1
+	for idx, name := range header {
+		switch strings.TrimSpace(name) {
+		case "time":
+			timeCol = idx
+		case "temperature_c":
+			tempCol = idx
+		case valueName:
+			valueCol = idx
+		}
+	}
+	if timeCol < 0 || (valueName != "" && valueCol < 0) || (valueName == "" && tempCol < 0) {
+		return fmt.Errorf("CSV is missing required columns, got %v", header)
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		t, err := forecast.ParseTime(record[timeCol])
+		if err != nil {
+			return err
+		}
+		value := 0.0
+		if valueCol >= 0 {
+			value, err = strconv.ParseFloat(strings.TrimSpace(record[valueCol]), 64)
+			if err != nil {
+				return err
+			}
+		}
+		temp := math.NaN()
+		if tempCol >= 0 && strings.TrimSpace(record[tempCol]) != "" {
+			temp, err = strconv.ParseFloat(strings.TrimSpace(record[tempCol]), 64)
+			if err != nil {
+				return err
+			}
+		}
+		add(t, value, temp)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package loadforecast
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPredict(t *testing.T) {
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatalf("LoadLocation: %v", err)
+	}
+
+	// Eight winter weeks where the heat pumps draw 200W more for every degree below 15C
+	// overnight, and the weekend daytime load is a steady 3kW.
+	var samples []Sample
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, loc)
+	for ts := start; ts.Before(start.AddDate(0, 0, 56)); ts = ts.Add(15 * time.Minute) {
+		temp := 5.0 + float64(ts.YearDay()%10)
+		watts := 1000.0 + 200.0*(15.0-temp)
+		if ts.Hour() >= 8 && ts.Hour() < 20 {
+			temp = math.NaN()
+			watts = 500.0
+			if ts.Weekday() == time.Saturday || ts.Weekday() == time.Sunday {
+				watts = 3000.0
+			}
+		}
+		samples = append(samples, Sample{Time: ts, Watts: watts, TemperatureC: temp})
+	}
+
+	m, err := Train(samples, loc)
+	if err != nil {
+		t.Fatalf("Train: %v", err)
+	}
+
+	saturday := time.Date(2024, 2, 24, 0, 0, 0, 0, loc)
+	temperatures := []Temperature{{Time: saturday.Add(-time.Hour), TemperatureC: 0.0}}
+	forecast := m.Predict(saturday, 48, temperatures)
+	if len(forecast) != 48 {
+		t.Fatalf("len(Predict) got=%d want=48", len(forecast))
+	}
+	if got := forecast[2].KWh; math.Abs(got-4.0) > 0.01 {
+		t.Errorf("Predict at 0C overnight got=%.2f want=4.0", got)
+	}
+	if got := forecast[12].KWh; math.Abs(got-3.0) > 0.01 {
+		t.Errorf("Predict Saturday noon got=%.2f want=3.0", got)
+	}
+	for _, h := range forecast {
+		if h.Low > h.KWh || h.High < h.KWh {
+			t.Errorf("Predict %v band %.2f <= %.2f <= %.2f violated", h.Start, h.Low, h.KWh, h.High)
+		}
+	}
+
+	monday := m.Predict(time.Date(2024, 2, 26, 12, 0, 0, 0, loc), 1, nil)
+	if got := monday[0].KWh; math.Abs(got-0.5) > 0.01 {
+		t.Errorf("Predict Monday noon got=%.2f want=0.5", got)
+	}
+}
+
+func TestPredictByWeekday(t *testing.T) {
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatalf("LoadLocation: %v", err)
+	}
+
+	// Twelve summer weeks working from home on Fridays.
+	var samples []Sample
+	start := time.Date(2024, 6, 3, 0, 0, 0, 0, loc)
+	for ts := start; ts.Before(start.AddDate(0, 0, 84)); ts = ts.Add(time.Hour) {
+		watts := 500.0
+		if ts.Weekday() == time.Friday {
+			watts = 1500.0
+		}
+		samples = append(samples, Sample{Time: ts, Watts: watts, TemperatureC: math.NaN()})
+	}
+	m, err := Train(samples, loc)
+	if err != nil {
+		t.Fatalf("Train: %v", err)
+	}
+	for _, tc := range []struct {
+		day  int
+		want float64
+	}{{26, 0.5}, {30, 1.5}} {
+		if got := m.Predict(time.Date(2024, 8, tc.day, 12, 0, 0, 0, loc), 1, nil)[0].KWh; math.Abs(got-tc.want) > 0.01 {
+			t.Errorf("Predict August %d noon got=%.2f want=%.2f", tc.day, got, tc.want)
+		}
+	}
+
+	// With only eight weeks, Fridays fall back to the weekday average.
+	m, err = Train(samples[:8*7*24], loc)
+	if err != nil {
+		t.Fatalf("Train: %v", err)
+	}
+	if got := m.Predict(time.Date(2024, 8, 30, 12, 0, 0, 0, loc), 1, nil)[0].KWh; math.Abs(got-0.7) > 0.01 {
+		t.Errorf("Predict Friday from eight weeks got=%.2f want=0.70", got)
+	}
+}
+
+func TestReadSamplesCSV(t *testing.T) {
+	csv := "time,load_watts,temperature_c\n" +
+		"2024-01-01T00:00:00Z,1500,4.5\n" +
+		"1704070800,1200,\n"
+	samples, err := ReadSamplesCSV(strings.NewReader(csv))
+	if err != nil {
+		t.Fatalf("ReadSamplesCSV: %v", err)
+	}
+	if len(samples) != 2 || samples[0].TemperatureC != 4.5 || !math.IsNaN(samples[1].TemperatureC) {
+		t.Errorf("ReadSamplesCSV got=%+v", samples)
+	}
+	if !samples[1].Time.Equal(time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC)) {
+		t.Errorf("ReadSamplesCSV time got=%v", samples[1].Time)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Device groups entities in Home Assistant.
+type Device struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+}
+
+// Entity is one Home Assistant entity configured by MQTT discovery.
+// https://www.home-assistant.io/integrations/mqtt/#mqtt-discovery
+type Entity struct {
+	// sensor, binary_sensor, number, select...
+	Component string
+
+	// Unique within the Device, used in the discovery topic and unique_id.
+	ObjectID string
+
+	// The rest of the config, such as name, state_topic, value_template, device_class
+	// and command_topic.
+	Config map[string]interface{}
+}
+
+// Discovery returns the retained config message for each entity, under prefix (usually
+// "homeassistant"). Each entity is tied to device and to the availability topic.
+func Discovery(prefix string, device Device, availability string, entities []Entity) ([]Message, error) {
+	node := device.Identifiers[0]
+	var messages []Message
+	for _, e := range entities {
+		config := map[string]interface{}{
+			"unique_id":          node + "_" + e.ObjectID,
+			"object_id":          node + "_" + e.ObjectID,
+			"device":             device,
+			"availability_topic": availability,
+		}
+		for k, v := range e.Config {
+			config[k] = v
+		}
+		b, err := json.Marshal(config)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, Message{
+			Topic:   fmt.Sprintf("%s/%s/%s/%s/config", prefix, e.Component, node, e.ObjectID),
+			Payload: b,
+			Retain:  true,
+		})
+	}
+	return messages, nil
+}
@@ -0,0 +1,322 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package mqtt is a small MQTT 3.1.1 client, enough to publish state to a broker and
+// receive commands from it at QoS 0. It doesn't reconnect by itself, the caller watches
+// Done and connects again.
+// https://docs.oasis-open.org/mqtt/mqtt/v3.1.1/mqtt-v3.1.1.html
+package mqtt
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Control packet types.
+const (
+	connect    = 1
+	connack    = 2
+	publish    = 3
+	subscribe  = 8
+	suback     = 9
+	pingreq    = 12
+	pingresp   = 13
+	disconnect = 14
+)
+
+// Message is a published message.
+type Message struct {
+	Topic   string
+	Payload []byte
+	Retain  bool
+}
+
+// Client is one connection to a broker.
+type Client struct {
+	// host:port, optionally prefixed by tcp://, or by ssl:// or tls:// for TLS.
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+
+	// Defaults to 60 seconds.
+	KeepAlive time.Duration
+
+	// Published by the broker if the connection is lost, for an availability topic.
+	Will *Message
+
+	// Called for each message received on a subscribed topic, from the goroutine
+	// reading the connection. It must not block for long.
+	OnMessage func(m Message)
+
+	mu       sync.Mutex
+	conn     net.Conn
+	packetID uint16
+	done     chan struct{}
+	err      error
+}
+
+func appendString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// packet frames a body with its fixed header.
+func packet(header byte, body []byte) []byte {
+	b := []byte{header}
+	n := len(body)
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			break
+		}
+	}
+	return append(b, body...)
+}
+
+func readPacket(r *bufio.Reader) (header byte, body []byte, err error) {
+	if header, err = r.ReadByte(); err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+		if i >= 3 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+	}
+	body = make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+func (c *Client) keepAlive() time.Duration {
+	if c.KeepAlive <= 0 {
+		return 60 * time.Second
+	}
+	return c.KeepAlive
+}
+
+func (c *Client) dial() (net.Conn, error) {
+	addr := c.Broker
+	switch {
+	case strings.HasPrefix(addr, "ssl://"), strings.HasPrefix(addr, "tls://"):
+		addr = addr[6:]
+		host, _, _ := net.SplitHostPort(addr)
+		return tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", addr, &tls.Config{ServerName: host})
+	case strings.HasPrefix(addr, "tcp://"):
+		addr = addr[6:]
+	}
+	return net.DialTimeout("tcp", addr, 10*time.Second)
+}
+
+// Connect opens the connection and waits for the broker to accept it.
+func (c *Client) Connect() error {
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+
+	body := appendString(nil, "MQTT")
+	body = append(body, 4) // protocol level 3.1.1
+	flags := byte(0x02)    // clean session
+	if c.Will != nil {
+		flags |= 0x04
+		if c.Will.Retain {
+			flags |= 0x20
+		}
+	}
+	if c.Username != "" {
+		flags |= 0x80
+		if c.Password != "" {
+			flags |= 0x40
+		}
+	}
+	keepAlive := int(c.keepAlive().Seconds())
+	body = append(body, flags, byte(keepAlive>>8), byte(keepAlive))
+	body = appendString(body, c.ClientID)
+	if c.Will != nil {
+		body = appendString(body, c.Will.Topic)
+		body = appendString(body, string(c.Will.Payload))
+	}
+	if c.Username != "" {
+		body = appendString(body, c.Username)
+		if c.Password != "" {
+			body = appendString(body, c.Password)
+		}
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err = conn.Write(packet(connect<<4, body)); err != nil {
+		conn.Close()
+		return err
+	}
+	r := bufio.NewReader(conn)
+	header, ack, err := readPacket(r)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if header>>4 != connack || len(ack) != 2 {
+		conn.Close()
+		return fmt.Errorf("expected CONNACK, got packet type %d", header>>4)
+	}
+	if ack[1] != 0 {
+		conn.Close()
+		return fmt.Errorf("broker refused connection, return code %d", ack[1])
+	}
+	conn.SetDeadline(time.Time{})
+
+	c.mu.Lock()
+	c.conn = conn
+	c.done = make(chan struct{})
+	c.err = nil
+	c.mu.Unlock()
+	go c.read(conn, r)
+	go c.ping()
+	return nil
+}
+
+// Done is closed when the connection is lost. Err then says why.
+func (c *Client) Done() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.done
+}
+
+// Err returns why the connection was lost, nil while it is up.
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return
+	}
+	c.err = err
+	c.conn.Close()
+	c.conn = nil
+	close(c.done)
+}
+
+// read gives up on a broker which has sent nothing, not even a PINGRESP, for one and a
+// half keepalive periods. A broker which went away without closing the connection would
+// otherwise never be noticed.
+func (c *Client) read(conn net.Conn, r *bufio.Reader) {
+	for {
+		conn.SetReadDeadline(time.Now().Add(c.keepAlive() * 3 / 2))
+		header, body, err := readPacket(r)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if header>>4 != publish || len(body) < 2 {
+			continue // SUBACK, PINGRESP
+		}
+		n := int(binary.BigEndian.Uint16(body))
+		if len(body) < 2+n {
+			continue
+		}
+		m := Message{Topic: string(body[2 : 2+n]), Retain: header&0x01 != 0}
+		payload := body[2+n:]
+		if qos := (header >> 1) & 0x03; qos > 0 && len(payload) >= 2 {
+			payload = payload[2:] // packet identifier, we only subscribe at QoS 0
+		}
+		m.Payload = payload
+		if c.OnMessage != nil {
+			c.OnMessage(m)
+		}
+	}
+}
+
+func (c *Client) ping() {
+	t := time.NewTicker(c.keepAlive() / 2)
+	defer t.Stop()
+	done := c.Done()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			if err := c.write(packet(pingreq<<4, nil)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// write drops the connection if it fails, a partly written packet leaves the stream
+// unusable.
+func (c *Client) write(b []byte) error {
+	c.mu.Lock()
+	if c.conn == nil {
+		c.mu.Unlock()
+		return errors.New("mqtt: not connected")
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.conn.Write(b)
+	c.mu.Unlock()
+	if err != nil {
+		c.fail(err)
+	}
+	return err
+}
+
+// Publish sends m at QoS 0.
+func (c *Client) Publish(m Message) error {
+	header := byte(publish << 4)
+	if m.Retain {
+		header |= 0x01
+	}
+	body := appendString(nil, m.Topic)
+	body = append(body, m.Payload...)
+	return c.write(packet(header, body))
+}
+
+// Subscribe asks for messages on topics at QoS 0.
+func (c *Client) Subscribe(topics ...string) error {
+	c.mu.Lock()
+	c.packetID++
+	if c.packetID == 0 {
+		c.packetID = 1
+	}
+	id := c.packetID
+	c.mu.Unlock()
+	body := []byte{byte(id >> 8), byte(id)}
+	for _, t := range topics {
+		body = appendString(body, t)
+		body = append(body, 0)
+	}
+	return c.write(packet(subscribe<<4|0x02, body))
+}
+
+// Close disconnects cleanly, so the broker doesn't publish the Will.
+func (c *Client) Close() error {
+	err := c.write(packet(disconnect<<4, nil))
+	c.fail(errors.New("mqtt: closed"))
+	return err
+}
@@ -0,0 +1,199 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+// broker accepts one connection, records what the client sends, and publishes the
+// message in commands once the client subscribes.
+type broker struct {
+	listener   net.Listener
+	connect    []byte
+	published  chan Message
+	subscribed chan string
+	command    Message
+}
+
+func newBroker(t *testing.T, command Message) *broker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	b := &broker{listener: l, published: make(chan Message, 10), subscribed: make(chan string, 10), command: command}
+	go b.serve()
+	return b
+}
+
+func readString(b []byte) (string, []byte) {
+	n := int(binary.BigEndian.Uint16(b))
+	return string(b[2 : 2+n]), b[2+n:]
+}
+
+func (b *broker) serve() {
+	conn, err := b.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		header, body, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		switch header >> 4 {
+		case connect:
+			b.connect = body
+			conn.Write(packet(connack<<4, []byte{0, 0}))
+		case publish:
+			topic, payload := readString(body)
+			b.published <- Message{Topic: topic, Payload: payload, Retain: header&0x01 != 0}
+		case subscribe:
+			topic, _ := readString(body[2:])
+			b.subscribed <- topic
+			conn.Write(packet(suback<<4, []byte{body[0], body[1], 0}))
+			conn.Write(packet(publish<<4, append(appendString(nil, b.command.Topic), b.command.Payload...)))
+		case pingreq:
+			conn.Write(packet(pingresp<<4, nil))
+		case disconnect:
+			return
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	b := newBroker(t, Message{Topic: "powerwall/reserve/set", Payload: []byte("50")})
+	defer b.listener.Close()
+
+	received := make(chan Message, 1)
+	c := &Client{
+		Broker:    "tcp://" + b.listener.Addr().String(),
+		ClientID:  "powerwall-test",
+		Username:  "user",
+		Password:  "secret",
+		KeepAlive: time.Second,
+		Will:      &Message{Topic: "powerwall/availability", Payload: []byte("offline"), Retain: true},
+		OnMessage: func(m Message) { received <- m },
+	}
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	protocol, rest := readString(b.connect)
+	if protocol != "MQTT" || rest[0] != 4 || rest[1] != 0x02|0x04|0x20|0x40|0x80 {
+		t.Errorf("CONNECT got %q %x", protocol, rest[:2])
+	}
+	id, rest := readString(rest[4:])
+	will, rest := readString(rest)
+	_, rest = readString(rest)
+	user, rest := readString(rest)
+	password, _ := readString(rest)
+	if id != "powerwall-test" || will != "powerwall/availability" || user != "user" || password != "secret" {
+		t.Errorf("CONNECT payload got %q %q %q %q", id, will, user, password)
+	}
+
+	if err := c.Publish(Message{Topic: "powerwall/state", Payload: []byte(`{"soc": 80}`), Retain: true}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	if m := <-b.published; m.Topic != "powerwall/state" || string(m.Payload) != `{"soc": 80}` || !m.Retain {
+		t.Errorf("broker got %+v", m)
+	}
+
+	if err := c.Subscribe("powerwall/reserve/set"); err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	if topic := <-b.subscribed; topic != "powerwall/reserve/set" {
+		t.Errorf("SUBSCRIBE got %q", topic)
+	}
+	select {
+	case m := <-received:
+		if m.Topic != "powerwall/reserve/set" || string(m.Payload) != "50" {
+			t.Errorf("OnMessage got %+v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no message received")
+	}
+
+	// Survives a keepalive ping, then disconnects cleanly.
+	time.Sleep(700 * time.Millisecond)
+	if err := c.Err(); err != nil {
+		t.Errorf("connection lost: %v", err)
+	}
+	c.Close()
+	select {
+	case <-c.Done():
+	default:
+		t.Errorf("Done not closed after Close")
+	}
+	if err := c.Publish(Message{Topic: "x"}); err == nil {
+		t.Errorf("Publish after Close succeeded")
+	}
+}
+
+func TestDeadBroker(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	// Accepts the connection, then never answers a ping.
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		if _, _, err = readPacket(r); err != nil {
+			return
+		}
+		conn.Write(packet(connack<<4, []byte{0, 0}))
+		for {
+			if _, _, err = readPacket(r); err != nil {
+				return
+			}
+		}
+	}()
+
+	c := &Client{Broker: l.Addr().String(), ClientID: "powerwall-test", KeepAlive: time.Second}
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	select {
+	case <-c.Done():
+		if c.Err() == nil {
+			t.Errorf("Done closed without an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("dead broker not noticed")
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	device := Device{Identifiers: []string{"powerwall_1"}, Name: "Powerwall", Manufacturer: "Tesla"}
+	messages, err := Discovery("homeassistant", device, "powerwall/availability", []Entity{
+		{Component: "sensor", ObjectID: "solar_power", Config: map[string]interface{}{
+			"name": "Solar power", "state_topic": "powerwall/state", "unit_of_measurement": "W"}},
+	})
+	if err != nil {
+		t.Fatalf("Discovery: %v", err)
+	}
+	if len(messages) != 1 || messages[0].Topic != "homeassistant/sensor/powerwall_1/solar_power/config" || !messages[0].Retain {
+		t.Fatalf("Discovery got %+v", messages)
+	}
+	var config map[string]interface{}
+	if err = json.Unmarshal(messages[0].Payload, &config); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if config["unique_id"] != "powerwall_1_solar_power" || config["availability_topic"] != "powerwall/availability" ||
+		config["unit_of_measurement"] != "W" || config["device"].(map[string]interface{})["name"] != "Powerwall" {
+		t.Errorf("config got %v", config)
+	}
+}
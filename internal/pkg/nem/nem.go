@@ -0,0 +1,245 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package nem tracks the running balance of a PG&E net energy metering account between
+// annual true-ups, and projects what the next true-up bill will be.
+package nem
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tariff"
+)
+
+// Scheme is the net metering program the account is enrolled in.
+type Scheme int
+
+const (
+	// NEM2 credits exports at the tariff's export price, which for PG&E is the same
+	// as the import price in that period.
+	NEM2 Scheme = 2
+
+	// NEM3, the Net Billing Tariff, credits exports at the avoided cost rate for the
+	// month and hour they happen in.
+	NEM3 Scheme = 3
+)
+
+// ExportRates are avoided cost export credits in $/kWh, indexed by month (January is 0)
+// and hour of the day. The file format is a JSON array of 12 arrays of 24 numbers.
+type ExportRates [12][24]float64
+
+// ReadExportRates reads ExportRates from a JSON file.
+func ReadExportRates(filename string) (*ExportRates, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var rates ExportRates
+	if err = json.Unmarshal(b, &rates); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return &rates, nil
+}
+
+// At returns the export credit for energy sent to the grid at t, in loc.
+func (r *ExportRates) At(t time.Time, loc *time.Location) float64 {
+	local := t.In(loc)
+	return r[local.Month()-1][local.Hour()]
+}
+
+// Config describes the account.
+type Config struct {
+	Tariff *tariff.Tariff
+	Scheme Scheme
+
+	// Required for NEM3.
+	ExportRates *ExportRates
+
+	// Non-bypassable charges in $/kWh of energy imported. Export credits can never
+	// offset them.
+	NonBypassable float64
+
+	// The true-up happens every year on this month and day.
+	AnniversaryMonth time.Month
+	AnniversaryDay   int
+}
+
+// ParseAnniversary sets the true-up anniversary from a MM-DD string.
+func (c *Config) ParseAnniversary(mmdd string) error {
+	t, err := time.Parse("01-02", mmdd)
+	if err != nil {
+		return fmt.Errorf("true-up anniversary %q is not MM-DD: %v", mmdd, err)
+	}
+	c.AnniversaryMonth = t.Month()
+	c.AnniversaryDay = t.Day()
+	return nil
+}
+
+func (c *Config) location() *time.Location {
+	if c.Tariff.Location == nil {
+		return time.Local
+	}
+	return c.Tariff.Location
+}
+
+// Year returns the true-up year containing now.
+func (c *Config) Year(now time.Time) (start, end time.Time) {
+	local := now.In(c.location())
+	start = time.Date(local.Year(), c.AnniversaryMonth, c.AnniversaryDay, 0, 0, 0, 0, c.location())
+	if start.After(local) {
+		start = start.AddDate(-1, 0, 0)
+	}
+	return start, start.AddDate(1, 0, 0)
+}
+
+// Charges is what a run of intervals adds to the account.
+type Charges struct {
+	tariff.Bill
+	NonBypassable float64
+}
+
+// Add returns the sum of two sets of Charges.
+func (c Charges) Add(o Charges) Charges {
+	c.EnergyCharges += o.EnergyCharges
+	c.ExportCredits += o.ExportCredits
+	c.FixedCharges += o.FixedCharges
+	c.BaselineCredits += o.BaselineCredits
+	c.Total += o.Total
+	c.Days += o.Days
+	c.NonBypassable += o.NonBypassable
+	return c
+}
+
+// Scale multiplies all of the Charges by f.
+func (c Charges) Scale(f float64) Charges {
+	c.EnergyCharges *= f
+	c.ExportCredits *= f
+	c.FixedCharges *= f
+	c.BaselineCredits *= f
+	c.Total *= f
+	c.Days = int(math.Round(float64(c.Days) * f))
+	c.NonBypassable *= f
+	return c
+}
+
+// Balance is the running balance of the account, negative if in credit.
+func (c Charges) Balance() float64 {
+	return c.Total + c.NonBypassable
+}
+
+// TrueUp is what would be owed if the true-up happened now. Leftover credits are
+// forfeited at the true-up: they never pay for fixed or non-bypassable charges.
+func (c Charges) TrueUp() float64 {
+	energy := c.EnergyCharges - c.ExportCredits - c.BaselineCredits
+	return math.Max(0, energy) + c.FixedCharges + c.NonBypassable
+}
+
+// Charges prices grid import and export in intervals under the account's scheme.
+func (c *Config) Charges(intervals []history.Interval) Charges {
+	usage := make([]tariff.Usage, len(intervals))
+	var charges Charges
+	for idx, i := range intervals {
+		usage[idx] = tariff.Usage{
+			Start:     i.Start,
+			Duration:  i.Duration,
+			ImportKWh: i.GridImportWh / 1000.0,
+			ExportKWh: i.GridExportWh / 1000.0,
+		}
+		charges.NonBypassable += usage[idx].ImportKWh * c.NonBypassable
+	}
+	charges.Bill = c.Tariff.Cost(usage)
+	if c.Scheme == NEM3 && c.ExportRates != nil {
+		charges.ExportCredits = 0
+		for _, u := range usage {
+			charges.ExportCredits += u.ExportKWh * c.ExportRates.At(u.Start.Add(u.Duration/2), c.location())
+		}
+		charges.Total = charges.EnergyCharges - charges.ExportCredits + charges.FixedCharges - charges.BaselineCredits
+	}
+	return charges
+}
+
+// IntervalReader is satisfied by *history.Store.
+type IntervalReader interface {
+	Intervals(res time.Duration, start, end time.Time) ([]history.Interval, error)
+}
+
+// Status is where the account stands part way through a true-up year.
+type Status struct {
+	Start time.Time // last true-up
+	End   time.Time // next true-up
+	AsOf  time.Time
+
+	YearToDate Charges
+	Remaining  Charges // projected from now until End
+	Projected  Charges // YearToDate plus Remaining
+
+	// How Remaining was projected: "last year" if from the same dates a year earlier,
+	// "average" if by extrapolating the average day so far, "none" without any data.
+	Basis string
+}
+
+// Validate checks that the Scheme is known and that NEM3 has its export rates.
+func (c *Config) Validate() error {
+	switch c.Scheme {
+	case NEM2:
+	case NEM3:
+		if c.ExportRates == nil {
+			return fmt.Errorf("NEM3 requires export rates")
+		}
+	default:
+		return fmt.Errorf("unknown net metering scheme %d", c.Scheme)
+	}
+	return nil
+}
+
+// lastYearCoverage is how much of the remainder of the year must be present in last
+// year's history to use it for the projection.
+const lastYearCoverage = 0.5
+
+// Track computes the year to date balance from 5 minute history and projects the rest
+// of the year, preferably from the same dates last year because usage and production
+// are so seasonal.
+func Track(c Config, r IntervalReader, now time.Time) (Status, error) {
+	if err := c.Validate(); err != nil {
+		return Status{}, err
+	}
+	now = now.Truncate(history.FiveMinutes)
+	start, end := c.Year(now)
+	status := Status{Start: start, End: end, AsOf: now, Basis: "none"}
+
+	ytd, err := r.Intervals(history.FiveMinutes, start, now)
+	if err != nil {
+		return status, err
+	}
+	status.YearToDate = c.Charges(ytd)
+
+	lastYear, err := r.Intervals(history.FiveMinutes, now.AddDate(-1, 0, 0), end.AddDate(-1, 0, 0))
+	if err != nil {
+		return status, err
+	}
+	var lastYearCovered time.Duration
+	for idx := range lastYear {
+		lastYear[idx].Start = lastYear[idx].Start.AddDate(1, 0, 0)
+		lastYearCovered += lastYear[idx].Duration
+	}
+	remaining := float64(end.Sub(now))
+	switch {
+	case remaining > 0 && float64(lastYearCovered) >= lastYearCoverage*remaining:
+		status.Remaining = c.Charges(lastYear).Scale(remaining / float64(lastYearCovered))
+		status.Basis = "last year"
+	case len(ytd) > 0:
+		var covered time.Duration
+		for _, i := range ytd {
+			covered += i.Duration
+		}
+		status.Remaining = status.YearToDate.Scale(remaining / float64(covered))
+		status.Basis = "average"
+	}
+	status.Projected = status.YearToDate.Add(status.Remaining)
+	return status, nil
+}
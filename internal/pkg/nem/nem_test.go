@@ -0,0 +1,133 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package nem
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tariff"
+)
+
+type fakeStore []history.Interval
+
+func (f fakeStore) Intervals(res time.Duration, start, end time.Time) ([]history.Interval, error) {
+	var out []history.Interval
+	for _, i := range f {
+		if !i.Start.Before(start) && i.Start.Before(end) {
+			out = append(out, i)
+		}
+	}
+	return out, nil
+}
+
+// flat is a tariff with one price all day and no fixed charges.
+func flat(loc *time.Location) *tariff.Tariff {
+	return &tariff.Tariff{
+		Name:     "flat",
+		Location: loc,
+		Seasons: []tariff.Season{{Name: "all",
+			Months: []time.Month{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+			Periods: []tariff.Period{{Name: "all", Days: tariff.AllDays, Start: 0, End: 1440,
+				ImportPrice: 0.40, ExportPrice: 0.40}}}},
+	}
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+func TestYear(t *testing.T) {
+	loc := time.UTC
+	c := Config{Tariff: flat(loc)}
+	if err := c.ParseAnniversary("03-15"); err != nil {
+		t.Fatalf("ParseAnniversary: %v", err)
+	}
+	start, end := c.Year(time.Date(2024, 1, 10, 12, 0, 0, 0, loc))
+	if !start.Equal(time.Date(2023, 3, 15, 0, 0, 0, 0, loc)) || !end.Equal(time.Date(2024, 3, 15, 0, 0, 0, 0, loc)) {
+		t.Errorf("Year got %v - %v", start, end)
+	}
+	start, _ = c.Year(time.Date(2024, 3, 15, 0, 0, 0, 0, loc))
+	if !start.Equal(time.Date(2024, 3, 15, 0, 0, 0, 0, loc)) {
+		t.Errorf("Year on the anniversary got start %v", start)
+	}
+	if err := c.ParseAnniversary("15-03"); err == nil {
+		t.Errorf("ParseAnniversary accepted 15-03")
+	}
+}
+
+func TestCharges(t *testing.T) {
+	loc := time.UTC
+	var rates ExportRates
+	rates[0][12] = 0.05
+	noon := time.Date(2024, 1, 10, 12, 0, 0, 0, loc)
+	intervals := []history.Interval{
+		{Start: noon, Duration: time.Hour, GridExportWh: 10000},
+		{Start: noon.Add(8 * time.Hour), Duration: time.Hour, GridImportWh: 2000},
+	}
+
+	nem2 := Config{Tariff: flat(loc), Scheme: NEM2, NonBypassable: 0.03}
+	c := nem2.Charges(intervals)
+	if !near(c.ExportCredits, 4.0) || !near(c.NonBypassable, 0.06) || !near(c.Balance(), 0.8-4.0+0.06) {
+		t.Errorf("NEM2 credits=%v nbc=%v balance=%v", c.ExportCredits, c.NonBypassable, c.Balance())
+	}
+	// The leftover energy credit is forfeited, non-bypassable charges are still owed.
+	if !near(c.TrueUp(), 0.06) {
+		t.Errorf("NEM2 TrueUp=%v, want 0.06", c.TrueUp())
+	}
+
+	nem3 := Config{Tariff: flat(loc), Scheme: NEM3, ExportRates: &rates, NonBypassable: 0.03}
+	c = nem3.Charges(intervals)
+	if !near(c.ExportCredits, 0.5) || !near(c.TrueUp(), 0.8-0.5+0.06) {
+		t.Errorf("NEM3 credits=%v TrueUp=%v", c.ExportCredits, c.TrueUp())
+	}
+	if err := nem3.Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+	nem3.ExportRates = nil
+	if err := nem3.Validate(); err == nil {
+		t.Errorf("Validate accepted NEM3 without export rates")
+	}
+}
+
+func TestTrack(t *testing.T) {
+	loc := time.UTC
+	c := Config{Tariff: flat(loc), Scheme: NEM2, AnniversaryMonth: time.January, AnniversaryDay: 1}
+	now := time.Date(2024, 7, 2, 0, 0, 0, 0, loc)
+
+	// 1 kWh imported every hour this year.
+	var store fakeStore
+	for t := time.Date(2024, 1, 1, 0, 0, 0, 0, loc); t.Before(now); t = t.Add(time.Hour) {
+		store = append(store, history.Interval{Start: t, Duration: time.Hour, GridImportWh: 1000})
+	}
+	status, err := Track(c, store, now)
+	if err != nil {
+		t.Fatalf("Track: %v", err)
+	}
+	hoursSoFar := now.Sub(time.Date(2024, 1, 1, 0, 0, 0, 0, loc)).Hours()
+	if status.Basis != "average" || !near(status.YearToDate.Balance(), hoursSoFar*0.40) {
+		t.Errorf("basis=%s balance=%v", status.Basis, status.YearToDate.Balance())
+	}
+	if !near(status.Projected.Balance(), 366*24*0.40) {
+		t.Errorf("average projection=%v, want %v", status.Projected.Balance(), 366*24*0.40)
+	}
+
+	// Last year the second half of the year exported 1 kWh every 5 minutes.
+	for t := now.AddDate(-1, 0, 0); t.Before(time.Date(2024, 1, 1, 0, 0, 0, 0, loc)); t = t.Add(history.FiveMinutes) {
+		store = append(store, history.Interval{Start: t, Duration: history.FiveMinutes, GridExportWh: 1000})
+	}
+	status, err = Track(c, store, now)
+	if err != nil {
+		t.Fatalf("Track: %v", err)
+	}
+	if status.Basis != "last year" || status.Remaining.Balance() >= 0 {
+		t.Errorf("basis=%s remaining=%v", status.Basis, status.Remaining.Balance())
+	}
+	// A large credit at the true-up pays for nothing.
+	if status.Projected.TrueUp() != 0 {
+		t.Errorf("TrueUp=%v, want 0", status.Projected.TrueUp())
+	}
+}
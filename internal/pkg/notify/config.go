@@ -0,0 +1,147 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// NotifierConfig describes one notifier. Type is "smtp", "webhook" or "ntfy". Secrets
+// are read from the environment variables named by PasswordEnv and TokenEnv, so the
+// config file can be world readable.
+type NotifierConfig struct {
+	Type string `json:"type"`
+
+	// smtp
+	Addr        string   `json:"addr,omitempty"`
+	From        string   `json:"from,omitempty"`
+	To          []string `json:"to,omitempty"`
+	Username    string   `json:"username,omitempty"`
+	PasswordEnv string   `json:"password_env,omitempty"`
+
+	// webhook and ntfy
+	URL        string        `json:"url,omitempty"`
+	TokenEnv   string        `json:"token_env,omitempty"`
+	Priorities map[Event]int `json:"priorities,omitempty"`
+}
+
+// Config is the notification setup, read from JSON:
+//
+//	{
+//	  "notifiers": {
+//	    "email": {"type": "smtp", "addr": "smtp.example.com:587", "from": "powerwall@example.com",
+//	              "to": ["us@example.com"], "username": "powerwall", "password_env": "SMTP_PASSWORD"},
+//	    "phone": {"type": "ntfy", "url": "https://ntfy.sh/our-powerwall", "priorities": {"grid_outage": 4}}
+//	  },
+//	  "routes": {"grid_outage": ["email", "phone"], "low_soc": ["phone"]},
+//	  "default": ["email"],
+//	  "low_soc_percent": 30,
+//	  "fetch_failures": 3
+//	}
+type Config struct {
+	Notifiers map[string]NotifierConfig `json:"notifiers"`
+	Routes    map[Event][]string        `json:"routes"`
+	Default   []string                  `json:"default"`
+
+	// Durations such as "6h", default to 6 hours and 15 minutes.
+	Dedup     string `json:"dedup,omitempty"`
+	RateLimit string `json:"rate_limit,omitempty"`
+
+	// Thresholds for LowSoC and FetchFailures, default to 20% and 3 in a row.
+	LowSoCPercent float64 `json:"low_soc_percent,omitempty"`
+	FetchFailures int     `json:"fetch_failures,omitempty"`
+}
+
+// ReadConfig reads a Config from a JSON file.
+func ReadConfig(filename string) (*Config, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var c Config
+	if err = json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	if c.LowSoCPercent <= 0 {
+		c.LowSoCPercent = 20
+	}
+	if c.FetchFailures <= 0 {
+		c.FetchFailures = 3
+	}
+	return &c, nil
+}
+
+func (nc NotifierConfig) notifier() (Notifier, error) {
+	switch nc.Type {
+	case "smtp":
+		if nc.Addr == "" || nc.From == "" || len(nc.To) == 0 {
+			return nil, fmt.Errorf("smtp needs addr, from and to")
+		}
+		return &Email{Addr: nc.Addr, From: nc.From, To: nc.To, Username: nc.Username,
+			Password: os.Getenv(nc.PasswordEnv)}, nil
+	case "webhook":
+		if nc.URL == "" {
+			return nil, fmt.Errorf("webhook needs url")
+		}
+		return &Webhook{URL: nc.URL}, nil
+	case "ntfy":
+		if nc.URL == "" {
+			return nil, fmt.Errorf("ntfy needs url")
+		}
+		n := &Ntfy{URL: nc.URL, Priorities: nc.Priorities}
+		if nc.TokenEnv != "" {
+			n.Token = os.Getenv(nc.TokenEnv)
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("unknown notifier type %q", nc.Type)
+}
+
+// Router builds the notifiers and routes.
+func (c *Config) Router() (*Router, error) {
+	notifiers := make(map[string]Notifier)
+	for name, nc := range c.Notifiers {
+		n, err := nc.notifier()
+		if err != nil {
+			return nil, fmt.Errorf("notifier %s: %v", name, err)
+		}
+		notifiers[name] = n
+	}
+	lookup := func(names []string) ([]Notifier, error) {
+		var list []Notifier
+		for _, name := range names {
+			n, ok := notifiers[name]
+			if !ok {
+				return nil, fmt.Errorf("no notifier named %q", name)
+			}
+			list = append(list, n)
+		}
+		return list, nil
+	}
+
+	r := &Router{Routes: make(map[Event][]Notifier)}
+	var err error
+	if r.Default, err = lookup(c.Default); err != nil {
+		return nil, err
+	}
+	for event, names := range c.Routes {
+		if r.Routes[event], err = lookup(names); err != nil {
+			return nil, fmt.Errorf("route %s: %v", event, err)
+		}
+	}
+	if c.Dedup != "" {
+		if r.DedupWindow, err = time.ParseDuration(c.Dedup); err != nil {
+			return nil, fmt.Errorf("dedup: %v", err)
+		}
+	}
+	if c.RateLimit != "" {
+		if r.RateLimit, err = time.ParseDuration(c.RateLimit); err != nil {
+			return nil, fmt.Errorf("rate_limit: %v", err)
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,399 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package notify tells people when something goes wrong: by email, by a JSON webhook, or
+// by an ntfy push notification. A Router picks the notifiers for each kind of event and
+// keeps a flapping problem from sending a flood of messages.
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/fileutil"
+)
+
+// Event is the kind of thing which happened.
+type Event string
+
+const (
+	GridOutage         Event = "grid_outage"
+	LowSoC             Event = "low_soc"
+	CommandFailed      Event = "command_failed"
+	TokenRefreshFailed Event = "token_refresh_failed"
+	FetchFailures      Event = "fetch_failures"
+)
+
+// Message is one notification.
+type Message struct {
+	Event Event
+	Title string
+	Body  string
+	Time  time.Time
+
+	// Messages with the same Key are duplicates. Defaults to the Title.
+	Key string
+
+	// Resolved marks a message saying that a problem has cleared, like the grid coming
+	// back. It is never held back by the rate limit, so an alert is always followed by
+	// its all clear.
+	Resolved bool
+}
+
+func (m Message) key() string {
+	if m.Key != "" {
+		return m.Key
+	}
+	return m.Title
+}
+
+// Notifier delivers a Message somewhere.
+type Notifier interface {
+	Notify(m Message) error
+}
+
+// Email sends through an SMTP server, with PLAIN authentication if Username is set.
+type Email struct {
+	Addr     string // host:port
+	From     string
+	To       []string
+	Username string
+	Password string
+
+	// Defaults to smtp.SendMail, replaced in tests.
+	send func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+func (e *Email) Notify(m Message) error {
+	var auth smtp.Auth
+	if e.Username != "" {
+		host := e.Addr
+		if idx := strings.LastIndex(host, ":"); idx >= 0 {
+			host = host[:idx]
+		}
+		auth = smtp.PlainAuth("", e.Username, e.Password, host)
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", e.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", m.Title)
+	fmt.Fprintf(&b, "Date: %s\r\n", m.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+	b.WriteString("\r\n")
+	send := e.send
+	if send == nil {
+		send = smtp.SendMail
+	}
+	return send(e.Addr, auth, e.From, e.To, b.Bytes())
+}
+
+func post(c *http.Client, req *http.Request) error {
+	if c == nil {
+		c = http.DefaultClient
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("POST %s: status=%d %s", req.URL, res.StatusCode, body)
+	}
+	return nil
+}
+
+// Webhook POSTs the Message as JSON with event, title, body and time members.
+type Webhook struct {
+	URL  string
+	HTTP *http.Client
+}
+
+func (w *Webhook) Notify(m Message) error {
+	b, err := json.Marshal(struct {
+		Event Event     `json:"event"`
+		Title string    `json:"title"`
+		Body  string    `json:"body"`
+		Time  time.Time `json:"time"`
+	}{m.Event, m.Title, m.Body, m.Time})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return post(w.HTTP, req)
+}
+
+// Ntfy publishes to an ntfy topic, such as https://ntfy.sh/mytopic.
+// https://docs.ntfy.sh/publish/
+type Ntfy struct {
+	URL string
+
+	// Optional access token for a protected topic.
+	Token string
+
+	// Priorities by event, 1-5, defaulting to 3. Outages deserve more than the default.
+	Priorities map[Event]int
+
+	HTTP *http.Client
+}
+
+func (n *Ntfy) Notify(m Message) error {
+	req, err := http.NewRequest(http.MethodPost, n.URL, strings.NewReader(m.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", m.Title)
+	req.Header.Set("Tags", string(m.Event))
+	if p, ok := n.Priorities[m.Event]; ok {
+		req.Header.Set("Priority", fmt.Sprintf("%d", p))
+	}
+	if n.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.Token)
+	}
+	return post(n.HTTP, req)
+}
+
+// StateFilename is the name of the Router's StateFile under --statedir.
+const StateFilename = "notify-state.json"
+
+// Router sends each Message to the notifiers for its Event, or to Default if the Event
+// has no route. It drops a Message with the same key as one sent within DedupWindow, and
+// holds back any Message within RateLimit of the last one for the same Event. Flush sends
+// the latest held Message once the rate limit allows, saying how many were held back.
+type Router struct {
+	Routes  map[Event][]Notifier
+	Default []Notifier
+
+	// Default to 6 hours and 15 minutes.
+	DedupWindow time.Duration
+	RateLimit   time.Duration
+
+	// Optional JSON file keeping what was sent and held, so that the windows carry over
+	// a restart. The daemon, dispatch and cmd/notify share it, so it is read again
+	// whenever someone else has rewritten it.
+	StateFile string
+
+	mu        sync.Mutex
+	sentKeys  map[string]time.Time
+	sentEvent map[Event]time.Time
+	held      map[Event]*heldMessages
+	loaded    os.FileInfo
+}
+
+type heldMessages struct {
+	Latest Message `json:"latest"`
+	Count  int     `json:"count"`
+}
+
+type routerState struct {
+	SentKeys  map[string]time.Time    `json:"sent_keys"`
+	SentEvent map[Event]time.Time     `json:"sent_event"`
+	Held      map[Event]*heldMessages `json:"held"`
+}
+
+func (r *Router) windows() (dedup, rate time.Duration) {
+	dedup, rate = r.DedupWindow, r.RateLimit
+	if dedup <= 0 {
+		dedup = 6 * time.Hour
+	}
+	if rate <= 0 {
+		rate = 15 * time.Minute
+	}
+	return dedup, rate
+}
+
+func dedupKey(m Message) string {
+	return string(m.Event) + "\x00" + m.key()
+}
+
+// reload reads the StateFile if it changed since we last read or wrote it. On failure
+// the state in memory is the best we have.
+func (r *Router) reload() {
+	if r.sentKeys == nil {
+		r.sentKeys = make(map[string]time.Time)
+		r.sentEvent = make(map[Event]time.Time)
+		r.held = make(map[Event]*heldMessages)
+	}
+	if r.StateFile == "" {
+		return
+	}
+	fi, err := os.Stat(r.StateFile)
+	if err != nil {
+		return
+	}
+	if r.loaded != nil && os.SameFile(fi, r.loaded) && fi.ModTime().Equal(r.loaded.ModTime()) {
+		return
+	}
+	b, err := os.ReadFile(r.StateFile)
+	if err != nil {
+		return
+	}
+	var s routerState
+	if err = json.Unmarshal(b, &s); err != nil {
+		return
+	}
+	if s.SentKeys != nil {
+		r.sentKeys = s.SentKeys
+	}
+	if s.SentEvent != nil {
+		r.sentEvent = s.SentEvent
+	}
+	if s.Held != nil {
+		r.held = s.Held
+	}
+	r.loaded = fi
+}
+
+func (r *Router) save() error {
+	if r.StateFile == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(routerState{r.sentKeys, r.sentEvent, r.held}, "", " ")
+	if err != nil {
+		return err
+	}
+	if err = fileutil.WriteFileAtomic(r.StateFile, b, 0600); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(r.StateFile); err == nil {
+		r.loaded = fi
+	}
+	return nil
+}
+
+// Send delivers m unless it is a duplicate or over the rate limit, in which case it
+// returns false. Delivery errors from every notifier, and from saving the StateFile,
+// are combined.
+func (r *Router) Send(m Message) (bool, error) {
+	if m.Time.IsZero() {
+		m.Time = time.Now()
+	}
+	dedup, rate := r.windows()
+
+	r.mu.Lock()
+	r.reload()
+	key := dedupKey(m)
+	if last, ok := r.sentKeys[key]; ok && m.Time.Sub(last) < dedup {
+		r.mu.Unlock()
+		return false, nil
+	}
+	if h := r.held[m.Event]; h != nil && dedupKey(h.Latest) == key {
+		r.mu.Unlock()
+		return false, nil
+	}
+	if last, ok := r.sentEvent[m.Event]; ok && m.Time.Sub(last) < rate && !m.Resolved {
+		h := r.held[m.Event]
+		if h == nil {
+			h = &heldMessages{}
+			r.held[m.Event] = h
+		}
+		h.Latest = m
+		h.Count++
+		err := r.save()
+		r.mu.Unlock()
+		return false, err
+	}
+	// The all clear supersedes whatever was held back, which Flush would otherwise send
+	// after it as though the problem were still going on.
+	m = r.takeHeld(m)
+	if !m.Resolved {
+		r.sentEvent[m.Event] = m.Time
+	}
+	r.sentKeys[key] = m.Time
+	for k, t := range r.sentKeys {
+		if m.Time.Sub(t) >= dedup {
+			delete(r.sentKeys, k)
+		}
+	}
+	saveErr := r.save()
+	r.mu.Unlock()
+
+	return true, combine(r.deliver(m), saveErr)
+}
+
+// takeHeld notes in m how many messages for its Event were held back, and forgets them.
+func (r *Router) takeHeld(m Message) Message {
+	if h := r.held[m.Event]; h != nil {
+		m.Body += fmt.Sprintf("\n\n%d other %s notifications were held back.", h.Count, m.Event)
+		delete(r.held, m.Event)
+	}
+	return m
+}
+
+func combine(errs ...error) error {
+	var msgs []string
+	for _, err := range errs {
+		if err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	if len(msgs) > 0 {
+		return fmt.Errorf("%s", strings.Join(msgs, "; "))
+	}
+	return nil
+}
+
+// Flush sends the latest held Message for each Event whose rate limit has passed by now.
+// Call it periodically, or a held Message waits for the next one for its Event.
+func (r *Router) Flush(now time.Time) error {
+	_, rate := r.windows()
+
+	r.mu.Lock()
+	r.reload()
+	var ready []Message
+	for event, h := range r.held {
+		if now.Sub(r.sentEvent[event]) < rate {
+			continue
+		}
+		m := h.Latest
+		h.Count--
+		if h.Count > 0 {
+			m = r.takeHeld(m)
+		} else {
+			delete(r.held, event)
+		}
+		r.sentKeys[dedupKey(m)] = now
+		r.sentEvent[event] = now
+		ready = append(ready, m)
+	}
+	var errs []error
+	if len(ready) > 0 {
+		errs = append(errs, r.save())
+	}
+	r.mu.Unlock()
+
+	for _, m := range ready {
+		errs = append(errs, r.deliver(m))
+	}
+	return combine(errs...)
+}
+
+func (r *Router) deliver(m Message) error {
+	notifiers, ok := r.Routes[m.Event]
+	if !ok {
+		notifiers = r.Default
+	}
+	var errs []string
+	for _, n := range notifiers {
+		if err := n.Notify(m); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("notify %s: %s", m.Event, strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package notify
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recorder struct {
+	messages []Message
+}
+
+func (r *recorder) Notify(m Message) error {
+	r.messages = append(r.messages, m)
+	return nil
+}
+
+func TestRouter(t *testing.T) {
+	outage, other := &recorder{}, &recorder{}
+	r := &Router{Routes: map[Event][]Notifier{GridOutage: {outage}}, Default: []Notifier{other}}
+	start := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	send := func(m Message, minutes int) bool {
+		m.Time = start.Add(time.Duration(minutes) * time.Minute)
+		sent, err := r.Send(m)
+		if err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		return sent
+	}
+
+	down := Message{Event: GridOutage, Title: "Grid down"}
+	up := Message{Event: GridOutage, Title: "Grid restored", Resolved: true}
+	if !send(down, 0) || !send(Message{Event: FetchFailures, Title: "fetch failing"}, 1) {
+		t.Errorf("first messages not sent")
+	}
+	if send(down, 20) {
+		t.Errorf("duplicate sent within the dedup window")
+	}
+	if !send(up, 5) {
+		t.Errorf("resolved message held by the rate limit")
+	}
+	if send(Message{Event: GridOutage, Title: "Grid down", Key: "second"}, 8) ||
+		send(Message{Event: GridOutage, Title: "Grid down again", Key: "third"}, 10) {
+		t.Errorf("sent within the rate limit")
+	}
+	flush := func(minutes int) {
+		if err := r.Flush(start.Add(time.Duration(minutes) * time.Minute)); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+	flush(12)
+	if len(outage.messages) != 2 {
+		t.Errorf("flushed within the rate limit")
+	}
+	flush(16)
+	flush(17)
+	if !send(down, 6*60+1) {
+		t.Errorf("not sent after the dedup window")
+	}
+
+	if len(outage.messages) != 4 || len(other.messages) != 1 || other.messages[0].Event != FetchFailures {
+		t.Fatalf("routed %d outage and %d other messages", len(outage.messages), len(other.messages))
+	}
+	if held := outage.messages[2]; held.Title != "Grid down again" || !strings.Contains(held.Body, "1 other grid_outage") {
+		t.Errorf("flushed %q, %q", held.Title, held.Body)
+	}
+}
+
+func TestRouterFlapping(t *testing.T) {
+	outage := &recorder{}
+	stateFile := filepath.Join(t.TempDir(), StateFilename)
+	newRouter := func() *Router {
+		return &Router{Routes: map[Event][]Notifier{GridOutage: {outage}}, StateFile: stateFile}
+	}
+	start := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+	send := func(r *Router, key string, resolved bool, minutes int) bool {
+		sent, err := r.Send(Message{Event: GridOutage, Key: key, Title: key, Resolved: resolved, Time: at(minutes)})
+		if err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		return sent
+	}
+
+	// Outage, restore, a second outage within the rate limit, restore.
+	r := newRouter()
+	if !send(r, "down 1", false, 0) || !send(r, "up 1", true, 5) {
+		t.Errorf("first outage not sent")
+	}
+	if send(r, "down 2", false, 10) {
+		t.Errorf("second outage sent within the rate limit")
+	}
+	if !send(r, "up 2", true, 12) {
+		t.Errorf("second restore held by the rate limit")
+	}
+	if err := r.Flush(at(20)); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if n := len(outage.messages); n != 3 {
+		t.Fatalf("sent %d messages, want 3", n)
+	}
+	if last := outage.messages[2]; last.Title != "up 2" || !strings.Contains(last.Body, "1 other grid_outage") {
+		t.Errorf("last sent %q, %q, want the restore noting the held outage", last.Title, last.Body)
+	}
+
+	// A restarted daemon, or cmd/notify, picks up where the last one left off.
+	if send(newRouter(), "down 1", false, 30) {
+		t.Errorf("duplicate sent after a restart")
+	}
+	r = newRouter()
+	if !send(r, "down 3", false, 40) || send(r, "down 4", false, 45) {
+		t.Errorf("fourth outage sent within the rate limit")
+	}
+	if err := newRouter().Flush(at(56)); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if n := len(outage.messages); n != 5 || outage.messages[4].Title != "down 4" {
+		t.Fatalf("held message not flushed after a restart: %+v", outage.messages[3:])
+	}
+	// r's state in memory is out of date, it must read the file again.
+	if err := r.Flush(at(72)); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if n := len(outage.messages); n != 5 {
+		t.Errorf("held message flushed twice")
+	}
+}
+
+func TestNotifiers(t *testing.T) {
+	var got []*http.Request
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got = append(got, r)
+		bodies = append(bodies, string(b))
+	}))
+	defer server.Close()
+
+	m := Message{Event: GridOutage, Title: "Grid down", Body: "80% charged", Time: time.Unix(1700000000, 0)}
+	if err := (&Webhook{URL: server.URL + "/hook", HTTP: server.Client()}).Notify(m); err != nil {
+		t.Fatalf("Webhook: %v", err)
+	}
+	var hook map[string]string
+	if err := json.Unmarshal([]byte(bodies[0]), &hook); err != nil || hook["event"] != "grid_outage" ||
+		hook["title"] != "Grid down" {
+		t.Errorf("webhook body got %s %v", bodies[0], err)
+	}
+
+	n := &Ntfy{URL: server.URL + "/topic", Token: "tk", Priorities: map[Event]int{GridOutage: 4}, HTTP: server.Client()}
+	if err := n.Notify(m); err != nil {
+		t.Fatalf("Ntfy: %v", err)
+	}
+	if r := got[1]; r.Header.Get("Title") != "Grid down" || r.Header.Get("Priority") != "4" ||
+		r.Header.Get("Authorization") != "Bearer tk" || bodies[1] != "80% charged" {
+		t.Errorf("ntfy got %v %q", r.Header, bodies[1])
+	}
+
+	var mail string
+	e := &Email{Addr: "smtp.example.com:587", From: "pw@example.com", To: []string{"us@example.com"},
+		send: func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+			mail = string(msg)
+			return nil
+		}}
+	if err := e.Notify(m); err != nil {
+		t.Fatalf("Email: %v", err)
+	}
+	if !strings.Contains(mail, "Subject: Grid down\r\n") || !strings.Contains(mail, "\r\n\r\n80% charged") {
+		t.Errorf("email got %q", mail)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusForbidden)
+	}))
+	defer failing.Close()
+	if err := (&Webhook{URL: failing.URL, HTTP: failing.Client()}).Notify(m); err == nil {
+		t.Errorf("Webhook to a failing server succeeded")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "notify.json")
+	config := `{
+		"notifiers": {
+			"email": {"type": "smtp", "addr": "smtp.example.com:587", "from": "a@example.com", "to": ["b@example.com"]},
+			"phone": {"type": "ntfy", "url": "https://ntfy.sh/topic"}
+		},
+		"routes": {"grid_outage": ["email", "phone"]},
+		"default": ["email"],
+		"rate_limit": "5m"
+	}`
+	if err := os.WriteFile(filename, []byte(config), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	c, err := ReadConfig(filename)
+	if err != nil {
+		t.Fatalf("ReadConfig: %v", err)
+	}
+	if c.LowSoCPercent != 20 || c.FetchFailures != 3 {
+		t.Errorf("thresholds got %v %v", c.LowSoCPercent, c.FetchFailures)
+	}
+	r, err := c.Router()
+	if err != nil {
+		t.Fatalf("Router: %v", err)
+	}
+	if len(r.Routes[GridOutage]) != 2 || len(r.Default) != 1 || r.RateLimit != 5*time.Minute {
+		t.Errorf("Router got %+v", r)
+	}
+
+	c.Routes[LowSoC] = []string{"pager"}
+	if _, err = c.Router(); err == nil {
+		t.Errorf("Router accepted an unknown notifier")
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package outage records grid outages: when they started and ended, the state of the
+// battery at each end, and how much energy the house drew while islanded.
+package outage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/fileutil"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tesla"
+)
+
+// Event is one outage. End is zero while it is ongoing. The SoC fields are percentages,
+// zero if not known.
+type Event struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end,omitempty"`
+	StartSoC float64   `json:"start_soc,omitempty"`
+	EndSoC   float64   `json:"end_soc,omitempty"`
+
+	// Energy drawn by the house, and the part of it supplied by the battery, while
+	// islanded. Zero for events only known from Tesla's backup history.
+	SuppliedWh float64 `json:"supplied_wh,omitempty"`
+	BatteryWh  float64 `json:"battery_wh,omitempty"`
+
+	// "poll" for outages we saw, "backup_history" for those only Tesla saw.
+	Source string `json:"source"`
+}
+
+// Ongoing reports whether the outage has not ended yet.
+func (e Event) Ongoing() bool {
+	return e.End.IsZero()
+}
+
+// Duration returns how long the outage lasted, or has lasted so far as of now.
+func (e Event) Duration(now time.Time) time.Duration {
+	if e.Ongoing() {
+		return now.Sub(e.Start)
+	}
+	return e.End.Sub(e.Start)
+}
+
+func (e Event) overlaps(start, end time.Time) bool {
+	eventEnd := e.End
+	if e.Ongoing() {
+		eventEnd = time.Now()
+	}
+	return e.Start.Before(end) && start.Before(eventEnd)
+}
+
+// Tracker follows the stream of polls and keeps the outages in a JSON file. The daemon
+// and cmd/outages share the file, so it is read again whenever someone else has
+// rewritten it.
+type Tracker struct {
+	Filename string
+
+	mu     sync.Mutex
+	events []Event
+	loaded os.FileInfo
+}
+
+// Open reads the outages recorded in filename. A missing file is not an error.
+func Open(filename string) (*Tracker, error) {
+	t := &Tracker{Filename: filename}
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// reload reads the file if it changed since we last read or wrote it.
+func (t *Tracker) reload() error {
+	if t.Filename == "" {
+		return nil
+	}
+	fi, err := os.Stat(t.Filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// Every save renames a new file into place, so a different file means someone else
+	// saved it. The times alone are too coarse to tell.
+	if t.loaded != nil && os.SameFile(fi, t.loaded) && fi.ModTime().Equal(t.loaded.ModTime()) {
+		return nil
+	}
+	b, err := os.ReadFile(t.Filename)
+	if err != nil {
+		return err
+	}
+	var events []Event
+	if err = json.Unmarshal(b, &events); err != nil {
+		return fmt.Errorf("%s: %v", t.Filename, err)
+	}
+	t.events = events
+	t.loaded = fi
+	return nil
+}
+
+// Events returns the outages, oldest first.
+func (t *Tracker) Events() []Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reload() // on failure the events in memory are the best we have
+	return append([]Event{}, t.events...)
+}
+
+func (t *Tracker) ongoing() *Event {
+	if n := len(t.events); n > 0 && t.events[n-1].Ongoing() {
+		return &t.events[n-1]
+	}
+	return nil
+}
+
+// Observe takes each pair of consecutive polls. It returns the outage if one started or
+// ended at cur, and saves the file when that happens. An outage is taken to start at
+// the first poll which sees it; merging Tesla's backup history refines the times.
+func (t *Tracker) Observe(prev, cur history.Sample) (*Event, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+	e := t.ongoing()
+	if e != nil && prev.OffGrid() {
+		end := cur.Time
+		if end.Sub(prev.Time) > history.MaxGap {
+			end = prev.Time.Add(history.MaxGap)
+		}
+		hours := end.Sub(prev.Time).Hours()
+		e.SuppliedWh += prev.LoadPower * hours
+		if prev.BatteryPower > 0 {
+			e.BatteryWh += prev.BatteryPower * hours
+		}
+	}
+
+	switch {
+	case e == nil && cur.OffGrid():
+		t.events = append(t.events, Event{Start: cur.Time, StartSoC: cur.PercentageCharged, Source: "poll"})
+		started := t.events[len(t.events)-1]
+		return &started, t.save()
+	case e != nil && !cur.OffGrid():
+		if prev.OffGrid() {
+			e.End = cur.Time
+			e.EndSoC = cur.PercentageCharged
+		} else {
+			// It ended while we weren't polling, some time before prev. Tesla's backup
+			// history has the real time.
+			e.End = prev.Time
+			e.EndSoC = 0
+		}
+		ended := *e
+		return &ended, t.save()
+	case e != nil && prev.OffGrid():
+		// Keep the energy so far on disk, in case cmd/outages rewrites the file.
+		return nil, t.save()
+	}
+	return nil, nil
+}
+
+// MergeBackupHistory adds the outages Tesla recorded which we missed, and takes Tesla's
+// start and end times for those we saw, as they are more precise than our polls. An
+// outage we still think is ongoing is closed if Tesla saw it end. It returns how many
+// outages were added.
+func (t *Tracker) MergeBackupHistory(events []tesla.BackupEvent) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.reload(); err != nil {
+		return 0, err
+	}
+	added, changed := 0, false
+	for _, b := range events {
+		matched := false
+		for idx := range t.events {
+			e := &t.events[idx]
+			if !e.overlaps(b.Timestamp.Add(-history.MaxGap), b.End().Add(history.MaxGap)) {
+				continue
+			}
+			matched = true
+			switch {
+			case e.Ongoing():
+				// Only once Tesla has the whole outage, and not a later one which
+				// started soon after it.
+				if b.DurationMs > 0 && !e.Start.After(b.End()) {
+					e.Start, e.End, e.EndSoC = b.Timestamp, b.End(), 0
+					changed = true
+				}
+			case !e.Start.Equal(b.Timestamp) || !e.End.Equal(b.End()):
+				e.Start, e.End = b.Timestamp, b.End()
+				changed = true
+			}
+			break
+		}
+		if !matched && b.DurationMs > 0 {
+			t.events = append(t.events, Event{Start: b.Timestamp, End: b.End(), Source: "backup_history"})
+			added++
+		}
+	}
+	if added == 0 && !changed {
+		return 0, nil
+	}
+	sort.SliceStable(t.events, func(i, j int) bool { return t.events[i].Start.Before(t.events[j].Start) })
+	return added, t.save()
+}
+
+func (t *Tracker) save() error {
+	if t.Filename == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(t.events, "", " ")
+	if err != nil {
+		return err
+	}
+	if err = fileutil.WriteFileAtomic(t.Filename, b, 0644); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(t.Filename); err == nil {
+		t.loaded = fi
+	}
+	return nil
+}
+
+// Summary totals a set of outages.
+type Summary struct {
+	Count    int
+	Duration time.Duration
+	Longest  time.Duration
+}
+
+// Summarize totals events as of now, counting an ongoing outage up to now.
+func Summarize(events []Event, now time.Time) Summary {
+	var s Summary
+	for _, e := range events {
+		d := e.Duration(now)
+		s.Count++
+		s.Duration += d
+		if d > s.Longest {
+			s.Longest = d
+		}
+	}
+	return s
+}
@@ -0,0 +1,135 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package outage
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tesla"
+)
+
+func TestTracker(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "outages.json")
+	tracker, err := Open(filename)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	start := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	var samples []history.Sample
+	for m := 0; m <= 30; m += 5 {
+		s := history.Sample{Time: start.Add(time.Duration(m) * time.Minute), LoadPower: 1200,
+			GridPower: 1200, PercentageCharged: 80, GridStatus: "Active"}
+		if m >= 10 && m < 25 {
+			s.GridStatus, s.GridPower, s.BatteryPower = "Inactive", 0, 1200
+			s.PercentageCharged = 80 - float64(m-5)
+		}
+		samples = append(samples, s)
+	}
+	var changes []*Event
+	for idx := 1; idx < len(samples); idx++ {
+		e, err := tracker.Observe(samples[idx-1], samples[idx])
+		if err != nil {
+			t.Fatalf("Observe: %v", err)
+		}
+		if e != nil {
+			changes = append(changes, e)
+		}
+	}
+	if len(changes) != 2 || !changes[0].Ongoing() || changes[1].Ongoing() {
+		t.Fatalf("Observe changes got %+v", changes)
+	}
+
+	events := tracker.Events()
+	if len(events) != 1 {
+		t.Fatalf("Events got %+v", events)
+	}
+	e := events[0]
+	if !e.Start.Equal(start.Add(10*time.Minute)) || e.Duration(time.Now()) != 15*time.Minute ||
+		e.StartSoC != 75 || e.EndSoC != 80 {
+		t.Errorf("event got %+v", e)
+	}
+	if math.Abs(e.SuppliedWh-300) > 1e-6 || math.Abs(e.BatteryWh-300) > 1e-6 {
+		t.Errorf("energy got %.1f supplied %.1f battery, want 300", e.SuppliedWh, e.BatteryWh)
+	}
+
+	// Tesla's times replace ours, and an outage we missed is added.
+	backup := []tesla.BackupEvent{
+		{Timestamp: start.Add(8 * time.Minute), DurationMs: int64(19 * time.Minute / time.Millisecond)},
+		{Timestamp: start.AddDate(0, 0, -3), DurationMs: int64(2 * time.Hour / time.Millisecond)},
+	}
+	added, err := tracker.MergeBackupHistory(backup)
+	if err != nil || added != 1 {
+		t.Fatalf("MergeBackupHistory got %d %v, want 1", added, err)
+	}
+	if added, _ = tracker.MergeBackupHistory(backup); added != 0 {
+		t.Errorf("MergeBackupHistory again added %d", added)
+	}
+
+	reopened, err := Open(filename)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	events = reopened.Events()
+	if len(events) != 2 || events[0].Source != "backup_history" || !events[1].Start.Equal(start.Add(8*time.Minute)) ||
+		events[1].SuppliedWh != e.SuppliedWh {
+		t.Errorf("reopened events got %+v", events)
+	}
+	s := Summarize(events, time.Now())
+	if s.Count != 2 || s.Duration != 2*time.Hour+19*time.Minute || s.Longest != 2*time.Hour {
+		t.Errorf("Summarize got %+v", s)
+	}
+
+	// The daemon stops during an outage and restarts after it ended. Its first pair of
+	// polls are both on grid, so the end is only known to be before them.
+	down := samples[2]
+	down.Time = start.Add(time.Hour)
+	if _, err = tracker.Observe(samples[1], down); err != nil {
+		t.Fatalf("Observe: %v", err)
+	}
+	up1, up2 := samples[0], samples[0]
+	up1.Time, up2.Time = start.Add(3*time.Hour), start.Add(3*time.Hour+5*time.Minute)
+	e2, err := tracker.Observe(up1, up2)
+	if err != nil || e2 == nil || !e2.End.Equal(up1.Time) || e2.EndSoC != 0 {
+		t.Errorf("Observe after restart got %+v %v, want the end before the first poll", e2, err)
+	}
+
+	// cmd/outages merges Tesla's history into the same file, and the daemon picks it up
+	// rather than overwriting it.
+	cli, err := Open(filename)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, err = cli.MergeBackupHistory([]tesla.BackupEvent{{Timestamp: start.Add(58 * time.Minute),
+		DurationMs: int64(40 * time.Minute / time.Millisecond)}}); err != nil {
+		t.Fatalf("MergeBackupHistory: %v", err)
+	}
+	if _, err = tracker.Observe(up2, up2); err != nil {
+		t.Fatalf("Observe: %v", err)
+	}
+	events = tracker.Events()
+	if len(events) != 3 || !events[2].End.Equal(start.Add(98*time.Minute)) {
+		t.Errorf("events after a merge by another process got %+v", events)
+	}
+
+	// An outage still open when Tesla's history shows it ended is closed by the merge.
+	other, err := Open(filepath.Join(t.TempDir(), "outages.json"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, err = other.Observe(samples[1], down); err != nil {
+		t.Fatalf("Observe: %v", err)
+	}
+	if _, err = other.MergeBackupHistory([]tesla.BackupEvent{{Timestamp: start.Add(58 * time.Minute),
+		DurationMs: int64(40 * time.Minute / time.Millisecond)}}); err != nil {
+		t.Fatalf("MergeBackupHistory: %v", err)
+	}
+	if events = other.Events(); len(events) != 1 || events[0].Ongoing() || !events[0].End.Equal(start.Add(98*time.Minute)) {
+		t.Errorf("stale ongoing outage after merge got %+v", events)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package promquery is a small client for the Prometheus HTTP query API, used to pull
+// the years of sherwood_energymon_* history which Prometheus already holds.
+// https://prometheus.io/docs/prometheus/latest/querying/api/
+package promquery
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Prometheus refuses range queries of more than 11,000 points per series.
+const maxPointsPerQuery = 10000
+
+// Client queries the Prometheus server at URL, for example http://localhost:9090
+type Client struct {
+	URL  string
+	HTTP *http.Client
+}
+
+type Point struct {
+	Time  time.Time
+	Value float64
+}
+
+type Series struct {
+	Labels map[string]string
+	Points []Point
+}
+
+type response struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+	Data      struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Metric map[string]string   `json:"metric"`
+			Values [][]json.RawMessage `json:"values"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// QueryRange evaluates query at every step between start and end. Long ranges are
+// split into several requests and stitched back together.
+func (c *Client) QueryRange(query string, start, end time.Time, step time.Duration) ([]Series, error) {
+	if step <= 0 {
+		return nil, fmt.Errorf("step must be positive")
+	}
+	var series []Series
+	index := make(map[string]int)
+	chunk := step * maxPointsPerQuery
+	for s := start; !s.After(end); s = s.Add(chunk + step) {
+		e := s.Add(chunk)
+		if e.After(end) {
+			e = end
+		}
+		result, err := c.queryRange(query, s, e, step)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range result {
+			key := fmt.Sprint(r.Labels)
+			idx, ok := index[key]
+			if !ok {
+				idx = len(series)
+				index[key] = idx
+				series = append(series, Series{Labels: r.Labels})
+			}
+			series[idx].Points = append(series[idx].Points, r.Points...)
+		}
+	}
+	return series, nil
+}
+
+func (c *Client) queryRange(query string, start, end time.Time, step time.Duration) ([]Series, error) {
+	params := url.Values{}
+	params.Set("query", query)
+	params.Set("start", strconv.FormatInt(start.Unix(), 10))
+	params.Set("end", strconv.FormatInt(end.Unix(), 10))
+	params.Set("step", strconv.FormatFloat(step.Seconds(), 'f', -1, 64))
+
+	client := c.HTTP
+	if client == nil {
+		client = &http.Client{Timeout: time.Minute}
+	}
+	res, err := client.Get(c.URL + "/api/v1/query_range?" + params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var r response
+	if err = json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("query_range status=%d: %v", res.StatusCode, err)
+	}
+	if r.Status != "success" {
+		return nil, fmt.Errorf("query_range %s: %s", r.ErrorType, r.Error)
+	}
+	if r.Data.ResultType != "matrix" {
+		return nil, fmt.Errorf("query_range returned %s, not matrix", r.Data.ResultType)
+	}
+
+	series := make([]Series, 0, len(r.Data.Result))
+	for _, result := range r.Data.Result {
+		s := Series{Labels: result.Metric, Points: make([]Point, 0, len(result.Values))}
+		for _, v := range result.Values {
+			p, err := parseValue(v)
+			if err != nil {
+				return nil, err
+			}
+			s.Points = append(s.Points, p)
+		}
+		series = append(series, s)
+	}
+	return series, nil
+}
+
+// Each value is [ <unix time>, "<sample value>" ].
+func parseValue(v []json.RawMessage) (Point, error) {
+	if len(v) != 2 {
+		return Point{}, fmt.Errorf("malformed value %s", v)
+	}
+	var secs float64
+	if err := json.Unmarshal(v[0], &secs); err != nil {
+		return Point{}, err
+	}
+	var s string
+	if err := json.Unmarshal(v[1], &s); err != nil {
+		return Point{}, err
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return Point{}, err
+	}
+	return Point{Time: time.Unix(0, int64(secs*1e9)), Value: value}, nil
+}
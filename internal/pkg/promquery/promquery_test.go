@@ -0,0 +1,66 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package promquery
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryRange(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/api/v1/query_range" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.FormValue("query") == "bad(" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"status":"error","errorType":"bad_data","error":"parse error"}`)
+			return
+		}
+		start, _ := strconv.ParseInt(r.FormValue("start"), 10, 64)
+		end, _ := strconv.ParseInt(r.FormValue("end"), 10, 64)
+		step, _ := strconv.ParseInt(r.FormValue("step"), 10, 64)
+		var values []string
+		for ts := start; ts <= end; ts += step {
+			values = append(values, fmt.Sprintf(`[%d,"%d"]`, ts, ts%1000))
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"matrix","result":[`+
+			`{"metric":{"__name__":"sherwood_energymon_solar_watts"},"values":[%s]}]}}`,
+			strings.Join(values, ","))
+	}))
+	defer server.Close()
+
+	c := &Client{URL: server.URL, HTTP: server.Client()}
+	start := time.Unix(1700000000, 0)
+	end := start.Add(25000 * time.Minute)
+	series, err := c.QueryRange("sherwood_energymon_solar_watts", start, end, time.Minute)
+	if err != nil {
+		t.Fatalf("QueryRange: %v", err)
+	}
+	if requests != 3 {
+		t.Errorf("QueryRange made %d requests, want 3", requests)
+	}
+	if len(series) != 1 || len(series[0].Points) != 25001 {
+		t.Fatalf("QueryRange got %d series, want 1 with 25001 points", len(series))
+	}
+	for idx, p := range series[0].Points {
+		want := start.Add(time.Duration(idx) * time.Minute)
+		if !p.Time.Equal(want) || p.Value != float64(want.Unix()%1000) {
+			t.Fatalf("Points[%d] got=%+v want time=%v", idx, p, want)
+		}
+	}
+
+	if _, err = c.QueryRange("bad(", start, end, time.Minute); err == nil ||
+		!strings.Contains(err.Error(), "parse error") {
+		t.Errorf("QueryRange(bad) got err=%v want parse error", err)
+	}
+}
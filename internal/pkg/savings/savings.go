@@ -0,0 +1,153 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package savings works out what each day actually cost, and what it would have cost
+// with no battery or with the battery left in Tesla's default self-powered mode.
+package savings
+
+import (
+	"sort"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/battery"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tariff"
+)
+
+// Usage converts history intervals into what the tariff bills for.
+func Usage(intervals []history.Interval) []tariff.Usage {
+	usage := make([]tariff.Usage, len(intervals))
+	for idx, i := range intervals {
+		usage[idx] = tariff.Usage{
+			Start:     i.Start,
+			Duration:  i.Duration,
+			ImportKWh: i.GridImportWh / 1000.0,
+			ExportKWh: i.GridExportWh / 1000.0,
+		}
+	}
+	return usage
+}
+
+// Day compares the actual cost of one day against the counterfactuals.
+type Day struct {
+	Start       time.Time
+	Actual      tariff.Bill
+	NoBattery   tariff.Bill
+	SelfPowered tariff.Bill
+}
+
+// BatterySavings is what having the battery at all saved.
+func (d Day) BatterySavings() float64 {
+	return d.NoBattery.Total - d.Actual.Total
+}
+
+// StrategySavings is what our scheduling saved over leaving the battery in
+// self-powered mode.
+func (d Day) StrategySavings() float64 {
+	return d.SelfPowered.Total - d.Actual.Total
+}
+
+// Options for the counterfactuals.
+type Options struct {
+	Battery battery.Battery
+
+	// Tesla's default backup reserve in self-powered mode.
+	SelfPoweredReservePercent float64
+
+	// If set, energy is priced by Prices rather than the tariff's own periods.
+	Prices tariff.PriceProvider
+}
+
+// Compute returns one Day for each day of 5 minute intervals. Each day's self-powered
+// simulation starts from the state of charge the battery actually had at midnight.
+func Compute(t *tariff.Tariff, opts Options, intervals []history.Interval, loc *time.Location) []Day {
+	byDay := make(map[time.Time][]history.Interval)
+	for _, i := range intervals {
+		local := i.Start.In(loc)
+		day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+		byDay[day] = append(byDay[day], i)
+	}
+	days := make([]time.Time, 0, len(byDay))
+	for day := range byDay {
+		days = append(days, day)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+
+	var prices tariff.PriceProvider = t
+	if opts.Prices != nil {
+		prices = opts.Prices
+	}
+	var previous []history.Interval
+	report := make([]Day, 0, len(days))
+	for _, day := range days {
+		today := byDay[day]
+		initial := initialSoC(previous, today)
+		selfPowered := battery.Simulate(opts.Battery, today,
+			battery.SelfPowered{ReservePercent: opts.SelfPoweredReservePercent}, initial)
+		report = append(report, Day{
+			Start:       day,
+			Actual:      t.CostWith(prices, Usage(today)),
+			NoBattery:   t.CostWith(prices, Usage(battery.NoBattery(today))),
+			SelfPowered: t.CostWith(prices, Usage(selfPowered)),
+		})
+		previous = today
+	}
+	return report
+}
+
+// initialSoC is the charge at the end of the previous day if we have it, otherwise at
+// the end of the first interval of today.
+func initialSoC(previous, today []history.Interval) float64 {
+	if n := len(previous); n > 0 && previous[n-1].End().Equal(today[0].Start) && previous[n-1].PercentageCharged > 0 {
+		return previous[n-1].PercentageCharged
+	}
+	for _, i := range today {
+		if i.PercentageCharged > 0 {
+			return i.PercentageCharged
+		}
+	}
+	return 0.0
+}
+
+// Month is the bill for one calendar month.
+type Month struct {
+	Start time.Time
+	Bill  tariff.Bill
+}
+
+// Plan is the cost of a run of history under one tariff.
+type Plan struct {
+	Tariff *tariff.Tariff
+	Total  tariff.Bill
+	Months []Month
+}
+
+// StrategyFunc returns the battery strategy to simulate under tariff t. The best
+// schedule differs from one plan to the next.
+type StrategyFunc func(t *tariff.Tariff) battery.Strategy
+
+// ComparePlans re-simulates the battery through intervals under each tariff in turn and
+// returns the resulting bills, cheapest first.
+func ComparePlans(tariffs []*tariff.Tariff, b battery.Battery, strategy StrategyFunc,
+	intervals []history.Interval, loc *time.Location) []Plan {
+	plans := make([]Plan, 0, len(tariffs))
+	initial := initialSoC(nil, intervals)
+	for _, t := range tariffs {
+		simulated := battery.Simulate(b, intervals, strategy(t), initial)
+		byMonth := make(map[time.Time][]history.Interval)
+		for _, i := range simulated {
+			local := i.Start.In(loc)
+			month := time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, loc)
+			byMonth[month] = append(byMonth[month], i)
+		}
+		plan := Plan{Tariff: t}
+		for month, m := range byMonth {
+			plan.Months = append(plan.Months, Month{Start: month, Bill: t.Cost(Usage(m))})
+		}
+		sort.Slice(plan.Months, func(i, j int) bool { return plan.Months[i].Start.Before(plan.Months[j].Start) })
+		plan.Total = t.Cost(Usage(simulated))
+		plans = append(plans, plan)
+	}
+	sort.SliceStable(plans, func(i, j int) bool { return plans[i].Total.Total < plans[j].Total.Total })
+	return plans
+}
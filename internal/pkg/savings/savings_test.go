@@ -0,0 +1,98 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package savings
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/battery"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/tariff"
+)
+
+func TestCompute(t *testing.T) {
+	ev2a := tariff.EV2A()
+	loc := ev2a.Location
+	day := time.Date(2024, 1, 10, 0, 0, 0, 0, loc)
+
+	// A winter day: 1kW load all day, 3kW of solar from 9am to 1pm. What we actually
+	// did was hold the battery until 4pm and use it from then until midnight.
+	var intervals []history.Interval
+	for h := 0; h < 24; h++ {
+		i := history.Interval{Start: day.Add(time.Duration(h) * time.Hour), Duration: time.Hour,
+			LoadWh: 1000, PercentageCharged: 20}
+		if h >= 9 && h < 13 {
+			i.SolarWh = 3000
+			i.BatteryChargeWh = 2000
+		} else if h >= 16 {
+			i.BatteryDischargeWh = 1000
+		} else {
+			i.GridImportWh = 1000
+		}
+		intervals = append(intervals, i)
+	}
+
+	report := Compute(ev2a, Options{Battery: battery.Powerwall2(1), SelfPoweredReservePercent: 20},
+		intervals, loc)
+	if len(report) != 1 {
+		t.Fatalf("len(Compute) got=%d want=1", len(report))
+	}
+	d := report[0]
+
+	actual := 11*0.31 + 1*0.47 + 0.35
+	if math.Abs(d.Actual.Total-actual) > 1e-9 {
+		t.Errorf("Actual got=%.4f want=%.4f", d.Actual.Total, actual)
+	}
+	noBattery := 9*0.31 + 2*0.31 - 8*0.31 + 1*0.47 + 5*0.49 + 3*0.47 + 0.35
+	if math.Abs(d.NoBattery.Total-noBattery) > 1e-9 {
+		t.Errorf("NoBattery got=%.4f want=%.4f", d.NoBattery.Total, noBattery)
+	}
+	// Self-powered starts discharging at 1pm and runs out before the end of peak.
+	if d.StrategySavings() <= 0 || d.BatterySavings() <= 0 {
+		t.Errorf("savings got strategy=%.2f battery=%.2f, want both positive",
+			d.StrategySavings(), d.BatterySavings())
+	}
+}
+
+func TestComparePlans(t *testing.T) {
+	loc := tariff.EV2A().Location
+	start := time.Date(2024, 1, 30, 0, 0, 0, 0, loc)
+
+	// Three days of a flat 1kW load with no solar.
+	var intervals []history.Interval
+	for h := 0; h < 72; h++ {
+		intervals = append(intervals, history.Interval{
+			Start: start.Add(time.Duration(h) * time.Hour), Duration: time.Hour, LoadWh: 1000})
+	}
+	tariffs := []*tariff.Tariff{tariff.EELEC(), tariff.EV2A(), tariff.ETOUC()}
+	none := func(*tariff.Tariff) battery.Strategy { return battery.SelfPowered{} }
+	plans := ComparePlans(tariffs, battery.Battery{}, none, intervals, loc)
+	if len(plans) != 3 {
+		t.Fatalf("ComparePlans got %d plans, want 3", len(plans))
+	}
+	for idx := 1; idx < len(plans); idx++ {
+		if plans[idx].Total.Total < plans[idx-1].Total.Total {
+			t.Errorf("plans not sorted: %s %.2f before %s %.2f", plans[idx-1].Tariff.Name,
+				plans[idx-1].Total.Total, plans[idx].Tariff.Name, plans[idx].Total.Total)
+		}
+	}
+	for _, p := range plans {
+		if len(p.Months) != 2 || !p.Months[1].Start.Equal(time.Date(2024, 2, 1, 0, 0, 0, 0, loc)) {
+			t.Fatalf("%s months=%+v, want January and February", p.Tariff.Name, p.Months)
+		}
+		sum := p.Months[0].Bill.Total + p.Months[1].Bill.Total
+		if math.Abs(sum-p.Total.Total) > 1e-6 {
+			t.Errorf("%s months sum to %.2f, total %.2f", p.Tariff.Name, sum, p.Total.Total)
+		}
+	}
+	// EV2A: 15h off peak, 4h partial peak and 5h peak a day.
+	ev2a := 3 * (15*0.31 + 4*0.47 + 5*0.49 + 0.35)
+	for _, p := range plans {
+		if p.Tariff.Name == "EV2A" && math.Abs(p.Total.Total-ev2a) > 1e-6 {
+			t.Errorf("EV2A total %.2f, want %.2f", p.Total.Total, ev2a)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package solarhealth looks for solar production falling short of what it should be:
+// sustained underperformance from soiling or a failed string, and mid-day dropouts when
+// an inverter trips.
+package solarhealth
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/forecast"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+)
+
+// Kinds of Alert.
+const (
+	Underperformance = "underperformance"
+	Dropout          = "dropout"
+)
+
+// Alert is a stretch of time during which production was lost.
+type Alert struct {
+	Kind    string
+	Start   time.Time
+	End     time.Time
+	LostKWh float64
+	Detail  string
+}
+
+func (a Alert) String() string {
+	return fmt.Sprintf("%s %s - %s: about %.1f kWh lost, %s", a.Kind, a.Start.Format("2006-01-02 15:04"),
+		a.End.Format("2006-01-02 15:04"), a.LostKWh, a.Detail)
+}
+
+// Day is one local day of production.
+type Day struct {
+	Start       time.Time
+	MeasuredKWh float64
+	ClearSkyKWh float64
+
+	// Forecast production, and what was measured, over the intervals an archived
+	// forecast covers.
+	ForecastKWh         float64
+	ForecastMeasuredKWh float64
+}
+
+// Index is measured production as a fraction of the clear sky model. It is highest on
+// clear days, where it reflects the health of the array rather than the weather.
+func (d Day) Index() float64 {
+	if d.ClearSkyKWh <= 0 {
+		return 0
+	}
+	return d.MeasuredKWh / d.ClearSkyKWh
+}
+
+// ForecastRatio is measured production as a fraction of the forecast, and false if
+// there was no forecast.
+func (d Day) ForecastRatio() (float64, bool) {
+	if d.ForecastKWh <= 0 {
+		return 0, false
+	}
+	return d.ForecastMeasuredKWh / d.ForecastKWh, true
+}
+
+// Analyzer compares measured production against the clear sky model and archived
+// forecasts.
+type Analyzer struct {
+	// The array, ideally with its Horizon. CloudCover should be empty.
+	Site      *forecast.ClearSky
+	Forecasts []forecast.IssuedForecast
+	Location  *time.Location
+
+	// The best days in the ReferenceDays before the last SustainDays are what the array
+	// can do. If every one of the last SustainDays falls more than Threshold short of
+	// that, and short of the forecast where there is one, it is underperforming.
+	// Default to 28 days, 7 days and 0.2.
+	ReferenceDays int
+	SustainDays   int
+	Threshold     float64
+
+	// Production stopping for at least DropoutDuration while the clear sky model expects
+	// at least 15% of the array's rating is a dropout. Defaults to 10 minutes.
+	DropoutDuration time.Duration
+}
+
+func (a *Analyzer) defaults() (reference, sustain int, threshold float64, dropout time.Duration) {
+	reference, sustain, threshold, dropout = a.ReferenceDays, a.SustainDays, a.Threshold, a.DropoutDuration
+	if reference <= 0 {
+		reference = 28
+	}
+	if sustain <= 0 {
+		sustain = 7
+	}
+	if threshold <= 0 {
+		threshold = 0.2
+	}
+	if dropout <= 0 {
+		dropout = 10 * time.Minute
+	}
+	return
+}
+
+// forecastAt returns the power in kW predicted for the middle of i by the latest
+// forecast issued before i started.
+func (a *Analyzer) forecastAt(i history.Interval) (float64, bool) {
+	mid := i.Start.Add(i.Duration / 2)
+	idx := sort.Search(len(a.Forecasts), func(n int) bool { return a.Forecasts[n].Issued.After(i.Start) })
+	for n := idx - 1; n >= 0; n-- {
+		p := a.Forecasts[n].Predictions
+		j := sort.Search(len(p), func(k int) bool { return p[k].End.After(mid) })
+		if j < len(p) && !p[j].End.Add(-forecast.Period(p, j)).After(mid) {
+			return p[j].KWatts, true
+		}
+	}
+	return 0, false
+}
+
+type point struct {
+	interval   history.Interval
+	clearKW    float64
+	forecastKW float64
+	forecastOK bool
+}
+
+func (p point) measuredKW() float64 {
+	return p.interval.SolarWh / 1000.0 / p.interval.Duration.Hours()
+}
+
+// Analyze returns the days covered by intervals and any alerts, oldest first.
+func (a *Analyzer) Analyze(intervals []history.Interval) ([]Day, []Alert) {
+	loc := a.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	sorted := append([]history.Interval{}, intervals...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start.Before(sorted[j].Start) })
+
+	var days []Day
+	var points [][]point
+	for _, i := range sorted {
+		if i.Duration <= 0 {
+			continue
+		}
+		local := i.Start.In(loc)
+		start := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+		if len(days) == 0 || !days[len(days)-1].Start.Equal(start) {
+			days = append(days, Day{Start: start})
+			points = append(points, nil)
+		}
+		d := &days[len(days)-1]
+		p := point{interval: i, clearKW: a.Site.Predict(i.Start, i.End(), i.Duration)[0].KWatts}
+		p.forecastKW, p.forecastOK = a.forecastAt(i)
+		d.MeasuredKWh += i.SolarWh / 1000.0
+		d.ClearSkyKWh += p.clearKW * i.Duration.Hours()
+		if p.forecastOK {
+			d.ForecastKWh += p.forecastKW * i.Duration.Hours()
+			d.ForecastMeasuredKWh += i.SolarWh / 1000.0
+		}
+		points[len(points)-1] = append(points[len(points)-1], p)
+	}
+
+	alerts := a.underperformance(days)
+	for idx := range days {
+		alerts = append(alerts, a.dropouts(points[idx], a.referenceIndex(days, idx, 0))...)
+	}
+	sort.SliceStable(alerts, func(i, j int) bool { return alerts[i].Start.Before(alerts[j].Start) })
+	return days, alerts
+}
+
+// referenceIndex is the 90th percentile Index of the ReferenceDays ending skip days
+// before days[idx], or 0 if there are too few days with any clear sky production.
+func (a *Analyzer) referenceIndex(days []Day, idx, skip int) float64 {
+	reference, _, _, _ := a.defaults()
+	end := days[idx].Start.AddDate(0, 0, -skip)
+	start := end.AddDate(0, 0, -reference)
+	var indices []float64
+	for _, d := range days {
+		if !d.Start.Before(start) && d.Start.Before(end) && d.ClearSkyKWh > 0 {
+			indices = append(indices, d.Index())
+		}
+	}
+	if len(indices) < 5 {
+		return 0
+	}
+	sort.Float64s(indices)
+	return indices[int(math.Floor(0.9*float64(len(indices)-1)))]
+}
+
+func (a *Analyzer) underperformance(days []Day) []Alert {
+	_, sustain, threshold, _ := a.defaults()
+	var alerts []Alert
+	var current *Alert
+	lastCounted := -1
+	for idx := sustain - 1; idx < len(days); idx++ {
+		reference := a.referenceIndex(days, idx, sustain-1)
+		recent := days[idx-sustain+1 : idx+1]
+		best := 0.0
+		var forecastKWh, measured float64
+		for _, d := range recent {
+			best = math.Max(best, d.Index())
+			forecastKWh += d.ForecastKWh
+			measured += d.ForecastMeasuredKWh
+		}
+		low := reference > 0 && best < reference*(1-threshold)
+		// A forecast which expected the shortfall means it was the weather.
+		if low && forecastKWh > 0 && measured/forecastKWh >= 1-threshold {
+			low = false
+		}
+		if !low {
+			current = nil
+			continue
+		}
+
+		factor := best / reference
+		if current == nil {
+			alerts = append(alerts, Alert{Kind: Underperformance, Start: recent[0].Start})
+			current = &alerts[len(alerts)-1]
+		}
+		current.End = days[idx].Start.AddDate(0, 0, 1)
+		current.Detail = fmt.Sprintf("best day of the last %d at %.0f%% of the usual clear sky production",
+			sustain, factor*100)
+		for n := idx - sustain + 1; n <= idx; n++ {
+			if n <= lastCounted {
+				continue
+			}
+			current.LostKWh += lost(days[n], factor)
+			lastCounted = n
+		}
+	}
+	return alerts
+}
+
+// lost estimates the production lost in d, from the forecast if there is one, otherwise
+// by scaling up what was measured by the fraction of capacity which seems to be missing.
+func lost(d Day, factor float64) float64 {
+	if d.ForecastKWh > 0 {
+		return math.Max(d.ForecastKWh-d.ForecastMeasuredKWh, 0)
+	}
+	if factor <= 0 {
+		return d.ClearSkyKWh
+	}
+	return d.MeasuredKWh * (1/factor - 1)
+}
+
+// dropouts finds runs of no production in the middle of a day which was producing.
+// Islanded intervals are skipped, the Powerwall curtails solar when it is full.
+func (a *Analyzer) dropouts(points []point, reference float64) []Alert {
+	_, _, _, minimum := a.defaults()
+	if reference <= 0 {
+		reference = 1
+	}
+	var alerts []Alert
+	producing := false
+	var run []point
+	flush := func() {
+		if len(run) > 0 && run[len(run)-1].interval.End().Sub(run[0].interval.Start) >= minimum {
+			alert := Alert{Kind: Dropout, Start: run[0].interval.Start, End: run[len(run)-1].interval.End(),
+				Detail: "production stopped under a clear sky model which expected power"}
+			for _, p := range run {
+				expected := p.clearKW * reference
+				if p.forecastOK {
+					expected = p.forecastKW
+				}
+				alert.LostKWh += math.Max(expected-p.measuredKW(), 0) * p.interval.Duration.Hours()
+			}
+			alerts = append(alerts, alert)
+		}
+		run = nil
+	}
+	for _, p := range points {
+		measured := p.measuredKW()
+		expecting := p.clearKW >= 0.15*a.Site.KWp
+		switch {
+		case p.interval.OffGrid > 0:
+			flush()
+			producing = false
+		case expecting && measured < 0.02*p.clearKW && (producing || len(run) > 0):
+			run = append(run, p)
+			producing = false
+		default:
+			flush()
+			producing = p.clearKW > 0 && measured >= 0.1*p.clearKW
+		}
+	}
+	flush()
+	return alerts
+}
@@ -0,0 +1,91 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package solarhealth
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/forecast"
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+)
+
+// production is 40 days at 90% of clear sky, except for the last 7 at 50% and a
+// dropout from 11:00 to 11:30 on day 20.
+func production(site *forecast.ClearSky, start time.Time) []history.Interval {
+	var intervals []history.Interval
+	for t := start; t.Before(start.AddDate(0, 0, 40)); t = t.Add(history.FiveMinutes) {
+		factor := 0.9
+		if !t.Before(start.AddDate(0, 0, 33)) {
+			factor = 0.5
+		}
+		dropout := start.AddDate(0, 0, 20).Add(11 * time.Hour)
+		if !t.Before(dropout) && t.Before(dropout.Add(30*time.Minute)) {
+			factor = 0
+		}
+		kw := site.Predict(t, t.Add(history.FiveMinutes), history.FiveMinutes)[0].KWatts
+		intervals = append(intervals, history.Interval{Start: t, Duration: history.FiveMinutes,
+			SolarWh: kw * factor * 1000 / 12})
+	}
+	return intervals
+}
+
+func TestAnalyze(t *testing.T) {
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatalf("LoadLocation: %v", err)
+	}
+	site := &forecast.ClearSky{Latitude: 37.4, Longitude: -122.1, Tilt: 20, Azimuth: 180, KWp: 5}
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, loc)
+	intervals := production(site, start)
+
+	a := &Analyzer{Site: site, Location: loc}
+	days, alerts := a.Analyze(intervals)
+	if len(days) != 40 {
+		t.Fatalf("len(days)=%d, want 40", len(days))
+	}
+	if math.Abs(days[0].Index()-0.9) > 0.01 {
+		t.Errorf("days[0].Index()=%.3f, want 0.9", days[0].Index())
+	}
+	if len(alerts) != 2 {
+		t.Fatalf("got %d alerts, want 2: %v", len(alerts), alerts)
+	}
+
+	dropout := alerts[0]
+	wantStart := start.AddDate(0, 0, 20).Add(11 * time.Hour)
+	if dropout.Kind != Dropout || !dropout.Start.Equal(wantStart) || !dropout.End.Equal(wantStart.Add(30*time.Minute)) {
+		t.Errorf("dropout got %v", dropout)
+	}
+	clear := forecast.EnergyBetween(site.Predict(wantStart, wantStart.Add(30*time.Minute), history.FiveMinutes),
+		wantStart, wantStart.Add(30*time.Minute))
+	if math.Abs(dropout.LostKWh-0.9*clear) > 0.05 {
+		t.Errorf("dropout lost %.2f kWh, want %.2f", dropout.LostKWh, 0.9*clear)
+	}
+
+	under := alerts[1]
+	if under.Kind != Underperformance || !under.Start.Equal(start.AddDate(0, 0, 33)) ||
+		!under.End.Equal(start.AddDate(0, 0, 40)) {
+		t.Errorf("underperformance got %v", under)
+	}
+	var measured float64
+	for _, d := range days[33:] {
+		measured += d.MeasuredKWh
+	}
+	if want := measured * (0.9/0.5 - 1); math.Abs(under.LostKWh-want)/want > 0.02 {
+		t.Errorf("underperformance lost %.1f kWh, want %.1f", under.LostKWh, want)
+	}
+
+	// A forecast which expected the last week to be cloudy explains the shortfall.
+	cloudy := forecast.IssuedForecast{Source: "test", Issued: start.AddDate(0, 0, 33).Add(-time.Hour)}
+	for t := start.AddDate(0, 0, 33); t.Before(start.AddDate(0, 0, 40)); t = t.Add(30 * time.Minute) {
+		p := site.Predict(t, t.Add(30*time.Minute), 30*time.Minute)[0]
+		p.KWatts *= 0.5
+		cloudy.Predictions = append(cloudy.Predictions, p)
+	}
+	a.Forecasts = []forecast.IssuedForecast{cloudy}
+	if _, alerts = a.Analyze(intervals); len(alerts) != 1 || alerts[0].Kind != Dropout {
+		t.Errorf("with a cloudy forecast got %v", alerts)
+	}
+}
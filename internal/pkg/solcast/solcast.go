@@ -8,15 +8,40 @@ package solcast
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/forecast"
 )
 
-type SolarPrediction struct {
-	End    time.Time
-	KWatts float64
+type SolarPrediction = forecast.SolarPrediction
+
+// Solcast implements forecast.Forecaster for a Solcast rooftop site.
+type Solcast struct {
+	ApiKey     string
+	ResourceId string
+}
+
+// New returns a Forecaster for a Solcast rooftop site. If archive is not nil, every
+// forecast fetched is saved to it as Solcast returned it, for forecast-accuracy.
+func New(apiKey, resourceId string, archive *forecast.Archive) forecast.Forecaster {
+	s := &Solcast{ApiKey: apiKey, ResourceId: resourceId}
+	if archive == nil {
+		return s
+	}
+	return &forecast.Recorder{
+		Forecaster: s,
+		Archive:    archive,
+		Source:     "solcast",
+		OnError:    func(err error) { log.Printf("forecast archive: %v", err) },
+	}
+}
+
+func (s *Solcast) Forecast() ([]SolarPrediction, error) {
+	return GetSolarProductionForecast(s.ApiKey, s.ResourceId)
 }
 
 // solcast Forecast API
@@ -61,7 +86,7 @@ func GetSolarProductionForecast(apiKey, resourceId string) (prediction []SolarPr
 			return nil, err
 		} else {
 			log.Println(string(body))
-			return nil, err
+			return nil, fmt.Errorf("Solcast forecast status=%v", resp.StatusCode)
 		}
 	}
 
@@ -0,0 +1,136 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tariff
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Built in PG&E residential rate plans. Prices are approximately those in effect in
+// early 2024, check the current tariff book before relying on them. Under NEM 2 exports
+// are credited at the same price as imports.
+
+var (
+	summer = []time.Month{time.June, time.July, time.August, time.September}
+	winter = []time.Month{time.January, time.February, time.March, time.April, time.May,
+		time.October, time.November, time.December}
+)
+
+func pacificTime() *time.Location {
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+func period(name string, start, end int, price float64) Period {
+	return Period{Name: name, Days: AllDays, Start: start * 60, End: end * 60,
+		ImportPrice: price, ExportPrice: price}
+}
+
+// EV2A is PG&E's Home Charging EV2-A plan, the same every day of the year:
+// + peak 4pm - 9pm
+// + partial peak 3pm - 4pm and 9pm - midnight
+// + off peak midnight - 3pm
+func EV2A() *Tariff {
+	return &Tariff{
+		Name:     "EV2A",
+		Location: pacificTime(),
+		Holidays: USUtilityHolidays,
+		Seasons: []Season{
+			{Name: "summer", Months: summer, Periods: []Period{
+				period("peak", 16, 21, 0.62),
+				period("partial-peak", 15, 16, 0.51),
+				period("partial-peak", 21, 24, 0.51),
+				period("off-peak", 0, 15, 0.31),
+			}},
+			{Name: "winter", Months: winter, Periods: []Period{
+				period("peak", 16, 21, 0.49),
+				period("partial-peak", 15, 16, 0.47),
+				period("partial-peak", 21, 24, 0.47),
+				period("off-peak", 0, 15, 0.31),
+			}},
+		},
+		FixedDaily: 0.35,
+	}
+}
+
+// ETOUC is PG&E's E-TOU-C plan, peak 4pm - 9pm every day, with a baseline credit for
+// usage up to the Territory X baseline allowance.
+func ETOUC() *Tariff {
+	return &Tariff{
+		Name:     "E-TOU-C",
+		Location: pacificTime(),
+		Holidays: USUtilityHolidays,
+		Seasons: []Season{
+			{Name: "summer", Months: summer, BaselineDailyKWh: 12.9, Periods: []Period{
+				period("peak", 16, 21, 0.49),
+				period("off-peak", 0, 16, 0.42),
+				period("off-peak", 21, 24, 0.42),
+			}},
+			{Name: "winter", Months: winter, BaselineDailyKWh: 11.0, Periods: []Period{
+				period("peak", 16, 21, 0.39),
+				period("off-peak", 0, 16, 0.36),
+				period("off-peak", 21, 24, 0.36),
+			}},
+		},
+		FixedDaily:     0.35,
+		BaselineCredit: 0.10,
+	}
+}
+
+// EELEC is PG&E's E-ELEC plan for all-electric homes, with the same periods as EV2A
+// but a higher off peak price and a larger base services charge.
+func EELEC() *Tariff {
+	return &Tariff{
+		Name:     "E-ELEC",
+		Location: pacificTime(),
+		Holidays: USUtilityHolidays,
+		Seasons: []Season{
+			{Name: "summer", Months: summer, Periods: []Period{
+				period("peak", 16, 21, 0.60),
+				period("partial-peak", 15, 16, 0.44),
+				period("partial-peak", 21, 24, 0.44),
+				period("off-peak", 0, 15, 0.38),
+			}},
+			{Name: "winter", Months: winter, Periods: []Period{
+				period("peak", 16, 21, 0.38),
+				period("partial-peak", 15, 16, 0.36),
+				period("partial-peak", 21, 24, 0.36),
+				period("off-peak", 0, 15, 0.34),
+			}},
+		},
+		FixedDaily: 0.49,
+	}
+}
+
+var builtin = map[string]func() *Tariff{
+	"EV2A":    EV2A,
+	"E-ELEC":  EELEC,
+	"E-TOU-C": ETOUC,
+}
+
+// Builtin returns the built in tariff called name, ignoring case.
+func Builtin(name string) (*Tariff, error) {
+	for n, f := range builtin {
+		if strings.EqualFold(n, name) {
+			return f(), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown tariff %q, built in tariffs are %v", name, BuiltinNames())
+}
+
+// BuiltinNames lists the built in tariffs.
+func BuiltinNames() []string {
+	names := make([]string, 0, len(builtin))
+	for n := range builtin {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
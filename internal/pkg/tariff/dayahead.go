@@ -0,0 +1,286 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tariff
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/fileutil"
+)
+
+// PriceProvider answers what energy costs at a moment. *Tariff is the static
+// implementation, DayAhead follows an hourly price feed.
+type PriceProvider interface {
+	PriceAt(t time.Time) Price
+}
+
+// HourlyPrice is one hour of a dynamic price feed, in $/kWh.
+type HourlyPrice struct {
+	Start  time.Time `json:"time"`
+	Import float64   `json:"price"`
+	Export float64   `json:"export_price"`
+}
+
+// DayAheadRetention is how long fetched prices are kept in the cache, long enough for
+// a year of cost calculations to use the prices which were actually charged.
+const DayAheadRetention = 400 * 24 * time.Hour
+
+// DayAhead prices energy from an hourly feed, such as the day-ahead files published for
+// the CAISO LMP based dynamic rate pilots. Hours the feed doesn't cover are priced by
+// Fallback. Fetched prices are cached in CacheFile, so a restart or a feed outage
+// doesn't lose them.
+type DayAhead struct {
+	// An http or https URL, or a local file. CSV or JSON, see ParsePrices.
+	Source    string
+	CacheFile string
+	Fallback  PriceProvider
+
+	// Used for http and https Sources, defaults to http.DefaultClient.
+	HTTP *http.Client
+
+	mu     sync.Mutex
+	prices []HourlyPrice
+}
+
+// PriceAt returns the feed's price for the hour containing t.
+func (d *DayAhead) PriceAt(t time.Time) Price {
+	d.mu.Lock()
+	idx := sort.Search(len(d.prices), func(i int) bool { return d.prices[i].Start.After(t) })
+	// A copy, merge reuses the slice.
+	var p HourlyPrice
+	found := idx > 0 && t.Before(d.prices[idx-1].Start.Add(time.Hour))
+	if found {
+		p = d.prices[idx-1]
+	}
+	d.mu.Unlock()
+
+	if !found {
+		if d.Fallback == nil {
+			return Price{}
+		}
+		return d.Fallback.PriceAt(t)
+	}
+	return Price{Season: "day-ahead", Period: p.Start.Format("15:04"), Import: p.Import, Export: p.Export}
+}
+
+// Covered returns the end of the last hour the feed has a price for.
+func (d *DayAhead) Covered() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.prices) == 0 {
+		return time.Time{}
+	}
+	return d.prices[len(d.prices)-1].Start.Add(time.Hour)
+}
+
+// LoadCache reads prices fetched before. A missing cache file is not an error.
+func (d *DayAhead) LoadCache() error {
+	if d.CacheFile == "" {
+		return nil
+	}
+	f, err := os.Open(d.CacheFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	prices, err := ParsePrices(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", d.CacheFile, err)
+	}
+	d.merge(prices, time.Now())
+	return nil
+}
+
+// Refresh fetches the feed, merges it with the prices already known and saves the
+// result to the cache.
+func (d *DayAhead) Refresh() error {
+	var r io.ReadCloser
+	if strings.HasPrefix(d.Source, "http://") || strings.HasPrefix(d.Source, "https://") {
+		c := d.HTTP
+		if c == nil {
+			c = http.DefaultClient
+		}
+		res, err := c.Get(d.Source)
+		if err != nil {
+			return err
+		}
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return fmt.Errorf("GET %s: status=%d", d.Source, res.StatusCode)
+		}
+		r = res.Body
+	} else {
+		f, err := os.Open(d.Source)
+		if err != nil {
+			return err
+		}
+		r = f
+	}
+	prices, err := ParsePrices(r)
+	r.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %v", d.Source, err)
+	}
+	d.merge(prices, time.Now())
+	return d.saveCache()
+}
+
+// merge adds prices, replacing any hour already known, and drops hours older than
+// DayAheadRetention.
+func (d *DayAhead) merge(prices []HourlyPrice, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	byHour := make(map[int64]HourlyPrice)
+	for _, p := range d.prices {
+		byHour[p.Start.Unix()] = p
+	}
+	for _, p := range prices {
+		byHour[p.Start.Unix()] = p
+	}
+	oldest := now.Add(-DayAheadRetention)
+	d.prices = d.prices[:0]
+	for _, p := range byHour {
+		if !p.Start.Before(oldest) {
+			d.prices = append(d.prices, p)
+		}
+	}
+	sort.Slice(d.prices, func(i, j int) bool { return d.prices[i].Start.Before(d.prices[j].Start) })
+}
+
+func (d *DayAhead) saveCache() error {
+	if d.CacheFile == "" {
+		return nil
+	}
+	d.mu.Lock()
+	b, err := json.MarshalIndent(d.prices, "", " ")
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// The daemon and dispatch share the cache.
+	return fileutil.WriteFileAtomic(d.CacheFile, b, 0644)
+}
+
+// ParsePrices reads an hourly price feed. JSON is an array of objects with "time",
+// "price" and optional "export_price" members. CSV has a header row with "time",
+// "price" and optional "export_price" columns. Times are RFC3339 or Unix seconds,
+// prices are $/kWh. Without an export price, exports are credited at the import price.
+func ParsePrices(r io.Reader) ([]HourlyPrice, error) {
+	br := bufio.NewReader(r)
+	first, err := br.Peek(1)
+	for err == nil && bytes.ContainsAny(first, " \t\r\n") {
+		br.ReadByte()
+		first, err = br.Peek(1)
+	}
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if first[0] == '[' {
+		return parsePricesJSON(br)
+	}
+	return parsePricesCSV(br)
+}
+
+func parsePricesJSON(r io.Reader) ([]HourlyPrice, error) {
+	var raw []struct {
+		Time        json.RawMessage `json:"time"`
+		Price       *float64        `json:"price"`
+		ExportPrice *float64        `json:"export_price"`
+	}
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, err
+	}
+	prices := make([]HourlyPrice, 0, len(raw))
+	for idx, p := range raw {
+		if p.Price == nil {
+			return nil, fmt.Errorf("entry %d has no price", idx)
+		}
+		t, err := parsePriceTime(strings.Trim(string(p.Time), `"`))
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %v", idx, err)
+		}
+		hp := HourlyPrice{Start: t, Import: *p.Price, Export: *p.Price}
+		if p.ExportPrice != nil {
+			hp.Export = *p.ExportPrice
+		}
+		prices = append(prices, hp)
+	}
+	return prices, nil
+}
+
+func parsePricesCSV(r io.Reader) ([]HourlyPrice, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	timeCol, priceCol, exportCol := -1, -1, -1
+	for idx, name := range header {
+		switch strings.TrimSpace(strings.ToLower(name)) {
+		case "time":
+			timeCol = idx
+		case "price":
+			priceCol = idx
+		case "export_price":
+			exportCol = idx
+		}
+	}
+	if timeCol < 0 || priceCol < 0 {
+		return nil, fmt.Errorf("CSV needs time and price columns, got %v", header)
+	}
+
+	var prices []HourlyPrice
+	for line := 2; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		t, err := parsePriceTime(record[timeCol])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		hp := HourlyPrice{Start: t}
+		if hp.Import, err = strconv.ParseFloat(strings.TrimSpace(record[priceCol]), 64); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		hp.Export = hp.Import
+		if exportCol >= 0 && strings.TrimSpace(record[exportCol]) != "" {
+			if hp.Export, err = strconv.ParseFloat(strings.TrimSpace(record[exportCol]), 64); err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+		}
+		prices = append(prices, hp)
+	}
+	return prices, nil
+}
+
+func parsePriceTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	secs, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("time %q is neither RFC3339 nor Unix seconds", s)
+	}
+	return time.Unix(secs, 0), nil
+}
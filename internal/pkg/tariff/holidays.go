@@ -0,0 +1,74 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tariff
+
+import (
+	"time"
+)
+
+// HolidayCalendar reports whether a day is a holiday for time of use purposes.
+type HolidayCalendar interface {
+	IsHoliday(t time.Time) bool
+}
+
+// USUtilityHolidays are the holidays on which PG&E and most California utilities apply
+// off-peak pricing: New Year's Day, Presidents' Day, Memorial Day, Independence Day,
+// Labor Day, Veterans Day, Thanksgiving Day and Christmas Day, on the day they are
+// legally observed.
+var USUtilityHolidays HolidayCalendar = usUtilityHolidays{}
+
+type usUtilityHolidays struct{}
+
+func (usUtilityHolidays) IsHoliday(t time.Time) bool {
+	// New Year's Day on a Saturday is observed on December 31st of the year before.
+	for _, year := range []int{t.Year(), t.Year() + 1} {
+		for _, h := range USHolidays(year) {
+			if h.Year() == t.Year() && h.Month() == t.Month() && h.Day() == t.Day() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// USHolidays returns the observed dates of the utility holidays in year. A holiday on a
+// Saturday is observed on the Friday before, one on a Sunday on the Monday after.
+func USHolidays(year int) []time.Time {
+	fixed := func(month time.Month, day int) time.Time {
+		t := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+		switch t.Weekday() {
+		case time.Saturday:
+			return t.AddDate(0, 0, -1)
+		case time.Sunday:
+			return t.AddDate(0, 0, 1)
+		}
+		return t
+	}
+	// The nth weekday of the month, or the last one if n is negative.
+	nth := func(month time.Month, weekday time.Weekday, n int) time.Time {
+		if n < 0 {
+			t := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC)
+			for t.Weekday() != weekday {
+				t = t.AddDate(0, 0, -1)
+			}
+			return t
+		}
+		t := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+		for t.Weekday() != weekday {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t.AddDate(0, 0, 7*(n-1))
+	}
+
+	return []time.Time{
+		fixed(time.January, 1),
+		nth(time.February, time.Monday, 3),
+		nth(time.May, time.Monday, -1),
+		fixed(time.July, 4),
+		nth(time.September, time.Monday, 1),
+		fixed(time.November, 11),
+		nth(time.November, time.Thursday, 4),
+		fixed(time.December, 25),
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package tariff models time-of-use electricity rate plans: seasons, weekday, weekend and
+// holiday periods, import prices, export credits, fixed charges and baseline credits.
+package tariff
+
+import (
+	"sort"
+	"time"
+)
+
+// DayType selects which days a Period applies to. Values may be combined.
+type DayType int
+
+const (
+	Weekday DayType = 1 << iota
+	Weekend
+	Holiday
+	AllDays = Weekday | Weekend | Holiday
+)
+
+// Period is a time of use window within a day. Start and End are minutes after local
+// midnight, End may be 1440. A window crossing midnight is written as two Periods.
+type Period struct {
+	Name        string  `json:"name"`
+	Days        DayType `json:"days"`
+	Start       int     `json:"start"`
+	End         int     `json:"end"`
+	ImportPrice float64 `json:"import_price"` // $/kWh
+	ExportPrice float64 `json:"export_price"` // $/kWh credited for export
+}
+
+// Season is the set of Periods in effect during Months. The first matching Period wins.
+type Season struct {
+	Name    string       `json:"name"`
+	Months  []time.Month `json:"months"`
+	Periods []Period     `json:"periods"`
+
+	// Daily allowance of energy which earns the BaselineCredit.
+	BaselineDailyKWh float64 `json:"baseline_daily_kwh,omitempty"`
+}
+
+// Tariff is a complete rate plan.
+type Tariff struct {
+	Name     string         `json:"name"`
+	Location *time.Location `json:"-"`
+	Seasons  []Season       `json:"seasons"`
+
+	// If nil, no day is treated as a Holiday.
+	Holidays HolidayCalendar `json:"-"`
+
+	FixedDaily     float64 `json:"fixed_daily"`     // $/day
+	BaselineCredit float64 `json:"baseline_credit"` // $/kWh
+}
+
+// Price is what energy costs at one moment.
+type Price struct {
+	Season string
+	Period string
+	Import float64 // $/kWh
+	Export float64 // $/kWh
+}
+
+func (t *Tariff) location() *time.Location {
+	if t.Location == nil {
+		return time.Local
+	}
+	return t.Location
+}
+
+// DayTypeOf returns whether t falls on a weekday, weekend or holiday.
+func (t *Tariff) DayTypeOf(tm time.Time) DayType {
+	tm = tm.In(t.location())
+	if t.Holidays != nil && t.Holidays.IsHoliday(tm) {
+		return Holiday
+	}
+	if tm.Weekday() == time.Saturday || tm.Weekday() == time.Sunday {
+		return Weekend
+	}
+	return Weekday
+}
+
+// SeasonAt returns the Season in effect at tm, or nil if the tariff doesn't cover it.
+func (t *Tariff) SeasonAt(tm time.Time) *Season {
+	month := tm.In(t.location()).Month()
+	for idx := range t.Seasons {
+		for _, m := range t.Seasons[idx].Months {
+			if m == month {
+				return &t.Seasons[idx]
+			}
+		}
+	}
+	return nil
+}
+
+// PriceAt returns the price of energy at tm. A time the tariff doesn't cover is free,
+// which is easier to spot in a report than an error halfway through a year.
+func (t *Tariff) PriceAt(tm time.Time) Price {
+	season := t.SeasonAt(tm)
+	if season == nil {
+		return Price{}
+	}
+	local := tm.In(t.location())
+	minute := local.Hour()*60 + local.Minute()
+	days := t.DayTypeOf(tm)
+	for _, p := range season.Periods {
+		if p.Days&days != 0 && minute >= p.Start && minute < p.End {
+			return Price{Season: season.Name, Period: p.Name, Import: p.ImportPrice, Export: p.ExportPrice}
+		}
+	}
+	return Price{Season: season.Name}
+}
+
+// Usage is the energy drawn from and sent to the grid over Duration starting at Start.
+type Usage struct {
+	Start     time.Time
+	Duration  time.Duration
+	ImportKWh float64
+	ExportKWh float64
+}
+
+// Bill breaks down the cost of a series of Usage. Credits are positive numbers which
+// are subtracted from the Total.
+type Bill struct {
+	EnergyCharges   float64
+	ExportCredits   float64
+	FixedCharges    float64
+	BaselineCredits float64
+	Total           float64
+	Days            int
+}
+
+// Cost prices each interval at its midpoint, charges FixedDaily for every day which
+// has any usage, and credits BaselineCredit for each day's net import up to the
+// season's baseline allowance.
+func (t *Tariff) Cost(usage []Usage) Bill {
+	return t.CostWith(t, usage)
+}
+
+// CostWith is Cost with energy priced by prices, such as a DayAhead feed, rather than
+// the tariff's own periods. Fixed charges and baseline credits still come from t.
+func (t *Tariff) CostWith(prices PriceProvider, usage []Usage) Bill {
+	var bill Bill
+	netByDay := make(map[time.Time]float64)
+	seasonByDay := make(map[time.Time]*Season)
+	for _, u := range usage {
+		mid := u.Start.Add(u.Duration / 2)
+		price := prices.PriceAt(mid)
+		bill.EnergyCharges += u.ImportKWh * price.Import
+		bill.ExportCredits += u.ExportKWh * price.Export
+
+		local := mid.In(t.location())
+		day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, t.location())
+		netByDay[day] += u.ImportKWh - u.ExportKWh
+		seasonByDay[day] = t.SeasonAt(mid)
+	}
+
+	days := make([]time.Time, 0, len(netByDay))
+	for day := range netByDay {
+		days = append(days, day)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+	for _, day := range days {
+		bill.FixedCharges += t.FixedDaily
+		if season := seasonByDay[day]; season != nil && netByDay[day] > 0 {
+			kwh := netByDay[day]
+			if kwh > season.BaselineDailyKWh {
+				kwh = season.BaselineDailyKWh
+			}
+			bill.BaselineCredits += kwh * t.BaselineCredit
+		}
+	}
+	bill.Days = len(days)
+	bill.Total = bill.EnergyCharges - bill.ExportCredits + bill.FixedCharges - bill.BaselineCredits
+	return bill
+}
@@ -0,0 +1,275 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tariff
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPriceAt(t *testing.T) {
+	ev2a := EV2A()
+	loc := ev2a.Location
+	tests := []struct {
+		t      time.Time
+		period string
+		price  float64
+	}{
+		{time.Date(2024, 1, 10, 10, 0, 0, 0, loc), "off-peak", 0.31},
+		{time.Date(2024, 1, 10, 15, 30, 0, 0, loc), "partial-peak", 0.47},
+		{time.Date(2024, 1, 10, 16, 0, 0, 0, loc), "peak", 0.49},
+		{time.Date(2024, 1, 10, 23, 59, 0, 0, loc), "partial-peak", 0.47},
+		{time.Date(2024, 7, 13, 18, 0, 0, 0, loc), "peak", 0.62},
+	}
+	for _, tt := range tests {
+		p := ev2a.PriceAt(tt.t)
+		if p.Period != tt.period || p.Import != tt.price || p.Export != tt.price {
+			t.Errorf("PriceAt(%v) got=%+v want %s %.2f", tt.t, p, tt.period, tt.price)
+		}
+	}
+
+	// A weekday-only peak, to check weekend and holiday handling.
+	custom := &Tariff{
+		Location: loc,
+		Holidays: USUtilityHolidays,
+		Seasons: []Season{{Name: "all", Months: append(summer, winter...), Periods: []Period{
+			{Name: "peak", Days: Weekday, Start: 16 * 60, End: 21 * 60, ImportPrice: 0.5},
+			{Name: "off-peak", Days: AllDays, Start: 0, End: 24 * 60, ImportPrice: 0.3},
+		}}},
+	}
+	for _, day := range []time.Time{
+		time.Date(2024, 7, 4, 17, 0, 0, 0, loc),   // Independence Day
+		time.Date(2024, 7, 6, 17, 0, 0, 0, loc),   // Saturday
+		time.Date(2021, 12, 31, 17, 0, 0, 0, loc), // New Year's Day 2022 observed
+		time.Date(2024, 11, 28, 17, 0, 0, 0, loc), // Thanksgiving
+	} {
+		if p := custom.PriceAt(day); p.Period != "off-peak" {
+			t.Errorf("PriceAt(%v) got=%+v want off-peak", day, p)
+		}
+	}
+	if p := custom.PriceAt(time.Date(2024, 7, 5, 17, 0, 0, 0, loc)); p.Period != "peak" {
+		t.Errorf("PriceAt(July 5th) got=%+v want peak", p)
+	}
+}
+
+func TestBuiltin(t *testing.T) {
+	for _, name := range BuiltinNames() {
+		tariff, err := Builtin(name)
+		if err != nil {
+			t.Fatalf("Builtin(%s): %v", name, err)
+		}
+		// Every hour of the year must fall in some period.
+		start := time.Date(2024, 1, 1, 0, 30, 0, 0, tariff.Location)
+		for tm := start; tm.Year() == 2024; tm = tm.Add(time.Hour) {
+			if p := tariff.PriceAt(tm); p.Period == "" || p.Import <= 0 {
+				t.Fatalf("%s PriceAt(%v) got=%+v", name, tm, p)
+			}
+		}
+	}
+	if _, err := Builtin("e-elec"); err != nil {
+		t.Errorf("Builtin(e-elec): %v", err)
+	}
+}
+
+func TestCost(t *testing.T) {
+	etouc := ETOUC()
+	loc := etouc.Location
+	day := time.Date(2024, 1, 10, 0, 0, 0, 0, loc)
+	var usage []Usage
+	for h := 0; h < 24; h++ {
+		u := Usage{Start: day.Add(time.Duration(h) * time.Hour), Duration: time.Hour, ImportKWh: 1}
+		if h == 12 {
+			u.ImportKWh = 0
+			u.ExportKWh = 4
+		}
+		usage = append(usage, u)
+	}
+
+	bill := etouc.Cost(usage)
+	energy := 5*0.39 + 18*0.36
+	if math.Abs(bill.EnergyCharges-energy) > 1e-9 {
+		t.Errorf("EnergyCharges got=%.4f want=%.4f", bill.EnergyCharges, energy)
+	}
+	if math.Abs(bill.ExportCredits-4*0.36) > 1e-9 {
+		t.Errorf("ExportCredits got=%.4f want=%.4f", bill.ExportCredits, 4*0.36)
+	}
+	// Net import of 19 kWh is capped at the 11 kWh winter baseline.
+	if math.Abs(bill.BaselineCredits-1.1) > 1e-9 || bill.Days != 1 || bill.FixedCharges != 0.35 {
+		t.Errorf("Cost got=%+v", bill)
+	}
+	want := energy - 4*0.36 + 0.35 - 1.1
+	if math.Abs(bill.Total-want) > 1e-9 {
+		t.Errorf("Total got=%.4f want=%.4f", bill.Total, want)
+	}
+}
+
+func TestUSHolidays(t *testing.T) {
+	want := []string{"2023-01-02", "2023-02-20", "2023-05-29", "2023-07-04",
+		"2023-09-04", "2023-11-10", "2023-11-23", "2023-12-25"}
+	for idx, h := range USHolidays(2023) {
+		if got := h.Format("2006-01-02"); got != want[idx] {
+			t.Errorf("USHolidays(2023)[%d] got=%s want=%s", idx, got, want[idx])
+		}
+	}
+}
+
+func urdbSchedule(peakStart, peakEnd, summerOffset int) string {
+	var months []string
+	for m := 1; m <= 12; m++ {
+		offset := 0
+		if m >= 6 && m <= 9 {
+			offset = summerOffset
+		}
+		var hours []string
+		for h := 0; h < 24; h++ {
+			p := offset
+			if h >= peakStart && h < peakEnd {
+				p = offset + 1
+			}
+			hours = append(hours, fmt.Sprint(p))
+		}
+		months = append(months, "["+strings.Join(hours, ",")+"]")
+	}
+	return "[" + strings.Join(months, ",") + "]"
+}
+
+func TestParseURDB(t *testing.T) {
+	loc := ETOUC().Location
+	rate := `{"items": [{
+		"name": "Residential Time-of-Use",
+		"energyratestructure": [
+			[{"rate": 0.30, "adj": 0.01, "unit": "kWh"}],
+			[{"rate": 0.40, "unit": "kWh"}],
+			[{"rate": 0.35, "unit": "kWh"}],
+			[{"rate": 0.55, "unit": "kWh", "sell": 0.05}]
+		],
+		"energyweekdayschedule": ` + urdbSchedule(16, 21, 2) + `,
+		"energyweekendschedule": ` + urdbSchedule(0, 0, 2) + `,
+		"fixedchargefirstmeter": 15.0,
+		"fixedchargeunits": "$/month"
+	}]}`
+	tariff, err := ParseURDB([]byte(rate), loc)
+	if err != nil {
+		t.Fatalf("ParseURDB: %v", err)
+	}
+	if len(tariff.Seasons) != 2 || tariff.Seasons[1].Name != "Jun/Jul/Aug/Sep" {
+		t.Fatalf("ParseURDB seasons got=%+v", tariff.Seasons)
+	}
+	if math.Abs(tariff.FixedDaily-15.0*12/365) > 1e-9 {
+		t.Errorf("FixedDaily got=%v", tariff.FixedDaily)
+	}
+
+	tests := []struct {
+		t           time.Time
+		imp, export float64
+	}{
+		{time.Date(2024, 1, 10, 10, 0, 0, 0, loc), 0.31, 0.31},
+		{time.Date(2024, 1, 10, 17, 0, 0, 0, loc), 0.40, 0.40},
+		{time.Date(2024, 1, 13, 17, 0, 0, 0, loc), 0.31, 0.31},
+		{time.Date(2024, 7, 10, 17, 0, 0, 0, loc), 0.55, 0.05},
+		{time.Date(2024, 7, 13, 17, 0, 0, 0, loc), 0.35, 0.35},
+	}
+	for _, tt := range tests {
+		if p := tariff.PriceAt(tt.t); math.Abs(p.Import-tt.imp) > 1e-9 || math.Abs(p.Export-tt.export) > 1e-9 {
+			t.Errorf("PriceAt(%v) got=%+v want import=%.2f export=%.2f", tt.t, p, tt.imp, tt.export)
+		}
+	}
+
+	tiered := `{"name": "Tiered",
+		"energyratestructure": [[{"rate": 0.30, "max": 10}, {"rate": 0.40}]],
+		"energyweekdayschedule": ` + urdbSchedule(0, 0, 0) + `,
+		"energyweekendschedule": ` + urdbSchedule(0, 0, 0) + `,
+		"demandratestructure": [[{"rate": 10.0}]]}`
+	_, err = ParseURDB([]byte(tiered), loc)
+	unsupported, ok := err.(*UnsupportedError)
+	if !ok || len(unsupported.Features) != 2 {
+		t.Fatalf("ParseURDB(tiered) got err=%v want tiers and demand charges", err)
+	}
+	if !strings.Contains(err.Error(), "demand charges") || !strings.Contains(err.Error(), "2 tiers") {
+		t.Errorf("ParseURDB(tiered) error=%q", err)
+	}
+
+	filename := filepath.Join(t.TempDir(), "rate.json")
+	if err = os.WriteFile(filename, []byte(rate), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	mountain, err := time.LoadLocation("America/Denver")
+	if err != nil {
+		t.Fatalf("LoadLocation: %v", err)
+	}
+	if tariff, err = Load(filename, mountain); err != nil || tariff.Location != mountain {
+		t.Errorf("Load(URDB) got=%v, %v want America/Denver", tariff, err)
+	}
+	if tariff, err = Load("EV2A", mountain); err != nil || tariff.Location.String() != "America/Los_Angeles" {
+		t.Errorf("Load(EV2A) got=%v, %v want America/Los_Angeles", tariff, err)
+	}
+}
+
+func TestDayAhead(t *testing.T) {
+	dir := t.TempDir()
+	ev2a := EV2A()
+	loc := ev2a.Location
+	hour := time.Now().In(loc).Truncate(time.Hour)
+
+	feed := filepath.Join(dir, "feed.csv")
+	feedCSV := fmt.Sprintf("time,price,export_price\n%s,0.12,0.05\n%d,0.80,\n",
+		hour.Format(time.RFC3339), hour.Add(time.Hour).Unix())
+	if err := os.WriteFile(feed, []byte(feedCSV), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	cache := filepath.Join(dir, "prices.json")
+	d := &DayAhead{Source: feed, CacheFile: cache, Fallback: ev2a}
+	if err := d.Refresh(); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if p := d.PriceAt(hour.Add(30 * time.Minute)); p.Import != 0.12 || p.Export != 0.05 {
+		t.Errorf("first hour got %+v", p)
+	}
+	if p := d.PriceAt(hour.Add(90 * time.Minute)); p.Import != 0.80 || p.Export != 0.80 {
+		t.Errorf("second hour got %+v, want export at the import price", p)
+	}
+	later := hour.Add(3 * time.Hour)
+	if p, want := d.PriceAt(later), ev2a.PriceAt(later); p != want {
+		t.Errorf("uncovered hour got %+v, want the fallback %+v", p, want)
+	}
+	if !d.Covered().Equal(hour.Add(2 * time.Hour)) {
+		t.Errorf("Covered got %v", d.Covered())
+	}
+
+	// A new process starts from the cache, and the JSON format replaces one hour.
+	feedJSON := fmt.Sprintf(`[{"time": %q, "price": 0.20}]`, hour.Format(time.RFC3339))
+	if err := os.WriteFile(feed, []byte(feedJSON), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	d = &DayAhead{Source: feed, CacheFile: cache}
+	if err := d.LoadCache(); err != nil {
+		t.Fatalf("LoadCache: %v", err)
+	}
+	if p := d.PriceAt(hour.Add(90 * time.Minute)); p.Import != 0.80 {
+		t.Errorf("cached second hour got %+v", p)
+	}
+	if err := d.Refresh(); err != nil {
+		t.Fatalf("Refresh JSON: %v", err)
+	}
+	if p := d.PriceAt(hour); p.Import != 0.20 || p.Export != 0.20 {
+		t.Errorf("replaced first hour got %+v", p)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("temporary cache files left behind: %v", entries)
+	}
+
+	usage := []Usage{{Start: hour, Duration: time.Hour, ImportKWh: 10}}
+	if bill := ev2a.CostWith(d, usage); math.Abs(bill.EnergyCharges-2.0) > 1e-9 || bill.FixedCharges != ev2a.FixedDaily {
+		t.Errorf("CostWith got %+v", bill)
+	}
+
+	if _, err := ParsePrices(strings.NewReader("when,cost\n1,2\n")); err == nil {
+		t.Errorf("ParsePrices accepted CSV without time and price columns")
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tariff
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// urdbRate is the subset of the OpenEI Utility Rate Database format which we understand,
+// plus the fields we look at only to refuse them.
+// https://openei.org/services/doc/rest/util_rates/?version=7
+type urdbRate struct {
+	Name    string `json:"name"`
+	Utility string `json:"utility"`
+
+	EnergyRateStructure   [][]urdbTier `json:"energyratestructure"`
+	EnergyWeekdaySchedule [][]int      `json:"energyweekdayschedule"`
+	EnergyWeekendSchedule [][]int      `json:"energyweekendschedule"`
+
+	FixedChargeFirstMeter *float64 `json:"fixedchargefirstmeter"`
+	FixedChargeUnits      string   `json:"fixedchargeunits"`
+	FixedMonthlyCharge    *float64 `json:"fixedmonthlycharge"`
+
+	DemandRateStructure     json.RawMessage `json:"demandratestructure"`
+	FlatDemandStructure     json.RawMessage `json:"flatdemandstructure"`
+	CoincidentRateStructure json.RawMessage `json:"coincidentratestructure"`
+	MinCharge               *float64        `json:"mincharge"`
+}
+
+type urdbTier struct {
+	Rate *float64 `json:"rate"`
+	Adj  float64  `json:"adj"`
+	Max  *float64 `json:"max"`
+	Unit string   `json:"unit"`
+	Sell *float64 `json:"sell"`
+}
+
+// UnsupportedError lists the parts of a URDB rate which the tariff model cannot
+// represent. Ignoring them would silently produce the wrong bill.
+type UnsupportedError struct {
+	Name     string
+	Features []string
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("URDB rate %q uses unsupported features: %s",
+		e.Name, strings.Join(e.Features, "; "))
+}
+
+// ReadURDB loads a tariff from a file in the OpenEI URDB JSON format, either a single
+// rate or an API response of the form {"items": [rate]}. Times are local to loc.
+func ReadURDB(filename string, loc *time.Location) (*Tariff, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseURDB(b, loc)
+}
+
+// ParseURDB converts one URDB rate into a Tariff. URDB does not define holidays, the
+// weekend schedule applies to Holiday as well if the caller sets Holidays. Exports are
+// credited at the import price, as under NEM 2, unless the rate has a sell price.
+func ParseURDB(b []byte, loc *time.Location) (*Tariff, error) {
+	var wrapper struct {
+		Items []json.RawMessage `json:"items"`
+	}
+	if err := json.Unmarshal(b, &wrapper); err == nil && wrapper.Items != nil {
+		if len(wrapper.Items) != 1 {
+			return nil, fmt.Errorf("URDB file holds %d rates, expected exactly one", len(wrapper.Items))
+		}
+		b = wrapper.Items[0]
+	}
+
+	var rate urdbRate
+	if err := json.Unmarshal(b, &rate); err != nil {
+		return nil, err
+	}
+
+	unsupported := &UnsupportedError{Name: rate.Name}
+	add := func(format string, args ...interface{}) {
+		unsupported.Features = append(unsupported.Features, fmt.Sprintf(format, args...))
+	}
+	if isSet(rate.DemandRateStructure) || isSet(rate.FlatDemandStructure) {
+		add("demand charges")
+	}
+	if isSet(rate.CoincidentRateStructure) {
+		add("coincident demand charges")
+	}
+	if rate.MinCharge != nil && *rate.MinCharge != 0 {
+		add("minimum charge")
+	}
+
+	if len(rate.EnergyRateStructure) == 0 {
+		add("no energyratestructure")
+	}
+	type price struct{ imp, exp float64 }
+	prices := make([]price, len(rate.EnergyRateStructure))
+	for idx, tiers := range rate.EnergyRateStructure {
+		if len(tiers) != 1 {
+			add("tiered energy rates (period %d has %d tiers)", idx, len(tiers))
+			continue
+		}
+		tier := tiers[0]
+		if tier.Unit != "" && tier.Unit != "kWh" {
+			add("energy rate unit %q in period %d", tier.Unit, idx)
+		}
+		if tier.Rate == nil {
+			add("period %d has no rate", idx)
+			continue
+		}
+		prices[idx] = price{imp: *tier.Rate + tier.Adj, exp: *tier.Rate + tier.Adj}
+		if tier.Sell != nil {
+			prices[idx].exp = *tier.Sell
+		}
+	}
+
+	for _, schedule := range []struct {
+		name  string
+		hours [][]int
+	}{
+		{"energyweekdayschedule", rate.EnergyWeekdaySchedule},
+		{"energyweekendschedule", rate.EnergyWeekendSchedule},
+	} {
+		if len(schedule.hours) != 12 {
+			add("%s has %d months, expected 12", schedule.name, len(schedule.hours))
+			continue
+		}
+		for m, hours := range schedule.hours {
+			if len(hours) != 24 {
+				add("%s month %d has %d hours, expected 24", schedule.name, m+1, len(hours))
+			}
+			for _, p := range hours {
+				if p < 0 || p >= len(prices) {
+					add("%s month %d refers to unknown period %d", schedule.name, m+1, p)
+					break
+				}
+			}
+		}
+	}
+
+	t := &Tariff{Name: rate.Name, Location: loc}
+	if rate.FixedChargeFirstMeter != nil {
+		switch rate.FixedChargeUnits {
+		case "$/day":
+			t.FixedDaily = *rate.FixedChargeFirstMeter
+		case "$/month", "":
+			t.FixedDaily = *rate.FixedChargeFirstMeter * 12.0 / 365.0
+		default:
+			add("fixed charge units %q", rate.FixedChargeUnits)
+		}
+	} else if rate.FixedMonthlyCharge != nil {
+		t.FixedDaily = *rate.FixedMonthlyCharge * 12.0 / 365.0
+	}
+
+	if len(unsupported.Features) > 0 {
+		return nil, unsupported
+	}
+
+	// Months with identical schedules become one Season.
+	seasons := make(map[string]*Season)
+	var order []string
+	for m := 0; m < 12; m++ {
+		weekday := rate.EnergyWeekdaySchedule[m]
+		weekend := rate.EnergyWeekendSchedule[m]
+		key := fmt.Sprint(weekday, weekend)
+		season, ok := seasons[key]
+		if !ok {
+			season = &Season{}
+			seasons[key] = season
+			order = append(order, key)
+
+			makePeriods := func(hours []int, days DayType) {
+				for start := 0; start < 24; {
+					end := start + 1
+					for end < 24 && hours[end] == hours[start] {
+						end++
+					}
+					p := prices[hours[start]]
+					season.Periods = append(season.Periods, Period{
+						Name:        fmt.Sprintf("period %d", hours[start]),
+						Days:        days,
+						Start:       start * 60,
+						End:         end * 60,
+						ImportPrice: p.imp,
+						ExportPrice: p.exp,
+					})
+					start = end
+				}
+			}
+			if fmt.Sprint(weekday) == fmt.Sprint(weekend) {
+				makePeriods(weekday, AllDays)
+			} else {
+				makePeriods(weekday, Weekday)
+				makePeriods(weekend, Weekend|Holiday)
+			}
+		}
+		season.Months = append(season.Months, time.Month(m+1))
+	}
+
+	for _, key := range order {
+		season := seasons[key]
+		sort.Slice(season.Months, func(i, j int) bool { return season.Months[i] < season.Months[j] })
+		names := make([]string, len(season.Months))
+		for idx, m := range season.Months {
+			names[idx] = m.String()[:3]
+		}
+		season.Name = strings.Join(names, "/")
+		t.Seasons = append(t.Seasons, *season)
+	}
+	return t, nil
+}
+
+// isSet reports whether a JSON member is present with some content.
+func isSet(raw json.RawMessage) bool {
+	s := strings.TrimSpace(string(raw))
+	return s != "" && s != "null" && s != "[]" && s != "{}"
+}
+
+// Load returns the built in tariff called nameOrFile, or if there is none by that name
+// reads nameOrFile as a URDB rate in loc. The built in tariffs are always in Pacific time.
+func Load(nameOrFile string, loc *time.Location) (*Tariff, error) {
+	if t, err := Builtin(nameOrFile); err == nil {
+		return t, nil
+	}
+	if _, err := os.Stat(nameOrFile); err != nil {
+		return nil, fmt.Errorf("%q is neither a built in tariff %v nor a URDB file",
+			nameOrFile, BuiltinNames())
+	}
+	t, err := ReadURDB(nameOrFile, loc)
+	if err != nil {
+		return nil, err
+	}
+	t.Holidays = USUtilityHolidays
+	return t, nil
+}
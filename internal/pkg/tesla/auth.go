@@ -0,0 +1,134 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tesla
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/fileutil"
+	"golang.org/x/oauth2"
+)
+
+var Endpoint = oauth2.Endpoint{
+	AuthURL:   "https://auth.tesla.com/oauth2/v3/authorize",
+	TokenURL:  "https://auth.tesla.com/oauth2/v3/token",
+	AuthStyle: oauth2.AuthStyleInParams,
+}
+
+// OAuthConfig returns the config for refreshing tokens, with the client ID and secret
+// from TESLA_OAUTH_CLIENT_ID and TESLA_OAUTH_CLIENT_SECRET.
+func OAuthConfig() *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     os.Getenv("TESLA_OAUTH_CLIENT_ID"),
+		ClientSecret: os.Getenv("TESLA_OAUTH_CLIENT_SECRET"),
+		Endpoint:     Endpoint,
+	}
+}
+
+// TokenFile is an oauth2.TokenSource which keeps the tokens in Filename. Tesla refresh
+// tokens can only be used once, so every refreshed token is saved back to the file
+// before it is used, and the file is read again before refreshing in case another
+// process sharing it has already done so.
+type TokenFile struct {
+	Filename string
+
+	// Defaults to OAuthConfig().
+	Config *oauth2.Config
+
+	// OnRefresh, if set, is called after each successful refresh and OnError with each
+	// failure to refresh or save the tokens.
+	OnRefresh func()
+	OnError   func(err error)
+
+	mu    sync.Mutex
+	token *oauth2.Token
+}
+
+func (t *TokenFile) read() (*oauth2.Token, error) {
+	b, err := os.ReadFile(t.Filename)
+	if err != nil {
+		return nil, err
+	}
+	var token oauth2.Token
+	if err = json.Unmarshal(b, &token); err != nil {
+		return nil, fmt.Errorf("%s: %v", t.Filename, err)
+	}
+	return &token, nil
+}
+
+// save writes the tokens to a temporary file and renames it over Filename, so a reader
+// never sees half a file.
+func (t *TokenFile) save(token *oauth2.Token) error {
+	b, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteFileAtomic(t.Filename, b, 0600)
+}
+
+// Token returns a valid access token, refreshing it if needed.
+func (t *TokenFile) Token() (*oauth2.Token, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token.Valid() {
+		return t.token, nil
+	}
+	token, err := t.read()
+	if err != nil {
+		t.reportError(err)
+		return nil, err
+	}
+	if token.Valid() {
+		t.token = token
+		return token, nil
+	}
+
+	config := t.Config
+	if config == nil {
+		config = OAuthConfig()
+	}
+	refreshed, err := config.TokenSource(context.Background(), token).Token()
+	if err != nil {
+		err = fmt.Errorf("refresh token: %v", err)
+		t.reportError(err)
+		return nil, err
+	}
+	if err = t.save(refreshed); err != nil {
+		// The old refresh token is already spent, so keep using the new one from memory.
+		t.reportError(fmt.Errorf("save token: %v", err))
+	}
+	t.token = refreshed
+	if t.OnRefresh != nil {
+		t.OnRefresh()
+	}
+	return refreshed, nil
+}
+
+func (t *TokenFile) reportError(err error) {
+	if t.OnError != nil {
+		t.OnError(err)
+	}
+}
+
+// Client returns an http.Client which authenticates with the tokens.
+func (t *TokenFile) Client() *http.Client {
+	return oauth2.NewClient(context.Background(), t)
+}
+
+// HTTPClientFromFile returns an http.Client which authenticates using the OAuth tokens
+// saved in filename, refreshing the access token as needed and saving the new tokens
+// back to filename. The client ID and secret come from TESLA_OAUTH_CLIENT_ID and
+// TESLA_OAUTH_CLIENT_SECRET.
+func HTTPClientFromFile(filename string) (*http.Client, error) {
+	t := &TokenFile{Filename: filename}
+	if _, err := t.read(); err != nil {
+		return nil, err
+	}
+	return t.Client(), nil
+}
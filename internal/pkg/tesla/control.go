@@ -0,0 +1,132 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tesla
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Operation modes accepted by SetOperationMode.
+const (
+	SelfConsumption = "self_consumption" // "Self-Powered" in the app
+	Autonomous      = "autonomous"       // "Time-Based Control" in the app
+	Backup          = "backup"
+)
+
+// LiveStatus is the current state of the energy site. Battery power is positive when
+// discharging, grid power is positive when importing.
+type LiveStatus struct {
+	SolarPower        float64   `json:"solar_power"`
+	EnergyLeft        float64   `json:"energy_left"`
+	TotalPackEnergy   float64   `json:"total_pack_energy"`
+	PercentageCharged float64   `json:"percentage_charged"`
+	BatteryPower      float64   `json:"battery_power"`
+	LoadPower         float64   `json:"load_power"`
+	GridStatus        string    `json:"grid_status"`
+	GridPower         float64   `json:"grid_power"`
+	IslandStatus      string    `json:"island_status"`
+	StormModeActive   bool      `json:"storm_mode_active"`
+	Timestamp         time.Time `json:"timestamp"`
+}
+
+// LiveStatus fetches the current power flows and state of charge.
+func (c *Client) LiveStatus() (*LiveStatus, error) {
+	var status LiveStatus
+	if err := c.get("/live_status", nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// SiteInfo is the configuration of the energy site which we control.
+type SiteInfo struct {
+	SiteName             string  `json:"site_name"`
+	BackupReservePercent float64 `json:"backup_reserve_percent"`
+	DefaultRealMode      string  `json:"default_real_mode"`
+}
+
+// SiteInfo fetches the current backup reserve and operation mode.
+func (c *Client) SiteInfo() (*SiteInfo, error) {
+	var info SiteInfo
+	if err := c.get("/site_info", nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// SetBackupReserve sets the percentage of the battery held back for outages.
+func (c *Client) SetBackupReserve(percent int) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("backup reserve %d%% out of range", percent)
+	}
+	return c.post("/backup", map[string]interface{}{"backup_reserve_percent": percent})
+}
+
+// SetOperationMode sets the mode, one of SelfConsumption, Autonomous or Backup.
+func (c *Client) SetOperationMode(mode string) error {
+	switch mode {
+	case SelfConsumption, Autonomous, Backup:
+	default:
+		return fmt.Errorf("unknown operation mode %q", mode)
+	}
+	return c.post("/operation", map[string]interface{}{"default_real_mode": mode})
+}
+
+// Apply sets the backup reserve and, if mode is not empty, the operation mode. It then
+// reads the settings back from site_info, returning an error unless they took effect.
+// A command which Tesla accepted but did not apply has bitten us before.
+func (c *Client) Apply(percent int, mode string) error {
+	if mode != "" {
+		if err := c.SetOperationMode(mode); err != nil {
+			return err
+		}
+	}
+	if err := c.SetBackupReserve(percent); err != nil {
+		return err
+	}
+	info, err := c.SiteInfo()
+	if err != nil {
+		return fmt.Errorf("verify: %v", err)
+	}
+	if math.Round(info.BackupReservePercent) != float64(percent) {
+		return fmt.Errorf("verify: backup reserve is %v%%, want %d%%", info.BackupReservePercent, percent)
+	}
+	if mode != "" && info.DefaultRealMode != mode {
+		return fmt.Errorf("verify: operation mode is %q, want %q", info.DefaultRealMode, mode)
+	}
+	return nil
+}
+
+// post sends body as JSON to path under the site.
+func (c *Client) post(path string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	u := c.SiteURL + path
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "https://github.com/DentonGentry/powerwall")
+
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("POST %s: status=%d %s", u, res.StatusCode, body)
+	}
+	return nil
+}
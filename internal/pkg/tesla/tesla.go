@@ -0,0 +1,167 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package tesla talks to the energy site endpoints of the Tesla Fleet API.
+// https://developer.tesla.com/docs/fleet-api/endpoints/energy
+package tesla
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const DefaultBaseURL = "https://fleet-api.prd.na.vn.cloud.tesla.com"
+
+// Client makes requests for one energy site. HTTP must add the OAuth bearer token, as
+// the client from oauth2.Config.Client does.
+type Client struct {
+	HTTP *http.Client
+
+	// For example https://fleet-api.prd.na.vn.cloud.tesla.com/api/1/energy_sites/12345
+	SiteURL string
+}
+
+// SiteURL returns the URL of energy site id under baseURL.
+func SiteURL(baseURL string, id int64) string {
+	return fmt.Sprintf("%s/api/1/energy_sites/%d", baseURL, id)
+}
+
+// FindEnergySite returns the energy_site_id of the first energy site on the account.
+// The product list can be a mix of vehicles, powerwalls, and other future Tesla products.
+func FindEnergySite(c *http.Client, baseURL string) (int64, error) {
+	var products []map[string]interface{}
+	err := getJSON(c, baseURL+"/api/1/products", nil, &products)
+	if err != nil {
+		return 0, err
+	}
+	for _, product := range products {
+		if id, ok := product["energy_site_id"].(json.Number); ok {
+			return id.Int64()
+		}
+	}
+	return 0, fmt.Errorf("no energy site found in %d products", len(products))
+}
+
+func (c *Client) get(path string, query url.Values, response interface{}) error {
+	return getJSON(c.HTTP, c.SiteURL+path, query, response)
+}
+
+// getJSON fetches u and decodes the "response" member of the result into response.
+func getJSON(c *http.Client, u string, query url.Values, response interface{}) error {
+	if query != nil {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "https://github.com/DentonGentry/powerwall")
+
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("GET %s: status=%d %s", u, res.StatusCode, body)
+	}
+
+	outer := struct {
+		Response interface{} `json:"response"`
+	}{Response: response}
+	decoder := json.NewDecoder(res.Body)
+	decoder.UseNumber() // we need the ID fields to be integers, not float64
+	return decoder.Decode(&outer)
+}
+
+// PowerPoint is one entry of the calendar_history power series, average power in Watts
+// over the 5 minutes starting at Timestamp. Battery power is positive when discharging,
+// grid power is positive when importing.
+type PowerPoint struct {
+	Timestamp         time.Time `json:"timestamp"`
+	SolarPower        float64   `json:"solar_power"`
+	BatteryPower      float64   `json:"battery_power"`
+	GridPower         float64   `json:"grid_power"`
+	GridServicesPower float64   `json:"grid_services_power"`
+	GeneratorPower    float64   `json:"generator_power"`
+}
+
+// LoadPower is not reported by calendar_history, it is whatever the other sources supply.
+func (p PowerPoint) LoadPower() float64 {
+	return p.SolarPower + p.BatteryPower + p.GridPower + p.GeneratorPower
+}
+
+// EnergyPoint is one entry of the calendar_history energy series, in Watt-hours.
+type EnergyPoint struct {
+	Timestamp                         time.Time `json:"timestamp"`
+	SolarEnergyExported               float64   `json:"solar_energy_exported"`
+	GridEnergyImported                float64   `json:"grid_energy_imported"`
+	GridEnergyExportedFromSolar       float64   `json:"grid_energy_exported_from_solar"`
+	GridEnergyExportedFromBattery     float64   `json:"grid_energy_exported_from_battery"`
+	BatteryEnergyExported             float64   `json:"battery_energy_exported"`
+	BatteryEnergyImportedFromGrid     float64   `json:"battery_energy_imported_from_grid"`
+	BatteryEnergyImportedFromSolar    float64   `json:"battery_energy_imported_from_solar"`
+	ConsumerEnergyImportedFromGrid    float64   `json:"consumer_energy_imported_from_grid"`
+	ConsumerEnergyImportedFromSolar   float64   `json:"consumer_energy_imported_from_solar"`
+	ConsumerEnergyImportedFromBattery float64   `json:"consumer_energy_imported_from_battery"`
+}
+
+func calendarQuery(kind string, start, end time.Time, loc *time.Location) url.Values {
+	query := url.Values{}
+	query.Set("kind", kind)
+	query.Set("period", "day")
+	query.Set("start_date", start.In(loc).Format(time.RFC3339))
+	query.Set("end_date", end.In(loc).Format(time.RFC3339))
+	query.Set("time_zone", loc.String())
+	return query
+}
+
+// PowerHistory returns the 5 minute power series for the day containing end.
+// Tesla only returns one day per request.
+func (c *Client) PowerHistory(start, end time.Time, loc *time.Location) ([]PowerPoint, error) {
+	var response struct {
+		TimeSeries []PowerPoint `json:"time_series"`
+	}
+	err := c.get("/calendar_history", calendarQuery("power", start, end, loc), &response)
+	return response.TimeSeries, err
+}
+
+// EnergyHistory returns daily energy totals for the days between start and end.
+func (c *Client) EnergyHistory(start, end time.Time, loc *time.Location) ([]EnergyPoint, error) {
+	var response struct {
+		TimeSeries []EnergyPoint `json:"time_series"`
+	}
+	err := c.get("/calendar_history", calendarQuery("energy", start, end, loc), &response)
+	return response.TimeSeries, err
+}
+
+// BackupEvent is one outage from the calendar_history backup series, when the Powerwall
+// islanded the house from the grid.
+type BackupEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	// Milliseconds.
+	DurationMs int64 `json:"duration"`
+}
+
+// End returns when the house reconnected to the grid.
+func (b BackupEvent) End() time.Time {
+	return b.Timestamp.Add(time.Duration(b.DurationMs) * time.Millisecond)
+}
+
+// BackupHistory returns every outage Tesla has recorded for the site.
+func (c *Client) BackupHistory() ([]BackupEvent, error) {
+	var response struct {
+		Events []BackupEvent `json:"events"`
+	}
+	query := url.Values{}
+	query.Set("kind", "backup")
+	err := c.get("/calendar_history", query, &response)
+	return response.Events, err
+}
@@ -0,0 +1,153 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tesla
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// fakeSite remembers the settings posted to it. If ignore is set it accepts commands
+// without applying them.
+type fakeSite struct {
+	reserve float64
+	mode    string
+	ignore  bool
+}
+
+func (f *fakeSite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/1/energy_sites/1")
+	switch {
+	case r.Method == http.MethodPost:
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !f.ignore {
+			switch path {
+			case "/backup":
+				f.reserve = body["backup_reserve_percent"].(float64)
+			case "/operation":
+				f.mode = body["default_real_mode"].(string)
+			}
+		}
+		fmt.Fprintf(w, `{"response": {"code": 201, "message": "Updated"}}`)
+	case path == "/site_info":
+		fmt.Fprintf(w, `{"response": {"site_name": "Home", "backup_reserve_percent": %v, "default_real_mode": %q}}`,
+			f.reserve, f.mode)
+	case path == "/live_status":
+		fmt.Fprintf(w, `{"response": {"solar_power": 3000, "percentage_charged": 55.5, "grid_status": "Active",
+			"timestamp": "2024-01-10T12:00:00-08:00"}}`)
+	case path == "/calendar_history" && r.URL.Query().Get("kind") == "backup":
+		fmt.Fprintf(w, `{"response": {"events": [{"timestamp": "2024-01-10T12:00:00-08:00", "duration": 5400000}],
+			"total_events": 1}}`)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestApply(t *testing.T) {
+	site := &fakeSite{reserve: 20, mode: SelfConsumption}
+	server := httptest.NewServer(site)
+	defer server.Close()
+	c := &Client{HTTP: server.Client(), SiteURL: SiteURL(server.URL, 1)}
+
+	if err := c.Apply(50, Autonomous); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if site.reserve != 50 || site.mode != Autonomous {
+		t.Errorf("site got reserve=%v mode=%q", site.reserve, site.mode)
+	}
+
+	site.ignore = true
+	if err := c.Apply(80, ""); err == nil || !strings.Contains(err.Error(), "verify") {
+		t.Errorf("Apply of an ignored command got err=%v, want a verify error", err)
+	}
+	if err := c.SetOperationMode("turbo"); err == nil {
+		t.Errorf("SetOperationMode accepted an unknown mode")
+	}
+	if err := c.SetBackupReserve(101); err == nil {
+		t.Errorf("SetBackupReserve accepted 101%%")
+	}
+
+	status, err := c.LiveStatus()
+	if err != nil {
+		t.Fatalf("LiveStatus: %v", err)
+	}
+	if status.SolarPower != 3000 || status.PercentageCharged != 55.5 || status.GridStatus != "Active" {
+		t.Errorf("LiveStatus got %+v", status)
+	}
+}
+
+func TestBackupHistory(t *testing.T) {
+	server := httptest.NewServer(&fakeSite{})
+	defer server.Close()
+	c := &Client{HTTP: server.Client(), SiteURL: SiteURL(server.URL, 1)}
+	events, err := c.BackupHistory()
+	if err != nil {
+		t.Fatalf("BackupHistory: %v", err)
+	}
+	if len(events) != 1 || events[0].End().Sub(events[0].Timestamp) != 90*time.Minute {
+		t.Errorf("BackupHistory got %+v", events)
+	}
+}
+
+func TestTokenFile(t *testing.T) {
+	var refreshes int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("refresh_token") != "r1" {
+			http.Error(w, `{"error": "invalid_grant"}`, http.StatusUnauthorized)
+			return
+		}
+		refreshes++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token": "a2", "refresh_token": "r2", "token_type": "Bearer", "expires_in": 28800}`)
+	}))
+	defer server.Close()
+	config := &oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: server.URL, AuthStyle: oauth2.AuthStyleInParams}}
+
+	filename := filepath.Join(t.TempDir(), "tokens")
+	expired, _ := json.Marshal(&oauth2.Token{AccessToken: "a1", RefreshToken: "r1", Expiry: time.Now().Add(-time.Hour)})
+	if err := os.WriteFile(filename, expired, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	var errs []error
+	first := &TokenFile{Filename: filename, Config: config, OnError: func(err error) { errs = append(errs, err) }}
+	token, err := first.Token()
+	if err != nil || token.AccessToken != "a2" {
+		t.Fatalf("Token got %+v, %v", token, err)
+	}
+	saved, err := first.read()
+	if err != nil || saved.RefreshToken != "r2" {
+		t.Errorf("tokens file got %+v, %v, want the new refresh token", saved, err)
+	}
+
+	// Another process sharing the file picks up the new token rather than spending r1 again.
+	second := &TokenFile{Filename: filename, Config: config}
+	if token, err = second.Token(); err != nil || token.AccessToken != "a2" || refreshes != 1 {
+		t.Errorf("second Token got %+v, %v after %d refreshes", token, err, refreshes)
+	}
+
+	if err = os.WriteFile(filename, expired, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	third := &TokenFile{Filename: filename, Config: config, OnError: func(err error) { errs = append(errs, err) }}
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": "invalid_grant"}`, http.StatusUnauthorized)
+	})
+	if _, err = third.Token(); err == nil || len(errs) != 1 {
+		t.Errorf("Token with a spent refresh token got err=%v, OnError called %d times", err, len(errs))
+	}
+}
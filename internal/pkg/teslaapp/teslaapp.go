@@ -0,0 +1,249 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package teslaapp reads the power and energy CSV files exported from the Tesla mobile
+// app, so that history from before this project existed can be used too.
+//
+// Power exports hold one row per 5 minutes:
+//
+//	Date time,Home (kW),Solar (kW),Powerwall (kW),Grid (kW)
+//	2023-06-01T00:00:00-07:00,0.82,0,0.82,0
+//
+// Energy exports hold one row per day:
+//
+//	Date time,Home (kWh),Vehicle (kWh),Powerwall (kWh),Solar (kWh),Grid (kWh)
+//
+// Newer versions of the app add columns such as "From Grid (kWh)" and "To Grid (kWh)",
+// older ones leave the UTC offset off the timestamp. Powerwall is positive when
+// discharging and Grid is positive when importing, as in live_status.
+package teslaapp
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+)
+
+// Export is the content of one CSV file, converted to the history schema.
+type Export struct {
+	// history.FiveMinutes for power exports, history.Daily for energy exports.
+	Resolution time.Duration
+	Intervals  []history.Interval
+}
+
+type column struct {
+	idx   int
+	name  string  // lower case, without the unit
+	scale float64 // to W or Wh
+}
+
+var units = map[string]struct {
+	scale  float64
+	energy bool
+}{
+	"w":   {1.0, false},
+	"kw":  {1000.0, false},
+	"mw":  {1000000.0, false},
+	"wh":  {1.0, true},
+	"kwh": {1000.0, true},
+	"mwh": {1000000.0, true},
+}
+
+// parseHeader splits "Solar Energy (kWh)" into its name and unit.
+func parseHeader(header []string) (timeCol int, columns []column, energy bool, err error) {
+	timeCol = -1
+	kinds := make(map[bool]bool)
+	for idx, h := range header {
+		h = strings.TrimSpace(strings.TrimPrefix(h, "\ufeff"))
+		name := strings.ToLower(h)
+		open := strings.LastIndex(h, "(")
+		if open < 0 || !strings.HasSuffix(h, ")") {
+			if name == "date time" || name == "datetime" || name == "date" || name == "timestamp" {
+				timeCol = idx
+			}
+			continue
+		}
+		unit, ok := units[strings.ToLower(strings.TrimSpace(h[open+1:len(h)-1]))]
+		if !ok {
+			return -1, nil, false, fmt.Errorf("unknown unit in column %q", h)
+		}
+		kinds[unit.energy] = true
+		columns = append(columns, column{
+			idx:   idx,
+			name:  strings.TrimSpace(strings.ToLower(h[:open])),
+			scale: unit.scale,
+		})
+	}
+	if timeCol < 0 {
+		return -1, nil, false, fmt.Errorf("no Date time column in %v", header)
+	}
+	if len(kinds) != 1 {
+		return -1, nil, false, fmt.Errorf("expected either power or energy columns in %v", header)
+	}
+	return timeCol, columns, kinds[true], nil
+}
+
+var layouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"01/02/2006 15:04",
+	"1/2/2006 15:04",
+	"2006-01-02",
+	"01/02/2006",
+	"1/2/2006",
+}
+
+// timeParser converts timestamps to time.Time, dealing with the hour which repeats when
+// daylight saving time ends. Without a UTC offset 01:30 happens twice, the second one
+// must be in standard time.
+type timeParser struct {
+	loc  *time.Location
+	prev time.Time
+}
+
+func (p *timeParser) parse(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range layouts {
+		t, err := time.ParseInLocation(layout, s, p.loc)
+		if err != nil {
+			continue
+		}
+		if layout != time.RFC3339 && !p.prev.IsZero() && !t.After(p.prev) {
+			later := t.Add(time.Hour)
+			if later.After(p.prev) && later.In(p.loc).Format(layout) == t.In(p.loc).Format(layout) {
+				t = later
+			}
+		}
+		p.prev = t
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("unrecognized timestamp %q", s)
+}
+
+// Read parses one exported CSV file. Timestamps without a UTC offset are in loc.
+func Read(r io.Reader, loc *time.Location) (*Export, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	timeCol, columns, energy, err := parseHeader(header)
+	if err != nil {
+		return nil, err
+	}
+
+	type row struct {
+		t      time.Time
+		values map[string]float64
+	}
+	var rows []row
+	parser := &timeParser{loc: loc}
+	seen := make(map[int64]bool)
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) <= timeCol || strings.TrimSpace(record[timeCol]) == "" {
+			continue
+		}
+		t, err := parser.parse(record[timeCol])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if seen[t.Unix()] {
+			continue
+		}
+		seen[t.Unix()] = true
+
+		values := make(map[string]float64)
+		for _, c := range columns {
+			if c.idx >= len(record) || strings.TrimSpace(record[c.idx]) == "" {
+				continue
+			}
+			v, err := strconv.ParseFloat(strings.TrimSpace(record[c.idx]), 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d, %s: %v", line, c.name, err)
+			}
+			values[c.name] = v * c.scale
+		}
+		rows = append(rows, row{t: t, values: values})
+	}
+
+	if !energy {
+		samples := make([]history.Sample, 0, len(rows)+1)
+		for _, r := range rows {
+			samples = append(samples, history.Sample{
+				Time:         r.t,
+				LoadPower:    r.values["home"],
+				SolarPower:   first(r.values, "solar", "solar energy"),
+				BatteryPower: r.values["powerwall"],
+				GridPower:    r.values["grid"],
+			})
+		}
+		// Hold the last row as long as the others, or it would contribute nothing.
+		if n := len(samples); n >= 2 {
+			samples = append(samples, history.Sample{
+				Time: samples[n-1].Time.Add(samples[n-1].Time.Sub(samples[n-2].Time)),
+			})
+		}
+		intervals := history.Integrate(samples, history.FiveMinutes)
+		for idx := range intervals {
+			intervals[idx].Source = "tesla_app"
+		}
+		return &Export{Resolution: history.FiveMinutes, Intervals: intervals}, nil
+	}
+
+	export := &Export{Resolution: history.Daily}
+	for _, r := range rows {
+		day := time.Date(r.t.Year(), r.t.Month(), r.t.Day(), 0, 0, 0, 0, r.t.Location())
+		if !day.Equal(r.t) {
+			return nil, fmt.Errorf("energy row at %v is not a whole day, only daily energy exports are supported", r.t)
+		}
+		interval := history.Interval{
+			Start:    day,
+			Duration: day.AddDate(0, 0, 1).Sub(day),
+			LoadWh:   r.values["home"],
+			SolarWh:  first(r.values, "solar energy", "solar"),
+			Source:   "tesla_app",
+		}
+		if v, ok := r.values["from grid"]; ok {
+			interval.GridImportWh = v
+			interval.GridExportWh = r.values["to grid"]
+		} else if v := r.values["grid"]; v > 0 {
+			interval.GridImportWh = v
+		} else {
+			interval.GridExportWh = -v
+		}
+		if v, ok := r.values["from powerwall"]; ok {
+			interval.BatteryDischargeWh = v
+			interval.BatteryChargeWh = r.values["to powerwall"]
+		} else if v := r.values["powerwall"]; v > 0 {
+			interval.BatteryDischargeWh = v
+		} else {
+			interval.BatteryChargeWh = -v
+		}
+		export.Intervals = append(export.Intervals, interval)
+	}
+	return export, nil
+}
+
+func first(values map[string]float64, names ...string) float64 {
+	for _, name := range names {
+		if v, ok := values[name]; ok {
+			return v
+		}
+	}
+	return 0.0
+}
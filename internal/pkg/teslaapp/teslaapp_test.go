@@ -0,0 +1,77 @@
+// Copyright (c), Denton Gentry <dgentry@decarbon.earth>
+// SPDX-License-Identifier: BSD-3-Clause
+
+package teslaapp
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DentonGentry/powerwall/v2/internal/pkg/history"
+)
+
+func TestReadPowerAcrossDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatalf("LoadLocation: %v", err)
+	}
+
+	// Daylight saving time ends at 2am on 2023-11-05, the 1am hour happens twice.
+	var b strings.Builder
+	b.WriteString("\ufeffDate time,Home (kW),Solar (kW),Powerwall (kW),Grid (kW)\n")
+	for _, hour := range []int{0, 1, 1, 2} {
+		for m := 0; m < 60; m += 5 {
+			fmt.Fprintf(&b, "2023-11-05 %02d:%02d:00,1.2,0,1.2,0\n", hour, m)
+		}
+	}
+	export, err := Read(strings.NewReader(b.String()), loc)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if export.Resolution != history.FiveMinutes || len(export.Intervals) != 48 {
+		t.Fatalf("Read got resolution=%v intervals=%d want 5m, 48", export.Resolution, len(export.Intervals))
+	}
+	sum := history.Sum(export.Intervals)
+	if sum.Duration != 4*time.Hour || math.Abs(sum.LoadWh-4800) > 1e-6 || math.Abs(sum.BatteryDischargeWh-4800) > 1e-6 {
+		t.Errorf("Sum got=%+v want 4h of 1.2kW", sum)
+	}
+	if export.Intervals[0].Source != "tesla_app" {
+		t.Errorf("Source got=%q", export.Intervals[0].Source)
+	}
+}
+
+func TestReadEnergy(t *testing.T) {
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatalf("LoadLocation: %v", err)
+	}
+	csv := "Date time,Home (kWh),Vehicle (kWh),Powerwall (kWh),Solar (kWh),Grid (kWh)\n" +
+		"2023-06-01T00:00:00-07:00,30.5,0,-2.5,40,-7\n" +
+		"2023-06-02T00:00:00-07:00,35,0,3,20,12\n"
+	export, err := Read(strings.NewReader(csv), loc)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if export.Resolution != history.Daily || len(export.Intervals) != 2 {
+		t.Fatalf("Read got resolution=%v intervals=%d want daily, 2", export.Resolution, len(export.Intervals))
+	}
+	day := export.Intervals[0]
+	if day.LoadWh != 30500 || day.SolarWh != 40000 || day.GridExportWh != 7000 || day.BatteryChargeWh != 2500 {
+		t.Errorf("first day got=%+v", day)
+	}
+	if day.Duration != 24*time.Hour {
+		t.Errorf("first day Duration got=%v", day.Duration)
+	}
+
+	_, err = Read(strings.NewReader("Date time,Home (kWh)\n2023-06-01 12:00:00,1\n"), loc)
+	if err == nil {
+		t.Errorf("Read of hourly energy succeeded, want error")
+	}
+	_, err = Read(strings.NewReader("Date time,Home (furlongs)\n"), loc)
+	if err == nil {
+		t.Errorf("Read of unknown unit succeeded, want error")
+	}
+}